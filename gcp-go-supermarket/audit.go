@@ -0,0 +1,450 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// catalogAudit is the audit trail of catalog changes. Its latest entries
+// are kept in memory and, with -audit.log, all of them are appended to a
+// file.
+var catalogAudit = newAuditTrail()
+
+// auditMemory is how many of the latest audit entries are kept in memory
+// for the audit endpoint, set with -audit.memory; 0 keeps them all.
+var auditMemory = 10000
+
+// Audit actions.
+const (
+	auditAdd    = "add"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// actor is who made a catalog change and through which request.
+type actor struct {
+	Name      string
+	IP        string
+	RequestID string
+	ctx       context.Context // of the request, for tracing; nil outside requests
+}
+
+// trustIAP makes actorFrom take the user from the headers Identity-Aware
+// Proxy sets, set with -iap. Only set it when every request comes through
+// IAP: anyone else can send those headers too.
+var trustIAP bool
+
+// trustedProxies are the proxies, by address or CIDR range, whose
+// X-Forwarded-For header gives the client IP, set with -trusted.proxies.
+// None are trusted by default, so the client IP of audit entries and
+// idempotency keys is the peer's address and cannot be made up by a caller.
+var trustedProxies []string
+
+// trustedPlatform is a header the platform in front of the server sets to
+// the client IP, e.g. X-Appengine-Remote-Addr, set with -trusted.platform.
+var trustedPlatform string
+
+// parseTrustedProxies parses a comma separated list of addresses and CIDR
+// ranges.
+func parseTrustedProxies(s string) ([]string, error) {
+	var proxies []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", p)
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+// actorFrom returns the authenticated actor of a request: the user
+// Identity-Aware Proxy signed in, with -iap, else admin for requests with the
+// admin token, else anonymous. Its IP is the client IP, see trustedProxies.
+func actorFrom(c *gin.Context) actor {
+	name := ""
+	if trustIAP {
+		name = strings.TrimPrefix(c.GetHeader("X-Goog-Authenticated-User-Email"), "accounts.google.com:")
+	}
+	if name == "" && isAdmin(c) {
+		name = "admin"
+	}
+	if name == "" {
+		name = "anonymous"
+	}
+	return actor{Name: name, IP: c.ClientIP(), RequestID: requestIDFrom(c), ctx: c.Request.Context()}
+}
+
+// fieldChange is a field of an item before and after a change, as JSON.
+// Before is omitted when the field was added and After when it was removed.
+type fieldChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// auditEntry is a change in the audit trail. Hash is the SHA-256 of the
+// previous entry's hash and this entry without its hash, so changing or
+// dropping an entry breaks the chain from there on.
+type auditEntry struct {
+	Seq         int64                  `json:"seq"`
+	Time        time.Time              `json:"time"`
+	Action      string                 `json:"action"`
+	ProduceCode string                 `json:"code"`
+	Actor       string                 `json:"actor"`
+	IP          string                 `json:"ip,omitempty"`
+	RequestID   string                 `json:"request_id,omitempty"`
+	Diff        map[string]fieldChange `json:"diff"`
+	PrevHash    string                 `json:"prev_hash"`
+	Hash        string                 `json:"hash"`
+}
+
+// hash returns the hash of e chained to e.PrevHash.
+func (e auditEntry) hash() string {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err) // an entry always marshals
+	}
+	sum := sha256.Sum256(append([]byte(e.PrevHash), b...))
+	return hex.EncodeToString(sum[:])
+}
+
+// itemFields returns the fields of item that are set, by JSON name. A nil
+// item has none.
+func itemFields(item *Item) map[string]json.RawMessage {
+	m := map[string]json.RawMessage{}
+	if item != nil {
+		b, _ := json.Marshal(item)
+		json.Unmarshal(b, &m)
+	}
+	return m
+}
+
+// itemDiff returns the fields that differ between before and after, either of
+// which is nil for an add or a delete.
+func itemDiff(before, after *Item) map[string]fieldChange {
+	b, a := itemFields(before), itemFields(after)
+	diff := map[string]fieldChange{}
+	for name, v := range b {
+		if !bytes.Equal(v, a[name]) {
+			diff[name] = fieldChange{Before: v, After: a[name]}
+		}
+	}
+	for name, v := range a {
+		if _, ok := b[name]; !ok {
+			diff[name] = fieldChange{After: v}
+		}
+	}
+	return diff
+}
+
+// auditTrail is an append-only, hash chained list of catalog changes.
+type auditTrail struct {
+	mu      sync.Mutex
+	entries []auditEntry // the latest, see auditMemory
+	dropped int64        // entries before entries[0], no longer in memory
+	base    string       // hash of the last entry dropped
+	f       *os.File     // nil keeps the trail in memory only
+	now     func() time.Time
+	health  logHealth
+}
+
+func newAuditTrail() *auditTrail {
+	return &auditTrail{now: time.Now}
+}
+
+// openAuditTrail loads the trail at path, checking its chain, and appends to it.
+func openAuditTrail(path string) (*auditTrail, error) {
+	a := newAuditTrail()
+	f, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 16<<20)
+	for s.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: entry %d: %v", path, a.seq()+1, err)
+		}
+		if err := e.follows(a.seq(), a.head()); err != nil { // the whole chain is checked, not only what stays in memory
+			f.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		a.append(e)
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.f = f
+	return a, nil
+}
+
+// seq is the number of the last entry. The caller must hold a.mu or own a.
+func (a *auditTrail) seq() int64 {
+	return a.dropped + int64(len(a.entries))
+}
+
+// head is the hash of the last entry. The caller must hold a.mu or own a.
+func (a *auditTrail) head() string {
+	if n := len(a.entries); n > 0 {
+		return a.entries[n-1].Hash
+	}
+	return a.base
+}
+
+// append adds e and drops the oldest entries beyond auditMemory, a quarter
+// of it at a time so that the entries are not copied on every change. The
+// caller must hold a.mu or own a.
+func (a *auditTrail) append(e auditEntry) {
+	a.entries = append(a.entries, e)
+	if auditMemory <= 0 || len(a.entries) <= auditMemory+auditMemory/4 {
+		return
+	}
+	n := len(a.entries) - auditMemory
+	a.dropped += int64(n)
+	a.base = a.entries[n-1].Hash
+	a.entries = append([]auditEntry(nil), a.entries[n:]...)
+}
+
+// follows checks that e comes right after the entry numbered seq with hash
+// prev.
+func (e auditEntry) follows(seq int64, prev string) error {
+	if e.Seq != seq+1 {
+		return fmt.Errorf("entry %d: out of sequence, got %d", seq+1, e.Seq)
+	}
+	if e.PrevHash != prev || e.hash() != e.Hash {
+		return fmt.Errorf("entry %d: hash chain broken", e.Seq)
+	}
+	return nil
+}
+
+// record appends the change of the item stored under code from before to
+// after; nil before is an add and nil after a delete. Changes that leave the
+// item as it was are not recorded. The caller must hold dbmux, which keeps
+// entries in the order the changes were made.
+func (a *auditTrail) record(who actor, code string, before, after *Item) {
+	diff := itemDiff(before, after)
+	if len(diff) == 0 {
+		return
+	}
+	action := auditUpdate
+	if before == nil {
+		action = auditAdd
+	} else if after == nil {
+		action = auditDelete
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := auditEntry{Seq: a.seq() + 1, Time: a.now().UTC(), Action: action, ProduceCode: code, Actor: who.Name, IP: who.IP, RequestID: who.RequestID, Diff: diff, PrevHash: a.head()}
+	e.Hash = e.hash()
+	a.append(e)
+	if a.f != nil {
+		b, _ := json.Marshal(e)
+		_, err := a.f.Write(append(b, '\n'))
+		a.health.wrote(err)
+		if err != nil {
+			log.Printf("audit: entry %d of %s not written: %v", e.Seq, code, err)
+		}
+	}
+}
+
+// ping fails when the last entry could not be written to the trail's file,
+// see logHealth. A trail kept in memory only is not checked.
+func (a *auditTrail) ping(ctx context.Context) error {
+	if a == nil || a.f == nil {
+		return errCheckSkipped
+	}
+	return a.health.check()
+}
+
+// verify checks the hash chain of the entries in memory. The caller must
+// hold a.mu or own a.
+func (a *auditTrail) verify() error {
+	seq, prev := a.dropped, a.base
+	for _, e := range a.entries {
+		if err := e.follows(seq, prev); err != nil {
+			return err
+		}
+		seq, prev = e.Seq, e.Hash
+	}
+	return nil
+}
+
+// close closes the trail's file.
+func (a *auditTrail) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// Binding from the query string.
+type AuditQuery struct {
+	ProduceCode string    `form:"code" binding:"omitempty,isproducecode"`
+	Actor       string    `form:"actor" binding:"omitempty,max=254"`
+	From        time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To          time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit       int       `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+// Audit godoc
+// @Summary Audit Trail
+// @Schemes
+// @Description List catalog changes, newest first: who made them, from where, in which request, and the fields before and after. Only the latest changes are kept in memory, see -audit.memory; older ones are read from -audit.log. Without it they are gone, and a list that may be missing some is marked with an Audit-Truncated header. Admins only, see X-Admin-Token
+// @Tags admin
+// @Param        X-Admin-Token   header      string  true  "Admin token"
+// @Param        code   query      string  false  "Only changes to this item"
+// @Param        actor   query      string  false  "Only changes by this actor"
+// @Param        from   query      string  false  "Only changes at or after this time, RFC 3339"
+// @Param        to   query      string  false  "Only changes before this time, RFC 3339"
+// @Param        limit   query      int  false  "At most this many changes, default 100"
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 403 {string} error
+// @Router /audit [get]
+func (a *auditTrail) list(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "the audit trail needs an admin token"})
+		return
+	}
+	var q AuditQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = 100
+	}
+	code := strings.ToUpper(q.ProduceCode)
+	match := func(e auditEntry) bool {
+		return (code == "" || e.ProduceCode == code) && (q.Actor == "" || e.Actor == q.Actor) &&
+			(q.From.IsZero() || !e.Time.Before(q.From)) && (q.To.IsZero() || e.Time.Before(q.To))
+	}
+	a.mu.Lock()
+	entries := []auditEntry{}
+	for i := len(a.entries) - 1; i >= 0 && len(entries) < q.Limit; i-- {
+		if e := a.entries[i]; match(e) {
+			entries = append(entries, e)
+		}
+	}
+	dropped, f := a.dropped, a.f
+	a.mu.Unlock()
+	if len(entries) < q.Limit && dropped > 0 {
+		if f == nil {
+			c.Header("Audit-Truncated", "true") // matching entries may have been dropped from memory
+		} else {
+			older, err := olderEntries(f, dropped, q.Limit-len(entries), match)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			entries = append(entries, older...)
+		}
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// olderEntries reads the entries numbered up to upTo, the ones no longer in
+// memory, from the trail's file f and returns the last n that match, newest
+// first. Entries are only ever appended to f, so it is read without a.mu,
+// which would hold up every catalog change meanwhile.
+func olderEntries(f *os.File, upTo int64, n int, match func(auditEntry) bool) ([]auditEntry, error) {
+	s := bufio.NewScanner(io.NewSectionReader(f, 0, 1<<62)) // ReadAt leaves the appends alone
+	s.Buffer(nil, 16<<20)
+	var found []auditEntry
+	for s.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		if e.Seq > upTo {
+			break
+		}
+		if !match(e) {
+			continue
+		}
+		if found = append(found, e); len(found) >= 2*n { // keep the last n, without copying on every match
+			found = append(found[:0], found[len(found)-n:]...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(found) > n {
+		found = found[len(found)-n:]
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, nil
+}
+
+// Verify Audit godoc
+// @Summary Verify Audit Trail
+// @Schemes
+// @Description Check the hash chain of the audit entries in memory; with -audit.log the whole file was checked at start up. A broken chain means an entry was changed or removed. Admins only, see X-Admin-Token
+// @Tags admin
+// @Param        X-Admin-Token   header      string  true  "Admin token"
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 403 {string} error
+// @Failure 409 {string} error
+// @Router /audit/verify [get]
+func (a *auditTrail) verifyChain(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "the audit trail needs an admin token"})
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.verify(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "audit trail intact", "entries": a.seq(), "in_memory": len(a.entries), "head": a.head()})
+}
@@ -0,0 +1,286 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestAudit -v
+
+func TestAudit(t *testing.T) {
+	defer func(a *auditTrail, token string, iap bool) { catalogAudit, adminToken, trustIAP = a, token, iap }(catalogAudit, adminToken, trustIAP)
+	catalogAudit, adminToken, trustIAP = newAuditTrail(), "s3cret", true
+	clock := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	catalogAudit.now = func() time.Time { clock = clock.Add(time.Minute); return clock }
+	db := database{}
+	router := db.dbInit()
+	req := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.RemoteAddr = "203.0.113.7:51234"
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	got := req("POST", "/api/v1/add", `[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"0.50"}]`, "X-Admin-Token", "s3cret", "X-Actor", "alice", "X-Request-Id", "req-1")
+	assert.Equal(t, got.Code, 201)
+	assert.Equal(t, got.Header().Get("X-Request-Id"), "req-1")
+	got = req("POST", "/api/v1/import", "code,name,price\nB111-2222-3333-4444,Kiwi,0.65\n", "X-Goog-Authenticated-User-Email", "accounts.google.com:bob@example.com")
+	assert.Equal(t, got.Code, 200)
+	generated := got.Header().Get("X-Request-Id")
+	assert.Equal(t, len(generated), 32)
+	got = req("GET", "/api/v1/delete/B111-2222-3333-4444", "", "X-Request-Id", "bad id with spaces", "X-Actor", "mallory")
+	assert.Equal(t, got.Code, 200)
+	got = req("POST", "/api/v1/stock/A12T-4GH7-QPL9-3N4M", `{"stock":5}`, "X-Admin-Token", "s3cret")
+	assert.Equal(t, got.Code, 200)
+
+	admin := []string{"X-Admin-Token", "s3cret"}
+	tests := []struct {
+		name       string
+		path       string
+		header     []string
+		wantCode   int
+		wantResult string
+	}{
+		{name: "needs admin", path: "/api/v1/audit", wantCode: 403, wantResult: `{"error":"the audit trail needs an admin token"}`},
+		{name: "by code", path: "/api/v1/audit?code=b111-2222-3333-4444", header: admin, wantCode: 200, wantResult: `[{"seq":3,"time":"2022-07-01T10:03:00Z","action":"delete","code":"B111-2222-3333-4444","actor":"anonymous","ip":"203.0.113.7","request_id":"`},
+		{name: "by actor", path: "/api/v1/audit?actor=bob@example.com", header: admin, wantCode: 200, wantResult: `[{"seq":2,"time":"2022-07-01T10:02:00Z","action":"update","code":"B111-2222-3333-4444","actor":"bob@example.com","ip":"203.0.113.7","request_id":"` + generated + `","diff":{"price":{"before":"$0.50","after":"$0.65"}},"prev_hash":"`},
+		{name: "by time", path: "/api/v1/audit?from=2022-07-01T10:01:00Z&to=2022-07-01T10:02:00Z", header: admin, wantCode: 200, wantResult: `[{"seq":1,"time":"2022-07-01T10:01:00Z","action":"add","code":"B111-2222-3333-4444","actor":"admin","ip":"203.0.113.7","request_id":"req-1","diff":{"code":{"after":"B111-2222-3333-4444"},"name":{"after":"Kiwi"},"price":{"after":"$0.50"}},"prev_hash":"","hash":"`},
+		{name: "stock update", path: "/api/v1/audit?code=A12T-4GH7-QPL9-3N4M", header: admin, wantCode: 200, wantResult: `[{"seq":4,"time":"2022-07-01T10:04:00Z","action":"update","code":"A12T-4GH7-QPL9-3N4M","actor":"admin","ip":"203.0.113.7","request_id":"`},
+		{name: "limit", path: "/api/v1/audit?limit=1", header: admin, wantCode: 200, wantResult: `[{"seq":4,`},
+		{name: "bad code", path: "/api/v1/audit?code=kiwi", header: admin, wantCode: 400, wantResult: `{"error":"Key: 'AuditQuery.ProduceCode' Error:Field validation for 'ProduceCode' failed on the 'isproducecode' tag"}`},
+		{name: "bad time", path: "/api/v1/audit?from=yesterday", header: admin, wantCode: 400, wantResult: `{"error":"parsing time`},
+		{name: "verify", path: "/api/v1/audit/verify", header: admin, wantCode: 200, wantResult: `{"entries":4,"head":"`},
+	}
+	for _, tc := range tests {
+		got := req("GET", tc.path, "", tc.header...)
+		if tc.wantCode != got.Code || !strings.HasPrefix(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	catalogAudit.entries[1].Actor = "mallory"
+	got = req("GET", "/api/v1/audit/verify", "", admin...)
+	assert.Equal(t, got.Code, 409)
+	assert.Equal(t, got.Body.String(), `{"error":"entry 2: hash chain broken"}`)
+}
+
+// go test -run TestActorFrom -v
+
+func TestActorFrom(t *testing.T) {
+	defer func(token string, iap bool) { adminToken, trustIAP = token, iap }(adminToken, trustIAP)
+	adminToken = "s3cret"
+	iap := []string{"X-Goog-Authenticated-User-Email", "accounts.google.com:bob@example.com"}
+	tests := []struct {
+		name     string
+		trustIAP bool
+		header   []string
+		want     string
+	}{
+		{name: "iap", trustIAP: true, header: iap, want: "bob@example.com"},
+		{name: "iap not trusted", header: iap, want: "anonymous"},
+		{name: "admin", header: []string{"X-Admin-Token", "s3cret", "X-Actor", "alice"}, want: "admin"},
+		{name: "wrong token", header: []string{"X-Admin-Token", "guess"}, want: "anonymous"},
+		{name: "x-actor", header: []string{"X-Actor", "alice"}, want: "anonymous"},
+	}
+	for _, tc := range tests {
+		trustIAP = tc.trustIAP
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("POST", "/api/v1/add", nil)
+		for i := 0; i < len(tc.header); i += 2 {
+			c.Request.Header.Set(tc.header[i], tc.header[i+1])
+		}
+		assert.Equal(t, actorFrom(c).Name, tc.want, tc.name)
+	}
+}
+
+// go test -run TestClientIP -v
+
+func TestClientIP(t *testing.T) {
+	defer func(proxies []string, platform string) { trustedProxies, trustedPlatform = proxies, platform }(trustedProxies, trustedPlatform)
+	var err error
+	trustedProxies, err = parseTrustedProxies("35.191.0.0/16, 10.0.0.1")
+	assert.NilError(t, err)
+	_, err = parseTrustedProxies("35.191.0.0/16,proxy")
+	assert.Error(t, err, `"proxy" is not an IP address or CIDR range`)
+	tests := []struct {
+		name     string
+		platform string
+		peer     string
+		header   []string
+		want     string
+	}{
+		{name: "peer", peer: "203.0.113.7:4711", want: "203.0.113.7"},
+		{name: "spoofed", peer: "203.0.113.7:4711", header: []string{"X-Forwarded-For", "198.51.100.1"}, want: "203.0.113.7"},
+		{name: "load balancer", peer: "35.191.3.4:4711", header: []string{"X-Forwarded-For", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "platform", platform: gin.PlatformGoogleAppEngine, peer: "203.0.113.7:4711", header: []string{"X-Appengine-Remote-Addr", "198.51.100.2"}, want: "198.51.100.2"},
+	}
+	for _, tc := range tests {
+		trustedPlatform = tc.platform
+		router := database{}.setupRouter()
+		router.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, actorFrom(c).IP) })
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ip", nil)
+		req.RemoteAddr = tc.peer
+		for i := 0; i < len(tc.header); i += 2 {
+			req.Header.Set(tc.header[i], tc.header[i+1])
+		}
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Body.String(), tc.want, tc.name)
+	}
+}
+
+// go test -run TestAuditFile -v
+
+func TestAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditTrail(path)
+	assert.NilError(t, err)
+	lettuce := Item{ProduceCode: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", UnitPrice: "$3.41"}
+	a.record(actor{Name: "alice"}, lettuce.ProduceCode, nil, &lettuce)
+	a.record(actor{Name: "alice"}, lettuce.ProduceCode, &lettuce, &lettuce) // no change, not recorded
+	cheaper := lettuce
+	cheaper.UnitPrice = "$2.99"
+	a.record(actor{Name: "bob"}, lettuce.ProduceCode, &lettuce, &cheaper)
+	assert.NilError(t, a.close())
+
+	a, err = openAuditTrail(path)
+	assert.NilError(t, err)
+	assert.Equal(t, len(a.entries), 2)
+	a.record(actor{Name: "carol"}, lettuce.ProduceCode, &cheaper, nil)
+	assert.NilError(t, a.close())
+
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, len(lines), 3)
+	var e auditEntry
+	assert.NilError(t, json.Unmarshal([]byte(lines[2]), &e))
+	assert.Equal(t, e.Action, auditDelete)
+	assert.Equal(t, string(e.Diff["price"].Before), `"$2.99"`)
+
+	assert.NilError(t, os.WriteFile(path, append(data, lines[2][:40]...), 0o644)) // a crash while writing
+	a, err = openAuditTrail(path)
+	assert.NilError(t, err)
+	assert.Equal(t, len(a.entries), 3)
+	a.record(actor{Name: "dave"}, lettuce.ProduceCode, nil, &lettuce)
+	assert.NilError(t, a.close())
+	a, err = openAuditTrail(path)
+	assert.NilError(t, err)
+	assert.Equal(t, len(a.entries), 4)
+	assert.NilError(t, a.close())
+
+	tampered := strings.Replace(string(data), `"after":"$2.99"`, `"after":"$0.99"`, 1)
+	assert.NilError(t, os.WriteFile(path, []byte(tampered), 0o644))
+	_, err = openAuditTrail(path)
+	assert.Error(t, err, path+": entry 2: hash chain broken")
+
+	assert.NilError(t, os.WriteFile(path, []byte(lines[0]+"\n"+lines[2]+"\n"), 0o644)) // an entry removed
+	_, err = openAuditTrail(path)
+	assert.Error(t, err, path+": entry 2: out of sequence, got 3")
+}
+
+// go test -run TestAuditMemory -v
+
+func TestAuditMemory(t *testing.T) {
+	defer func(n int, token string) { auditMemory, adminToken = n, token }(auditMemory, adminToken)
+	auditMemory, adminToken = 4, "s3cret"
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditTrail(path)
+	assert.NilError(t, err)
+	item := Item{ProduceCode: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce"}
+	for i := 0; i < 12; i++ {
+		before := item
+		item.Stock = i + 1
+		a.record(actor{Name: "alice"}, item.ProduceCode, &before, &item)
+	}
+	assert.Assert(t, len(a.entries) >= 4 && len(a.entries) <= 5, len(a.entries))
+	assert.Equal(t, a.seq(), int64(12))
+	assert.Equal(t, a.entries[len(a.entries)-1].Seq, int64(12))
+	assert.NilError(t, a.verify())
+	assert.NilError(t, a.close())
+
+	// The whole file is checked when it is opened, but only the latest
+	// entries stay in memory.
+	a, err = openAuditTrail(path)
+	assert.NilError(t, err)
+	assert.Assert(t, len(a.entries) <= 5, len(a.entries))
+	assert.Equal(t, a.seq(), int64(12))
+	a.record(actor{Name: "bob"}, item.ProduceCode, &item, nil)
+	assert.NilError(t, a.verify())
+
+	// The list goes on into the file for the entries no longer in memory.
+	seqs := func(a *auditTrail, query string) (string, string) {
+		router := gin.New()
+		router.GET("/api/v1/audit", a.list)
+		w := routerAdminReq("GET", "/api/v1/audit?"+query, nil, router)
+		var entries []auditEntry
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &entries), w.Body.String())
+		var seqs []string
+		for _, e := range entries {
+			seqs = append(seqs, fmt.Sprint(e.Seq))
+		}
+		return strings.Join(seqs, " "), w.Header().Get("Audit-Truncated")
+	}
+	got, truncated := seqs(a, "limit=8")
+	assert.Equal(t, got, "13 12 11 10 9 8 7 6")
+	assert.Equal(t, truncated, "")
+	got, _ = seqs(a, "actor=alice")
+	assert.Equal(t, got, "12 11 10 9 8 7 6 5 4 3 2 1")
+	got, _ = seqs(a, "actor=alice&limit=1")
+	assert.Equal(t, got, "12")
+	assert.NilError(t, a.close())
+
+	// Without a file they are gone, which the list says.
+	m := newAuditTrail()
+	for i := 0; i < 12; i++ {
+		m.record(actor{Name: "alice"}, item.ProduceCode, &Item{Stock: i}, &Item{Stock: i + 1})
+	}
+	got, truncated = seqs(m, "limit=8")
+	assert.Equal(t, truncated, "true")
+	assert.Assert(t, strings.HasPrefix(got, "12 11 10 9"), got)
+	_, truncated = seqs(m, "limit=2")
+	assert.Equal(t, truncated, "")
+
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	tampered := strings.Replace(string(data), `"actor":"alice"`, `"actor":"mallory"`, 1)
+	assert.NilError(t, os.WriteFile(path, []byte(tampered), 0o644))
+	_, err = openAuditTrail(path)
+	assert.Error(t, err, path+": entry 1: hash chain broken")
+}
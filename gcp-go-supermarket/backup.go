@@ -0,0 +1,579 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Backups are configured by main from flags; a nil backupStore disables
+// them.
+var (
+	backupStore    objectStore   // where snapshots are written, see newObjectStore
+	backupInterval time.Duration // how often a snapshot is taken; 0 takes them on request only
+)
+
+const (
+	backupPrefix   = "catalog-"             // names of snapshot objects start with it
+	backupSuffix   = ".json"                // and end with it; the checksum object adds checksumSuffix
+	checksumSuffix = ".sha256"              // the hex SHA-256 of the snapshot it is named after
+	backupTime     = "20060102T150405.000Z" // the time a snapshot was taken, in its name
+)
+
+var (
+	errObjectNotFound = errors.New("object not found")
+	errNoBackup       = errors.New("no backup")
+)
+
+// objectStore holds backup objects: a local directory or a bucket.
+type objectStore interface {
+	put(ctx context.Context, name string, data []byte) error
+	get(ctx context.Context, name string) ([]byte, error) // errObjectNotFound when there is none
+	list(ctx context.Context, prefix string) ([]string, error)
+	ping(ctx context.Context) error // nil when the store can be reached, see readiness
+}
+
+// newObjectStore returns the store of a -backup.to target: gs://bucket or
+// gs://bucket/prefix for a Cloud Storage bucket, anything else is a local
+// directory, created if needed.
+func newObjectStore(target string) (objectStore, error) {
+	if !strings.HasPrefix(target, "gs://") {
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return nil, err
+		}
+		return dirStore{dir: target}, nil
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(target, "gs://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("%q has no bucket", target)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s := &bucketStore{endpoint: "https://storage.googleapis.com", bucket: bucket, prefix: prefix, client: &http.Client{Timeout: time.Minute}}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" { // the variable the Cloud Storage client libraries honour
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		s.endpoint = strings.TrimSuffix(host, "/")
+	} else {
+		s.token = (&metadataToken{client: &http.Client{Timeout: 5 * time.Second}}).get
+	}
+	return s, nil
+}
+
+// dirStore keeps objects as files in a directory.
+type dirStore struct {
+	dir string
+}
+
+func (s dirStore) put(_ context.Context, name string, data []byte) error {
+	tmp := filepath.Join(s.dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name)) // readers never see a partial object
+}
+
+func (s dirStore) get(_ context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	return data, err
+}
+
+func (s dirStore) list(_ context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s dirStore) ping(_ context.Context) error {
+	fi, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
+
+// bucketStore keeps objects in a bucket through the Cloud Storage JSON API,
+// which emulators such as fake-gcs-server also serve.
+type bucketStore struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	token    func(ctx context.Context) (string, error) // nil sends no credentials
+	client   *http.Client
+}
+
+func (s *bucketStore) do(ctx context.Context, method, rawURL string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != nil {
+		token, err := s.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errObjectNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("bucket %s: unexpected status %s", s.bucket, resp.Status)
+	}
+	return data, nil
+}
+
+func (s *bucketStore) put(ctx context.Context, name string, data []byte) error {
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", s.endpoint, url.PathEscape(s.bucket), url.QueryEscape(s.prefix+name))
+	_, err := s.do(ctx, http.MethodPost, u, data)
+	return err
+}
+
+func (s *bucketStore) get(ctx context.Context, name string) ([]byte, error) {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", s.endpoint, url.PathEscape(s.bucket), url.PathEscape(s.prefix+name))
+	return s.do(ctx, http.MethodGet, u, nil)
+}
+
+func (s *bucketStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	for page := ""; ; {
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?prefix=%s&pageToken=%s", s.endpoint, url.PathEscape(s.bucket), url.QueryEscape(s.prefix+prefix), url.QueryEscape(page))
+		data, err := s.do(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		var objects struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &objects); err != nil {
+			return nil, fmt.Errorf("bucket %s: %v", s.bucket, err)
+		}
+		for _, o := range objects.Items {
+			names = append(names, strings.TrimPrefix(o.Name, s.prefix))
+		}
+		if page = objects.NextPageToken; page == "" {
+			return names, nil
+		}
+	}
+}
+
+func (s *bucketStore) ping(ctx context.Context) error {
+	u := fmt.Sprintf("%s/storage/v1/b/%s?fields=name", s.endpoint, url.PathEscape(s.bucket))
+	_, err := s.do(ctx, http.MethodGet, u, nil)
+	if errors.Is(err, errObjectNotFound) {
+		return fmt.Errorf("bucket %s not found", s.bucket)
+	}
+	return err
+}
+
+// metadataToken fetches access tokens of the instance's service account from
+// the metadata server and keeps them until shortly before they expire.
+type metadataToken struct {
+	mu      sync.Mutex
+	client  *http.Client
+	token   string
+	expires time.Time
+}
+
+func (m *metadataToken) get(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Now().Before(m.expires) {
+		return m.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server: unexpected status %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("metadata server: %v", err)
+	}
+	m.token, m.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second-time.Minute)
+	return m.token, nil
+}
+
+// snapshot is a backup of the catalog. Seq is the last journal record it
+// includes; later records are replayed on top of it by a restore.
+type snapshot struct {
+	TakenAt    time.Time           `json:"taken_at"`
+	Seq        int64               `json:"seq"`
+	Items      map[string]Item     `json:"items"`
+	Categories map[string]Category `json:"categories"` // the taxonomy the items' categories refer to
+}
+
+// checksum returns the hex SHA-256 of data.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// backupInfo describes a snapshot in a store.
+type backupInfo struct {
+	Name    string    `json:"name"`
+	TakenAt time.Time `json:"taken_at"`
+	SHA256  string    `json:"sha256"`
+}
+
+// backups takes snapshots of db and restores it from them and the journal.
+type backups struct {
+	mu         sync.Mutex // one backup or restore at a time
+	db         database
+	store      objectStore
+	journal    *journal
+	trash      *trash        // emptied by a restore, see restore
+	categories *categoryTree // snapshotted and restored with the catalog
+	now        func() time.Time
+}
+
+func newBackups(db database, store objectStore, j *journal, bin *trash, categories *categoryTree) *backups {
+	if store != nil {
+		store = timedObjectStore{store} // see supermarket_store_operation_duration_seconds
+	}
+	return &backups{db: db, store: store, journal: j, trash: bin, categories: categories, now: time.Now}
+}
+
+// take writes a snapshot of the catalog and then its checksum, so a snapshot
+// without one was not completely written.
+func (b *backups) take(ctx context.Context) (backupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.categories.mu.Lock()
+	dbmux.Lock() // the snapshot and its journal position must agree
+	snap := snapshot{TakenAt: b.now().UTC(), Seq: b.journal.last(), Items: b.db, Categories: b.categories.byID}
+	data, err := json.Marshal(snap)
+	dbmux.Unlock()
+	b.categories.mu.Unlock()
+	if err != nil {
+		return backupInfo{}, err
+	}
+	info := backupInfo{Name: backupPrefix + snap.TakenAt.Format(backupTime) + backupSuffix, TakenAt: snap.TakenAt, SHA256: checksum(data)}
+	if err := b.store.put(ctx, info.Name, data); err != nil {
+		return backupInfo{}, err
+	}
+	if err := b.store.put(ctx, info.Name+checksumSuffix, []byte(info.SHA256+"\n")); err != nil {
+		return backupInfo{}, err
+	}
+	return info, nil
+}
+
+// list returns the complete snapshots in the store, oldest first.
+func (b *backups) list(ctx context.Context) ([]backupInfo, error) {
+	names, err := b.store.list(ctx, backupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names) // the time in the name sorts in order
+	list := []backupInfo{}
+	for _, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix)
+		takenAt, err := time.Parse(backupTime, stamp)
+		if err != nil || !strings.HasSuffix(name, backupSuffix) {
+			continue // a checksum or another object
+		}
+		sum, err := b.store.get(ctx, name+checksumSuffix)
+		if errors.Is(err, errObjectNotFound) {
+			continue // not completely written
+		} else if err != nil {
+			return nil, err
+		}
+		list = append(list, backupInfo{Name: name, TakenAt: takenAt, SHA256: strings.TrimSpace(string(sum))})
+	}
+	return list, nil
+}
+
+// restoreResult reports a restore.
+type restoreResult struct {
+	Backup     backupInfo `json:"backup"`
+	To         time.Time  `json:"to"`
+	Changes    int        `json:"changes"` // journal records replayed on top of the backup
+	Items      int        `json:"items"`
+	Categories int        `json:"categories"`
+}
+
+// restore returns the catalog to what it was at to: the latest snapshot
+// taken at or before to, checked against its checksum, with the journal
+// records made after it up to to replayed on top. The catalog changes it
+// makes are journaled like any other.
+func (b *backups) restore(ctx context.Context, who actor, to time.Time) (restoreResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list, err := b.list(ctx)
+	if err != nil {
+		return restoreResult{}, err
+	}
+	i := sort.Search(len(list), func(i int) bool { return list[i].TakenAt.After(to) })
+	if i == 0 {
+		return restoreResult{}, fmt.Errorf("%w at or before %s", errNoBackup, to.Format(time.RFC3339))
+	}
+	info := list[i-1]
+	data, err := b.store.get(ctx, info.Name)
+	if err != nil {
+		return restoreResult{}, fmt.Errorf("%s: %v", info.Name, err)
+	}
+	if sum := checksum(data); sum != info.SHA256 {
+		return restoreResult{}, fmt.Errorf("%s: checksum mismatch: got %s, want %s", info.Name, sum, info.SHA256)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return restoreResult{}, fmt.Errorf("%s: %v", info.Name, err)
+	}
+	changes, err := b.journal.changes(snap.Seq, to)
+	if err != nil {
+		return restoreResult{}, err
+	}
+	items := snap.Items
+	if items == nil {
+		items = map[string]Item{}
+	}
+	categories := snap.Categories
+	if categories == nil {
+		categories = map[string]Category{}
+	}
+	for _, c := range changes {
+		switch {
+		case c.CategoryID != "" && c.Category == nil:
+			delete(categories, c.CategoryID)
+		case c.CategoryID != "":
+			categories[c.CategoryID] = *c.Category
+		case c.Item == nil:
+			delete(items, c.ProduceCode)
+		default:
+			items[c.ProduceCode] = *c.Item
+		}
+	}
+
+	b.categories.mu.Lock()
+	defer b.categories.mu.Unlock()
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	for id := range b.categories.byID {
+		if _, ok := categories[id]; !ok {
+			b.categories.writeLocked(who, id, nil)
+		}
+	}
+	for id, cat := range categories {
+		if old, ok := b.categories.byID[id]; !ok || !reflect.DeepEqual(old, cat) {
+			b.categories.writeLocked(who, id, &cat)
+		}
+	}
+	for code := range b.db {
+		if _, ok := items[code]; !ok {
+			b.db.remove(who, code)
+		}
+	}
+	for code, item := range items {
+		if old, ok := b.db[code]; !ok || !reflect.DeepEqual(old, item) {
+			b.db.put(who, code, item)
+		}
+	}
+	b.trash.clear(who) // its items may be back in the catalog, or deleted before it was
+	return restoreResult{Backup: info, To: to, Changes: len(changes), Items: len(items), Categories: len(categories)}, nil
+}
+
+// run takes a snapshot now and then every interval until ctx is done. A
+// snapshot at start up is what later restores build on: the catalog may have
+// been seeded again or rebuilt from events on start, which the journal does
+// not record.
+func (b *backups) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if info, err := b.take(ctx); err != nil {
+			log.Printf("backup: %v", err)
+		} else {
+			log.Printf("backup: %s taken", info.Name)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// configured answers 403 to requests that are not an admin's and 503 when no
+// backup store is configured.
+func (b *backups) configured(c *gin.Context) bool {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "backups need an admin token"})
+		return false
+	}
+	if b.store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "backups are not configured, see -backup.to"})
+		return false
+	}
+	return true
+}
+
+// List Backups godoc
+// @Summary List Backups
+// @Schemes
+// @Description List the catalog snapshots in the backup store, oldest first, with their SHA-256 checksums. Admins only, see X-Admin-Token
+// @Tags admin
+// @Produce json
+// @Param        X-Admin-Token   header      string  true  "Admin token"
+// @Success 200 {string} ok
+// @Failure 403 {string} error
+// @Failure 503 {string} error
+// @Router /backups [get]
+func (b *backups) listBackups(c *gin.Context) {
+	if !b.configured(c) {
+		return
+	}
+	list, err := b.list(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// Take Backup godoc
+// @Summary Take Backup
+// @Schemes
+// @Description Write a snapshot of the catalog to the backup store now. Admins only, see X-Admin-Token
+// @Tags admin
+// @Produce json
+// @Param        X-Admin-Token   header      string  true  "Admin token"
+// @Success 201 {string} ok
+// @Failure 403 {string} error
+// @Failure 503 {string} error
+// @Router /backups [post]
+func (b *backups) takeBackup(c *gin.Context) {
+	if !b.configured(c) {
+		return
+	}
+	info, err := b.take(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, info)
+}
+
+// Binding from JSON with POST.
+type Restore struct {
+	To time.Time `json:"to" binding:"required"` // To is the point in time to restore, in RFC 3339
+}
+
+// Restore godoc
+// @Summary Restore Catalog
+// @Schemes
+// @Description Restore the catalog to a point in time from the latest backup at or before it and the change journal. The backup is verified against its checksum first. Admins only, see X-Admin-Token
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param        X-Admin-Token   header      string  true  "Admin token"
+// @Param        restore  body      Restore  true  "Point in time"
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 403 {string} error
+// @Failure 500 {string} error
+// @Failure 503 {string} error
+// @Router /restore [post]
+func (b *backups) restoreCatalog(c *gin.Context) {
+	if !b.configured(c) {
+		return
+	}
+	var req Restore
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.To.After(b.now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to is in the future"})
+		return
+	}
+	result, err := b.restore(c.Request.Context(), actorFrom(c), req.To)
+	if errors.Is(err, errNoBackup) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
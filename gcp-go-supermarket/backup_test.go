@@ -0,0 +1,272 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestBackupRestore -v
+
+func TestBackupRestore(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "s3cret"
+	dir := t.TempDir()
+	clock := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	now := func() time.Time { return clock }
+	j, err := openJournal(filepath.Join(dir, "journal.jsonl"))
+	assert.NilError(t, err)
+	defer j.close()
+	j.now = now
+	defer func(j *journal) { catalogJournal = j }(catalogJournal)
+	catalogJournal = j
+
+	f, err := loadFixture(fixtureTest)
+	assert.NilError(t, err)
+	db := f.database(clock)
+	store, err := newObjectStore(filepath.Join(dir, "backups"))
+	assert.NilError(t, err)
+	categories := newCategoryTree(db)
+	b := newBackups(db, store, j, newTrash(db), categories)
+	b.now = now
+	router := gin.New()
+	router.GET("/api/v1/backups", b.listBackups)
+	router.POST("/api/v1/backups", b.takeBackup)
+	router.POST("/api/v1/restore", b.restoreCatalog)
+	change := func(d time.Duration, fn func()) {
+		clock = clock.Add(d)
+		dbmux.Lock()
+		fn()
+		dbmux.Unlock()
+	}
+	addCategory := func(id string) {
+		categories.mu.Lock()
+		categories.write(actor{}, id, &Category{ID: id, Name: id})
+		categories.mu.Unlock()
+	}
+
+	got := routerAdminReq("POST", "/api/v1/backups", nil, router)
+	assert.Equal(t, got.Code, 201, got.Body.String())
+	change(time.Minute, func() {
+		db.put(actor{}, "B111-2222-3333-4444", Item{ProduceCode: "B111-2222-3333-4444", Name: "Kiwi", UnitPrice: "$0.50"})
+	})
+	change(time.Minute, func() { db.remove(actor{}, "E5T6-9UI3-TH15-QR88") })
+	addCategory("produce")
+	clock = clock.Add(time.Minute)
+	_, err = b.take(context.Background())
+	assert.NilError(t, err)
+	change(time.Minute, func() {
+		item := db["A12T-4GH7-QPL9-3N4M"]
+		item.UnitPrice = "$3.99"
+		db.put(actor{}, "A12T-4GH7-QPL9-3N4M", item)
+	})
+	addCategory("fruit")
+	clock = clock.Add(5 * time.Minute)
+	addCategory("vegetables")
+
+	tests := []struct {
+		name       string
+		notAdmin   bool
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "list, not admin", notAdmin: true, method: "GET", path: "/api/v1/backups", wantCode: 403, wantResult: `{"error":"backups need an admin token"}`},
+		{name: "take, not admin", notAdmin: true, method: "POST", path: "/api/v1/backups", wantCode: 403, wantResult: `{"error":"backups need an admin token"}`},
+		{name: "restore, not admin", notAdmin: true, method: "POST", path: "/api/v1/restore", jsonData: []byte(`{"to":"2022-07-01T10:01:30Z"}`), wantCode: 403, wantResult: `{"error":"backups need an admin token"}`},
+		{name: "list", method: "GET", path: "/api/v1/backups", wantCode: 200, wantResult: `[{"name":"catalog-20220701T100000.000Z.json","taken_at":"2022-07-01T10:00:00Z","sha256":"`},
+		{name: "before the first", method: "POST", path: "/api/v1/restore", jsonData: []byte(`{"to":"2022-07-01T09:59:59Z"}`), wantCode: 400, wantResult: `{"error":"no backup at or before 2022-07-01T09:59:59Z"}`},
+		{name: "future", method: "POST", path: "/api/v1/restore", jsonData: []byte(`{"to":"2022-07-02T00:00:00Z"}`), wantCode: 400, wantResult: `{"error":"to is in the future"}`},
+		{name: "missing to", method: "POST", path: "/api/v1/restore", jsonData: []byte(`{}`), wantCode: 400, wantResult: `{"error":"Key: 'Restore.To' Error:Field validation for 'To' failed on the 'required' tag"}`},
+		{name: "first backup and journal", method: "POST", path: "/api/v1/restore", jsonData: []byte(`{"to":"2022-07-01T10:01:30Z"}`), wantCode: 200, wantResult: `{"backup":{"name":"catalog-20220701T100000.000Z.json","taken_at":"2022-07-01T10:00:00Z","sha256":"`},
+	}
+	for _, tc := range tests {
+		got := routerAdminReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.notAdmin {
+			got = routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		}
+		if tc.wantCode != got.Code || !strings.HasPrefix(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+	codes := func() string {
+		dbmux.Lock()
+		defer dbmux.Unlock()
+		var codes []string
+		for code, item := range db {
+			codes = append(codes, code+" "+item.UnitPrice)
+		}
+		sort.Strings(codes)
+		return strings.Join(codes, ", ")
+	}
+	assert.Equal(t, codes(), "A12T-4GH7-QPL9-3N4M $3.41, B111-2222-3333-4444 $0.50, E5T6-9UI3-TH15-QR88 $2.99, TQ4C-VV6T-75ZX-1RMR $3.59, YRT6-72AS-K736-L4AR $0.79")
+
+	clock = clock.Add(time.Minute)
+	b.trash.items["Z111-2222-3333-4444"] = trashed{item: Item{Name: "Plum"}, deletedAt: clock}
+	result, err := b.restore(context.Background(), actor{}, time.Date(2022, 7, 1, 10, 5, 0, 0, time.UTC))
+	assert.NilError(t, err)
+	assert.Equal(t, len(b.trash.items), 0) // a restore empties the trash
+	assert.Equal(t, result.Backup.Name, "catalog-20220701T100300.000Z.json")
+	assert.Equal(t, result.Changes, 2)
+	assert.Equal(t, codes(), "A12T-4GH7-QPL9-3N4M $3.99, B111-2222-3333-4444 $0.50, TQ4C-VV6T-75ZX-1RMR $3.59, YRT6-72AS-K736-L4AR $0.79")
+	assert.Equal(t, result.Categories, 2) // the taxonomy is restored with the catalog
+	assert.DeepEqual(t, categories.byID, map[string]Category{"fruit": {ID: "fruit", Name: "fruit"}, "produce": {ID: "produce", Name: "produce"}})
+
+	// The restores were journaled: the journal carries on from them after a restart.
+	assert.Equal(t, j.last(), int64(15))
+	j2, err := openJournal(j.path)
+	assert.NilError(t, err)
+	j2.close()
+	assert.Equal(t, j2.last(), int64(15))
+
+	path := filepath.Join(dir, "backups", "catalog-20220701T100300.000Z.json")
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(path, append(data, ' '), 0o644))
+	_, err = b.restore(context.Background(), actor{}, time.Date(2022, 7, 1, 10, 5, 0, 0, time.UTC))
+	assert.ErrorContains(t, err, "catalog-20220701T100300.000Z.json: checksum mismatch")
+}
+
+// go test -run TestJournalTornLine -v
+
+func TestJournalTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	data := `{"seq":1,"time":"2022-07-01T10:00:00Z","code":"A12T-4GH7-QPL9-3N4M","item":null}` + "\n" + `{"seq":2,"time":"2022-07-01T10:0`
+	assert.NilError(t, os.WriteFile(path, []byte(data), 0o644))
+	j, err := openJournal(path)
+	assert.NilError(t, err)
+	assert.Equal(t, j.last(), int64(1))
+	j.record("E5T6-9UI3-TH15-QR88", nil) // on a line of its own
+	assert.NilError(t, j.close())
+	j, err = openJournal(path)
+	assert.NilError(t, err)
+	defer j.close()
+	changes, err := j.changes(0, time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(changes), 2)
+	assert.Equal(t, changes[1].ProduceCode, "E5T6-9UI3-TH15-QR88")
+
+	assert.NilError(t, os.WriteFile(path, []byte("{\n"+data), 0o644))
+	_, err = openJournal(path)
+	assert.ErrorContains(t, err, "line 1: unexpected end of JSON input")
+}
+
+// go test -run TestBucketStore -v
+
+func TestBucketStore(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/shop/o":
+			objects[r.URL.Query().Get("name")], _ = io.ReadAll(r.Body)
+		case r.Method == "GET" && r.URL.Path == "/storage/v1/b/shop/o": // one object per page
+			var names []string
+			for name := range objects {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) && name > r.URL.Query().Get("pageToken") {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			page := map[string]any{"kind": "storage#objects"}
+			if len(names) > 0 {
+				page["items"] = []map[string]string{{"name": names[0]}}
+				page["nextPageToken"] = names[0]
+			}
+			json.NewEncoder(w).Encode(page)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/shop/o/"):
+			data, ok := objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/shop/o/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	store, err := newObjectStore("gs://shop/prod/store-1")
+	assert.NilError(t, err)
+	s := store.(*bucketStore)
+	assert.Equal(t, s.prefix, "prod/store-1/")
+	s.token = func(context.Context) (string, error) { return "secret", nil }
+
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		assert.NilError(t, s.put(ctx, fmt.Sprintf("catalog-%d.json", i), []byte(fmt.Sprint(i))))
+	}
+	assert.NilError(t, s.put(ctx, "other.json", nil))
+	names, err := s.list(ctx, "catalog-")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, names, []string{"catalog-1.json", "catalog-2.json", "catalog-3.json"})
+	data, err := s.get(ctx, "catalog-2.json")
+	assert.NilError(t, err)
+	assert.Equal(t, string(data), "2")
+	_, err = s.get(ctx, "catalog-4.json")
+	assert.Assert(t, errors.Is(err, errObjectNotFound))
+
+	s.token = func(context.Context) (string, error) { return "expired", nil }
+	_, err = s.get(ctx, "catalog-2.json")
+	assert.Error(t, err, "bucket shop: unexpected status 401 Unauthorized")
+
+	_, err = newObjectStore("gs://")
+	assert.Error(t, err, `"gs://" has no bucket`)
+}
+
+// go test -run TestBackupsNotConfigured -v
+
+func TestBackupsNotConfigured(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "s3cret"
+	router := database{}.dbInit()
+	got := routerAdminReq("GET", "/api/v1/backups", nil, router)
+	assert.Equal(t, got.Code, 503)
+	assert.Equal(t, got.Body.String(), `{"error":"backups are not configured, see -backup.to"}`)
+}
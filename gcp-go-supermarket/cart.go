@@ -0,0 +1,346 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cartTTL is how long a cart lives after it was last changed. It is set from
+// the -cart.ttl flag in main.
+var cartTTL = 2 * time.Hour
+
+// cart is a shopper's basket. Lines hold one entry per code, in the order the
+// codes were first added.
+type cart struct {
+	ID        string
+	Lines     []basketLine
+	ExpiresAt time.Time
+}
+
+// cartStore holds the open carts. Expired carts are dropped the next time the
+// store is used.
+type cartStore struct {
+	mu     sync.Mutex
+	carts  map[string]*cart
+	pricer *pricer
+	now    func() time.Time
+}
+
+func newCartStore(p *pricer) *cartStore {
+	return &cartStore{carts: map[string]*cart{}, pricer: p, now: time.Now}
+}
+
+// Binding from URI.
+type CartId struct {
+	ID string `uri:"id" binding:"required,hexadecimal,len=32"`
+}
+
+// Binding from JSON with POST.
+type CartLine struct {
+	ProduceCode string `json:"code" binding:"required,isproducecode"`
+	Quantity    string `json:"quantity" binding:"required,isweight,max=9"` // Quantity in the item's unit, whole for items sold by each or bunch; at most maxQuantity
+}
+
+// cartView is the JSON view of a priced cart.
+type cartView struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	basketView
+}
+
+// newCartID returns 16 random bytes in hex.
+func newCartID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// purge drops expired carts. The caller must hold s.mu.
+func (s *cartStore) purge(now time.Time) {
+	for id, ct := range s.carts {
+		if !now.Before(ct.ExpiresAt) {
+			delete(s.carts, id)
+		}
+	}
+}
+
+// lookup returns the open cart id. The caller must hold s.mu.
+func (s *cartStore) lookup(id string) (*cart, bool) {
+	s.purge(s.now())
+	ct, ok := s.carts[strings.ToLower(id)]
+	return ct, ok
+}
+
+// checkout takes the open cart id out of the store, so that only one order
+// is placed for it. A cart no order was placed for is given back with reopen.
+func (s *cartStore) checkout(id string) (*cart, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct, ok := s.lookup(id)
+	if ok {
+		delete(s.carts, strings.ToLower(id))
+	}
+	return ct, ok
+}
+
+// reopen gives back a cart taken by checkout.
+func (s *cartStore) reopen(ct *cart) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.carts[strings.ToLower(ct.ID)] = ct
+}
+
+// view prices ct in the store's tax jurisdiction. The caller must hold s.mu.
+func (s *cartStore) view(ct *cart) (cartView, error) {
+	priced, err := s.pricer.price(ct.Lines, "")
+	return cartView{ID: ct.ID, ExpiresAt: ct.ExpiresAt, basketView: priced.view()}, err
+}
+
+// respond writes the priced view of ct.
+func (s *cartStore) respond(c *gin.Context, code int, ct *cart) {
+	view, err := s.view(ct)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(code, view)
+}
+
+// maxQuantity is the most of an item, in its unit, a cart or order line can
+// hold. It keeps the amounts of a basket well inside int64 cents.
+var maxQuantity = big.NewRat(10000, 1)
+
+// parseQuantity parses a cart quantity for an item sold by unit.
+func parseQuantity(s, unit string) (*big.Rat, error) {
+	q, ok := new(big.Rat).SetString(s)
+	if !ok || q.Sign() <= 0 {
+		return nil, fmt.Errorf("quantity must be greater than 0")
+	}
+	if !isWeightUnit(unit) && !q.IsInt() {
+		return nil, fmt.Errorf("item is sold by %s, quantity must be whole", unit)
+	}
+	return q, checkQuantity(q)
+}
+
+// checkQuantity returns an error if q is more than maxQuantity.
+func checkQuantity(q *big.Rat) error {
+	if q.Cmp(maxQuantity) > 0 {
+		return fmt.Errorf("quantity must be at most %s", maxQuantity.RatString())
+	}
+	return nil
+}
+
+// Create Cart godoc
+// @Summary Create Cart
+// @Schemes
+// @Description Open an empty cart. Carts expire when left unchanged for the cart TTL
+// @Tags cart
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Router /carts [post]
+func (s *cartStore) create(c *gin.Context) {
+	id, err := newCartID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.purge(now)
+	ct := &cart{ID: id, Lines: []basketLine{}, ExpiresAt: now.Add(cartTTL)}
+	s.carts[id] = ct
+	s.respond(c, http.StatusCreated, ct)
+}
+
+// Get Cart godoc
+// @Summary Get Cart
+// @Schemes
+// @Description Cart lines priced against the current catalog, with subtotals, discounts, tax and totals
+// @Tags cart
+// @Param        id   path      string  true  "Cart ID"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /cart/:id [get]
+func (s *cartStore) get(c *gin.Context) {
+	var cartId CartId
+	if err := c.ShouldBindUri(&cartId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct, ok := s.lookup(cartId.ID)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "cart not found"})
+		return
+	}
+	s.respond(c, http.StatusOK, ct)
+}
+
+// Add Cart Line godoc
+// @Summary Add Cart Line
+// @Schemes
+// @Description Add a quantity of an item to a cart. Adding a code already in the cart increases its quantity
+// @Tags cart
+// @Param        id   path      string  true  "Cart ID"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /cart/:id/lines [post]
+func (s *cartStore) addLine(c *gin.Context) {
+	var cartId CartId
+	if err := c.ShouldBindUri(&cartId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var line CartLine
+	if err := c.ShouldBindJSON(&line); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(line.ProduceCode)
+	dbmux.Lock()
+	item, found := s.pricer.db[code]
+	dbmux.Unlock()
+	if !found {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	qty, err := parseQuantity(line.Quantity, itemUnit(item))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct, ok := s.lookup(cartId.ID)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "cart not found"})
+		return
+	}
+	merged := false
+	for i, l := range ct.Lines {
+		if l.ProduceCode == code {
+			sum := new(big.Rat).Add(l.Quantity, qty)
+			if err := checkQuantity(sum); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			ct.Lines[i].Quantity = sum
+			merged = true
+			break
+		}
+	}
+	if !merged {
+		ct.Lines = append(ct.Lines, basketLine{ProduceCode: code, Quantity: qty})
+	}
+	ct.ExpiresAt = s.now().Add(cartTTL)
+	s.respond(c, http.StatusOK, ct)
+}
+
+// Remove Cart Line godoc
+// @Summary Remove Cart Line
+// @Schemes
+// @Description Remove an item from a cart, or only ?quantity= of it
+// @Tags cart
+// @Param        id   path      string  true  "Cart ID"
+// @Param        code   path      string  true  "Code"
+// @Param        quantity   query      string  false  "Quantity to remove; the whole line when omitted"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /cart/:id/lines/:code [delete]
+func (s *cartStore) removeLine(c *gin.Context) {
+	var cartId CartId
+	if err := c.ShouldBindUri(&cartId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	var qty *big.Rat
+	if q := c.Query("quantity"); q != "" {
+		if !weightRegex.MatchString(q) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid quantity %q", q)})
+			return
+		}
+		dbmux.Lock()
+		item, found := s.pricer.db[code]
+		dbmux.Unlock()
+		unit := unitKg // any quantity of an item no longer in the catalog
+		if found {
+			unit = itemUnit(item)
+		}
+		var err error
+		if qty, err = parseQuantity(q, unit); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ct, ok := s.lookup(cartId.ID)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "cart not found"})
+		return
+	}
+	i := 0
+	for i < len(ct.Lines) && ct.Lines[i].ProduceCode != code {
+		i++
+	}
+	if i == len(ct.Lines) {
+		c.JSON(http.StatusOK, gin.H{"error": "code not in cart"})
+		return
+	}
+	if left := new(big.Rat); qty != nil && left.Sub(ct.Lines[i].Quantity, qty).Sign() > 0 {
+		ct.Lines[i].Quantity = left
+	} else {
+		ct.Lines = append(ct.Lines[:i], ct.Lines[i+1:]...)
+	}
+	ct.ExpiresAt = s.now().Add(cartTTL)
+	s.respond(c, http.StatusOK, ct)
+}
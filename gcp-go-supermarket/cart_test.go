@@ -0,0 +1,118 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestCart -v
+
+func TestCart(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	assert.Equal(t, routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","price":"2.20","unit":"lb"}]`), router).Code, 201)
+
+	got := routerPOSTReq("POST", "/api/v1/carts", nil, router)
+	assert.Equal(t, got.Code, 201)
+	var created struct {
+		ID        string    `json:"id"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Total     string    `json:"total"`
+	}
+	assert.NilError(t, json.Unmarshal(got.Body.Bytes(), &created))
+	assert.Equal(t, len(created.ID), 32)
+	assert.Equal(t, created.Total, "$0.00")
+	cart := "/api/v1/cart/" + created.ID
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "add", method: "POST", path: cart + "/lines", jsonData: []byte(`{"code":"A12T-4GH7-QPL9-3N4M","quantity":"2"}`), wantCode: 200, wantResult: `"lines":[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","quantity":"2","unit":"each","unit_price":"$3.41","subtotal":"$6.82","discounts":[],"discount":"$0.00","tax_class":"standard","tax_rate":"0","tax":"$0.00","total":"$6.82"}],"subtotal":"$6.82","discount":"$0.00","tax":"$0.00","total":"$6.82","jurisdiction":"default","tax_table":"flat"}`},
+		{name: "add again", method: "POST", path: cart + "/lines", jsonData: []byte(`{"code":"a12t-4gh7-qpl9-3n4m","quantity":"1"}`), wantCode: 200, wantResult: `"quantity":"3","unit":"each","unit_price":"$3.41","subtotal":"$10.23",`},
+		{name: "add weight", method: "POST", path: cart + "/lines", jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4AZ","quantity":"1.25"}`), wantCode: 200, wantResult: `"subtotal":"$12.98","discount":"$0.00","tax":"$0.00","total":"$12.98",`},
+		{name: "fractional each", method: "POST", path: cart + "/lines", jsonData: []byte(`{"code":"E5T6-9UI3-TH15-QR88","quantity":"0.5"}`), wantCode: 400, wantResult: `{"error":"item is sold by each, quantity must be whole"}`},
+		{name: "zero", method: "POST", path: cart + "/lines", jsonData: []byte(`{"code":"E5T6-9UI3-TH15-QR88","quantity":"0"}`), wantCode: 400, wantResult: `{"error":"quantity must be greater than 0"}`},
+		{name: "bad quantity", method: "POST", path: cart + "/lines", jsonData: []byte(`{"code":"E5T6-9UI3-TH15-QR88","quantity":"-1"}`), wantCode: 400, wantResult: `{"error":"Key: 'CartLine.Quantity' Error:Field validation for 'Quantity' failed on the 'isweight' tag"}`},
+		{name: "unknown code", method: "POST", path: cart + "/lines", jsonData: []byte(`{"code":"Z5T6-9UI3-TH15-QR88","quantity":"1"}`), wantCode: 200, wantResult: `{"error":"code not found"}`},
+		{name: "remove some", method: "DELETE", path: cart + "/lines/A12T-4GH7-QPL9-3N4M?quantity=2", wantCode: 200, wantResult: `"quantity":"1","unit":"each","unit_price":"$3.41","subtotal":"$3.41",`},
+		{name: "remove zero", method: "DELETE", path: cart + "/lines/A12T-4GH7-QPL9-3N4M?quantity=0", wantCode: 400, wantResult: `{"error":"quantity must be greater than 0"}`},
+		{name: "remove fractional each", method: "DELETE", path: cart + "/lines/A12T-4GH7-QPL9-3N4M?quantity=0.5", wantCode: 400, wantResult: `{"error":"item is sold by each, quantity must be whole"}`},
+		{name: "remove bad quantity", method: "DELETE", path: cart + "/lines/A12T-4GH7-QPL9-3N4M?quantity=all", wantCode: 400, wantResult: `{"error":"invalid quantity \"all\""}`},
+		{name: "remove line", method: "DELETE", path: cart + "/lines/A12T-4GH7-QPL9-3N4M", wantCode: 200, wantResult: `"lines":[{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","quantity":"1.250","unit":"lb","unit_price":"$2.20","subtotal":"$2.75",`},
+		{name: "remove missing", method: "DELETE", path: cart + "/lines/A12T-4GH7-QPL9-3N4M", wantCode: 200, wantResult: `{"error":"code not in cart"}`},
+		{name: "remove some weight", method: "DELETE", path: cart + "/lines/ZRT6-72AS-K736-L4AZ?quantity=0.25", wantCode: 200, wantResult: `"quantity":"1","unit":"lb","unit_price":"$2.20","subtotal":"$2.20",`},
+		{name: "catalog delete", method: "GET", path: "/api/v1/delete/ZRT6-72AS-K736-L4AZ", wantCode: 200, wantResult: `{"status":"item deleted"}`},
+		{name: "unavailable", method: "GET", path: cart, wantCode: 200, wantResult: `"lines":[],"unavailable":["ZRT6-72AS-K736-L4AZ"],"subtotal":"$0.00","discount":"$0.00","tax":"$0.00","total":"$0.00",`},
+		{name: "bad id", method: "GET", path: "/api/v1/cart/123", wantCode: 400, wantResult: `{"error":"Key: 'CartId.ID' Error:Field validation for 'ID' failed on the 'len' tag"}`},
+		{name: "unknown cart", method: "GET", path: "/api/v1/cart/" + strings.Repeat("0", 32), wantCode: 200, wantResult: `{"error":"cart not found"}`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || !strings.Contains(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
+
+// go test -run TestCartExpiry -v
+
+func TestCartExpiry(t *testing.T) {
+	now := time.Date(2022, 7, 8, 12, 0, 0, 0, time.UTC)
+	database{}.setupRouter() // registers the validators
+	store := newCartStore(newPricer(database{"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41"}}, nil))
+	store.now = func() time.Time { return now }
+	r := gin.New()
+	r.POST("/api/v1/carts", store.create)
+	r.GET("/api/v1/cart/:id", store.get)
+	r.POST("/api/v1/cart/:id/lines", store.addLine)
+
+	got := routerPOSTReq("POST", "/api/v1/carts", nil, r)
+	var created cartView
+	assert.NilError(t, json.Unmarshal(got.Body.Bytes(), &created))
+	assert.Equal(t, created.ExpiresAt, now.Add(cartTTL))
+	cart := "/api/v1/cart/" + created.ID
+
+	now = now.Add(cartTTL - time.Minute) // changing the cart extends it
+	got = routerPOSTReq("POST", cart+"/lines", []byte(`{"code":"A12T-4GH7-QPL9-3N4M","quantity":"1"}`), r)
+	assert.Assert(t, strings.Contains(got.Body.String(), `"total":"$3.41"`), got.Body.String())
+	now = now.Add(cartTTL - time.Minute)
+	assert.Assert(t, strings.Contains(routerPOSTReq("GET", cart, nil, r).Body.String(), `"total":"$3.41"`))
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, routerPOSTReq("GET", cart, nil, r).Body.String(), `{"error":"cart not found"}`)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, len(store.carts), 0)
+}
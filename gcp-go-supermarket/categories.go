@@ -0,0 +1,515 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Attribute types an AttributeDef can declare.
+const (
+	attrBool   = "bool"
+	attrString = "string"
+	attrNumber = "number"
+)
+
+// Binding from JSON with POST.
+// Category is a node of the product taxonomy, e.g. Produce > Fruit > Stone Fruit.
+// Root categories are departments.
+type Category struct {
+	ID         string         `json:"id" binding:"required,isslug"`                  // ID is a slug such as stone-fruit
+	Name       string         `json:"name" binding:"required,alphanumandspace"`      // Name is a string with only alphanumeric characters and spaces
+	Parent     string         `json:"parent,omitempty" binding:"omitempty,isslug"`   // Parent is the ID of the parent category; empty for a department
+	Attributes []AttributeDef `json:"attributes,omitempty" binding:"omitempty,dive"` // Attributes are the typed custom attributes items in this category and its descendants can carry
+}
+
+// AttributeDef declares a typed custom attribute, e.g. organic (bool),
+// country_of_origin (string) or variety (string).
+type AttributeDef struct {
+	Name string `json:"name" binding:"required,isslug"`
+	Type string `json:"type" binding:"required,oneof=bool string number"`
+}
+
+// Binding from JSON with POST.
+type CategoryAssignment struct {
+	Category   string         `json:"category" binding:"omitempty,isslug"` // Category is the ID of the category; empty unassigns the item
+	Attributes map[string]any `json:"attributes"`                          // Attributes must be declared by the category or one of its ancestors
+}
+
+// CategoryId is the URL binding of a category ID.
+type CategoryId struct {
+	ID string `uri:"id" binding:"required,isslug"`
+}
+
+// categoryView is a category with its place in the tree.
+type categoryView struct {
+	Category
+	Path     []string `json:"path"`     // Path is the names from the department down, e.g. Produce, Fruit, Stone Fruit
+	Children []string `json:"children"` // Children are the IDs of the direct subcategories
+}
+
+// categoryTree is the product taxonomy. Its changes are recorded in the
+// journal and the event store like the catalog's, and it is rebuilt from the
+// events on start, see apply.
+// categoryTree methods are safe to call concurrently. They must not be
+// called while holding dbmux; the tree locks dbmux itself when it needs to.
+type categoryTree struct {
+	mu   sync.Mutex
+	db   database
+	byID map[string]Category
+}
+
+func newCategoryTree(db database) *categoryTree {
+	return &categoryTree{db: db, byID: map[string]Category{}}
+}
+
+// categoriesKey is the gin context key of the request's *categoryTree.
+const categoriesKey = "categories"
+
+// categoriesFrom returns the category tree set on the context by setupRouter.
+func categoriesFrom(c *gin.Context) *categoryTree {
+	return c.MustGet(categoriesKey).(*categoryTree)
+}
+
+// apply applies a category event to the tree; item events leave it alone.
+func (t *categoryTree) apply(e event) error {
+	switch e.Type {
+	case eventCategorySaved:
+		var data categorySaved
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		t.byID[e.Category] = data.Category
+	case eventCategoryDeleted:
+		delete(t.byID, e.Category)
+	}
+	return nil
+}
+
+// write stores cat under id for who, or deletes category id when cat is nil,
+// recording the change in the journal and the event store. The caller must
+// hold t.mu but not dbmux.
+func (t *categoryTree) write(who actor, id string, cat *Category) {
+	dbmux.Lock() // keeps the records in order with the catalog's
+	defer dbmux.Unlock()
+	t.writeLocked(who, id, cat)
+}
+
+// writeLocked is write for callers holding dbmux too.
+func (t *categoryTree) writeLocked(who actor, id string, cat *Category) {
+	if cat != nil {
+		t.byID[id] = *cat
+	} else {
+		delete(t.byID, id)
+	}
+	catalogJournal.recordCategory(id, cat)
+	catalogEvents.recordCategory(who, id, cat)
+}
+
+// ancestors returns id followed by its ancestors up to the department.
+// The caller must hold t.mu.
+func (t *categoryTree) ancestors(id string) []string {
+	var chain []string
+	for id != "" {
+		chain = append(chain, id)
+		id = t.byID[id].Parent
+	}
+	return chain
+}
+
+// subtree returns id and the IDs of all its descendants, or nil if id does not exist.
+func (t *categoryTree) subtree(id string) map[string]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[id]; !ok {
+		return nil
+	}
+	ids := map[string]bool{id: true}
+	for changed := true; changed; {
+		changed = false
+		for cid, cat := range t.byID {
+			if !ids[cid] && ids[cat.Parent] {
+				ids[cid] = true
+				changed = true
+			}
+		}
+	}
+	return ids
+}
+
+// view returns the view of category id. The caller must hold t.mu.
+func (t *categoryTree) view(id string) categoryView {
+	chain := t.ancestors(id)
+	names := make([]string, len(chain))
+	for i, cid := range chain {
+		names[len(chain)-1-i] = t.byID[cid].Name
+	}
+	children := []string{}
+	for cid, cat := range t.byID {
+		if cat.Parent == id {
+			children = append(children, cid)
+		}
+	}
+	sort.Strings(children)
+	return categoryView{Category: t.byID[id], Path: names, Children: children}
+}
+
+// checkParent returns an error if parent cannot be the parent of id.
+// The caller must hold t.mu.
+func (t *categoryTree) checkParent(id, parent string) error {
+	if parent == "" {
+		return nil
+	}
+	if _, ok := t.byID[parent]; !ok {
+		return fmt.Errorf("parent category %q not found", parent)
+	}
+	for _, a := range t.ancestors(parent) {
+		if a == id {
+			return fmt.Errorf("category %q cannot be moved under its own subcategory %q", id, parent)
+		}
+	}
+	return nil
+}
+
+// checkAttributes returns an error if attrs are not declared by category or
+// its ancestors, or a value does not have the declared type.
+func (t *categoryTree) checkAttributes(category string, attrs map[string]any) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.checkAttributesLocked(category, attrs)
+}
+
+// checkAttributesLocked is checkAttributes for callers holding t.mu.
+func (t *categoryTree) checkAttributesLocked(category string, attrs map[string]any) error {
+	if category == "" {
+		if len(attrs) > 0 {
+			return fmt.Errorf("attributes require a category")
+		}
+		return nil
+	}
+	if _, ok := t.byID[category]; !ok {
+		return fmt.Errorf("category %q not found", category)
+	}
+	declared := map[string]string{}
+	for _, id := range t.ancestors(category) {
+		for _, def := range t.byID[id].Attributes {
+			if _, ok := declared[def.Name]; !ok { // the closest declaration wins
+				declared[def.Name] = def.Type
+			}
+		}
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names) // report errors in a stable order
+	for _, name := range names {
+		typ, ok := declared[name]
+		if !ok {
+			return fmt.Errorf("attribute %q is not declared for category %q", name, category)
+		}
+		var valid bool
+		switch attrs[name].(type) {
+		case bool:
+			valid = typ == attrBool
+		case string:
+			valid = typ == attrString
+		case float64: // encoding/json decodes numbers into interface values as float64
+			valid = typ == attrNumber
+		}
+		if !valid {
+			return fmt.Errorf("attribute %q must be a %s", name, typ)
+		}
+	}
+	return nil
+}
+
+// checkItems returns an error if one of items has an unknown category or
+// attributes that its category does not declare.
+func (t *categoryTree) checkItems(items []Item) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.checkItemsLocked(items)
+}
+
+// checkItemsLocked is checkItems for callers holding t.mu.
+func (t *categoryTree) checkItemsLocked(items []Item) error {
+	for i, item := range items {
+		if err := t.checkAttributesLocked(item.Category, item.Attributes); err != nil {
+			return fmt.Errorf("[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// checkSubtreeItemsLocked returns an error if an item in category id or one
+// of its descendants has attributes the tree no longer declares. The caller
+// must hold t.mu but not dbmux.
+func (t *categoryTree) checkSubtreeItemsLocked(id string) error {
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	codes := make([]string, 0, len(t.db))
+	for code := range t.db {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes) // report errors in a stable order
+	for _, code := range codes {
+		item := t.db[code]
+		for _, a := range t.ancestors(item.Category) {
+			if a != id {
+				continue
+			}
+			if err := t.checkAttributesLocked(item.Category, item.Attributes); err != nil {
+				return fmt.Errorf("item %s: %v", code, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// List Categories godoc
+// @Summary List Categories
+// @Schemes
+// @Description List all categories with their path from the department
+// @Tags taxonomy
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Router /categories [get]
+func (t *categoryTree) list(c *gin.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	views := []categoryView{}
+	for id := range t.byID {
+		views = append(views, t.view(id))
+	}
+	sort.Slice(views, func(i, j int) bool { // depth first, by name
+		return strings.Join(views[i].Path, "\x00") < strings.Join(views[j].Path, "\x00")
+	})
+	c.JSON(http.StatusOK, views)
+}
+
+// Add Category godoc
+// @Summary Add Category
+// @Schemes
+// @Description Add a category. Omit the parent to add a department
+// @Tags taxonomy
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /categories [post]
+func (t *categoryTree) add(c *gin.Context) {
+	var cat Category
+	if err := c.ShouldBindJSON(&cat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[cat.ID]; ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "category exists"})
+		return
+	}
+	if err := t.checkParent(cat.ID, cat.Parent); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.write(actorFrom(c), cat.ID, &cat)
+	c.JSON(http.StatusCreated, gin.H{"status": "category added"})
+}
+
+// Get Category godoc
+// @Summary Get Category
+// @Schemes
+// @Description Get a category with its path and subcategories
+// @Tags taxonomy
+// @Param        id   path      string  true  "Category ID"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /category/:id [get]
+func (t *categoryTree) get(c *gin.Context) {
+	var categoryId CategoryId
+	if err := c.ShouldBindUri(&categoryId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[categoryId.ID]; !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "category not found"})
+		return
+	}
+	c.JSON(http.StatusOK, t.view(categoryId.ID))
+}
+
+// Update Category godoc
+// @Summary Update Category
+// @Schemes
+// @Description Rename, move or redeclare the attributes of a category. The ID in the body must match the path. Fails if an item in the category or its subcategories would be left with attributes that are no longer declared
+// @Tags taxonomy
+// @Param        id   path      string  true  "Category ID"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /category/:id [post]
+func (t *categoryTree) update(c *gin.Context) {
+	var categoryId CategoryId
+	if err := c.ShouldBindUri(&categoryId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var cat Category
+	if err := c.ShouldBindJSON(&cat); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if cat.ID != categoryId.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "category id does not match the path"})
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.byID[cat.ID]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "category not found"})
+		return
+	}
+	if err := t.checkParent(cat.ID, cat.Parent); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.byID[cat.ID] = cat
+	if err := t.checkSubtreeItemsLocked(cat.ID); err != nil {
+		t.byID[cat.ID] = old
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	t.write(actorFrom(c), cat.ID, &cat)
+	c.JSON(http.StatusOK, gin.H{"status": "category updated"})
+}
+
+// Delete Category godoc
+// @Summary Delete Category
+// @Schemes
+// @Description Delete a category that has no subcategories and no items, in the catalog or in the trash
+// @Tags taxonomy
+// @Param        id   path      string  true  "Category ID"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /category/:id [delete]
+func (t *categoryTree) delete(c *gin.Context) {
+	var categoryId CategoryId
+	if err := c.ShouldBindUri(&categoryId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id := categoryId.ID
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[id]; !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "category not found"})
+		return
+	}
+	if children := t.view(id).Children; len(children) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "category has subcategories"})
+		return
+	}
+	dbmux.Lock()
+	inUse, inTrash := false, false
+	for _, item := range t.db {
+		inUse = inUse || item.Category == id
+	}
+	for _, v := range trashFrom(c).items { // they could not be restored
+		inTrash = inTrash || v.item.Category == id
+	}
+	dbmux.Unlock()
+	if inUse {
+		c.JSON(http.StatusConflict, gin.H{"error": "category has items"})
+		return
+	}
+	if inTrash {
+		c.JSON(http.StatusConflict, gin.H{"error": "category has items in the trash"})
+		return
+	}
+	t.write(actorFrom(c), id, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "category deleted"})
+}
+
+// Assign Category godoc
+// @Summary Assign Category
+// @Schemes
+// @Description Assign an item to a category and set its custom attributes, replacing the previous ones
+// @Tags taxonomy
+// @Param        code   path      string  true  "Code"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /item/:code/category [post]
+func (t *categoryTree) assign(c *gin.Context) {
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var assignment CategoryAssignment
+	if err := c.ShouldBindJSON(&assignment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.mu.Lock() // held until the item is updated so the category cannot be deleted meanwhile
+	defer t.mu.Unlock()
+	if err := t.checkAttributesLocked(assignment.Category, assignment.Attributes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	item, ok := t.db[code]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	item.Category = assignment.Category
+	item.Attributes = assignment.Attributes
+	t.db.put(actorFrom(c), code, item)
+	c.JSON(http.StatusOK, gin.H{"status": "category assigned"})
+}
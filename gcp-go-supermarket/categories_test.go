@@ -0,0 +1,84 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"testing"
+)
+
+// go test -run TestCategories -v
+
+func TestCategories(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "department", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"produce","name":"Produce","attributes":[{"name":"organic","type":"bool"},{"name":"country_of_origin","type":"string"}]}`), wantCode: 201, wantResult: `{"status":"category added"}`},
+		{name: "fruit", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"fruit","name":"Fruit","parent":"produce"}`), wantCode: 201, wantResult: `{"status":"category added"}`},
+		{name: "stone fruit", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"stone-fruit","name":"Stone Fruit","parent":"fruit","attributes":[{"name":"variety","type":"string"},{"name":"brix","type":"number"}]}`), wantCode: 201, wantResult: `{"status":"category added"}`},
+		{name: "vegetables", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"vegetables","name":"Vegetables","parent":"produce"}`), wantCode: 201, wantResult: `{"status":"category added"}`},
+		{name: "exists", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"fruit","name":"Fruit"}`), wantCode: 409, wantResult: `{"error":"category exists"}`},
+		{name: "no parent", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"berries","name":"Berries","parent":"fruits"}`), wantCode: 400, wantResult: `{"error":"parent category \"fruits\" not found"}`},
+		{name: "bad id", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"Stone Fruit","name":"Stone Fruit"}`), wantCode: 400, wantResult: `{"error":"Key: 'Category.ID' Error:Field validation for 'ID' failed on the 'isslug' tag"}`},
+		{name: "bad type", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"herbs","name":"Herbs","attributes":[{"name":"fresh","type":"date"}]}`), wantCode: 400, wantResult: `{"error":"Key: 'Category.Attributes[0].Type' Error:Field validation for 'Type' failed on the 'oneof' tag"}`},
+		{name: "get", method: "GET", path: "/api/v1/category/fruit", wantCode: 200, wantResult: `{"id":"fruit","name":"Fruit","parent":"produce","path":["Produce","Fruit"],"children":["stone-fruit"]}`},
+		{name: "list", method: "GET", path: "/api/v1/categories", wantCode: 200, wantResult: `[{"id":"produce","name":"Produce","attributes":[{"name":"organic","type":"bool"},{"name":"country_of_origin","type":"string"}],"path":["Produce"],"children":["fruit","vegetables"]},{"id":"fruit","name":"Fruit","parent":"produce","path":["Produce","Fruit"],"children":["stone-fruit"]},{"id":"stone-fruit","name":"Stone Fruit","parent":"fruit","attributes":[{"name":"variety","type":"string"},{"name":"brix","type":"number"}],"path":["Produce","Fruit","Stone Fruit"],"children":[]},{"id":"vegetables","name":"Vegetables","parent":"produce","path":["Produce","Vegetables"],"children":[]}]`},
+		{name: "cycle", method: "POST", path: "/api/v1/category/fruit", jsonData: []byte(`{"id":"fruit","name":"Fruit","parent":"stone-fruit"}`), wantCode: 400, wantResult: `{"error":"category \"fruit\" cannot be moved under its own subcategory \"stone-fruit\""}`},
+		{name: "id mismatch", method: "POST", path: "/api/v1/category/fruit", jsonData: []byte(`{"id":"fruits","name":"Fruit"}`), wantCode: 400, wantResult: `{"error":"category id does not match the path"}`},
+		{name: "rename", method: "POST", path: "/api/v1/category/fruit", jsonData: []byte(`{"id":"fruit","name":"Fresh Fruit","parent":"produce"}`), wantCode: 200, wantResult: `{"status":"category updated"}`},
+		{name: "add item", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","price":"1.99","category":"stone-fruit","attributes":{"variety":"Santa Rosa","organic":true,"brix":14.5}}]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "add unknown category", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AY","name":"Kiwi","price":"0.59","category":"kiwis"}]`), wantCode: 400, wantResult: `{"error":"[0]: category \"kiwis\" not found"}`},
+		{name: "add undeclared attribute", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AY","name":"Kiwi","price":"0.59","category":"fruit","attributes":{"variety":"Hayward"}}]`), wantCode: 400, wantResult: `{"error":"[0]: attribute \"variety\" is not declared for category \"fruit\""}`},
+		{name: "add mistyped attribute", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AY","name":"Kiwi","price":"0.59","category":"fruit","attributes":{"organic":"yes"}}]`), wantCode: 400, wantResult: `{"error":"[0]: attribute \"organic\" must be a bool"}`},
+		{name: "assign", method: "POST", path: "/api/v1/item/E5T6-9UI3-TH15-QR88/category", jsonData: []byte(`{"category":"stone-fruit","attributes":{"country_of_origin":"USA"}}`), wantCode: 200, wantResult: `{"status":"category assigned"}`},
+		{name: "assign vegetable", method: "POST", path: "/api/v1/item/YRT6-72AS-K736-L4AR/category", jsonData: []byte(`{"category":"vegetables"}`), wantCode: 200, wantResult: `{"status":"category assigned"}`},
+		{name: "assign attributes without category", method: "POST", path: "/api/v1/item/A12T-4GH7-QPL9-3N4M/category", jsonData: []byte(`{"attributes":{"organic":true}}`), wantCode: 400, wantResult: `{"error":"attributes require a category"}`},
+		{name: "assign not found", method: "POST", path: "/api/v1/item/Z5T6-9UI3-TH15-QR88/category", jsonData: []byte(`{"category":"fruit"}`), wantCode: 200, wantResult: `{"error":"code not found"}`},
+		{name: "items in fruit", method: "GET", path: "/api/v1/items?category=fruit", wantCode: 200, wantResult: `[{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","price":"$2.99","category":"stone-fruit","attributes":{"country_of_origin":"USA"}},{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","price":"$1.99","category":"stone-fruit","attributes":{"brix":14.5,"organic":true,"variety":"Santa Rosa"}}]`},
+		{name: "items in produce", method: "GET", path: "/api/v1/items?category=produce", wantCode: 200, wantResult: `[{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","price":"$2.99","category":"stone-fruit","attributes":{"country_of_origin":"USA"}},{"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","price":"$0.79","category":"vegetables"},{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","price":"$1.99","category":"stone-fruit","attributes":{"brix":14.5,"organic":true,"variety":"Santa Rosa"}}]`},
+		{name: "items in vegetables", method: "GET", path: "/api/v1/items?category=vegetables", wantCode: 200, wantResult: `[{"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","price":"$0.79","category":"vegetables"}]`},
+		{name: "items in unknown", method: "GET", path: "/api/v1/items?category=dairy", wantCode: 200, wantResult: `{"error":"category not found"}`},
+		{name: "redeclare in use", method: "POST", path: "/api/v1/category/stone-fruit", jsonData: []byte(`{"id":"stone-fruit","name":"Stone Fruit","parent":"fruit","attributes":[{"name":"brix","type":"string"}]}`), wantCode: 409, wantResult: `{"error":"item ZRT6-72AS-K736-L4AZ: attribute \"brix\" must be a string"}`},
+		{name: "move in use", method: "POST", path: "/api/v1/category/fruit", jsonData: []byte(`{"id":"fruit","name":"Fresh Fruit"}`), wantCode: 409, wantResult: `{"error":"item E5T6-9UI3-TH15-QR88: attribute \"country_of_origin\" is not declared for category \"stone-fruit\""}`},
+		{name: "left as it was", method: "GET", path: "/api/v1/category/stone-fruit", wantCode: 200, wantResult: `{"id":"stone-fruit","name":"Stone Fruit","parent":"fruit","attributes":[{"name":"variety","type":"string"},{"name":"brix","type":"number"}],"path":["Produce","Fresh Fruit","Stone Fruit"],"children":[]}`},
+		{name: "redeclare", method: "POST", path: "/api/v1/category/stone-fruit", jsonData: []byte(`{"id":"stone-fruit","name":"Stone Fruit","parent":"fruit","attributes":[{"name":"variety","type":"string"},{"name":"brix","type":"number"},{"name":"freestone","type":"bool"}]}`), wantCode: 200, wantResult: `{"status":"category updated"}`},
+		{name: "delete with children", method: "DELETE", path: "/api/v1/category/fruit", wantCode: 409, wantResult: `{"error":"category has subcategories"}`},
+		{name: "delete with items", method: "DELETE", path: "/api/v1/category/vegetables", wantCode: 409, wantResult: `{"error":"category has items"}`},
+		{name: "unassign", method: "POST", path: "/api/v1/item/YRT6-72AS-K736-L4AR/category", jsonData: []byte(`{}`), wantCode: 200, wantResult: `{"status":"category assigned"}`},
+		{name: "delete", method: "DELETE", path: "/api/v1/category/vegetables", wantCode: 200, wantResult: `{"status":"category deleted"}`},
+		{name: "deleted", method: "GET", path: "/api/v1/category/vegetables", wantCode: 200, wantResult: `{"error":"category not found"}`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// catalogEvents is the event store the catalog is a projection of. main sets
+// it, to a file with -events.store; nil records no events (e.g. in tests).
+var catalogEvents *eventStore
+
+// eventMemory is how many of the latest events are kept in memory for the
+// events endpoint, set with -events.memory; 0 keeps them all.
+var eventMemory = 10000
+
+// Item event types.
+const (
+	eventItemAdded    = "ItemAdded"    // data: itemAdded
+	eventPriceChanged = "PriceChanged" // data: priceChanged
+	eventItemRenamed  = "ItemRenamed"  // data: itemRenamed
+	eventItemUpdated  = "ItemUpdated"  // data: itemUpdated; any other change, e.g. to stock or lots
+	eventItemDeleted  = "ItemDeleted"  // data: empty
+	eventItemTrashed  = "ItemTrashed"  // data: itemAdded with the item deleted; it went to the trash, see trash.go
+	eventItemRestored = "ItemRestored" // data: itemAdded; back from the trash
+	eventItemPurged   = "ItemPurged"   // data: empty; dropped from the trash, whether or not the code is in use again
+)
+
+// Category event types, see categoryTree.apply.
+const (
+	eventCategorySaved   = "CategorySaved"   // data: categorySaved; the category added or changed
+	eventCategoryDeleted = "CategoryDeleted" // data: empty
+)
+
+type itemAdded struct {
+	Item Item `json:"item"`
+}
+
+type priceChanged struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type itemRenamed struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// itemUpdated carries the whole item after the change.
+type itemUpdated struct {
+	Item Item `json:"item"`
+}
+
+// categorySaved carries the whole category after the change.
+type categorySaved struct {
+	Category Category `json:"category"`
+}
+
+// event is a domain event of an item, or of a category when Category is set.
+// The events of an item or a category, its stream, are numbered by Version
+// from 1; Seq orders all events in the store.
+type event struct {
+	Seq         int64           `json:"seq"`
+	ProduceCode string          `json:"code,omitempty"`
+	Category    string          `json:"category,omitempty"`
+	Version     int             `json:"version"`
+	Type        string          `json:"type"`
+	Time        time.Time       `json:"time"`
+	Actor       string          `json:"actor,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
+}
+
+// stream returns the key of the stream e belongs to, the code of its item or
+// the ID of its category.
+func (e event) stream() string {
+	if e.Category != "" {
+		return "category/" + e.Category // not a produce code
+	}
+	return e.ProduceCode
+}
+
+// newEvent is the type and data of an event yet to be numbered.
+type newEvent struct {
+	typ  string
+	data any // nil for no data
+}
+
+// itemEvents returns the events that take the item stored under a code from
+// before to after; nil before is an add and nil after a delete. Renames and
+// price changes get their own events; other changes are an ItemUpdated.
+func itemEvents(before, after *Item) []newEvent {
+	type e = newEvent
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case before == nil:
+		return []e{{eventItemAdded, itemAdded{*after}}}
+	case after == nil:
+		return []e{{eventItemDeleted, nil}}
+	}
+	var events []e
+	if after.UnitPrice != before.UnitPrice {
+		events = append(events, e{eventPriceChanged, priceChanged{before.UnitPrice, after.UnitPrice}})
+	}
+	if after.Name != before.Name {
+		events = append(events, e{eventItemRenamed, itemRenamed{before.Name, after.Name}})
+	}
+	rest := *after
+	rest.UnitPrice, rest.Name = before.UnitPrice, before.Name
+	if !reflect.DeepEqual(rest, *before) {
+		events = append(events, e{eventItemUpdated, itemUpdated{*after}})
+	}
+	return events
+}
+
+// projection is a read model built by applying events in order. database is
+// the projection the API serves; replay builds others, see projections.
+type projection interface {
+	apply(e event) error
+}
+
+// apply applies e to the catalog.
+func (db database) apply(e event) error {
+	if e.Category != "" {
+		return nil // the taxonomy, see categoryTree.apply
+	}
+	item, ok := db[e.ProduceCode]
+	if !ok && e.Type != eventItemAdded && e.Type != eventItemRestored && e.Type != eventItemPurged {
+		return fmt.Errorf("event %d: %s of %s, which does not exist", e.Seq, e.Type, e.ProduceCode)
+	}
+	switch e.Type {
+	case eventItemAdded, eventItemRestored:
+		var data itemAdded
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		db[e.ProduceCode] = data.Item
+	case eventPriceChanged:
+		var data priceChanged
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		item.UnitPrice = data.To
+		db[e.ProduceCode] = item
+	case eventItemRenamed:
+		var data itemRenamed
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		item.Name = data.To
+		db[e.ProduceCode] = item
+	case eventItemUpdated:
+		var data itemUpdated
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		db[e.ProduceCode] = data.Item
+	case eventItemDeleted, eventItemTrashed:
+		delete(db, e.ProduceCode)
+	case eventItemPurged:
+	default:
+		return fmt.Errorf("event %d: unknown type %q", e.Seq, e.Type)
+	}
+	return nil
+}
+
+// pricePoint is a price an item had from a time on.
+type pricePoint struct {
+	Time  time.Time `json:"time"`
+	Price string    `json:"price"` // empty while the item was deleted
+}
+
+// priceHistory is a projection of the prices of every item over time.
+type priceHistory map[string][]pricePoint
+
+func (h priceHistory) apply(e event) error {
+	var price string
+	switch e.Type {
+	case eventItemAdded, eventItemUpdated, eventItemRestored:
+		var data itemAdded // itemUpdated has the same shape
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		price = data.Item.UnitPrice
+	case eventPriceChanged:
+		var data priceChanged
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		price = data.To
+	case eventItemDeleted, eventItemTrashed:
+	default:
+		return nil
+	}
+	if points := h[e.ProduceCode]; len(points) > 0 && points[len(points)-1].Price == price {
+		return nil
+	}
+	h[e.ProduceCode] = append(h[e.ProduceCode], pricePoint{Time: e.Time, Price: price})
+	return nil
+}
+
+// projections are the projections -replay can build, by name. A new read
+// model is a type implementing projection, registered here.
+var projections = map[string]func() projection{
+	"catalog":       func() projection { return database{} },
+	"price-history": func() projection { return priceHistory{} },
+}
+
+// eventStore is an append-only store of item events. Its latest events are
+// kept in memory and, when opened from a file, all of them are appended to
+// it one JSON event per line. Replays read the file; a store without one
+// folds the events it drops from memory into a catalog to replay from.
+type eventStore struct {
+	mu          sync.Mutex
+	events      []event             // the latest, see eventMemory
+	dropped     int64               // events before events[0], no longer in memory
+	compacted   database            // the catalog as of the dropped events, without a file
+	compactedAt time.Time           // time of the last event dropped
+	categories  map[string]Category // the taxonomy as of the dropped events, without a file
+	versions    map[string]int      // stream -> version of its last event, see event.stream
+	f           *os.File
+	now         func() time.Time
+	health      logHealth
+}
+
+func newEventStore() *eventStore {
+	return &eventStore{versions: map[string]int{}, now: time.Now}
+}
+
+// openEventStore loads the events at path and appends to it. The events are
+// checked by replaying them into a scratch catalog as they are read.
+func openEventStore(path string) (*eventStore, error) {
+	s := newEventStore()
+	f, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f // set first, so that load keeps nothing but the latest events
+	if err := s.load(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// load reads events in order, checking their numbering and that they apply
+// to the catalog.
+func (s *eventStore) load(r io.Reader) error {
+	check := database{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		var e event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("event %d: %v", s.seq()+1, err)
+		}
+		if e.Seq != s.seq()+1 {
+			return fmt.Errorf("event %d: out of sequence, got %d", s.seq()+1, e.Seq)
+		}
+		if e.Version != s.versions[e.stream()]+1 {
+			return fmt.Errorf("event %d: version %d of %s follows %d", e.Seq, e.Version, e.stream(), s.versions[e.stream()])
+		}
+		if err := check.apply(e); err != nil {
+			return err
+		}
+		s.versions[e.stream()] = e.Version
+		s.append(e)
+	}
+	return sc.Err()
+}
+
+// seq is the number of the last event. The caller must hold s.mu or own s.
+func (s *eventStore) seq() int64 {
+	return s.dropped + int64(len(s.events))
+}
+
+// append adds e and drops the oldest events beyond eventMemory, a quarter of
+// it at a time so that the events are not copied on every change. Without a
+// file the dropped events are folded into s.compacted and s.categories. The
+// caller must hold s.mu or own s.
+func (s *eventStore) append(e event) {
+	s.events = append(s.events, e)
+	if eventMemory <= 0 || len(s.events) <= eventMemory+eventMemory/4 {
+		return
+	}
+	n := len(s.events) - eventMemory
+	if s.f == nil {
+		if s.compacted == nil {
+			s.compacted, s.categories = database{}, map[string]Category{}
+		}
+		categories := &categoryTree{byID: s.categories}
+		for _, d := range s.events[:n] {
+			s.compacted.apply(d) // applied when recorded, so it cannot fail
+			categories.apply(d)
+		}
+	}
+	s.dropped += int64(n)
+	s.compactedAt = s.events[n-1].Time
+	s.events = append([]event(nil), s.events[n:]...)
+}
+
+// len returns the number of events in the store, in memory or not.
+func (s *eventStore) len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.seq())
+}
+
+// record appends the events that take the item stored under code from before
+// to after. Write errors are logged rather than failing the request that made
+// the change. The caller must hold dbmux, which keeps events in the order the
+// changes were made.
+func (s *eventStore) record(who actor, code string, before, after *Item) {
+	if s == nil {
+		return
+	}
+	s.add(who, event{ProduceCode: code}, itemEvents(before, after))
+}
+
+// recordAs appends an event of type typ with data, nil for none, for changes
+// that say more than the item before and after, e.g. ItemTrashed. The caller
+// must hold dbmux.
+func (s *eventStore) recordAs(who actor, code, typ string, data any) {
+	if s == nil {
+		return
+	}
+	s.add(who, event{ProduceCode: code}, []newEvent{{typ, data}})
+}
+
+// recordCategory appends a CategorySaved with cat, or a CategoryDeleted when
+// cat is nil, to the stream of category id. The caller must hold dbmux.
+func (s *eventStore) recordCategory(who actor, id string, cat *Category) {
+	if s == nil {
+		return
+	}
+	if cat == nil {
+		s.add(who, event{Category: id}, []newEvent{{eventCategoryDeleted, nil}})
+		return
+	}
+	s.add(who, event{Category: id}, []newEvent{{eventCategorySaved, categorySaved{*cat}}})
+}
+
+// add numbers and appends events to the stream of the item or category of
+// stream, an event with only ProduceCode or Category set.
+func (s *eventStore) add(who actor, stream event, events []newEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	for _, ie := range events {
+		e := stream
+		e.Seq, e.Version, e.Type, e.Time, e.Actor = s.seq()+1, s.versions[stream.stream()]+1, ie.typ, now, who.Name
+		if ie.data != nil {
+			e.Data, _ = json.Marshal(ie.data)
+		}
+		s.versions[stream.stream()] = e.Version
+		s.append(e)
+		if s.f != nil {
+			b, _ := json.Marshal(e)
+			_, err := s.f.Write(append(b, '\n'))
+			s.health.wrote(err)
+			if err != nil {
+				log.Printf("events: event %d of %s not written: %v", e.Seq, e.stream(), err)
+			}
+		}
+	}
+}
+
+// seed records an ItemAdded for every item of db, in code order. It starts
+// the store of a catalog seeded from a fixture.
+func (s *eventStore) seed(db database) {
+	codes := make([]string, 0, len(db))
+	for code := range db {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		item := db[code]
+		s.record(actor{Name: "seed"}, code, nil, &item)
+	}
+}
+
+// replay applies the events up to and including those at until to p, in
+// order; a zero until applies them all. A store with a file replays it from
+// the start. One without starts from the catalog and taxonomy its dropped
+// events were folded into, as a CategorySaved per category and an ItemAdded
+// per item, so it cannot replay to before them.
+func (s *eventStore) replay(p projection, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		sc := bufio.NewScanner(io.NewSectionReader(s.f, 0, 1<<62)) // ReadAt leaves the appends alone
+		sc.Buffer(nil, 16<<20)
+		for sc.Scan() {
+			var e event
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				return err
+			}
+			if !until.IsZero() && e.Time.After(until) {
+				return nil
+			}
+			if err := p.apply(e); err != nil {
+				return err
+			}
+		}
+		return sc.Err()
+	}
+	if s.dropped > 0 {
+		if !until.IsZero() && until.Before(s.compactedAt) {
+			return fmt.Errorf("events up to %s are no longer in memory, see -events.store", s.compactedAt.Format(time.RFC3339))
+		}
+		ids := make([]string, 0, len(s.categories))
+		for id := range s.categories {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			data, _ := json.Marshal(categorySaved{s.categories[id]})
+			e := event{Seq: s.dropped, Category: id, Type: eventCategorySaved, Time: s.compactedAt, Data: data}
+			e.Version = s.versions[e.stream()]
+			if err := p.apply(e); err != nil {
+				return err
+			}
+		}
+		codes := make([]string, 0, len(s.compacted))
+		for code := range s.compacted {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			data, _ := json.Marshal(itemAdded{s.compacted[code]})
+			e := event{Seq: s.dropped, ProduceCode: code, Version: s.versions[code], Type: eventItemAdded, Time: s.compactedAt, Data: data}
+			if err := p.apply(e); err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range s.events {
+		if !until.IsZero() && e.Time.After(until) {
+			break
+		}
+		if err := p.apply(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ping fails when the last event could not be written to the store's file,
+// see logHealth. A store without one is not checked.
+func (s *eventStore) ping(ctx context.Context) error {
+	if s == nil || s.f == nil {
+		return errCheckSkipped
+	}
+	return s.health.check()
+}
+
+// close closes the store's file.
+func (s *eventStore) close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// replayProjection builds the named projection from the store at path up to
+// until and writes it to w as JSON. It backs the -replay flag.
+func replayProjection(w io.Writer, path, name string, until time.Time) error {
+	newProjection, ok := projections[name]
+	if !ok {
+		names := make([]string, 0, len(projections))
+		for n := range projections {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown projection %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	s, err := openEventStore(path)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	p := newProjection()
+	if err := s.replay(p, until); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// Item Events godoc
+// @Summary Item Events
+// @Schemes
+// @Description List the events of an item, oldest first: ItemAdded, PriceChanged, ItemRenamed, ItemUpdated, ItemDeleted, and ItemTrashed, ItemRestored and ItemPurged for the trash. Only the latest events are kept in memory, see -events.memory
+// @Tags example
+// @Param        code   path      string  true  "Code"
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /item/{code}/events [get]
+func (s *eventStore) stream(c *gin.Context) {
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	events := []event{}
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, e := range s.events {
+			if e.ProduceCode == code {
+				events = append(events, e)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, events)
+}
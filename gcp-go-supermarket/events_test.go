@@ -0,0 +1,238 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestEventSourcing -v
+
+func TestEventSourcing(t *testing.T) {
+	defer func(s *eventStore, token string) { catalogEvents, adminToken = s, token }(catalogEvents, adminToken)
+	catalogEvents, adminToken = newEventStore(), "s3cret"
+	clock := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	catalogEvents.now = func() time.Time { clock = clock.Add(time.Minute); return clock }
+	db := database{}
+	router := db.dbInit()
+	assert.Equal(t, catalogEvents.len(), 4) // the seed items
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "add", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"0.50"}]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "rename and reprice", method: "POST", path: "/api/v1/import", jsonData: []byte("code,name,price\nA12T-4GH7-QPL9-3N4M,Romaine Lettuce,3.99\n"), wantCode: 200, wantResult: `{"format":"csv","mode":"upsert","rows":1,"inserted":0,"updated":1`},
+		{name: "restock", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M", jsonData: []byte(`{"stock":12}`), wantCode: 200, wantResult: `{"status":"stock updated"}`},
+		{name: "delete", method: "GET", path: "/api/v1/delete/B111-2222-3333-4444", wantCode: 200, wantResult: `{"status":"item deleted"}`},
+		{name: "events", method: "GET", path: "/api/v1/item/a12t-4gh7-qpl9-3n4m/events", wantCode: 200, wantResult: `[` +
+			`{"seq":1,"code":"A12T-4GH7-QPL9-3N4M","version":1,"type":"ItemAdded","time":"2022-07-01T10:01:00Z","actor":"seed","data":{"item":{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"}}},` +
+			`{"seq":6,"code":"A12T-4GH7-QPL9-3N4M","version":2,"type":"PriceChanged","time":"2022-07-01T10:06:00Z","actor":"anonymous","data":{"from":"$3.41","to":"$3.99"}},` +
+			`{"seq":7,"code":"A12T-4GH7-QPL9-3N4M","version":3,"type":"ItemRenamed","time":"2022-07-01T10:06:00Z","actor":"anonymous","data":{"from":"Lettuce","to":"Romaine Lettuce"}},` +
+			`{"seq":8,"code":"A12T-4GH7-QPL9-3N4M","version":4,"type":"ItemUpdated","time":"2022-07-01T10:07:00Z","actor":"anonymous","data":{"item":{"code":"A12T-4GH7-QPL9-3N4M","name":"Romaine Lettuce","price":"$3.99","stock":12}}}]`},
+		{name: "deleted events", method: "GET", path: "/api/v1/item/B111-2222-3333-4444/events", wantCode: 200, wantResult: `[{"seq":5,"code":"B111-2222-3333-4444","version":1,"type":"ItemAdded",` +
+			`"time":"2022-07-01T10:05:00Z","actor":"anonymous","data":{"item":{"code":"B111-2222-3333-4444","name":"Kiwi","price":"$0.50"}}},` +
+			`{"seq":9,"code":"B111-2222-3333-4444","version":2,"type":"ItemTrashed","time":"2022-07-01T10:08:00Z","actor":"anonymous","data":{"item":{"code":"B111-2222-3333-4444","name":"Kiwi","price":"$0.50"}}}]`},
+		{name: "no events", method: "GET", path: "/api/v1/item/C111-2222-3333-4444/events", wantCode: 200, wantResult: `[]`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || !strings.HasPrefix(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	// The catalog is a projection of the events: replaying them rebuilds it,
+	// and a new router starts from them rather than from the seed.
+	projected := database{}
+	assert.NilError(t, catalogEvents.replay(projected, time.Time{}))
+	assert.Equal(t, len(projected), 4)
+	assert.DeepEqual(t, projected["A12T-4GH7-QPL9-3N4M"], Item{ProduceCode: "A12T-4GH7-QPL9-3N4M", Name: "Romaine Lettuce", UnitPrice: "$3.99", Stock: 12})
+
+	router = database{}.dbInit()
+	got := routerPOSTReq("GET", "/api/v1/item/A12T-4GH7-QPL9-3N4M", nil, router)
+	assert.Equal(t, got.Body.String(), `{"code":"A12T-4GH7-QPL9-3N4M","name":"Romaine Lettuce","price":"$3.99"}`)
+	assert.Equal(t, catalogEvents.len(), 9)
+
+	// So is the trash: the deleted item can still be restored.
+	got = routerAdminReq("GET", "/api/v1/trash", nil, router)
+	assert.Assert(t, strings.HasPrefix(got.Body.String(), `[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"$0.50","deleted_at":"2022-07-01T10:08:00Z"`), got.Body.String())
+	got = routerAdminReq("POST", "/api/v1/item/B111-2222-3333-4444/restore", nil, router)
+	assert.Equal(t, got.Body.String(), `{"status":"item restored"}`)
+	router = database{}.dbInit()
+	assert.Equal(t, routerAdminReq("GET", "/api/v1/trash", nil, router).Body.String(), `[]`)
+	assert.Equal(t, routerPOSTReq("GET", "/api/v1/item/B111-2222-3333-4444", nil, router).Code, 200)
+	assert.Equal(t, catalogEvents.len(), 10)
+
+	// And the taxonomy.
+	got = routerPOSTReq("POST", "/api/v1/categories", []byte(`{"id":"produce","name":"Produce"}`), router)
+	assert.Equal(t, got.Code, 201, got.Body.String())
+	router = database{}.dbInit()
+	got = routerPOSTReq("GET", "/api/v1/category/produce", nil, router)
+	assert.Equal(t, got.Body.String(), `{"id":"produce","name":"Produce","path":["Produce"],"children":[]}`)
+	assert.Equal(t, catalogEvents.len(), 11)
+
+	asOf := database{}
+	assert.NilError(t, catalogEvents.replay(asOf, time.Date(2022, 7, 1, 10, 5, 0, 0, time.UTC)))
+	assert.Equal(t, len(asOf), 5)
+	assert.Equal(t, asOf["A12T-4GH7-QPL9-3N4M"].Name, "Lettuce")
+}
+
+// go test -run TestEventStoreFile -v
+
+func TestEventStoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, err := openEventStore(path)
+	assert.NilError(t, err)
+	clock := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { clock = clock.Add(time.Hour); return clock }
+	lettuce := Item{ProduceCode: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", UnitPrice: "$3.41"}
+	s.record(actor{Name: "alice"}, lettuce.ProduceCode, nil, &lettuce)
+	cheaper := lettuce
+	cheaper.UnitPrice = "$2.99"
+	s.record(actor{Name: "bob"}, lettuce.ProduceCode, &lettuce, &cheaper)
+	s.record(actor{Name: "bob"}, lettuce.ProduceCode, &cheaper, &cheaper) // no change, no event
+	assert.NilError(t, s.close())
+
+	s, err = openEventStore(path)
+	assert.NilError(t, err)
+	assert.Equal(t, s.len(), 2)
+	s.now = func() time.Time { clock = clock.Add(time.Hour); return clock }
+	s.record(actor{Name: "carol"}, lettuce.ProduceCode, &cheaper, nil)
+	assert.NilError(t, s.close())
+
+	var out bytes.Buffer
+	assert.NilError(t, replayProjection(&out, path, "price-history", time.Time{}))
+	assert.Equal(t, out.String(), `{
+  "A12T-4GH7-QPL9-3N4M": [
+    {
+      "time": "2022-07-01T11:00:00Z",
+      "price": "$3.41"
+    },
+    {
+      "time": "2022-07-01T12:00:00Z",
+      "price": "$2.99"
+    },
+    {
+      "time": "2022-07-01T13:00:00Z",
+      "price": ""
+    }
+  ]
+}
+`)
+	out.Reset()
+	assert.NilError(t, replayProjection(&out, path, "catalog", time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, strings.Contains(out.String(), `"price": "$2.99"`), true)
+	assert.Error(t, replayProjection(&out, path, "stock", time.Time{}), `unknown projection "stock", want one of catalog, price-history`)
+
+	data, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	lines := strings.SplitAfter(string(data), "\n")
+	assert.NilError(t, os.WriteFile(path, append(data, lines[0][:40]...), 0o644)) // a crash while writing
+	s, err = openEventStore(path)
+	assert.NilError(t, err)
+	assert.Equal(t, s.len(), 3)
+	s.record(actor{Name: "dave"}, lettuce.ProduceCode, nil, &lettuce)
+	assert.NilError(t, s.close())
+	s, err = openEventStore(path)
+	assert.NilError(t, err)
+	assert.Equal(t, s.len(), 4)
+	assert.NilError(t, s.close())
+
+	assert.NilError(t, os.WriteFile(path, []byte(lines[1]), 0o644)) // the ItemAdded is gone
+	_, err = openEventStore(path)
+	assert.Error(t, err, path+": event 1: out of sequence, got 2")
+	assert.NilError(t, os.WriteFile(path, []byte(strings.Replace(lines[0], `"type":"ItemAdded"`, `"type":"ItemDeleted"`, 1)), 0o644))
+	_, err = openEventStore(path)
+	assert.Error(t, err, path+": event 1: ItemDeleted of A12T-4GH7-QPL9-3N4M, which does not exist")
+}
+
+// go test -run TestEventStoreMemory -v
+
+func TestEventStoreMemory(t *testing.T) {
+	defer func(n int) { eventMemory = n }(eventMemory)
+	eventMemory = 4
+	clock := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	tick := func() time.Time { clock = clock.Add(time.Hour); return clock }
+	lettuce := Item{ProduceCode: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", UnitPrice: "$3.41"}
+	peach := Item{ProduceCode: "E5T6-9UI3-TH15-QR88", Name: "Peach", UnitPrice: "$2.99"}
+	record := func(s *eventStore) {
+		s.record(actor{Name: "alice"}, lettuce.ProduceCode, nil, &lettuce)
+		s.record(actor{Name: "alice"}, peach.ProduceCode, nil, &peach)
+		item := lettuce
+		for i := 0; i < 10; i++ {
+			before := item
+			item.Stock = i + 1
+			s.record(actor{Name: "alice"}, item.ProduceCode, &before, &item)
+		}
+		s.record(actor{Name: "bob"}, peach.ProduceCode, &peach, nil)
+	}
+
+	// Without a file, the dropped events are folded into a catalog.
+	s := newEventStore()
+	s.now = tick
+	record(s)
+	assert.Assert(t, len(s.events) >= 4 && len(s.events) <= 5, len(s.events))
+	assert.Equal(t, s.len(), 13)
+	db := database{}
+	assert.NilError(t, s.replay(db, time.Time{}))
+	assert.Equal(t, len(db), 1)
+	assert.Equal(t, db[lettuce.ProduceCode].Stock, 10)
+	assert.ErrorContains(t, s.replay(database{}, time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)), "no longer in memory")
+	s.record(actor{Name: "carol"}, peach.ProduceCode, nil, &peach)
+	assert.Equal(t, s.events[len(s.events)-1].Version, 3) // versions survive the drop
+
+	// With a file, replays read it, all of it.
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, err := openEventStore(path)
+	assert.NilError(t, err)
+	s.now = tick
+	record(s)
+	assert.Assert(t, len(s.events) <= 5, len(s.events))
+	assert.NilError(t, s.close())
+	s, err = openEventStore(path)
+	assert.NilError(t, err)
+	defer s.close()
+	assert.Assert(t, len(s.events) <= 5, len(s.events))
+	assert.Equal(t, s.len(), 13)
+	asOf := database{}
+	assert.NilError(t, s.replay(asOf, clock.Add(-11*time.Hour))) // both added, before any restock
+	assert.Equal(t, len(asOf), 2)
+	assert.Equal(t, asOf[lettuce.ProduceCode].Stock, 0)
+	s.record(actor{Name: "carol"}, peach.ProduceCode, nil, &peach)
+	db = database{}
+	assert.NilError(t, s.replay(db, time.Time{}))
+	assert.Equal(t, len(db), 2)
+	assert.Equal(t, db[lettuce.ProduceCode].Stock, 10)
+}
@@ -0,0 +1,214 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthCheck returns why a part of the service is unhealthy, or nil. It
+// returns errCheckSkipped when the part is not configured.
+type healthCheck func(ctx context.Context) error
+
+var errCheckSkipped = errors.New("not configured")
+
+// healthCheckTimeout is how long a check may take before it fails.
+var healthCheckTimeout = 2 * time.Second
+
+// catalogLockRetry is how often the catalog_lock check tries dbmux again.
+var catalogLockRetry = 10 * time.Millisecond
+
+// The probes and their checks. Anything may register a check of its own.
+var (
+	livenessChecks  = newHealthChecks("liveness")  // /healthz: restart the instance when failing
+	readinessChecks = newHealthChecks("readiness") // /readyz: send no requests when failing
+	startupChecks   = newHealthChecks("startup")   // /startupz: the instance has started once passing
+)
+
+// draining is set when the server stops taking new requests, see main;
+// readiness fails from then on.
+var draining atomic.Bool
+
+// seedLoaded is set by dbInit once the catalog is loaded from the seed
+// fixture or the event store.
+var seedLoaded atomic.Bool
+
+func init() {
+	livenessChecks.register("catalog_lock", func(ctx context.Context) error { // a handler stuck holding dbmux stalls every request
+		for !dbmux.TryLock() { // not Lock, which would leave the check waiting after it timed out
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(catalogLockRetry):
+			}
+		}
+		dbmux.Unlock()
+		return nil
+	})
+	readinessChecks.register("draining", func(ctx context.Context) error {
+		if draining.Load() {
+			return errors.New("draining, not taking new requests")
+		}
+		return nil
+	})
+	seed := func(ctx context.Context) error {
+		if !seedLoaded.Load() {
+			return errors.New("catalog not loaded")
+		}
+		return nil
+	}
+	readinessChecks.register("seed", seed)
+	startupChecks.register("seed", seed)
+	// The stores every catalog change is written to. Their writes do not
+	// fail requests, so a store that cannot be written to is caught here.
+	readinessChecks.register("event_store", func(ctx context.Context) error { return catalogEvents.ping(ctx) })
+	readinessChecks.register("audit_log", func(ctx context.Context) error { return catalogAudit.ping(ctx) })
+	readinessChecks.register("journal", func(ctx context.Context) error { return catalogJournal.ping(ctx) })
+	// Requests do not use the backup store, so it is only reported.
+	readinessChecks.registerReportOnly("backup_store", func(ctx context.Context) error {
+		if backupStore == nil {
+			return errCheckSkipped
+		}
+		return backupStore.ping(ctx)
+	})
+}
+
+// healthChecks is the registry of the checks of a probe.
+type healthChecks struct {
+	probe      string
+	mu         sync.Mutex
+	checks     map[string]healthCheck
+	reportOnly map[string]bool // checks that do not fail the probe
+}
+
+func newHealthChecks(probe string) *healthChecks {
+	return &healthChecks{probe: probe, checks: map[string]healthCheck{}, reportOnly: map[string]bool{}}
+}
+
+// register adds check under name, replacing a check of the same name.
+func (h *healthChecks) register(name string, check healthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+	delete(h.reportOnly, name)
+}
+
+// registerReportOnly adds check under name like register, but its failures
+// are only reported: they do not fail the probe.
+func (h *healthChecks) registerReportOnly(name string, check healthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+	h.reportOnly[name] = true
+}
+
+// healthReport is the JSON detail report of a probe.
+type healthReport struct {
+	Probe  string                 `json:"probe"`
+	Status string                 `json:"status"` // ok or failing
+	Checks map[string]checkResult `json:"checks"`
+}
+
+type checkResult struct {
+	Status     string `json:"status"` // ok, failing or skipped
+	Error      string `json:"error,omitempty"`
+	Duration   string `json:"duration"`
+	ReportOnly bool   `json:"report_only,omitempty"` // its failure does not fail the probe
+}
+
+// run runs the checks side by side, each for up to healthCheckTimeout. The
+// probe fails when any check that is not report-only fails.
+func (h *healthChecks) run(ctx context.Context) healthReport {
+	h.mu.Lock()
+	checks := make(map[string]healthCheck, len(h.checks))
+	reportOnly := make(map[string]bool, len(h.reportOnly))
+	for name, check := range h.checks {
+		checks[name] = check
+		reportOnly[name] = h.reportOnly[name]
+	}
+	h.mu.Unlock()
+
+	report := healthReport{Probe: h.probe, Status: "ok", Checks: map[string]checkResult{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check healthCheck) {
+			defer wg.Done()
+			result := runCheck(ctx, check)
+			result.ReportOnly = reportOnly[name]
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status == "failing" && !result.ReportOnly {
+				report.Status = "failing"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+func runCheck(ctx context.Context, check healthCheck) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1) // a check ignoring ctx finishes on its own
+	go func() { done <- check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = errors.New("timed out after " + healthCheckTimeout.String())
+		}
+	}
+	result := checkResult{Status: "ok", Duration: time.Since(start).String()}
+	switch {
+	case errors.Is(err, errCheckSkipped):
+		result.Status, result.Error = "skipped", err.Error()
+	case err != nil:
+		result.Status, result.Error = "failing", err.Error()
+	}
+	return result
+}
+
+// serve answers a probe with the report of its checks: 200 when they pass,
+// else 503.
+func (h *healthChecks) serve(c *gin.Context) {
+	report := h.run(c.Request.Context())
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(code, report)
+}
@@ -0,0 +1,135 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestProbes -v
+
+func TestProbes(t *testing.T) {
+	defer func(store objectStore, j *journal) { backupStore, catalogJournal = store, j; draining.Store(false) }(backupStore, catalogJournal)
+	db := database{}
+	router := db.dbInit()
+	dir := filepath.Join(t.TempDir(), "backups")
+	j, err := openJournal(filepath.Join(t.TempDir(), "journal.jsonl"))
+	assert.NilError(t, err)
+	defer j.close()
+
+	tests := []struct {
+		name       string
+		setup      func()
+		path       string
+		wantCode   int
+		wantStatus string
+		wantChecks map[string]string // name -> status, error
+	}{
+		{name: "liveness", path: "/healthz", wantCode: 200, wantStatus: "ok", wantChecks: map[string]string{"catalog_lock": "ok"}},
+		{name: "readiness", path: "/readyz", wantCode: 200, wantStatus: "ok", wantChecks: map[string]string{"draining": "ok", "seed": "ok", "event_store": "skipped, not configured", "audit_log": "skipped, not configured", "journal": "skipped, not configured", "backup_store": "skipped, not configured"}},
+		{name: "startup", path: "/startupz", wantCode: 200, wantStatus: "ok", wantChecks: map[string]string{"seed": "ok"}},
+		{name: "backup store", setup: func() { backupStore, _ = newObjectStore(dir) }, path: "/readyz", wantCode: 200, wantStatus: "ok", wantChecks: map[string]string{"backup_store": "ok"}},
+		{name: "backup store gone", setup: func() { os.RemoveAll(dir) }, path: "/readyz", wantCode: 200, wantStatus: "ok", wantChecks: map[string]string{"backup_store": "failing, stat " + dir + ": no such file or directory", "seed": "ok"}}, // report-only
+		{name: "journal", setup: func() { catalogJournal = j }, path: "/readyz", wantCode: 200, wantStatus: "ok", wantChecks: map[string]string{"journal": "ok"}},
+		{name: "journal not written", setup: func() { j.health.wrote(errors.New("no space left on device")) }, path: "/readyz", wantCode: 503, wantStatus: "failing", wantChecks: map[string]string{"journal": "failing, last write failed: no space left on device"}},
+		{name: "journal written again", setup: func() { j.health.wrote(nil) }, path: "/readyz", wantCode: 200, wantStatus: "ok", wantChecks: map[string]string{"journal": "ok"}},
+		{name: "draining", setup: func() { backupStore = nil; draining.Store(true) }, path: "/readyz", wantCode: 503, wantStatus: "failing", wantChecks: map[string]string{"draining": "failing, draining, not taking new requests"}},
+		{name: "alive while draining", path: "/healthz", wantCode: 200, wantStatus: "ok"},
+	}
+	for _, tc := range tests {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		w := routerPOSTReq("GET", tc.path, nil, router)
+		var report healthReport
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &report), tc.name)
+		if w.Code != tc.wantCode || report.Status != tc.wantStatus {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantStatus, w.Code, w.Body.String())
+		}
+		for name, want := range tc.wantChecks {
+			got := report.Checks[name].Status
+			if report.Checks[name].Error != "" {
+				got += ", " + report.Checks[name].Error
+			}
+			assert.Equal(t, got, want, "%s: %s", tc.name, name)
+		}
+	}
+}
+
+// go test -run TestHealthChecks -v
+
+func TestHealthChecks(t *testing.T) {
+	defer func(timeout time.Duration) { healthCheckTimeout = timeout }(healthCheckTimeout)
+	healthCheckTimeout = 20 * time.Millisecond
+	h := newHealthChecks("readiness")
+	report := h.run(context.Background())
+	assert.Equal(t, report.Status, "ok") // no checks, nothing failing
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	h.register("database", func(ctx context.Context) error { return nil })
+	h.register("cache", func(ctx context.Context) error { return errors.New("connection refused") })
+	h.register("queue", func(ctx context.Context) error { <-stuck; return nil }) // ignores ctx
+	report = h.run(context.Background())
+	assert.Equal(t, report.Probe, "readiness")
+	assert.Equal(t, report.Status, "failing")
+	assert.Equal(t, report.Checks["database"].Status, "ok")
+	assert.Equal(t, report.Checks["cache"].Error, "connection refused")
+	assert.Equal(t, report.Checks["queue"].Error, "timed out after 20ms")
+
+	h.register("cache", func(ctx context.Context) error { return nil }) // replaces the failing one
+	h.register("queue", func(ctx context.Context) error { return errCheckSkipped })
+	report = h.run(context.Background())
+	assert.Equal(t, report.Status, "ok")
+	assert.Equal(t, report.Checks["queue"].Status, "skipped")
+}
+
+// go test -run TestCatalogLockCheck -v
+
+func TestCatalogLockCheck(t *testing.T) {
+	defer func(timeout time.Duration) { healthCheckTimeout = timeout }(healthCheckTimeout)
+	healthCheckTimeout = 20 * time.Millisecond
+	before := runtime.NumGoroutine()
+	dbmux.Lock()
+	report := livenessChecks.run(context.Background())
+	assert.Equal(t, report.Checks["catalog_lock"].Error, "timed out after 20ms")
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; { // the check gives up rather than waiting for dbmux
+		if time.Now().After(deadline) {
+			dbmux.Unlock()
+			t.Fatalf("catalog_lock: expected: %d goroutines, got: %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dbmux.Unlock()
+	report = livenessChecks.run(context.Background())
+	assert.Equal(t, report.Checks["catalog_lock"].Status, "ok")
+}
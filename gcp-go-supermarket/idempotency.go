@@ -0,0 +1,246 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyTTL is how long the response to a request with an
+// Idempotency-Key is kept for replaying to retries, set with
+// -idempotency.ttl.
+var idempotencyTTL = 24 * time.Hour
+
+// idempotencyKeyRegex is what an Idempotency-Key must look like, e.g. a UUID.
+var idempotencyKeyRegex = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+const (
+	maxIdempotentBody     = 8 << 20  // the largest request body an Idempotency-Key covers; only its hash is kept
+	maxIdempotentResponse = 16 << 10 // the largest response kept for replaying; larger ones are not replayed
+	maxIdempotencyKeys    = 10000    // responses kept at most, for all callers
+	maxKeysPerCaller      = 1000     // responses kept at most for one caller
+)
+
+// idempotentResponse is a response kept for replaying. done is closed once
+// the first request has finished.
+type idempotentResponse struct {
+	caller      string // whose quota it counts against, see maxKeysPerCaller
+	fingerprint [sha256.Size]byte // of the request body
+	done        chan struct{}
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyKeys keeps the responses to requests with an Idempotency-Key.
+type idempotencyKeys struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse // caller name, method, path and key -> response
+	callers   map[string]int                 // caller -> responses kept
+	ttl       time.Duration
+	now       func() time.Time
+	nextSweep time.Time
+}
+
+func newIdempotencyKeys(ttl time.Duration) *idempotencyKeys {
+	return &idempotencyKeys{responses: map[string]*idempotentResponse{}, callers: map[string]int{}, ttl: ttl, now: time.Now}
+}
+
+// drop forgets the response kept under id. The caller must hold k.mu.
+func (k *idempotencyKeys) drop(id string) {
+	r, ok := k.responses[id]
+	if !ok {
+		return
+	}
+	delete(k.responses, id)
+	if k.callers[r.caller]--; k.callers[r.caller] == 0 {
+		delete(k.callers, r.caller)
+	}
+}
+
+// sweep drops the expired responses, at most once a minute unless force is
+// set. The caller must hold k.mu.
+func (k *idempotencyKeys) sweep(now time.Time, force bool) {
+	if !force && now.Before(k.nextSweep) {
+		return
+	}
+	k.nextSweep = now.Add(time.Minute)
+	for id, r := range k.responses {
+		if isClosed(r.done) && now.After(r.expires) {
+			k.drop(id)
+		}
+	}
+}
+
+// makeRoom drops expired responses and then, while there are too many, the
+// one expiring first. It reports false when every response kept is for a
+// request still running. The caller must hold k.mu.
+func (k *idempotencyKeys) makeRoom(now time.Time) bool {
+	if len(k.responses) < maxIdempotencyKeys {
+		return true
+	}
+	k.sweep(now, true)
+	for len(k.responses) >= maxIdempotencyKeys {
+		oldest := ""
+		for id, r := range k.responses {
+			if isClosed(r.done) && (oldest == "" || r.expires.Before(k.responses[oldest].expires)) {
+				oldest = id
+			}
+		}
+		if oldest == "" {
+			return false
+		}
+		k.drop(oldest)
+	}
+	return true
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordingWriter keeps a copy of the body written through it.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent is middleware that makes retries of a request with the same
+// Idempotency-Key header safe: the first response is kept for the TTL and
+// retries get it again byte for byte, marked with Idempotent-Replayed.
+// Reusing a key with a different body is rejected with 422, and a retry
+// while the first request is still running with 409. Keys are the caller's
+// own: the same key sent by another admin or IAP user is another request.
+// Anonymous callers share theirs, so that a retry from another IP address,
+// e.g. after a mobile client changes networks, is still replayed; only
+// their quota is per address. Server
+// errors, panics and responses too large to keep are not kept, so those
+// requests can be retried. Requests without the header are not affected.
+func (k *idempotencyKeys) idempotent(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	if !idempotencyKeyRegex.MatchString(key) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be 1 to 255 printable characters"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBody))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	fingerprint := sha256.Sum256(body)
+	who := actorFrom(c)
+	caller := who.Name
+	if caller == "anonymous" {
+		caller += " " + who.IP
+	}
+	id := who.Name + " " + c.Request.Method + " " + c.Request.URL.Path + " " + key
+
+	k.mu.Lock()
+	now := k.now()
+	k.sweep(now, false)
+	r, ok := k.responses[id]
+	if ok && isClosed(r.done) && now.After(r.expires) {
+		ok = false
+	}
+	if ok {
+		k.mu.Unlock()
+		switch {
+		case r.fingerprint != fingerprint:
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was used with a different request body"})
+		case !isClosed(r.done):
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is in progress"})
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(r.status, r.contentType, r.body)
+			c.Abort()
+		}
+		return
+	}
+	if ok {
+		k.drop(id) // expired
+	}
+	if k.callers[caller] >= maxKeysPerCaller {
+		k.mu.Unlock()
+		c.Header("Retry-After", "60")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many Idempotency-Keys in use, retry later"})
+		return
+	}
+	if !k.makeRoom(now) {
+		k.mu.Unlock()
+		c.Header("Retry-After", "1")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "too many requests with an Idempotency-Key in progress"})
+		return
+	}
+	r = &idempotentResponse{caller: caller, fingerprint: fingerprint, done: make(chan struct{})}
+	k.responses[id] = r
+	k.callers[caller]++
+	k.mu.Unlock()
+
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	defer func() {
+		p := recover() // recoverPanics runs after this, so the response is not written yet
+		k.mu.Lock()
+		if p != nil || !w.Written() || w.Status() >= 500 || w.body.Len() > maxIdempotentResponse {
+			k.drop(id) // a failure, not an answer: let the retry run
+		} else {
+			r.status, r.contentType, r.body = w.Status(), w.Header().Get("Content-Type"), w.body.Bytes()
+			r.expires = k.now().Add(k.ttl)
+		}
+		close(r.done)
+		k.mu.Unlock()
+		if p != nil {
+			panic(p)
+		}
+	}()
+	c.Next()
+}
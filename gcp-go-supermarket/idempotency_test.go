@@ -0,0 +1,200 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+)
+
+func idempotentReq(router http.Handler, key string, jsonData []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/add", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// go test -run TestIdempotencyKey -v
+
+func TestIdempotencyKey(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	kiwi := []byte(`[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"0.50"}]`)
+	lime := []byte(`[{"code":"B111-2222-3333-5555","name":"Lime","price":"0.40"}]`)
+
+	tests := []struct {
+		name         string
+		key          string
+		jsonData     []byte
+		wantCode     int
+		wantResult   string
+		wantReplayed bool
+	}{
+		{name: "first", key: "4f6c1a52", jsonData: kiwi, wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "retry", key: "4f6c1a52", jsonData: kiwi, wantCode: 201, wantResult: `{"status":"item added"}`, wantReplayed: true},
+		{name: "no key", jsonData: kiwi, wantCode: 200, wantResult: `{"status":"item exist, not added"}`},
+		{name: "other payload", key: "4f6c1a52", jsonData: lime, wantCode: 422, wantResult: `{"error":"Idempotency-Key was used with a different request body"}`},
+		{name: "other key", key: "9d0e77b3", jsonData: kiwi, wantCode: 200, wantResult: `{"status":"item exist, not added"}`},
+		{name: "bad key", key: "has space", jsonData: kiwi, wantCode: 400, wantResult: `{"error":"Idempotency-Key must be 1 to 255 printable characters"}`},
+	}
+	for _, tc := range tests {
+		w := idempotentReq(router, tc.key, tc.jsonData)
+		if w.Code != tc.wantCode || w.Body.String() != tc.wantResult {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, w.Code, w.Body.String())
+		}
+		assert.Equal(t, w.Header().Get("Idempotent-Replayed") == "true", tc.wantReplayed, tc.name)
+	}
+}
+
+// go test -run TestIdempotencyReplay -v
+
+func TestIdempotencyReplay(t *testing.T) {
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	keys := newIdempotencyKeys(time.Hour)
+	keys.now = func() time.Time { return now }
+	calls, status := 0, http.StatusCreated
+	router := gin.New()
+	router.POST("/api/v1/add", keys.idempotent, func(c *gin.Context) {
+		calls++
+		c.Data(status, "text/plain; charset=utf-8", []byte("call "+string(rune('0'+calls))))
+	})
+
+	// Server errors are not kept, so the retry runs the handler again.
+	status = http.StatusServiceUnavailable
+	assert.Equal(t, idempotentReq(router, "k1", []byte("[]")).Body.String(), "call 1")
+	status = http.StatusCreated
+	assert.Equal(t, idempotentReq(router, "k1", []byte("[]")).Body.String(), "call 2")
+
+	w := idempotentReq(router, "k1", []byte("[]"))
+	assert.Equal(t, w.Code, http.StatusCreated)
+	assert.Equal(t, w.Body.String(), "call 2")
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	assert.Equal(t, calls, 2)
+
+	// Once the TTL has passed the key can be used again.
+	now = now.Add(time.Hour + time.Second)
+	assert.Equal(t, idempotentReq(router, "k1", []byte("[]")).Body.String(), "call 3")
+}
+
+// go test -run TestIdempotencyInProgress -v
+
+func TestIdempotencyInProgress(t *testing.T) {
+	keys := newIdempotencyKeys(time.Hour)
+	started, finish := make(chan struct{}), make(chan struct{})
+	router := gin.New()
+	router.POST("/api/v1/add", keys.idempotent, func(c *gin.Context) {
+		close(started)
+		<-finish
+		c.JSON(http.StatusCreated, gin.H{"status": "item added"})
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentReq(router, "k1", []byte("[]")) }()
+	<-started
+	w := idempotentReq(router, "k1", []byte("[]"))
+	assert.Equal(t, w.Code, http.StatusConflict)
+	assert.Equal(t, w.Body.String(), `{"error":"a request with this Idempotency-Key is in progress"}`)
+	close(finish)
+	assert.Equal(t, (<-done).Code, http.StatusCreated)
+	assert.Equal(t, idempotentReq(router, "k1", []byte("[]")).Header().Get("Idempotent-Replayed"), "true")
+}
+
+// go test -run TestIdempotencyPanic -v
+
+func TestIdempotencyPanic(t *testing.T) {
+	keys := newIdempotencyKeys(time.Hour)
+	calls := 0
+	router := gin.New()
+	router.Use(recoverPanics)
+	router.POST("/api/v1/add", keys.idempotent, func(c *gin.Context) {
+		if calls++; calls == 1 {
+			panic("boom")
+		}
+		c.JSON(http.StatusCreated, gin.H{"status": "item added"})
+	})
+
+	// The panic is answered with 500 and not kept, so the retry runs.
+	assert.Equal(t, idempotentReq(router, "k1", []byte("[]")).Code, http.StatusInternalServerError)
+	w := idempotentReq(router, "k1", []byte("[]"))
+	assert.Equal(t, w.Code, http.StatusCreated)
+	assert.Equal(t, w.Header().Get("Idempotent-Replayed"), "")
+	assert.Equal(t, calls, 2)
+}
+
+// go test -run TestIdempotencyCallers -v
+
+func TestIdempotencyCallers(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "s3cret"
+	keys := newIdempotencyKeys(time.Hour)
+	calls := 0
+	router := gin.New()
+	router.POST("/api/v1/add", keys.idempotent, func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusCreated, gin.H{"status": "item added"})
+	})
+	as := func(token, ip, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/add", bytes.NewBufferString("[]"))
+		req.RemoteAddr = ip + ":40000"
+		req.Header.Set("Idempotency-Key", key)
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	from := func(ip, key string) *httptest.ResponseRecorder { return as("", ip, key) }
+
+	// Anonymous callers share their keys: a retry from another address,
+	// e.g. after a phone changes networks, is replayed.
+	assert.Equal(t, from("10.0.0.1", "k1").Header().Get("Idempotent-Replayed"), "")
+	assert.Equal(t, from("10.0.0.2", "k1").Header().Get("Idempotent-Replayed"), "true")
+	assert.Equal(t, calls, 1)
+
+	// The same key from another caller is another request.
+	assert.Equal(t, as("s3cret", "10.0.0.1", "k1").Header().Get("Idempotent-Replayed"), "")
+	assert.Equal(t, as("s3cret", "10.0.0.3", "k1").Header().Get("Idempotent-Replayed"), "true")
+	assert.Equal(t, calls, 2)
+
+	// One caller cannot keep more than maxKeysPerCaller responses; for
+	// anonymous callers that is one address.
+	for i := 1; i < maxKeysPerCaller; i++ {
+		assert.Equal(t, from("10.0.0.1", fmt.Sprint("k1-", i)).Code, http.StatusCreated)
+	}
+	w := from("10.0.0.1", "one-too-many")
+	assert.Equal(t, w.Code, http.StatusTooManyRequests)
+	assert.Equal(t, w.Body.String(), `{"error":"too many Idempotency-Keys in use, retry later"}`)
+	assert.Equal(t, from("10.0.0.2", "k2").Code, http.StatusCreated)
+}
@@ -0,0 +1,230 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Identifier types resolved by the lookup endpoint.
+const (
+	idProduceCode = "code"
+	idUPC         = "upc"
+	idEAN         = "ean"
+	idGTIN        = "gtin"
+	idPLU         = "plu"
+)
+
+// isDigits reports whether s is a non-empty string of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validGTIN reports whether the last digit of a GTIN (UPC-A, EAN-13 or
+// GTIN-14) is the GS1 mod 10 check digit of the digits before it.
+func validGTIN(s string) bool {
+	if len(s) < 2 || !isDigits(s) {
+		return false
+	}
+	sum := 0
+	for i, weight := len(s)-2, 3; i >= 0; i, weight = i-1, 4-weight { // weights 3,1,3,1... from the right
+		sum += int(s[i]-'0') * weight
+	}
+	return int(s[len(s)-1]-'0') == (10-sum%10)%10
+}
+
+// gtin14 pads a UPC-A or EAN-13 to 14 digits so that the same product
+// scanned as UPC-A or as EAN-13 compares equal.
+func gtin14(s string) string {
+	return strings.Repeat("0", 14-len(s)) + s
+}
+
+// validPLU reports whether s is a 4 digit IFPS price look-up code in the
+// 3000-4999 range, or a 5 digit one with an 8 or 9 prefix.
+func validPLU(s string) bool {
+	if !isDigits(s) {
+		return false
+	}
+	switch len(s) {
+	case 4:
+		return s[0] == '3' || s[0] == '4'
+	case 5:
+		return (s[0] == '8' || s[0] == '9') && validPLU(s[1:])
+	}
+	return false
+}
+
+// IsUPCA is the validation function for validating if the current field
+// is a 12 digit UPC-A with a valid check digit.
+func IsUPCA(fl validator.FieldLevel) bool {
+	s := fl.Field().String()
+	return len(s) == 12 && validGTIN(s)
+}
+
+// IsEAN13 is the validation function for validating if the current field
+// is a 13 digit EAN-13 with a valid check digit.
+func IsEAN13(fl validator.FieldLevel) bool {
+	s := fl.Field().String()
+	return len(s) == 13 && validGTIN(s)
+}
+
+// IsPLU is the validation function for validating if the current field
+// is a 4 or 5 digit PLU code.
+func IsPLU(fl validator.FieldLevel) bool {
+	return validPLU(fl.Field().String())
+}
+
+// classifyIdentifier returns the type of id and its normalized form: upper
+// case for produce codes, GTIN-14 for barcodes.
+func classifyIdentifier(id string) (string, string, error) {
+	if uUIDRegex.MatchString(id) {
+		return idProduceCode, strings.ToUpper(id), nil
+	}
+	if !isDigits(id) {
+		return "", "", fmt.Errorf("unrecognized identifier %q", id)
+	}
+	var kind string
+	switch len(id) {
+	case 4, 5:
+		if !validPLU(id) {
+			return "", "", fmt.Errorf("invalid PLU %q", id)
+		}
+		return idPLU, id, nil
+	case 12:
+		kind = idUPC
+	case 13:
+		kind = idEAN
+	case 14:
+		kind = idGTIN
+	default:
+		return "", "", fmt.Errorf("unrecognized identifier %q", id)
+	}
+	if !validGTIN(id) {
+		return "", "", fmt.Errorf("invalid check digit in %s %q", kind, id)
+	}
+	return kind, gtin14(id), nil
+}
+
+// findByIdentifier returns the code of the item identified by the
+// normalized identifier id of the given kind.
+// The caller must hold dbmux.
+func (db database) findByIdentifier(kind, id string) (string, bool) {
+	if kind == idProduceCode {
+		_, ok := db[id]
+		return id, ok
+	}
+	for code, item := range db {
+		switch {
+		case kind == idPLU && item.PLU == id:
+			return code, true
+		case kind != idPLU && item.UPC != "" && gtin14(item.UPC) == id:
+			return code, true
+		case kind != idPLU && item.EAN != "" && gtin14(item.EAN) == id:
+			return code, true
+		}
+	}
+	return "", false
+}
+
+// identifierConflict returns an error when an alternate identifier of one of
+// items is used by another item, in db or earlier in items.
+func (db database) identifierConflict(items []Item) error {
+	taken := map[string]string{} // normalized identifier -> code
+	for code, item := range db {
+		for _, id := range itemIdentifiers(item) {
+			taken[id.key] = code
+		}
+	}
+	for i, item := range items {
+		code := strings.ToUpper(item.ProduceCode)
+		for _, id := range itemIdentifiers(item) {
+			if owner, ok := taken[id.key]; ok && owner != code {
+				return fmt.Errorf("[%d]: %s %s is already used by %s", i, id.kind, id.value, owner)
+			}
+			taken[id.key] = code
+		}
+	}
+	return nil
+}
+
+// itemIdentifier is an alternate identifier of an item. Barcodes are keyed by
+// their GTIN-14 so that a UPC-A and the equivalent EAN-13 collide.
+type itemIdentifier struct {
+	kind, value, key string
+}
+
+// itemIdentifiers returns the alternate identifiers of item.
+func itemIdentifiers(item Item) []itemIdentifier {
+	var ids []itemIdentifier
+	if item.UPC != "" {
+		ids = append(ids, itemIdentifier{idUPC, item.UPC, gtin14(item.UPC)})
+	}
+	if item.EAN != "" && (item.UPC == "" || gtin14(item.EAN) != gtin14(item.UPC)) {
+		ids = append(ids, itemIdentifier{idEAN, item.EAN, gtin14(item.EAN)})
+	}
+	if item.PLU != "" {
+		ids = append(ids, itemIdentifier{idPLU, item.PLU, "plu:" + item.PLU})
+	}
+	return ids
+}
+
+// Lookup godoc
+// @Summary Lookup Item
+// @Schemes
+// @Description Resolve a produce code, UPC-A, EAN-13, GTIN-14 or PLU to its item. A UPC-A also matches an item stored by its EAN-13 and vice versa
+// @Tags example
+// @Param        id   path      string  true  "Identifier"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /lookup/:id [get]
+func (db database) lookup(c *gin.Context) {
+	kind, id, err := classifyIdentifier(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	code, ok := db.findByIdentifier(kind, id)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"type": kind, "item": itemView(code, db[code], time.Now())})
+}
@@ -0,0 +1,164 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestValidGTIN -v
+
+func TestValidGTIN(t *testing.T) {
+	tests := map[string]struct {
+		id   string
+		want bool
+	}{
+		"upc-a":          {id: "036000291452", want: true},
+		"upc-a bad":      {id: "036000291453", want: false},
+		"ean-13":         {id: "4006381333931", want: true},
+		"ean-13 bad":     {id: "4006381333932", want: false},
+		"upc as ean":     {id: "0036000291452", want: true},
+		"gtin-14":        {id: "10036000291459", want: true},
+		"letters":        {id: "03600029145A", want: false},
+		"too short":      {id: "0", want: false},
+		"zero check sum": {id: "000000000000", want: true},
+	}
+	for name, tc := range tests {
+		assert.Equal(t, validGTIN(tc.id), tc.want, name)
+	}
+}
+
+func TestValidPLU(t *testing.T) {
+	tests := map[string]bool{
+		"4011":  true,  // bananas
+		"3283":  true,  // honeycrisp
+		"94011": true,  // organic bananas
+		"84011": true,  // genetically modified
+		"2011":  false, // outside the produce range
+		"74011": false,
+		"401":   false,
+		"40111": false,
+		"4o11":  false,
+	}
+	for id, want := range tests {
+		assert.Equal(t, validPLU(id), want, id)
+	}
+}
+
+// go test -run TestLookup -v
+
+func TestLookup(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	add := map[string]struct {
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		"ok":      {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AZ","name":"Bananas","price":"0.59","upc":"036000291452","plu":"4011"},{"code":"ZRT6-72AS-K736-L4AY","name":"Organic Bananas","price":"0.79","ean":"4006381333931","plu":"94011"}]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		"bad upc": {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","upc":"036000291453"}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.UPC' Error:Field validation for 'UPC' failed on the 'isupca' tag"}`},
+		"bad ean": {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","ean":"036000291452"}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.EAN' Error:Field validation for 'EAN' failed on the 'isean13' tag"}`},
+		"bad plu": {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","plu":"123"}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.PLU' Error:Field validation for 'PLU' failed on the 'isplu' tag"}`},
+	}
+	for _, name := range []string{"ok", "bad upc", "bad ean", "bad plu"} {
+		tc := add[name]
+		got := routerPOSTReq("POST", "/api/v1/add", tc.jsonData, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	bananas := `{"code":"ZRT6-72AS-K736-L4AZ","name":"Bananas","price":"$0.59","upc":"036000291452","plu":"4011"}`
+	tests := map[string]struct {
+		path       string
+		wantCode   int
+		wantResult string
+	}{
+		"produce code":   {path: "/api/v1/lookup/zrt6-72as-k736-l4az", wantCode: 200, wantResult: `{"item":` + bananas + `,"type":"code"}`},
+		"upc":            {path: "/api/v1/lookup/036000291452", wantCode: 200, wantResult: `{"item":` + bananas + `,"type":"upc"}`},
+		"upc as ean":     {path: "/api/v1/lookup/0036000291452", wantCode: 200, wantResult: `{"item":` + bananas + `,"type":"ean"}`},
+		"plu":            {path: "/api/v1/lookup/4011", wantCode: 200, wantResult: `{"item":` + bananas + `,"type":"plu"}`},
+		"ean":            {path: "/api/v1/lookup/4006381333931", wantCode: 200, wantResult: `{"item":{"code":"ZRT6-72AS-K736-L4AY","name":"Organic Bananas","price":"$0.79","ean":"4006381333931","plu":"94011"},"type":"ean"}`},
+		"not found":      {path: "/api/v1/lookup/3283", wantCode: 200, wantResult: `{"error":"code not found"}`},
+		"bad check":      {path: "/api/v1/lookup/036000291453", wantCode: 400, wantResult: `{"error":"invalid check digit in upc \"036000291453\""}`},
+		"bad plu":        {path: "/api/v1/lookup/1234", wantCode: 400, wantResult: `{"error":"invalid PLU \"1234\""}`},
+		"unrecognized":   {path: "/api/v1/lookup/12345678", wantCode: 400, wantResult: `{"error":"unrecognized identifier \"12345678\""}`},
+		"not a code":     {path: "/api/v1/lookup/A12T-4GH7", wantCode: 400, wantResult: `{"error":"unrecognized identifier \"A12T-4GH7\""}`},
+		"existing items": {path: "/api/v1/lookup/A12T-4GH7-QPL9-3N4M", wantCode: 200, wantResult: `{"item":{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"},"type":"code"}`},
+	}
+	for name, tc := range tests {
+		got := routerGETReq("GET", tc.path, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	conflicts := map[string]struct {
+		jsonData   []byte
+		wantResult string
+	}{
+		"upc taken":      {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","upc":"036000291452"}]`), wantResult: `{"error":"[0]: upc 036000291452 is already used by ZRT6-72AS-K736-L4AZ"}`},
+		"upc as ean":     {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","ean":"0036000291452"}]`), wantResult: `{"error":"[0]: ean 0036000291452 is already used by ZRT6-72AS-K736-L4AZ"}`},
+		"plu taken":      {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","plu":"94011"}]`), wantResult: `{"error":"[0]: plu 94011 is already used by ZRT6-72AS-K736-L4AY"}`},
+		"within a batch": {jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","plu":"3279"},{"code":"ZRT6-72AS-K736-L4AW","name":"Gold Kiwi","price":"0.99","plu":"3279"}]`), wantResult: `{"error":"[1]: plu 3279 is already used by ZRT6-72AS-K736-L4AX"}`},
+	}
+	for name, tc := range conflicts {
+		got := routerPOSTReq("POST", "/api/v1/add", tc.jsonData, router)
+		if got.Code != 400 || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: 400 %v, got: %v %v", name, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
+
+// go test -race -run TestAddIdentifierRace -v
+
+func TestAddIdentifierRace(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jsonData := []byte(fmt.Sprintf(`[{"code":"B111-2222-3333-444%d","name":"Kiwi","price":"0.50","upc":"036000291452"}]`, i))
+			codes <- routerPOSTReq("POST", "/api/v1/add", jsonData, router).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	added := 0
+	for code := range codes {
+		if code == 201 {
+			added++
+		} else {
+			assert.Equal(t, code, 400)
+		}
+	}
+	assert.Equal(t, added, 1) // the UPC identifies one item
+}
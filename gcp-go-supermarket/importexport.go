@@ -0,0 +1,393 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Bulk file formats.
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+)
+
+// Import modes.
+const (
+	importUpsert = "upsert" // add new codes and update existing ones
+	importInsert = "insert" // add new codes only
+)
+
+// exportFlushRows is how many rows are written between flushes of an export.
+const exportFlushRows = 500
+
+// maxImportErrors is how many row errors an import report lists. Failed
+// rows beyond it are only counted.
+const maxImportErrors = 100
+
+// maxImportLine is the longest JSONL line accepted by an import, in bytes.
+const maxImportLine = 1 << 20
+
+// csvColumns are the columns of a CSV export, in order. Imports accept them
+// in any order; code, name and price are required.
+var csvColumns = []string{"code", "name", "price", "unit", "tax_class", "category", "upc", "ean", "plu"}
+
+// exportItem returns the catalog fields of v stored under code, with the
+// price as the add endpoint takes it so that exports can be imported again.
+func exportItem(code string, v Item) Item {
+	item := itemView(code, v, time.Time{})
+	item.UnitPrice = strings.TrimPrefix(item.UnitPrice, "$")
+	item.Markdown = nil
+	return item
+}
+
+// csvRecord returns item as a CSV record in csvColumns order.
+func csvRecord(item Item) []string {
+	return []string{item.ProduceCode, item.Name, item.UnitPrice, item.Unit, item.TaxClass, item.Category, item.UPC, item.EAN, item.PLU}
+}
+
+// Export godoc
+// @Summary Export Catalog
+// @Schemes
+// @Description Stream the catalog ordered by code as CSV or JSON Lines. The export can be imported again
+// @Tags bulk
+// @Param        format   query      string  false  "csv (default) or jsonl"
+// @Produce plain
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /export [get]
+func (db database) export(c *gin.Context) {
+	format := c.DefaultQuery("format", formatCSV)
+	if format != formatCSV && format != formatJSONL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid format %q", format)})
+		return
+	}
+	dbmux.Lock()
+	codes := make([]string, 0, len(db))
+	for code := range db {
+		codes = append(codes, code)
+	}
+	dbmux.Unlock()
+	sort.Strings(codes)
+
+	var write func(Item) error
+	if format == formatCSV {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		defer w.Flush()
+		if err := w.Write(csvColumns); err != nil {
+			return
+		}
+		write = func(item Item) error {
+			if err := w.Write(csvRecord(item)); err != nil {
+				return err
+			}
+			w.Flush()
+			return w.Error()
+		}
+	} else {
+		c.Header("Content-Type", "application/jsonl; charset=utf-8")
+		enc := json.NewEncoder(c.Writer)
+		write = func(item Item) error { return enc.Encode(item) }
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="catalog.%s"`, format))
+	c.Status(http.StatusOK)
+	for i, code := range codes { // one item at a time, so adds are not held up by a long export
+		dbmux.Lock()
+		v, ok := db[code]
+		dbmux.Unlock()
+		if !ok { // deleted since the export started
+			continue
+		}
+		if err := write(exportItem(code, v)); err != nil {
+			return // the client went away
+		}
+		if (i+1)%exportFlushRows == 0 {
+			c.Writer.Flush()
+		}
+	}
+}
+
+// rowError is a row an import rejected. Line is the line of the file the row
+// starts on, counting from 1.
+type rowError struct {
+	Line        int    `json:"line"`
+	ProduceCode string `json:"code,omitempty"`
+	Error       string `json:"error"`
+}
+
+// importReport is the result of an import.
+type importReport struct {
+	Format   string     `json:"format"`
+	Mode     string     `json:"mode"`
+	Rows     int        `json:"rows"`
+	Inserted int        `json:"inserted"`
+	Updated  int        `json:"updated"`
+	Failed   int        `json:"failed"`
+	Errors   []rowError `json:"errors"` // Errors are the first maxImportErrors failed rows
+}
+
+// importer applies the rows of one import to db.
+type importer struct {
+	db         database
+	who        actor
+	categories *categoryTree
+	mode       string
+	now        time.Time
+	report     importReport
+}
+
+func newImporter(db database, who actor, categories *categoryTree, format, mode string) *importer {
+	imp := &importer{db: db, who: who, categories: categories, mode: mode, now: time.Now()}
+	imp.report = importReport{Format: format, Mode: mode, Errors: []rowError{}}
+	return imp
+}
+
+// fail records a rejected row.
+func (imp *importer) fail(line int, code string, err error) {
+	imp.report.Failed++
+	if len(imp.report.Errors) < maxImportErrors {
+		imp.report.Errors = append(imp.report.Errors, rowError{Line: line, ProduceCode: code, Error: err.Error()})
+	}
+}
+
+// mergeItem returns old with the fields of item named in fields, by JSON
+// name. A named field item does not set is cleared.
+func mergeItem(old, item Item, fields []string) Item {
+	m, set := itemFields(&old), itemFields(&item)
+	for _, name := range fields {
+		if v, ok := set[name]; ok {
+			m[name] = v
+		} else {
+			delete(m, name)
+		}
+	}
+	b, _ := json.Marshal(m)
+	var merged Item
+	json.Unmarshal(b, &merged)
+	return merged
+}
+
+// apply validates item with the rules of the add endpoint and stores it.
+// fields are the JSON names of the fields the row has: updates set those
+// catalog fields and keep the others, and always keep the inventory fields:
+// stock, reorder point and lots. The row is merged, checked and stored
+// holding the taxonomy lock and dbmux, like the add endpoint, so that no
+// other change comes in between.
+func (imp *importer) apply(line int, item Item, fields []string) {
+	imp.report.Rows++
+	item.ProduceCode = strings.ToUpper(item.ProduceCode)
+	imp.categories.mu.Lock()
+	defer imp.categories.mu.Unlock()
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	old, exists := imp.db[item.ProduceCode]
+	if exists && imp.mode == importUpsert {
+		item = mergeItem(exportItem(item.ProduceCode, old), item, fields)
+	}
+	if err := binding.Validator.ValidateStruct(&item); err != nil {
+		imp.fail(line, item.ProduceCode, err)
+		return
+	}
+	if err := imp.categories.checkAttributesLocked(item.Category, item.Attributes); err != nil {
+		imp.fail(line, item.ProduceCode, err)
+		return
+	}
+	if err := imp.db.identifierConflict([]Item{item}); err != nil {
+		imp.fail(line, item.ProduceCode, errors.New(strings.TrimPrefix(err.Error(), "[0]: ")))
+		return
+	}
+	if exists && imp.mode == importInsert {
+		imp.fail(line, item.ProduceCode, errors.New("code exists"))
+		return
+	}
+
+	item.UnitPrice = "$" + item.UnitPrice
+	item.Markdown = nil
+	if exists {
+		item.Stock, item.ReorderPoint, item.Lots = old.Stock, old.ReorderPoint, old.Lots
+		imp.report.Updated++
+	} else {
+		normalizeLots(&item, imp.now)
+		imp.report.Inserted++
+	}
+	imp.db.put(imp.who, item.ProduceCode, item)
+}
+
+// importCSV applies the rows of a CSV file with a header line.
+func (imp *importer) importCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	column := map[string]int{}
+	fields := make([]string, 0, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(strings.ToLower(name))
+		known := false
+		for _, c := range csvColumns {
+			known = known || c == name
+		}
+		if !known {
+			return fmt.Errorf("unknown column %q", name)
+		}
+		column[name] = i
+		fields = append(fields, name)
+	}
+	for _, name := range []string{"code", "name", "price"} {
+		if _, ok := column[name]; !ok {
+			return fmt.Errorf("missing column %q", name)
+		}
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			imp.report.Rows++
+			imp.fail(parseErr.StartLine, "", err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := column[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		item := Item{
+			ProduceCode: field("code"),
+			Name:        field("name"),
+			UnitPrice:   strings.TrimPrefix(field("price"), "$"),
+			Unit:        field("unit"),
+			TaxClass:    field("tax_class"),
+			Category:    field("category"),
+			UPC:         field("upc"),
+			EAN:         field("ean"),
+			PLU:         field("plu"),
+		}
+		imp.apply(line, item, fields)
+	}
+}
+
+// importJSONL applies a file of one JSON item per line. Blank lines are
+// skipped.
+func (imp *importer) importJSONL(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	for line := 1; ; line++ {
+		b, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) { // a long line, read the rest of it
+			rest := append([]byte(nil), b...)
+			for errors.Is(err, bufio.ErrBufferFull) && len(rest) <= maxImportLine {
+				b, err = br.ReadSlice('\n')
+				rest = append(rest, b...)
+			}
+			if len(rest) > maxImportLine {
+				return fmt.Errorf("line %d is longer than %d bytes", line, maxImportLine)
+			}
+			b = rest
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			var item Item
+			var set map[string]json.RawMessage
+			dec := json.NewDecoder(bytes.NewReader(b))
+			dec.DisallowUnknownFields()
+			derr := dec.Decode(&item)
+			if derr == nil {
+				derr = json.Unmarshal(b, &set)
+			}
+			if derr != nil {
+				imp.report.Rows++
+				imp.fail(line, "", derr)
+			} else {
+				fields := make([]string, 0, len(set))
+				for name := range set {
+					fields = append(fields, name)
+				}
+				imp.apply(line, item, fields)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Import godoc
+// @Summary Import Catalog
+// @Schemes
+// @Description Stream a CSV or JSON Lines file of items into the catalog. Rows are checked with the same rules as the add endpoint and applied one at a time; the report lists the rows that failed. In upsert mode existing items are updated with the columns or fields a row has and keep the others and their stock; in insert mode they are rejected
+// @Tags bulk
+// @Param        format   query      string  false  "csv (default) or jsonl"
+// @Param        mode   query      string  false  "upsert (default) or insert"
+// @Accept plain
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /import [post]
+func (db database) importItems(c *gin.Context) {
+	format := c.DefaultQuery("format", formatCSV)
+	if format != formatCSV && format != formatJSONL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid format %q", format)})
+		return
+	}
+	mode := c.DefaultQuery("mode", importUpsert)
+	if mode != importUpsert && mode != importInsert {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid mode %q", mode)})
+		return
+	}
+	imp := newImporter(db, actorFrom(c), categoriesFrom(c), format, mode)
+	var err error
+	if format == formatCSV {
+		err = imp.importCSV(c.Request.Body)
+	} else {
+		err = imp.importJSONL(c.Request.Body)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "report": imp.report})
+		return
+	}
+	c.JSON(http.StatusOK, imp.report)
+}
@@ -0,0 +1,106 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// go test -run TestExportImport -v
+
+func TestExportImport(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	csvFile := "code,name,price,unit\n" +
+		"A12T-4GH7-QPL9-3N4M,Romaine Lettuce,3.49,\n" + // update
+		"b111-2222-3333-4444,Kale,2.50,bunch\n" + // insert, the code is upper cased
+		"C111-2222-3333-4444,Bad Price,2.505,\n" +
+		"\"D111-2222-3333-4444,Broken\n"
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "export csv", method: "GET", path: "/api/v1/export", wantCode: 200, wantResult: "code,name,price,unit,tax_class,category,upc,ean,plu\nA12T-4GH7-QPL9-3N4M,Lettuce,3.41,,,,,,\n"},
+		{name: "export jsonl", method: "GET", path: "/api/v1/export?format=jsonl", wantCode: 200, wantResult: `{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"3.41"}` + "\n"},
+		{name: "export bad format", method: "GET", path: "/api/v1/export?format=xml", wantCode: 400, wantResult: `{"error":"invalid format \"xml\""}`},
+		{name: "import csv", method: "POST", path: "/api/v1/import", jsonData: []byte(csvFile), wantCode: 200, wantResult: `{"format":"csv","mode":"upsert","rows":4,"inserted":1,"updated":1,"failed":2,"errors":[{"line":4,"code":"C111-2222-3333-4444","error":"Key: 'Item.UnitPrice' Error:Field validation for 'UnitPrice' failed on the 'isunitprice' tag"},{"line":5,"error":"parse error on line 5, column 29: extraneous or missing \" in quoted-field"}]}`},
+		{name: "updated", method: "GET", path: "/api/v1/item/A12T-4GH7-QPL9-3N4M", wantCode: 200, wantResult: `{"code":"A12T-4GH7-QPL9-3N4M","name":"Romaine Lettuce","price":"$3.49"`},
+		{name: "inserted", method: "GET", path: "/api/v1/item/B111-2222-3333-4444", wantCode: 200, wantResult: `{"code":"B111-2222-3333-4444","name":"Kale","price":"$2.50","unit":"bunch"}`},
+		{name: "import insert", method: "POST", path: "/api/v1/import?format=jsonl&mode=insert", jsonData: []byte(`{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"3.41"}` + "\n\n" + `{"code":"E111-2222-3333-4444","name":"Leek","price":"1.20","upc":"036000291452"}` + "\n" + `{"code":"F111-2222-3333-4444","name":"Onion","price":"0.80","upc":"036000291452"}` + "\n" + `{"code":"G111-2222-3333-4444","name":"Yam","colour":"orange"}`), wantCode: 200, wantResult: `{"format":"jsonl","mode":"insert","rows":4,"inserted":1,"updated":0,"failed":3,"errors":[{"line":1,"code":"A12T-4GH7-QPL9-3N4M","error":"code exists"},{"line":4,"code":"F111-2222-3333-4444","error":"upc 036000291452 is already used by E111-2222-3333-4444"},{"line":5,"error":"json: unknown field \"colour\""}]}`},
+		{name: "import unknown column", method: "POST", path: "/api/v1/import", jsonData: []byte("code,name,price,colour\n"), wantCode: 400, wantResult: `{"error":"unknown column \"colour\""`},
+		{name: "import missing column", method: "POST", path: "/api/v1/import", jsonData: []byte("code,name\n"), wantCode: 400, wantResult: `{"error":"missing column \"price\""`},
+		{name: "import bad mode", method: "POST", path: "/api/v1/import?mode=replace", jsonData: []byte(csvFile), wantCode: 400, wantResult: `{"error":"invalid mode \"replace\""}`},
+		{name: "import with allergens", method: "POST", path: "/api/v1/import?format=jsonl", jsonData: []byte(`{"code":"H111-2222-3333-4444","name":"Almond Milk","price":"3.49","allergens":["tree_nuts"],"dietary":["vegan"]}`), wantCode: 200, wantResult: `{"format":"jsonl","mode":"upsert","rows":1,"inserted":1,`},
+		{name: "csv keeps other fields", method: "POST", path: "/api/v1/import", jsonData: []byte("code,name,price,unit\nH111-2222-3333-4444,Almond Milk,3.99,\n"), wantCode: 200, wantResult: `{"format":"csv","mode":"upsert","rows":1,"inserted":0,"updated":1,`},
+		{name: "jsonl sets named fields", method: "POST", path: "/api/v1/import?format=jsonl", jsonData: []byte(`{"code":"H111-2222-3333-4444","name":"Almond Milk","price":"3.99","dietary":["vegan","gluten_free"]}`), wantCode: 200, wantResult: `{"format":"jsonl","mode":"upsert","rows":1,"inserted":0,"updated":1,`},
+		{name: "merged", method: "GET", path: "/api/v1/item/H111-2222-3333-4444", wantCode: 200, wantResult: `{"code":"H111-2222-3333-4444","name":"Almond Milk","price":"$3.99","allergens":["tree_nuts"],"dietary":["vegan","gluten_free"]}`},
+		{name: "round trip", method: "GET", path: "/api/v1/export", wantCode: 200, wantResult: "code,name,price,unit,tax_class,category,upc,ean,plu\nA12T-4GH7-QPL9-3N4M,Romaine Lettuce,3.49,,,,,,\nB111-2222-3333-4444,Kale,2.50,bunch,,,,,\n"},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || !strings.HasPrefix(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
+
+// go test -race -run TestImportIdentifierRace -v
+
+func TestImportIdentifierRace(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	var wg sync.WaitGroup
+	added := make(chan bool, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			item := fmt.Sprintf(`{"code":"B111-2222-3333-444%d","name":"Kiwi","price":"0.50","upc":"036000291452"}`, i)
+			if i%2 == 0 {
+				added <- routerPOSTReq("POST", "/api/v1/add", []byte("["+item+"]"), router).Code == 201
+				return
+			}
+			got := routerPOSTReq("POST", "/api/v1/import?format=jsonl", []byte(item), router)
+			added <- strings.Contains(got.Body.String(), `"inserted":1,`)
+		}(i)
+	}
+	wg.Wait()
+	close(added)
+	n := 0
+	for ok := range added {
+		if ok {
+			n++
+		}
+	}
+	if n != 1 { // the UPC identifies one item
+		t.Fatalf("expected: 1 item added, got: %d", n)
+	}
+}
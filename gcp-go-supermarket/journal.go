@@ -0,0 +1,295 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// catalogJournal records every change to the catalog for point-in-time
+// restores, see backup.go. It is opened by main when backups are configured;
+// nil disables it.
+var catalogJournal *journal
+
+// put stores item under code for who, recording the change in the journal,
+// the audit trail and the event store. The caller must hold dbmux.
+func (db database) put(who actor, code string, item Item) {
+	db.write(who, code, &item, "")
+}
+
+// remove deletes the item stored under code for who, recording the change in
+// the journal, the audit trail and the event store. The caller must hold
+// dbmux.
+func (db database) remove(who actor, code string) {
+	db.write(who, code, nil, "")
+}
+
+// write stores item under code for who, or deletes it when item is nil, and
+// records the change. The event store gets the events itemEvents derives
+// from it or, when typ is set, one event of that type carrying the item
+// stored or deleted, e.g. ItemTrashed. The caller must hold dbmux.
+func (db database) write(who actor, code string, item *Item, typ string) {
+	op := "put"
+	if item == nil {
+		op = "remove"
+	}
+	defer timeStore("catalog", op, time.Now())
+	defer traceStore(who.ctx, "catalog", op).End()
+	var before *Item
+	if old, ok := db[code]; ok {
+		before = &old
+	}
+	if item == nil && before == nil {
+		return
+	}
+	if item != nil {
+		db[code] = *item
+	} else {
+		delete(db, code)
+	}
+	catalogJournal.record(code, item)
+	catalogAudit.record(who, code, before, item)
+	switch {
+	case typ == "":
+		catalogEvents.record(who, code, before, item)
+	case item != nil:
+		catalogEvents.recordAs(who, code, typ, itemAdded{*item})
+	default:
+		catalogEvents.recordAs(who, code, typ, itemAdded{*before})
+	}
+}
+
+// change is a journal record: the item stored under a code after a change,
+// or nil when it was deleted. A change of the taxonomy has CategoryID set
+// instead, with the category after it or nil.
+type change struct {
+	Seq         int64     `json:"seq"`
+	Time        time.Time `json:"time"`
+	ProduceCode string    `json:"code,omitempty"`
+	Item        *Item     `json:"item,omitempty"`
+	CategoryID  string    `json:"category_id,omitempty"`
+	Category    *Category `json:"category,omitempty"`
+}
+
+// journal is an append-only file of changes, one JSON record per line.
+// Records are numbered in order; the numbers carry on across restarts.
+type journal struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	seq    int64
+	now    func() time.Time
+	health logHealth
+}
+
+// openJournal opens the journal at path for appending, creating it if needed.
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path, now: time.Now}
+	var err error
+	if j.f, err = openLog(path); err != nil {
+		return nil, err
+	}
+	changes, err := j.changes(0, time.Time{})
+	if err != nil {
+		j.f.Close()
+		return nil, err
+	}
+	if len(changes) > 0 {
+		j.seq = changes[len(changes)-1].Seq
+	}
+	return j, nil
+}
+
+// logHealth remembers whether the last write to an append-only log failed.
+// Writes to the logs are not retried and do not fail the request that made
+// them, so the log's readiness check reports it instead, see health.go. It
+// has a lock of its own so that checks never wait for the log's.
+type logHealth struct {
+	mu     sync.Mutex
+	failed error
+}
+
+// wrote records the outcome of a write.
+func (h *logHealth) wrote(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failed = err
+}
+
+// check returns the error of the last write, nil if it succeeded.
+func (h *logHealth) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failed != nil {
+		return fmt.Errorf("last write failed: %v", h.failed)
+	}
+	return nil
+}
+
+// openLog opens the append-only file of JSON lines at path, creating it if
+// needed, for reading from the start and appending. A last line without its
+// newline was torn by a crash during a write; it is cut off, else the next
+// line appended would be glued onto it and the file could not be read again.
+func openLog(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size, keep := fi.Size(), int64(0)
+	buf := make([]byte, 4096)
+	for end := size; end > 0; end -= int64(len(buf)) { // back to the last newline
+		n := min(end, int64(len(buf)))
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			keep = end - n + int64(i) + 1
+			break
+		}
+	}
+	if keep < size {
+		log.Printf("%s: cutting off a torn last line of %d bytes", path, size-keep)
+		if err := f.Truncate(keep); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// record appends a change to the journal. Write errors are logged rather than
+// failing the request that made the change. The caller must hold dbmux, which
+// keeps records in the order the changes were made.
+func (j *journal) record(code string, item *Item) {
+	j.append(change{ProduceCode: code, Item: item}, code)
+}
+
+// recordCategory appends a change of category id, to cat or deleted when cat
+// is nil. The caller must hold dbmux.
+func (j *journal) recordCategory(id string, cat *Category) {
+	j.append(change{CategoryID: id, Category: cat}, "category "+id)
+}
+
+// append numbers and writes c, the change of what.
+func (j *journal) append(c change, what string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	c.Seq, c.Time = j.seq, j.now().UTC()
+	b, err := json.Marshal(c)
+	if err == nil {
+		_, err = j.f.Write(append(b, '\n'))
+	}
+	j.health.wrote(err)
+	if err != nil {
+		log.Printf("journal %s: change %d of %s not recorded: %v", j.path, j.seq, what, err)
+	}
+}
+
+// ping fails when the last change could not be recorded, see logHealth.
+func (j *journal) ping(ctx context.Context) error {
+	if j == nil {
+		return errCheckSkipped
+	}
+	return j.health.check()
+}
+
+// last returns the number of the latest record.
+func (j *journal) last() int64 {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seq
+}
+
+// changes reads the records after record number after, up to and including
+// those made at until; a zero until reads to the end. A torn last line, left
+// by a crash part way through a write, is skipped.
+func (j *journal) changes(after int64, until time.Time) ([]change, error) {
+	if j == nil {
+		return nil, nil
+	}
+	f, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var changes []change
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return changes, nil // a line without a newline is torn
+		} else if err != nil {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		var c change
+		if err := json.Unmarshal(line, &c); err != nil {
+			return nil, fmt.Errorf("journal %s: line %d: %v", j.path, n, err)
+		}
+		if c.Seq <= after {
+			continue
+		}
+		if !until.IsZero() && c.Time.After(until) {
+			return changes, nil
+		}
+		changes = append(changes, c)
+	}
+}
+
+// close closes the journal file.
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logLevel is the least severe level logged, set with -log.level.
+var logLevel = new(slog.LevelVar)
+
+// redactedHeaders are the request headers whose values are not logged, in
+// canonical form. -log.redact adds to them.
+var redactedHeaders = map[string]bool{
+	"Authorization":                   true,
+	"Cookie":                          true,
+	"Proxy-Authorization":             true,
+	"X-Admin-Token":                   true,
+	"X-Api-Key":                       true,
+	"X-Goog-Authenticated-User-Email": true,
+	"X-Goog-Authenticated-User-Id":    true,
+	"X-Goog-Iap-Jwt-Assertion":        true,
+	"X-Serverless-Authorization":      true,
+}
+
+// redacted replaces the values of redacted headers.
+const redacted = "REDACTED"
+
+// newLogger returns a logger writing JSON lines to w in the structure Cloud
+// Logging reads from Cloud Run: severity, message and timestamp, the trace
+// of the request in project, and its request ID.
+func newLogger(w io.Writer, level slog.Leveler, project string) *slog.Logger {
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: cloudLoggingAttr})
+	return slog.New(cloudLoggingHandler{Handler: h, project: project})
+}
+
+// cloudLoggingAttr renames the built in attributes to Cloud Logging's.
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.TimeKey:
+		a.Key = "timestamp"
+	case slog.MessageKey:
+		a.Key = "message"
+	case slog.LevelKey:
+		a = slog.String("severity", severity(a.Value.Any().(slog.Level)))
+	}
+	return a
+}
+
+// severity is the Cloud Logging LogSeverity of level.
+func severity(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// cloudLoggingHandler adds the trace and request ID of the context of a
+// record, so Cloud Logging shows the record under the request's trace.
+type cloudLoggingHandler struct {
+	slog.Handler
+	project string // the trace's Google Cloud project, $GOOGLE_CLOUD_PROJECT
+}
+
+func (h cloudLoggingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		traceName := sc.TraceID().String()
+		if h.project != "" {
+			traceName = "projects/" + h.project + "/traces/" + traceName
+		}
+		r.AddAttrs(
+			slog.String("logging.googleapis.com/trace", traceName),
+			slog.String("logging.googleapis.com/spanId", sc.SpanID().String()),
+			slog.Bool("logging.googleapis.com/trace_sampled", sc.IsSampled()),
+		)
+	}
+	if id := requestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h cloudLoggingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return cloudLoggingHandler{Handler: h.Handler.WithAttrs(attrs), project: h.project}
+}
+
+func (h cloudLoggingHandler) WithGroup(name string) slog.Handler {
+	return cloudLoggingHandler{Handler: h.Handler.WithGroup(name), project: h.project}
+}
+
+// logRequests is middleware that logs every request once it is answered,
+// with Cloud Logging's httpRequest fields and its headers, redacted. Server
+// errors are logged as errors and client errors as warnings.
+func logRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+	ctx := c.Request.Context()
+	logger := slog.Default()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Group("httpRequest",
+			slog.String("requestMethod", c.Request.Method),
+			slog.String("requestUrl", c.Request.URL.String()),
+			slog.Int("status", status),
+			slog.Int("responseSize", c.Writer.Size()),
+			slog.String("userAgent", c.Request.UserAgent()),
+			slog.String("remoteIp", c.ClientIP()),
+			slog.String("referer", c.Request.Referer()),
+			slog.String("protocol", c.Request.Proto),
+			slog.String("latency", fmt.Sprintf("%.9fs", time.Since(start).Seconds())),
+		),
+		slog.String("route", c.FullPath()),
+		slogHeaders("headers", c.Request.Header),
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, slog.String("error", c.Errors.String()))
+	}
+	logger.LogAttrs(ctx, level, c.Request.Method+" "+c.Request.URL.Path, attrs...)
+}
+
+// slogHeaders is a group of headers, one value per header, with the values
+// of redacted headers replaced.
+func slogHeaders(key string, header http.Header) slog.Attr {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]any, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			value = redacted
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.Group(key, attrs...)
+}
+
+// recoverPanics is middleware that answers a request whose handler panicked
+// with 500 and logs the panic with its stack, in place of gin's recovery
+// that writes plain text.
+var recoverPanics = gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err any) {
+	slog.Default().ErrorContext(c.Request.Context(), fmt.Sprintf("panic: %v", err), slog.String("stack_trace", string(debug.Stack())))
+	c.AbortWithStatus(http.StatusInternalServerError)
+})
+
+// parseRedactedHeaders adds the comma separated headers of -log.redact.
+func parseRedactedHeaders(s string) {
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			redactedHeaders[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+)
+
+// logTo makes the default logger, and the log package, write JSON to a
+// buffer until the test ends.
+func logTo(t *testing.T, level slog.Leveler) *bytes.Buffer {
+	old, w, flags := slog.Default(), log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	})
+	var buf bytes.Buffer
+	slog.SetDefault(newLogger(&buf, level, "shop-prod"))
+	return &buf
+}
+
+// logEntries decodes the JSON lines logged to buf and empties it.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]any
+		assert.NilError(t, json.Unmarshal([]byte(line), &e), line)
+		entries = append(entries, e)
+	}
+	buf.Reset()
+	return entries
+}
+
+// go test -run TestLogRequests -v
+
+func TestLogRequests(t *testing.T) {
+	defer delete(redactedHeaders, "X-Store-Secret")
+	parseRedactedHeaders(" x-store-secret ,")
+	level := new(slog.LevelVar)
+	buf := logTo(t, level)
+	db := database{}
+	router := db.dbInit()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/item/A12T-4GH7-QPL9-3N4M", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("Cookie", "session=abc")
+	req.Header.Set("X-Admin-Token", "s3cret")
+	req.Header.Set("X-Store-Secret", "abc")
+	req.Header.Set("User-Agent", "scale/1.0")
+	req.Header.Set("X-Request-Id", "req-1")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(w, req)
+
+	entries := logEntries(t, buf)
+	assert.Equal(t, len(entries), 1)
+	e := entries[0]
+	assert.Equal(t, e["severity"], "INFO")
+	assert.Equal(t, e["message"], "GET /api/v1/item/A12T-4GH7-QPL9-3N4M")
+	assert.Assert(t, e["timestamp"] != nil)
+	assert.Assert(t, e["level"] == nil && e["msg"] == nil && e["time"] == nil)
+	assert.Equal(t, e["route"], "/api/v1/item/:code")
+	assert.Equal(t, e["request_id"], "req-1")
+	assert.Equal(t, e["logging.googleapis.com/trace"], "projects/shop-prod/traces/4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, e["logging.googleapis.com/spanId"], "00f067aa0ba902b7")
+	assert.Equal(t, e["logging.googleapis.com/trace_sampled"], true)
+	httpRequest := e["httpRequest"].(map[string]any)
+	assert.Equal(t, httpRequest["requestMethod"], "GET")
+	assert.Equal(t, httpRequest["status"], 200.0)
+	assert.Equal(t, httpRequest["userAgent"], "scale/1.0")
+	assert.Assert(t, strings.HasSuffix(httpRequest["latency"].(string), "s"))
+	headers := e["headers"].(map[string]any)
+	for _, name := range []string{"Authorization", "Cookie", "X-Admin-Token", "X-Store-Secret"} {
+		assert.Equal(t, headers[name], redacted, name)
+	}
+	assert.Equal(t, headers["User-Agent"], "scale/1.0")
+	assert.Assert(t, !strings.Contains(buf.String(), "s3cret"))
+
+	tests := []struct {
+		name         string
+		level        slog.Level
+		path         string
+		wantSeverity string
+	}{
+		{name: "info", level: slog.LevelInfo, path: "/api/v1/ping", wantSeverity: "INFO"},
+		{name: "client error", level: slog.LevelInfo, path: "/no/such/path", wantSeverity: "WARNING"},
+		{name: "info at warn", level: slog.LevelWarn, path: "/api/v1/ping"},
+		{name: "client error at warn", level: slog.LevelWarn, path: "/no/such/path", wantSeverity: "WARNING"},
+		{name: "client error at error", level: slog.LevelError, path: "/no/such/path"},
+	}
+	for _, tc := range tests {
+		level.Set(tc.level)
+		routerPOSTReq("GET", tc.path, nil, router)
+		entries := logEntries(t, buf)
+		if tc.wantSeverity == "" {
+			assert.Equal(t, len(entries), 0, tc.name)
+			continue
+		}
+		assert.Equal(t, len(entries), 1, tc.name)
+		assert.Equal(t, entries[0]["severity"], tc.wantSeverity, tc.name)
+		assert.Assert(t, entries[0]["request_id"] != "", tc.name)
+	}
+}
+
+// go test -run TestLogPanics -v
+
+func TestLogPanics(t *testing.T) {
+	buf := logTo(t, slog.LevelInfo)
+	router := gin.New()
+	router.Use(requestID, logRequests, recoverPanics)
+	router.GET("/boom", func(c *gin.Context) { panic("boom") })
+
+	w := routerPOSTReq("GET", "/boom", nil, router)
+	assert.Equal(t, w.Code, http.StatusInternalServerError)
+	entries := logEntries(t, buf)
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, entries[0]["severity"], "ERROR")
+	assert.Equal(t, entries[0]["message"], "panic: boom")
+	assert.Assert(t, strings.Contains(entries[0]["stack_trace"].(string), "TestLogPanics"))
+	assert.Equal(t, entries[0]["request_id"], entries[1]["request_id"])
+	assert.Equal(t, entries[1]["severity"], "ERROR")
+	assert.Equal(t, entries[1]["httpRequest"].(map[string]any)["status"], 500.0)
+
+	log.Printf("reorder alert for %s", "A12T-4GH7-QPL9-3N4M") // the log package writes through the default logger
+	entries = logEntries(t, buf)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0]["severity"], "INFO")
+	assert.Equal(t, entries[0]["message"], "reorder alert for A12T-4GH7-QPL9-3N4M")
+}
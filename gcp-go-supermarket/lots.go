@@ -0,0 +1,253 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Binding from JSON with POST.
+// Lot is a batch of an item received together from one supplier.
+type Lot struct {
+	LotNumber  string    `json:"lot" binding:"omitempty,alphanum"`              // LotNumber is generated from the received date when omitted
+	Supplier   string    `json:"supplier" binding:"omitempty,alphanumandspace"` // Supplier is the grower or distributor the lot came from
+	ReceivedAt time.Time `json:"received"`                                      // ReceivedAt defaults to the time the lot is posted
+	BestBefore time.Time `json:"best_before" binding:"required"`                // BestBefore is when the lot expires
+	Quantity   int       `json:"quantity" binding:"required,min=1"`             // Quantity is the number of units left in the lot
+}
+
+// lotPick is the quantity taken from a lot by a deduction.
+type lotPick struct {
+	LotNumber string `json:"lot"`
+	Quantity  int    `json:"quantity"`
+}
+
+// expiringLot is a lot listed by the expiring endpoint.
+type expiringLot struct {
+	ProduceCode string `json:"code"`
+	Name        string `json:"name"`
+	Lot
+}
+
+// lotQuantity returns the number of units held in lots.
+func lotQuantity(lots []Lot) int {
+	n := 0
+	for _, l := range lots {
+		n += l.Quantity
+	}
+	return n
+}
+
+// sortFEFO orders lots first-expired-first-out; lots expiring together are
+// ordered by the date they were received.
+func sortFEFO(lots []Lot) {
+	sort.SliceStable(lots, func(i, j int) bool {
+		if !lots[i].BestBefore.Equal(lots[j].BestBefore) {
+			return lots[i].BestBefore.Before(lots[j].BestBefore)
+		}
+		return lots[i].ReceivedAt.Before(lots[j].ReceivedAt)
+	})
+}
+
+// normalizeLots fills in lot defaults, orders the lots of item
+// first-expired-first-out and makes sure Stock covers the units in lots.
+// Stock above the lot total is stock that is not tracked by lot.
+func normalizeLots(item *Item, now time.Time) {
+	if len(item.Lots) == 0 {
+		return
+	}
+	lots := make([]Lot, len(item.Lots)) // copy, items share their lots slice with the caller
+	copy(lots, item.Lots)
+	for i := range lots {
+		if lots[i].ReceivedAt.IsZero() {
+			lots[i].ReceivedAt = now
+		}
+		if lots[i].LotNumber == "" {
+			day := lots[i].ReceivedAt.Format("20060102")
+			lots[i].LotNumber = newLotNumber(lots, func(n int) string { return fmt.Sprintf("%s%d", day, n) })
+		}
+	}
+	sortFEFO(lots)
+	item.Lots = lots
+	if n := lotQuantity(lots); item.Stock < n {
+		item.Stock = n
+	}
+}
+
+// newLotNumber returns number(n) for the lowest n from 1 that no lot of lots
+// has as its number, so that generated lot numbers never collide.
+func newLotNumber(lots []Lot, number func(n int) string) string {
+	used := make(map[string]bool, len(lots))
+	for _, l := range lots {
+		used[l.LotNumber] = true
+	}
+	for n := 1; ; n++ {
+		if s := number(n); !used[s] {
+			return s
+		}
+	}
+}
+
+// pickFEFO takes qty units from lots first-expired-first-out. It returns the
+// lots left over, which never share memory with lots, and the picks made.
+// When lots hold fewer than qty units the rest is untracked stock.
+func pickFEFO(lots []Lot, qty int) ([]Lot, []lotPick) {
+	left := make([]Lot, 0, len(lots))
+	picks := []lotPick{}
+	for _, l := range lots { // lots are kept in FEFO order, see normalizeLots
+		if qty > 0 {
+			n := l.Quantity
+			if n > qty {
+				n = qty
+			}
+			l.Quantity -= n
+			qty -= n
+			picks = append(picks, lotPick{LotNumber: l.LotNumber, Quantity: n})
+		}
+		if l.Quantity > 0 {
+			left = append(left, l)
+		}
+	}
+	return left, picks
+}
+
+// Receive Lot godoc
+// @Summary Receive Lot
+// @Schemes
+// @Description Receive a lot of an item. The lot quantity is added to the stock
+// @Tags stock
+// @Param        code   path      string  true  "Code"
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Router /stock/:code/lots [post]
+func (inv *inventory) receiveLot(c *gin.Context) {
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var lot Lot
+	if err := c.ShouldBindJSON(&lot); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	dbmux.Lock()
+	item, ok := inv.db[code]
+	if ok {
+		untracked := item.Stock - lotQuantity(item.Lots)
+		item.Lots = append(item.Lots[:len(item.Lots):len(item.Lots)], lot)
+		normalizeLots(&item, inv.evaluator.now())
+		item.Stock = untracked + lotQuantity(item.Lots)
+		inv.db.put(actorFrom(c), code, item)
+	}
+	dbmux.Unlock()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	inv.evaluator.evaluate()
+	c.JSON(http.StatusCreated, gin.H{"status": "lot received"})
+}
+
+// List Lots godoc
+// @Summary List Lots
+// @Schemes
+// @Description List the lots of an item, first-expired first
+// @Tags stock
+// @Param        code   path      string  true  "Code"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /stock/:code/lots [get]
+func (inv *inventory) lots(c *gin.Context) {
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	dbmux.Lock()
+	item, ok := inv.db[code]
+	dbmux.Unlock()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	c.JSON(http.StatusOK, append([]Lot{}, item.Lots...))
+}
+
+// Expiring godoc
+// @Summary Expiring Lots
+// @Schemes
+// @Description List lots whose best-before date is within the given duration (default 24h), including lots already expired
+// @Tags stock
+// @Param        within   query      string  false  "Duration, e.g. 48h"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /expiring [get]
+func (inv *inventory) expiring(c *gin.Context) {
+	within := 24 * time.Hour
+	if s := c.Query("within"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid within duration %q", s)})
+			return
+		}
+		within = d
+	}
+	cutoff := inv.evaluator.now().Add(within)
+
+	dbmux.Lock()
+	expiring := []expiringLot{}
+	for code, item := range inv.db {
+		for _, l := range item.Lots {
+			if !l.BestBefore.After(cutoff) {
+				expiring = append(expiring, expiringLot{ProduceCode: code, Name: item.Name, Lot: l})
+			}
+		}
+	}
+	dbmux.Unlock()
+
+	sort.Slice(expiring, func(i, j int) bool {
+		if !expiring[i].BestBefore.Equal(expiring[j].BestBefore) {
+			return expiring[i].BestBefore.Before(expiring[j].BestBefore)
+		}
+		if expiring[i].ProduceCode != expiring[j].ProduceCode {
+			return expiring[i].ProduceCode < expiring[j].ProduceCode
+		}
+		return expiring[i].LotNumber < expiring[j].LotNumber
+	})
+	c.JSON(http.StatusOK, expiring)
+}
@@ -0,0 +1,145 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestPickFEFO -v
+
+func TestPickFEFO(t *testing.T) {
+	day := time.Date(2022, 7, 8, 0, 0, 0, 0, time.UTC)
+	lots := []Lot{
+		{LotNumber: "A", BestBefore: day.AddDate(0, 0, 5), ReceivedAt: day, Quantity: 4},
+		{LotNumber: "B", BestBefore: day.AddDate(0, 0, 2), ReceivedAt: day, Quantity: 3},
+		{LotNumber: "C", BestBefore: day.AddDate(0, 0, 2), ReceivedAt: day.AddDate(0, 0, -1), Quantity: 2},
+	}
+	item := Item{Lots: lots}
+	normalizeLots(&item, day)
+	assert.Equal(t, item.Stock, 9)
+	assert.Equal(t, item.Lots[0].LotNumber, "C") // same best-before as B, received earlier
+	assert.Equal(t, lots[0].LotNumber, "A")      // the caller's slice is left alone
+
+	tests := map[string]struct {
+		qty       int
+		wantPicks []lotPick
+		wantLeft  int
+	}{
+		"first lot":     {qty: 1, wantPicks: []lotPick{{"C", 1}}, wantLeft: 3},
+		"across lots":   {qty: 6, wantPicks: []lotPick{{"C", 2}, {"B", 3}, {"A", 1}}, wantLeft: 1},
+		"all lots":      {qty: 9, wantPicks: []lotPick{{"C", 2}, {"B", 3}, {"A", 4}}, wantLeft: 0},
+		"untracked too": {qty: 12, wantPicks: []lotPick{{"C", 2}, {"B", 3}, {"A", 4}}, wantLeft: 0},
+	}
+	for name, tc := range tests {
+		left, picks := pickFEFO(item.Lots, tc.qty)
+		assert.DeepEqual(t, picks, tc.wantPicks)
+		assert.Equal(t, len(left), tc.wantLeft, name)
+		assert.Equal(t, lotQuantity(item.Lots), 9, name)
+	}
+}
+
+// go test -run TestLotNumbers -v
+
+func TestLotNumbers(t *testing.T) {
+	day := time.Date(2022, 7, 8, 0, 0, 0, 0, time.UTC)
+	item := Item{Lots: []Lot{{BestBefore: day.AddDate(0, 0, 2), Quantity: 1}}}
+	normalizeLots(&item, day)
+	assert.Equal(t, item.Lots[0].LotNumber, "202207081")
+
+	// The first lot sold out, a second and a third are received the same
+	// day: neither may take the number of the lot still held.
+	item.Lots = append(item.Lots, Lot{BestBefore: day.AddDate(0, 0, 3), Quantity: 1})
+	normalizeLots(&item, day)
+	item.Lots = append(item.Lots[1:], Lot{BestBefore: day.AddDate(0, 0, 4), Quantity: 1})
+	normalizeLots(&item, day)
+	assert.Equal(t, item.Lots[0].LotNumber, "202207082")
+	assert.Equal(t, item.Lots[1].LotNumber, "202207081")
+
+	item.Lots = []Lot{{LotNumber: "202207081", BestBefore: day, Quantity: 1}, {BestBefore: day, Quantity: 1}}
+	normalizeLots(&item, day)
+	assert.Equal(t, item.Lots[1].LotNumber, "202207082")
+}
+
+// go test -run TestLots -v
+
+func TestLots(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	now := time.Now().UTC().Truncate(time.Second)
+	at := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "untracked stock", method: "POST", path: "/api/v1/stock/E5T6-9UI3-TH15-QR88", jsonData: []byte(`{"stock": 2}`), wantCode: 200, wantResult: `{"status":"stock updated"}`},
+		{name: "receive late lot", method: "POST", path: "/api/v1/stock/E5T6-9UI3-TH15-QR88/lots", jsonData: []byte(fmt.Sprintf(`{"lot":"P2","supplier":"Sunny Farms","received":"%s","best_before":"%s","quantity":10}`, at(-time.Hour), at(72*time.Hour))), wantCode: 201, wantResult: `{"status":"lot received"}`},
+		{name: "receive early lot", method: "POST", path: "/api/v1/stock/E5T6-9UI3-TH15-QR88/lots", jsonData: []byte(fmt.Sprintf(`{"lot":"P1","supplier":"Orchard Co","received":"%s","best_before":"%s","quantity":5}`, at(-48*time.Hour), at(20*time.Hour))), wantCode: 201, wantResult: `{"status":"lot received"}`},
+		{name: "stock counts lots", method: "GET", path: "/api/v1/stock/E5T6-9UI3-TH15-QR88", wantCode: 200, wantResult: `{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","stock":17,"reorder_point":0,"avg_daily_sales":0,"low":false}`},
+		{name: "fefo sale", method: "POST", path: "/api/v1/stock/E5T6-9UI3-TH15-QR88/sale", jsonData: []byte(`{"quantity": 7}`), wantCode: 200, wantResult: `{"picked":[{"lot":"P1","quantity":5},{"lot":"P2","quantity":2}],"status":"sale recorded"}`},
+		{name: "lots", method: "GET", path: "/api/v1/stock/E5T6-9UI3-TH15-QR88/lots", wantCode: 200, wantResult: fmt.Sprintf(`[{"lot":"P2","supplier":"Sunny Farms","received":"%s","best_before":"%s","quantity":8}]`, at(-time.Hour), at(72*time.Hour))},
+		{name: "lettuce lot", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M/lots", jsonData: []byte(fmt.Sprintf(`{"lot":"L1","received":"%s","best_before":"%s","quantity":3}`, at(-time.Hour), at(30*time.Hour))), wantCode: 201, wantResult: `{"status":"lot received"}`},
+		{name: "expiring default", method: "GET", path: "/api/v1/expiring", wantCode: 200, wantResult: `[]`},
+		{name: "expiring 48h", method: "GET", path: "/api/v1/expiring?within=48h", wantCode: 200, wantResult: fmt.Sprintf(`[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","lot":"L1","supplier":"","received":"%s","best_before":"%s","quantity":3}]`, at(-time.Hour), at(30*time.Hour))},
+		{name: "bad within", method: "GET", path: "/api/v1/expiring?within=2d", wantCode: 400, wantResult: `{"error":"invalid within duration \"2d\""}`},
+		{name: "missing best before", method: "POST", path: "/api/v1/stock/E5T6-9UI3-TH15-QR88/lots", jsonData: []byte(`{"quantity":5}`), wantCode: 400, wantResult: `{"error":"Key: 'Lot.BestBefore' Error:Field validation for 'BestBefore' failed on the 'required' tag"}`},
+		{name: "not found", method: "GET", path: "/api/v1/stock/Z5T6-9UI3-TH15-QR88/lots", wantCode: 200, wantResult: `{"error":"code not found"}`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
+
+func TestAddWithLots(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	got := routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","price":"1.99","lots":[{"lot":"X1","best_before":"2022-07-12T00:00:00Z","quantity":4},{"lot":"X2","best_before":"2022-07-10T00:00:00Z","quantity":6}]}]`), router)
+	assert.Equal(t, got.Code, 201)
+	got = routerGETReq("GET", "/api/v1/stock/ZRT6-72AS-K736-L4AZ", router)
+	assert.Equal(t, got.Body.String(), `{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","stock":10,"reorder_point":0,"avg_daily_sales":0,"low":false}`)
+	got = routerPOSTReq("POST", "/api/v1/stock/ZRT6-72AS-K736-L4AZ", []byte(`{"stock": 5}`), router) // shrink writes off X2 first
+	assert.Equal(t, got.Code, 200)
+	got = routerGETReq("GET", "/api/v1/expiring?within=1h", router)
+	var expiring []expiringLot
+	assert.NilError(t, json.Unmarshal(got.Body.Bytes(), &expiring))
+	assert.Equal(t, len(expiring), 2)
+	assert.Equal(t, expiring[0].LotNumber, "X2")
+	assert.Equal(t, expiring[0].Quantity, 1)
+	assert.Equal(t, expiring[1].LotNumber, "X1")
+	assert.Equal(t, expiring[1].Quantity, 4)
+	assert.Assert(t, !expiring[1].ReceivedAt.IsZero())
+}
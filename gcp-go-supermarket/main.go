@@ -23,13 +23,21 @@ package main
 // SOFTWARE.
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -59,6 +67,47 @@ type Item struct {
 	ProduceCode string `json:"code" binding:"required,isproducecode"`    // ProduceCode is a UUID
 	Name        string `json:"name" binding:"required,alphanumandspace"` // Name is a string with only alphanumeric characters and spaces
 	UnitPrice   string `json:"price" binding:"required,isunitprice"`     // UnitPrice is a number with up to 2 decimal places (e.g. $3.41)
+
+	Stock        int    `json:"stock,omitempty" binding:"omitempty,min=0"`                 // Stock is the number of units on hand
+	ReorderPoint int    `json:"reorder_point,omitempty" binding:"omitempty,min=0"`         // ReorderPoint is the stock level at or below which a reorder is suggested; 0 disables alerts
+	Unit         string `json:"unit,omitempty" binding:"omitempty,oneof=each lb kg bunch"` // Unit is the unit of measure UnitPrice is per; empty means each
+	TaxClass     string `json:"tax_class,omitempty" binding:"omitempty,isslug"`            // TaxClass selects the sales tax rate, e.g. grocery; empty means standard
+	Lots         []Lot  `json:"lots,omitempty" binding:"omitempty,dive"`                   // Lots are kept first-expired-first-out; Stock above their total is not tracked by lot
+
+	UPC string `json:"upc,omitempty" binding:"omitempty,isupca"`  // UPC is the 12 digit UPC-A barcode
+	EAN string `json:"ean,omitempty" binding:"omitempty,isean13"` // EAN is the 13 digit EAN-13 barcode
+	PLU string `json:"plu,omitempty" binding:"omitempty,isplu"`   // PLU is the 4 or 5 digit price look-up code keyed by cashiers
+
+	Category   string         `json:"category,omitempty" binding:"omitempty,isslug"` // Category is the ID of the item's category in the product taxonomy
+	Attributes map[string]any `json:"attributes,omitempty"`                          // Attributes are custom attributes typed by the category, e.g. organic, variety
+
+	Nutrition *Nutrition `json:"nutrition,omitempty"`                                            // Nutrition is the optional nutrition facts panel
+	Allergens []string   `json:"allergens,omitempty" binding:"omitempty,unique,dive,isallergen"` // Allergens are the allergens the item contains, e.g. tree_nuts
+	Dietary   []string   `json:"dietary,omitempty" binding:"omitempty,unique,dive,isdietary"`    // Dietary are dietary flags such as vegan or gluten_free
+
+	Markdown *Markdown `json:"markdown,omitempty" binding:"-"` // Markdown is the near-expiry price computed at read time, see markdownFor
+}
+
+// itemView returns the public view of item v stored under code: the
+// catalog fields without the inventory fields, plus the markdown in effect
+// at now, which is computed at read time from the lots' best-before dates.
+func itemView(code string, v Item, now time.Time) Item {
+	var item Item
+	item.ProduceCode = code
+	item.Name = v.Name
+	item.UnitPrice = v.UnitPrice
+	item.Unit = v.Unit
+	item.TaxClass = v.TaxClass
+	item.UPC = v.UPC
+	item.EAN = v.EAN
+	item.PLU = v.PLU
+	item.Category = v.Category
+	item.Attributes = v.Attributes
+	item.Nutrition = v.Nutrition
+	item.Allergens = v.Allergens
+	item.Dietary = v.Dietary
+	item.Markdown = markdownFor(v, markdownRules, now)
+	return item
 }
 
 // URL binding
@@ -69,6 +118,46 @@ type ProduceId struct {
 
 //
 
+// registerValidators registers the custom validation tags with gin's
+// validator. Fixtures are validated before a router exists, so it is not
+// left to setupRouter alone.
+func registerValidators() {
+	if _, ok := binding.Validator.(countingValidator); !ok { // Validation failures are counted by tag, see metrics.go.
+		binding.Validator = countingValidator{binding.Validator}
+	}
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { // Get the validator instance from the binding.Validator.Engine(). It is a pointer to the validator.Validate.
+		v.RegisterValidation("isproducecode", IsProduceCode) // Register the validation function IsProduceCode with the validator.Validate instance. The validation function is called when the field is validated.
+	}
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { // Alternate identifiers: barcodes with their check digit and cashier keyed PLUs.
+		v.RegisterValidation("isupca", IsUPCA)
+		v.RegisterValidation("isean13", IsEAN13)
+		v.RegisterValidation("isplu", IsPLU)
+	}
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { //  Get the validator instance from the binding.Validator.Engine(). It is a pointer to the validator.Validate.
+		v.RegisterValidation("alphanumandspace", isAlphaNumericAndSpace) // Register the validation function isAlphaNumericAndSpace with the validator.Validate instance. The validation function is called when the field is validated.
+	}
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { //  Get the validator instance from the binding.Validator.Engine(). It is a pointer to the validator.Validate. The validator.Validate instance is used to validate the fields of the struct.
+		v.RegisterValidation("isunitprice", IsUnitPrice) //  Register the validation function IsUnitPrice with the validator.Validate instance. The validation function is called when the field is validated.
+	}
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterValidation("isweight", isWeight) // Register the validation function isWeight for weights reported by scales.
+	}
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { // Allergen and dietary flags of the nutrition data.
+		v.RegisterValidation("isallergen", IsAllergen)
+		v.RegisterValidation("isdietary", IsDietaryFlag)
+	}
+
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterValidation("isslug", isSlug) // Register the validation function isSlug for category and attribute IDs.
+	}
+}
+
 // setupRouter is a function that creates a gin.Engine and sets up the routes. It returns the gin.Engine. It is called by main. It is not exported.
 //
 // .setupRouter
@@ -84,30 +173,128 @@ func (db database) setupRouter() *gin.Engine { // db is the database map that is
 	// r := gin.New()
 	// r.Use(gin.Recovery())
 
-	r := gin.Default() // Create a new gin.Engine.
-
-	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { // Get the validator instance from the binding.Validator.Engine(). It is a pointer to the validator.Validate.
-		v.RegisterValidation("isproducecode", IsProduceCode) // Register the validation function IsProduceCode with the validator.Validate instance. The validation function is called when the field is validated.
-	}
-
-	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { //  Get the validator instance from the binding.Validator.Engine(). It is a pointer to the validator.Validate.
-		v.RegisterValidation("alphanumandspace", isAlphaNumericAndSpace) // Register the validation function isAlphaNumericAndSpace with the validator.Validate instance. The validation function is called when the field is validated.
-	}
-
-	if v, ok := binding.Validator.Engine().(*validator.Validate); ok { //  Get the validator instance from the binding.Validator.Engine(). It is a pointer to the validator.Validate. The validator.Validate instance is used to validate the fields of the struct.
-		v.RegisterValidation("isunitprice", IsUnitPrice) //  Register the validation function IsUnitPrice with the validator.Validate instance. The validation function is called when the field is validated.
+	r := gin.New()                                          // Create a new gin.Engine.
+	r.SetTrustedProxies(trustedProxies)                     // The client IP is the peer's unless it is a trusted proxy, see -trusted.proxies; checked by main.
+	r.TrustedPlatform = trustedPlatform                     // Or the header the platform sets, see -trusted.platform.
+	r.Use(requestID)                                        // Every request gets an ID, see requestID; changes are audited with it.
+	r.Use(traceRequests(tracerProvider.Tracer(tracerName))) // A span per request, see tracing.go.
+	r.Use(logRequests)                                      // A JSON log entry per request, see logging.go.
+	r.Use(instrument)                                       // Request counts and latencies by route, served on /metrics.
+	r.Use(recoverPanics)                                    // A panic answers 500 and is logged; the middleware above see the 500.
+
+	registerValidators() // The custom validation tags used by the binding structs.
+
+	r.GET("/metrics", metricsHandler(newMetricsRegistry(db))) // Prometheus metrics, see metrics.go.
+	r.GET("/healthz", livenessChecks.serve)                   // Probes, see health.go.
+	r.GET("/readyz", readinessChecks.serve)
+	r.GET("/startupz", startupChecks.serve)
+
+	categories := newCategoryTree(db) // The product taxonomy. Handlers of db reach it through the context, see categoriesFrom.
+	bin := newTrash(db)               // Deleted items until they are purged. Handlers of db reach it through the context, see trashFrom.
+	if catalogEvents.len() > 0 {      // The taxonomy and the trash are projections of the events too, see dbInit.
+		for _, p := range []projection{categories, bin} {
+			if err := catalogEvents.replay(p, time.Time{}); err != nil {
+				panic(err) // The events were checked when the store was opened.
+			}
+		}
 	}
+	r.Use(func(c *gin.Context) {
+		c.Set(categoriesKey, categories)
+		c.Set(trashKey, bin)
+	})
 
 	r.GET("/api/v1/ping", ping) // Create a new route for the GET method on the /ping path. The handler function is called when the route is matched.  The handler function is a closure that accepts a context.Context as its only parameter.  The handler function returns a gin.H. The gin.H is a map of key/value pairs that are used to create the response. The response is sent to the client. The handler is called when the route is matched.
 
 	r.GET("/api/v1/items", db.items)
 
-	r.POST("/api/v1/add", db.add)
+	keys := newIdempotencyKeys(idempotencyTTL) // Responses kept for retries with the same Idempotency-Key.
+	r.POST("/api/v1/add", keys.idempotent, db.add)
 
 	// This handler will match /item/A12T-4GH7-QPL9-3N4M but will not match /item/ or /item
 	r.GET("/api/v1/item/:code", db.itemCode)
 
+	// This handler resolves a produce code, UPC-A, EAN-13 or PLU to its item.
+	r.GET("/api/v1/lookup/:id", db.lookup)
+
+	r.GET("/api/v1/categories", categories.list)
+	r.POST("/api/v1/categories", categories.add)
+	r.GET("/api/v1/category/:id", categories.get)
+	r.POST("/api/v1/category/:id", categories.update)
+	r.DELETE("/api/v1/category/:id", categories.delete)
+	r.POST("/api/v1/item/:code/category", categories.assign)
+
 	r.GET("/api/v1/delete/:code", db.deleteCode)
+	r.GET("/api/v1/audit", catalogAudit.list) // Who changed which item, when and how.
+	r.GET("/api/v1/audit/verify", catalogAudit.verifyChain)
+	r.GET("/api/v1/item/:code/events", catalogEvents.stream) // The item's domain events, see events.go.
+	r.GET("/api/v1/trash", bin.list)
+	r.POST("/api/v1/item/:code/restore", bin.restore)
+	if trashRetention > 0 && trashPurgeInterval > 0 { // The purge job is only started when configured, see main.
+		backgroundJobs.start(func(ctx context.Context) { bin.run(ctx, trashPurgeInterval) })
+	}
+
+	r.POST("/api/v1/price-quote", db.priceQuote) // Deli scales price a measured weight of an item sold by lb or kg.
+
+	r.GET("/api/v1/export", db.export)       // Streams the catalog as CSV or JSON Lines.
+	r.POST("/api/v1/import", db.importItems) // Streams a CSV or JSON Lines file into the catalog.
+
+	inv := newInventory(db, newNotifier()) // Stock levels, sales history and reorder alerts for the items in db.
+	r.GET("/api/v1/stock/:code", inv.stockCode)
+	r.POST("/api/v1/stock/:code", inv.setStock)
+	r.POST("/api/v1/stock/:code/sale", inv.sale)
+	r.GET("/api/v1/stock/:code/lots", inv.lots)
+	r.POST("/api/v1/stock/:code/lots", inv.receiveLot)
+	r.GET("/api/v1/expiring", inv.expiring)
+	r.GET("/api/v1/reorder", inv.reorder)
+	if reorderInterval > 0 { // The background evaluator is only started when configured, see main.
+		backgroundJobs.start(func(ctx context.Context) { inv.evaluator.run(ctx, reorderInterval) })
+	}
+
+	procure := newProcurement(db, inv) // Suppliers, their item costs and purchase orders that restock inventory.
+	r.GET("/api/v1/suppliers", procure.listSuppliers)
+	r.POST("/api/v1/suppliers", procure.addSupplier)
+	r.GET("/api/v1/supplier/:id", procure.getSupplier)
+	r.POST("/api/v1/supplier/:id/items", procure.mapItems)
+	r.GET("/api/v1/margins", procure.margins)
+	r.GET("/api/v1/purchase-orders", procure.listOrders)
+	r.POST("/api/v1/purchase-orders", procure.createOrder)
+	r.GET("/api/v1/purchase-order/:id", procure.getOrder)
+	r.POST("/api/v1/purchase-order/:id/send", procure.sendOrder)
+	r.POST("/api/v1/purchase-order/:id/receive", procure.receiveOrder)
+
+	promotions := newPromotionStore(categories)
+	r.GET("/api/v1/promotions", promotions.list)
+	r.POST("/api/v1/promotions", promotions.add)
+	r.DELETE("/api/v1/promotion/:id", promotions.delete)
+
+	prices := newPricer(db, promotions) // Markdowns, promotions and tax on baskets of items.
+	r.POST("/api/v1/price-basket", prices.priceBasket)
+	r.GET("/api/v1/tax/rates", getTaxRates)
+
+	carts := newCartStore(prices) // Open carts, priced against the live catalog on every read.
+	r.POST("/api/v1/carts", carts.create)
+	r.GET("/api/v1/cart/:id", carts.get)
+	r.POST("/api/v1/cart/:id/lines", carts.addLine)
+	r.DELETE("/api/v1/cart/:id/lines/:code", carts.removeLine)
+
+	orders := newOrderBook(prices, carts) // Orders snapshot the priced basket at checkout.
+	r.POST("/api/v1/orders", orders.create)
+	r.GET("/api/v1/order/:id", orders.get)
+	r.POST("/api/v1/order/:id/pay", orders.pay)
+	r.POST("/api/v1/order/:id/refund", orders.refund)
+	r.GET("/api/v1/order/:id/receipt", orders.receipt)
+	r.POST("/api/v1/order/:id/returns", orders.returnItems)
+	r.GET("/api/v1/order/:id/returns", orders.returns)
+	r.GET("/api/v1/credit-note/:id", orders.creditNote)
+
+	backups := newBackups(db, backupStore, catalogJournal, bin, categories) // Catalog snapshots and point-in-time restores, see -backup.to.
+	r.GET("/api/v1/backups", backups.listBackups)
+	r.POST("/api/v1/backups", backups.takeBackup)
+	r.POST("/api/v1/restore", backups.restoreCatalog)
+	if backupStore != nil && backupInterval > 0 { // Scheduled backups are only taken when configured, see main.
+		backgroundJobs.start(func(ctx context.Context) { backups.run(ctx, backupInterval) })
+	}
+
 	r.NoRoute(func(c *gin.Context) {
 		res := "endpoint not found"
 		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": res}) // The response is sent to the client. The response is a JSON with the status code and the error. The status code is 405 and the error is the value of the method is not allowed.
@@ -134,7 +321,10 @@ func ping(c *gin.Context) { // Create a new route for the GET method on the /pin
 // items godoc
 // @Summary List Items
 // @Schemes
-// @Description List all items
+// @Description List all items. Items with a lot nearing its best-before date show a markdown price and the rule that fired
+// @Param        category   query      string  false  "Only items in this category or its descendants"
+// @Param        exclude_allergens   query      string  false  "Comma separated allergens, e.g. peanuts,tree_nuts. Items without allergen data are included"
+// @Param        include_deleted   query      bool  false  "Also list deleted items with their deleted_at; admins only, see X-Admin-Token"
 // @Tags example
 // @Accept json
 // @Produce json
@@ -152,21 +342,64 @@ func (db database) items(c *gin.Context) { // Create a new route for the GET met
 	// the keys explicitly, for instance, using the Strings
 	// function from the sort package if the keys are strings.
 	//
+	var inCategory map[string]bool           // The category filter and its descendant categories; nil lists all items.
+	if id := c.Query("category"); id != "" { // Resolve the category before locking the database, see categoryTree.
+		if inCategory = categoriesFrom(c).subtree(id); inCategory == nil {
+			c.JSON(http.StatusOK, gin.H{"error": "category not found"})
+			return
+		}
+	}
+	excluded, err := parseAllergenFilter(c.Query("exclude_allergens")) // Items declaring one of these allergens are left out.
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	include, ok := includeDeleted(c) // Admins can list deleted items too, see trash.
+	if !ok {
+		return
+	}
+	keep := func(item Item) bool {
+		if inCategory != nil && !inCategory[item.Category] {
+			return false // Not in the requested category or one of its descendants.
+		}
+		return !containsAllergen(item, excluded) // Leave out items containing an excluded allergen.
+	}
+
 	dbmux.Lock()         // Lock the database map. The database map is a pointer to the database map.
 	defer dbmux.Unlock() // Unlock the database map.
+	now := time.Now()    // The markdowns of all items are computed at the same instant.
 	var keys []string    // Create a new slice of strings.  The slice is used to store the keys of the database map. The slice is created empty.
 	for k := range db {  // For each key in the database map.  The key is a string. The key is assigned to k.
-		keys = append(keys, k) // The key is appended to the slice of keys.
+		if keep(db[k]) {
+			keys = append(keys, k) // The key is appended to the slice of keys.
+		}
+	}
+	if include {
+		bin := trashFrom(c)
+		for k, v := range bin.items {
+			if _, ok := db[k]; !ok && keep(v.item) { // A code reused since it was deleted lists the live item.
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var listing []deletedItem
+		for _, k := range keys {
+			if v, ok := db[k]; ok {
+				listing = append(listing, deletedItem{Item: itemView(k, v, now)})
+			} else {
+				listing = append(listing, bin.view(k, now))
+			}
+		}
+		c.JSON(http.StatusOK, listing)
+		return
 	}
 	sort.Strings(keys)       // Sort the keys of the database map. The keys are sorted in alphabetical order.
 	var items []Item         // Create a new slice of Items. The slice is used to store the items of the database map. The slice is created empty.
 	for _, k := range keys { // For each key in the database map.  The key is a string. The key is assigned to k.
-		v := db[k]                   // Get the value of the key from the database map. The value is assigned to v.
-		var item Item                // Create a new Item. The Item is used to store the item of the database map. The Item is created empty.
-		item.ProduceCode = k         // Set the ProduceCode of the Item to the key. The key is a string. The key is assigned to k. The key is assigned to the ProduceCode of the Item.
-		item.Name = v.Name           // Set the Name of the Item to the value. The value is a string. The value is assigned to v. The value is assigned to the Name of the Item.
-		item.UnitPrice = v.UnitPrice // Set the UnitPrice of the Item to the value. The value is a string. The value is assigned to v. The value is assigned to the UnitPrice of the Item.
-		items = append(items, item)  // Append the Item to the slice of Items. The Item is added to the slice of Items.
+		v := db[k]                  // Get the value of the key from the database map. The value is assigned to v.
+		item := itemView(k, v, now) // Build the public view of the item, without its inventory fields.
+		items = append(items, item) // Append the Item to the slice of Items. The Item is added to the slice of Items.
 	}
 	c.JSON(http.StatusOK, items) // The response is sent to the client. The response is a JSON with the status code and the items. The status code is 200 and the items are the items of the database map.
 }
@@ -178,6 +411,7 @@ func (db database) items(c *gin.Context) { // Create a new route for the GET met
 // @Tags example
 // @Accept json
 // @Produce json
+// @Param Idempotency-Key header string false "replays the first response to retries with the same key"
 // @Success 200 {string} ok
 // @Failure 400 {string} error
 // @Router /add [post]
@@ -186,6 +420,19 @@ func (db database) add(c *gin.Context) { // Create a new route for the POST meth
 	if err := c.ShouldBindJSON(&items); err != nil { // ShouldBindJSON is a shortcut for c.ShouldBindWith(obj, binding.JSON).
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // The response is sent to the client. The response is a JSON with the status code and the error. The status code is 400 and the error is the error message.
 	} else {
+		categories := categoriesFrom(c)
+		categories.mu.Lock() // Held with dbmux, so neither the categories nor the identifiers in use change between the checks and the adds.
+		defer categories.mu.Unlock()
+		dbmux.Lock() // Adds are recorded in the journal in the order they are made.
+		defer dbmux.Unlock()
+		if err := db.identifierConflict(items); err != nil { // A UPC, EAN or PLU can only identify one item.
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := categories.checkItemsLocked(items); err != nil { // Categories must exist and declare the attributes.
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		itemsAdded := false          // Create a new boolean. The boolean is used to store the value of whether the items were added to the database map. The boolean is created with the value false. The boolean is assigned to itemsAdded.
 		for _, item := range items { // For each item in the slice of Items.
 			item.ProduceCode = strings.ToUpper(item.ProduceCode) // Set the ProduceCode of the item to the upper case of the ProduceCode of the item. The ProduceCode of the item is a string.
@@ -195,9 +442,11 @@ func (db database) add(c *gin.Context) { // Create a new route for the POST meth
 				c.JSON(http.StatusOK, gin.H{"status": res}) // The response is sent to the client. The response is a JSON with the status code and the status. The status code is 200 and the status is the value of the item that was not added to the database map.
 				break                                       // Break the for loop.
 			} else { // If the ProduceCode of the item is not in the database map.
-				item.UnitPrice = "$" + item.UnitPrice // Set the UnitPrice of the item to the value of the UnitPrice of the item. The UnitPrice of the item is a string.
-				db[item.ProduceCode] = item           // Set the map key to the value of the ProduceCode of the item. The map key is a string. The map key is assigned to the ProduceCode of the item. The value of the ProduceCode of the item is the item.
-				itemsAdded = true                     // Set the itemsAdded boolean to true.
+				item.UnitPrice = "$" + item.UnitPrice        // Set the UnitPrice of the item to the value of the UnitPrice of the item. The UnitPrice of the item is a string.
+				normalizeLots(&item, time.Now())             // Order the lots first-expired-first-out and count them in the stock.
+				item.Markdown = nil                          // Markdowns are computed at read time, never stored.
+				db.put(actorFrom(c), item.ProduceCode, item) // Set the map key to the value of the ProduceCode of the item. The map key is a string. The map key is assigned to the ProduceCode of the item. The value of the ProduceCode of the item is the item.
+				itemsAdded = true                            // Set the itemsAdded boolean to true.
 			}
 		}
 		if itemsAdded { // If the itemsAdded boolean is true.
@@ -210,9 +459,10 @@ func (db database) add(c *gin.Context) { // Create a new route for the POST meth
 // Get Item godoc
 // @Summary Get Item
 // @Schemes
-// @Description Get individual item by code like this: A12T-4GH7-QPL9-3N4M
+// @Description Get individual item by code like this: A12T-4GH7-QPL9-3N4M. Items with a lot nearing its best-before date show a markdown price and the rule that fired
 // @Tags example
 // @Param        code   path      string  true  "Code"
+// @Param        include_deleted   query      bool  false  "Also get a deleted item with its deleted_at; admins only, see X-Admin-Token"
 // @Accept json
 // @Produce json
 // @Success 200 {string} ok
@@ -220,6 +470,10 @@ func (db database) add(c *gin.Context) { // Create a new route for the POST meth
 // @Router /item/:code [get]
 func (db database) itemCode(c *gin.Context) { // Create a new route for the GET method on the /item/:code path. The handler function is called when the route is matched.  The handler function is a closure that accepts a context.Context as its only parameter.  The handler function returns a gin.H. The gin.H is a map of key/value pairs that are used to create the response. The response is sent to the client. The handler is called when the route is matched.
 	//localhost:8080/api/v1/item/A12T-4GH7-QPL9-3N4M
+	include, ok := includeDeleted(c) // Admins can get a deleted item too, see trash.
+	if !ok {
+		return
+	}
 	dbmux.Lock()         // Lock the database map.
 	defer dbmux.Unlock() // Unlock the database map.
 
@@ -230,15 +484,15 @@ func (db database) itemCode(c *gin.Context) { // Create a new route for the GET
 		code := c.Param("code")      // Create a new string. The string is created with the value of the ProduceCode of the item. The string is assigned to code.
 		code = strings.ToUpper(code) // Set the ProduceCode of the item to the upper case of the ProduceCode of the item. The ProduceCode of the item is a string.
 		v, ok := db[code]            // Get the value of the ProduceCode of the item from the database map. The value of the ProduceCode of the item is a Item. The value of the ProduceCode of the item is assigned to v. The value of the ProduceCode of the item is assigned to the Item.
-		if !ok {                     // If the value of the ProduceCode of the item is not in the database map.
+		bin := trashFrom(c)
+		if _, deleted := bin.items[code]; !ok && deleted && include { // Admins can see a deleted item, see trash.
+			c.JSON(http.StatusOK, bin.view(code, time.Now()))
+		} else if !ok { // If the value of the ProduceCode of the item is not in the database map.
 			res := `code not found`                    // Create a new string. The string is created with the value of the item that was not found in the database map. The string is assigned to res.
 			c.JSON(http.StatusOK, gin.H{"error": res}) // The response is sent to the client. The response is a JSON with the status code and the error. The status code is 200 and the error is the value of the item that was not found in the database map.
 		} else { // If the value of the ProduceCode of the item is in the database map.
-			var item Item                // Create a new Item. The Item is used to store the value of the item that was found in the database map. The Item is created empty. The Item is assigned to item.
-			item.ProduceCode = code      // Set the ProduceCode of the item to the value of the ProduceCode of the item. The ProduceCode of the item is a string.
-			item.Name = v.Name           // Set the Name of the item to the value of the Name of the item. The Name of the item is a string.
-			item.UnitPrice = v.UnitPrice // Set the UnitPrice of the item to the value of the UnitPrice of the item. The UnitPrice of the item is a string. The UnitPrice of the item is assigned to the Item.
-			c.JSON(http.StatusOK, item)  // The response is sent to the client. The response is a JSON with the status code and the item. The status code is 200 and the item is the value of the item that was found in the database map.
+			item := itemView(code, v, time.Now()) // Build the public view of the item, without its inventory fields.
+			c.JSON(http.StatusOK, item)           // The response is sent to the client. The response is a JSON with the status code and the item. The status code is 200 and the item is the value of the item that was found in the database map.
 		}
 	}
 }
@@ -246,7 +500,7 @@ func (db database) itemCode(c *gin.Context) { // Create a new route for the GET
 // Get Item godoc
 // @Summary Get Item
 // @Schemes
-// @Description Get individual item by code
+// @Description Delete individual item by code. The item is moved to the trash, from which it can be restored until it is purged
 // @Tags example
 // @Accept json
 // @Produce json
@@ -267,7 +521,7 @@ func (db database) deleteCode(c *gin.Context) { // Create a new route for the GE
 			res := `code not found`                    // Create a new string. The string is created with the value of the item that was not found in the database map. The string is assigned to res.
 			c.JSON(http.StatusOK, gin.H{"error": res}) // The response is sent to the client. The response is a JSON with the status code and the error. The status code is 200 and the error is the value of the item that was not found in the database map. The response is sent to the client. The response is a JSON with the status code and the error. The status code is 200 and the error is the value of the item that was not found in the database map.
 		} else { // If the value of the ProduceCode of the item is in the database map.
-			delete(db, code)                                       // Delete the value of the ProduceCode of the item from the database map. The value of the ProduceCode of the item is a Item. The value of the ProduceCode of the item is assigned to v. The value of the ProduceCode of the item is assigned to the Item. The value of the ProduceCode of the item is deleted from the database map.
+			trashFrom(c).deleteItem(actorFrom(c), code)            // Move the item to the trash, from which it can be restored until it is purged.
 			c.JSON(http.StatusOK, gin.H{"status": "item deleted"}) // The response is sent to the client. The response is a JSON with the status code and the status. The status code is 200 and the status is the value of the item that was deleted from the database map.
 		}
 	}
@@ -285,28 +539,32 @@ func (db database) deleteCode(c *gin.Context) { // Create a new route for the GE
 // ----
 // tag::dbInit[]
 func (db database) dbInit() *gin.Engine {
-	/* load test data */
-	// Initialize initial data:
-	var item Item                              // Create a new Item. The Item is used to store the value of the item that was found in the database map. The Item is created empty. The Item is assigned to item.
-	item.Name = "Lettuce"                      //  Set the Name of the item to the value of the Name of the item. The Name of the item is a string. The Name of the item is assigned to the Item. The Name of the item is "Lettuce".
-	item.UnitPrice = "$3.41"                   // Set the UnitPrice of the item to the value of the UnitPrice of the item. The UnitPrice of the item is a string. The UnitPrice of the item is assigned to the Item. The UnitPrice of the item is "$3.41". The UnitPrice of the item is assigned to the Item.
-	db = database{"A12T-4GH7-QPL9-3N4M": item} // Set the database map to the value of the database map. The database map is a map. The database map is assigned to db. The database map is assigned to the database map.  The database map is initialized with the key of the item and the value of the item. The key of the item is a string. The value of the item is a Item. The key of the item is assigned to the Item. The value of the item is assigned to the Item. The key of the item is assigned to the database map. The value of the item is assigned to the database map.
-
-	item.Name = "Peach"
-	item.UnitPrice = "$2.99"
-	db["E5T6-9UI3-TH15-QR88"] = item
-
-	item.Name = "Green Pepper"
-	item.UnitPrice = "$0.79"
-	db["YRT6-72AS-K736-L4AR"] = item
-
-	item.Name = "Gala Apple"
-	item.UnitPrice = "$3.59"
-	db["TQ4C-VV6T-75ZX-1RMR"] = item
-	//
+	/* load seed data */
+	fixture := seedFixture // The fixture selected with -seed, see loadFixture.
+	if fixture == nil {
+		var err error
+		if fixture, err = loadFixture(fixtureTest); err != nil {
+			panic(err) // The built in fixtures are checked by the tests.
+		}
+	}
+	if catalogEvents.len() > 0 { // The catalog is a projection of the events recorded so far, see events.go.
+		db = database{}
+		if err := catalogEvents.replay(db, time.Time{}); err != nil {
+			panic(err) // The events were checked when the store was opened.
+		}
+	} else {
+		db = fixture.database(time.Now()) // The catalog as the add endpoint would have stored the fixture's items.
+		catalogEvents.seed(db)            // A new event store starts with the seed items.
+	}
 	// log.Printf("dbInit:%v", db)
 
-	return db.setupRouter() // Return the router. The router is a Gin engine.
+	seedLoaded.Store(true) // See the seed probe check.
+
+	r := db.setupRouter()              // The router. The router is a Gin engine.
+	if gin.Mode() != gin.ReleaseMode { // Resetting the catalog is for development and tests only.
+		r.POST("/api/v1/reset", newSeeder(db, fixture).reset)
+	}
+	return r
 }
 
 // end::dbInit[]
@@ -334,32 +592,155 @@ func main() { // The main function is called. The main function is a function.
 	// go tool pprof -png -cum profile/block.pprof
 
 	mode := flag.String("profile.mode", "", "enable profiling mode, one of [cpu, mem, mutex, block]") // Create a new string. The string is created with the value of the mode. The string is assigned to mode.
-	flag.Parse()                                                                                      // Parse the command line flags.
+	flag.DurationVar(&reorderInterval, "reorder.interval", time.Hour, "how often to evaluate stock levels for reorder alerts, 0 disables")
+	flag.StringVar(&reorderWebhookURL, "reorder.webhook", "", "URL to POST low-stock alerts to; alerts are logged when empty")
+	rules := flag.String("markdown.rules", "24h:30,6h:50", "near-expiry markdowns as within:percent pairs, empty disables")
+	flag.DurationVar(&cartTTL, "cart.ttl", 2*time.Hour, "how long an unchanged cart is kept")
+	taxRate := flag.String("tax.rate", "0", "sales tax rate in percent for every item, e.g. 7.25; ignored with -tax.table")
+	taxTable := flag.String("tax.table", "", "JSON file of sales tax rates by jurisdiction and tax class")
+	flag.StringVar(&taxJurisdiction, "tax.jurisdiction", defaultJurisdiction, "jurisdiction in -tax.table baskets are taxed in by default")
+	approval := flag.String("returns.approval", "50.00", "total refunded on an order above which returns need a manager's approval with the admin token")
+	backupTo := flag.String("backup.to", "", "directory or gs://bucket/prefix catalog backups are written to, empty disables backups")
+	flag.DurationVar(&backupInterval, "backup.interval", time.Hour, "how often the catalog is backed up, 0 backs up on request only")
+	journalPath := flag.String("backup.journal", "journal.jsonl", "file catalog changes are journaled to for point-in-time restores")
+	flag.DurationVar(&trashRetention, "trash.retention", 30*24*time.Hour, "how long deleted items can be restored before they are purged, 0 keeps them")
+	flag.DurationVar(&trashPurgeInterval, "trash.purge", time.Hour, "how often deleted items past -trash.retention are purged")
+	flag.StringVar(&adminToken, "admin.token", os.Getenv("ADMIN_TOKEN"), "token admin requests send in the X-Admin-Token header; defaults to $ADMIN_TOKEN, empty disables admin requests")
+	flag.BoolVar(&trustIAP, "iap", false, "take the user of audit entries and events from the Identity-Aware Proxy headers; only set it when all requests come through IAP")
+	proxies := flag.String("trusted.proxies", "", "comma separated addresses and CIDR ranges of the proxies, e.g. a Google Cloud load balancer's 35.191.0.0/16,130.211.0.0/22, whose X-Forwarded-For gives the client IP; empty uses the peer's address")
+	flag.StringVar(&trustedPlatform, "trusted.platform", "", "header the platform sets to the client IP, e.g. X-Appengine-Remote-Addr on App Engine; only set it when all requests come through the platform")
+	flag.DurationVar(&idempotencyTTL, "idempotency.ttl", idempotencyTTL, "how long responses to requests with an Idempotency-Key are replayed to retries")
+	auditPath := flag.String("audit.log", "", "file the audit trail of catalog changes is appended to, empty keeps it in memory only")
+	flag.IntVar(&auditMemory, "audit.memory", auditMemory, "latest audit entries kept in memory for /api/v1/audit; -audit.log keeps them all, 0 keeps them all in memory too")
+	seed := flag.String("seed", fixtureTest, "catalog seed data: dev, demo, test, empty or a .yaml or .json fixture file; ignored when -events.store has events")
+	eventsPath := flag.String("events.store", "", "file item events are stored in and the catalog is rebuilt from at start up, empty keeps them in memory only")
+	flag.IntVar(&eventMemory, "events.memory", eventMemory, "latest events kept in memory for /api/v1/item/{code}/events; -events.store keeps them all, 0 keeps them all in memory too")
+	traceExporter := flag.String("trace.exporter", "", "where request traces go: stdout or otlp; empty disables tracing")
+	traceFile := flag.String("trace.file", "", "file -trace.exporter stdout appends spans to; empty writes them to stderr, apart from the logs")
+	traceEndpoint := flag.String("trace.endpoint", defaultOTLPEndpoint(), "OTLP/HTTP collector for -trace.exporter otlp; defaults to $OTEL_EXPORTER_OTLP_ENDPOINT")
+	traceRatio := flag.Float64("trace.ratio", 1, "share of new traces sampled; requests keep their caller's sampling decision")
+	flag.TextVar(logLevel, "log.level", logLevel, "least severe level logged: debug, info, warn or error")
+	redact := flag.String("log.redact", "", "comma separated request headers not logged, in addition to Authorization, Cookie, X-Admin-Token and the like")
+	flag.DurationVar(&shutdownTimeout, "shutdown.timeout", shutdownTimeout, "how long requests in flight have to finish after SIGTERM")
+	flag.DurationVar(&shutdownDelay, "shutdown.delay", 0, "how long /readyz fails after SIGTERM before new connections are refused, for load balancers that probe it")
+	replay := flag.String("replay", "", "build a projection, e.g. catalog or price-history, from -events.store, print it as JSON and exit")
+	replayUntil := flag.String("replay.until", "", "replay the events up to this time, RFC 3339; empty replays them all")
+	flag.Parse() // Parse the command line flags.
+	parseRedactedHeaders(*redact)
+	slog.SetDefault(newLogger(os.Stdout, logLevel, os.Getenv("GOOGLE_CLOUD_PROJECT"))) // JSON for Cloud Logging; the log package writes through it too.
+	gin.DebugPrintRouteFunc = func(method, path, handler string, handlers int) {
+		slog.Debug("route", "method", method, "path", path, "handler", handler)
+	}
+
+	var err error
+	if markdownRules, err = parseMarkdownRules(*rules); err != nil {
+		log.Fatalf("-markdown.rules: %v", err)
+	}
+	if *taxTable != "" {
+		if taxRates, err = loadTaxTable(*taxTable); err != nil {
+			log.Fatalf("-tax.table: %v", err)
+		}
+	} else if rate, err := parseTaxRate(*taxRate); err != nil {
+		log.Fatalf("-tax.rate: %v", err)
+	} else {
+		taxRates = flatTaxTable(rate)
+	}
+	if _, err := taxRates.calculator(taxJurisdiction); err != nil {
+		log.Fatalf("-tax.jurisdiction: %v", err)
+	}
+	if trustedProxies, err = parseTrustedProxies(*proxies); err != nil {
+		log.Fatalf("-trusted.proxies: %v", err)
+	}
+	if returnApprovalCents, err = parseCents(*approval); err != nil {
+		log.Fatalf("-returns.approval: %v", err)
+	}
+	if seedFixture, err = loadFixture(*seed); err != nil {
+		log.Fatalf("-seed: %v", err)
+	}
+	if *replay != "" {
+		if *eventsPath == "" {
+			log.Fatalf("-replay needs -events.store")
+		}
+		var until time.Time
+		if *replayUntil != "" {
+			if until, err = time.Parse(time.RFC3339, *replayUntil); err != nil {
+				log.Fatalf("-replay.until: %v", err)
+			}
+		}
+		if err := replayProjection(os.Stdout, *eventsPath, *replay, until); err != nil {
+			log.Fatalf("-replay: %v", err)
+		}
+		return
+	}
+	if *eventsPath != "" {
+		if catalogEvents, err = openEventStore(*eventsPath); err != nil {
+			log.Fatalf("-events.store: %v", err)
+		}
+		onShutdown("event store", closeStore(catalogEvents.close))
+	} else {
+		catalogEvents = newEventStore()
+	}
+	if *auditPath != "" {
+		if catalogAudit, err = openAuditTrail(*auditPath); err != nil {
+			log.Fatalf("-audit.log: %v", err)
+		}
+		onShutdown("audit log", closeStore(catalogAudit.close))
+	}
+	if *backupTo != "" {
+		if backupStore, err = newObjectStore(*backupTo); err != nil {
+			log.Fatalf("-backup.to: %v", err)
+		}
+		if catalogJournal, err = openJournal(*journalPath); err != nil {
+			log.Fatalf("-backup.journal: %v", err)
+		}
+		onShutdown("journal", closeStore(catalogJournal.close))
+	}
+
+	if *traceExporter != "" {
+		out := io.Writer(os.Stderr) // Spans stay apart from the JSON logs on stdout.
+		if *traceFile != "" {
+			f, err := os.OpenFile(*traceFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				log.Fatalf("-trace.file: %v", err)
+			}
+			onShutdown("trace file", func(context.Context) error { return f.Close() }) // After the traces are flushed.
+			out = f
+		}
+		tp, err := newTracerProvider(*traceExporter, *traceEndpoint, *traceRatio, out)
+		if err != nil {
+			log.Fatalf("-trace.exporter: %v", err)
+		}
+		onShutdown("traces", tp.Shutdown) // Exports the spans still batched.
+		tracerProvider = tp
+	}
 
+	var prof interface{ Stop() } // The profile is written when the server stops, see onShutdown. NoShutdownHook leaves SIGINT to the shutdown below.
 	switch *mode {
 	case "cpu": // If the mode is cpu.
 		fmt.Printf("cpu profiling enabled\n")
-		defer profile.Start(profile.CPUProfile, profile.ProfilePath("./profile/")).Stop() // Create a new profile. The profile is created with the value of the CPUProfile. The profile is assigned to the profile. The profile is started with the value of the CPUProfile. The profile is started with the value of the profile. The profile is stopped when the call ends.
+		prof = profile.Start(profile.CPUProfile, profile.ProfilePath("./profile/"), profile.NoShutdownHook) // Start a CPU profile, written to ./profile/cpu.pprof when stopped.
 	case "mem": // If the mode is mem.
 		fmt.Printf("mem profiling enabled\n")
-		defer profile.Start(profile.MemProfile, profile.ProfilePath("./profile/")).Stop() // Create a new profile. The profile is created with the value of the MemProfile. The profile is assigned to the profile. The profile is started with the value of the MemProfile. The profile is started with the value of the profile. The profile is stopped when the call ends.
+		prof = profile.Start(profile.MemProfile, profile.ProfilePath("./profile/"), profile.NoShutdownHook) // Start a memory profile, written to ./profile/mem.pprof when stopped.
 	case "mutex": // If the mode is mutex.
 		fmt.Printf("mutex profiling enabled\n")
-		defer profile.Start(profile.MutexProfile, profile.ProfilePath("./profile/")).Stop() // Create a new profile. The profile is created with the value of the MutexProfile. The profile is assigned to the profile. The profile is started with the value of the MutexProfile. The profile is stopped with the value of the profile. The profile is stopped when the call ends.
+		prof = profile.Start(profile.MutexProfile, profile.ProfilePath("./profile/"), profile.NoShutdownHook) // Start a mutex profile, written to ./profile/mutex.pprof when stopped.
 	case "block": // If the mode is block.
 		fmt.Printf("block profiling enabled\n")
-		defer profile.Start(profile.BlockProfile, profile.ProfilePath("./profile/")).Stop() // Create a new profile. The profile is created with the value of the BlockProfile. The profile is assigned to the profile. The profile is started with the value of the BlockProfile. The profile is stopped with the value of the profile. The profile is stopped when the call ends.
+		prof = profile.Start(profile.BlockProfile, profile.ProfilePath("./profile/"), profile.NoShutdownHook) // Start a block profile, written to ./profile/block.pprof when stopped.
 	default:
 		// do nothing
 	}
+	if prof != nil {
+		onShutdown("profile", func(context.Context) error { prof.Stop(); return nil })
+	}
 	db := database{} // Create a new database. The database is used to store the database map. The database is created empty. The database is assigned to db. The database is assigned to the database.
 	r := db.dbInit()
 	// use ginSwagger middleware to serve the API docs
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	// It then calls http.ListenAndServe, specifying that it should listen
-	// on port 8080 on any interface (":8080").
-	// This function will block until the program is terminated.
+	// It then calls serve, which listens on port 8080 on any interface
+	// (":8080") until the program is told to stop.
 
 	// Custom HTTP configuration
 	// Create a custom server for using in production instead of using the default one:
@@ -380,7 +761,36 @@ func main() { // The main function is called. The main function is a function.
 		ReadTimeout:  5 * time.Second,  // Set the ReadTimeout of the http.Server to the value of the ReadTimeout of the http.Server. The ReadTimeout of the http.Server is a time.Duration. The ReadTimeout of the http.Server is assigned to the http.Server. The ReadTimeout of the http.Server is 5 seconds. The ReadTimeout of the http.Server is assigned to the http.Server.
 		WriteTimeout: 10 * time.Second, // Set the WriteTimeout of the http.Server to the value of the WriteTimeout of the http.Server. The WriteTimeout of the http.Server is a time.Duration. The WriteTimeout of the http.Server is assigned to the http.Server. The WriteTimeout of the http.Server is 10 seconds. The WriteTimeout of the http.Server is assigned to the http.Server.
 	}
-	s.ListenAndServe() // ListenAndServe is a blocking call that will listen on the Addr and then accept and serve incoming connections. It will block until the program is terminated.
+
+	// Cloud Run sends SIGTERM and gives the instance 10 seconds before it is
+	// killed; Ctrl-C sends SIGINT. serve drains the requests in flight, then
+	// the background jobs stop and the hooks close the stores and flush the
+	// profile and the traces.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	code := 0
+	l, err := net.Listen("tcp", s.Addr)
+	if err == nil {
+		err = serve(ctx, s, l)
+	}
+	if err != nil {
+		slog.Error("server", "error", err)
+		code = 1
+	}
+	flush, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := backgroundJobs.stop(flush); err != nil { // No backup, purge or reorder alert is running when the stores close.
+		slog.Error("shutdown", "error", err)
+		code = 1
+	}
+	if err := runShutdownHooks(flush); err != nil {
+		code = 1
+	}
+	slog.Info("shutdown complete")
+	os.Stdout.Sync() // The logs.
+	if code != 0 {
+		os.Exit(code)
+	}
 }
 
 // end::main[]
@@ -392,12 +802,18 @@ const (
 	alphaNumericAndSpaceRegexString = "^[a-zA-Z0-9 ]*$"
 	//represents a number with up to 2 decimal places
 	unitPriceString = "^\\d+\\.\\d{1,2}$"
+	// represents a lower case identifier such as stone-fruit or country_of_origin
+	slugString = "^[a-z0-9]+([_-][a-z0-9]+)*$"
+	// represents a weight with up to 3 decimal places, as reported by a scale
+	weightString = "^\\d+(\\.\\d{1,3})?$"
 )
 
 var ( // The following are used to validate the data that is being sent to the server.
 	uUIDRegex                 = regexp.MustCompile(uUIDRegexString)                 // The uUIDRegex is used to validate the uUID. The uUIDRegex is a regexp.Regexp. The uUIDRegex is created from the uUIDRegexString. The uUIDRegexString is a string. The uUIDRegexString is assigned to the uUIDRegex.
 	alphaNumericAndSpaceRegex = regexp.MustCompile(alphaNumericAndSpaceRegexString) // The alphaNumericAndSpaceRegex is used to validate the alphaNumericAndSpace. The alphaNumericAndSpaceRegex is a regexp.Regexp. The alphaNumericAndSpaceRegex is created from the alphaNumericAndSpaceRegexString. The alphaNumericAndSpaceRegexString is a string. The alphaNumericAndSpaceRegexString is assigned to the alphaNumericAndSpaceRegex.
 	unitPriceRegex            = regexp.MustCompile(unitPriceString)                 // The unitPriceRegex is used to validate the unitPrice. The unitPriceRegex is a regexp.Regexp. The unitPriceRegex is created from the unitPriceString. The unitPriceString is a string. The unitPriceString is assigned to the unitPriceRegex.
+	weightRegex               = regexp.MustCompile(weightString)                    // The weightRegex is used to validate weights reported by scales.
+	slugRegex                 = regexp.MustCompile(slugString)                      // The slugRegex is used to validate category and attribute IDs.
 )
 
 // isUUID is the validation function for validating if the field's value is a valid custom UUID.
@@ -420,3 +836,27 @@ func IsProduceCode(fl validator.FieldLevel) bool { // The IsProduceCode function
 func IsUnitPrice(fl validator.FieldLevel) bool { // The IsUnitPrice function is used to validate if the current field is a number with up to 2 decimal places. The IsUnitPrice function is a function. The IsUnitPrice function is assigned to the IsUnitPrice function.
 	return unitPriceRegex.MatchString(fl.Field().String()) // The MatchString function is used to validate if the current field is a number with up to 2 decimal places. The MatchString function is a function. The MatchString function is assigned to the MatchString function. The MatchString function is called with the field's value as the argument.
 }
+
+// isWeight is the validation function for validating if the current field
+// is a number with up to 3 decimal places
+func isWeight(fl validator.FieldLevel) bool {
+	return weightRegex.MatchString(fl.Field().String())
+}
+
+// isSlug is the validation function for validating if the current field
+// is a lower case identifier made of words joined by - or _
+func isSlug(fl validator.FieldLevel) bool {
+	return slugRegex.MatchString(fl.Field().String())
+}
+
+// IsAllergen is the validation function for validating if the current field
+// is one of the known allergens, e.g. peanuts or tree_nuts
+func IsAllergen(fl validator.FieldLevel) bool {
+	return allergens[fl.Field().String()]
+}
+
+// IsDietaryFlag is the validation function for validating if the current field
+// is one of the known dietary flags, e.g. vegan or gluten_free
+func IsDietaryFlag(fl validator.FieldLevel) bool {
+	return dietaryFlags[fl.Field().String()]
+}
@@ -58,6 +58,16 @@ import (
 //     fuzz tests should be executed. The default is the current value
 //     of GOMAXPROCS. -cpu does not apply to fuzz tests matched by -fuzz.
 
+// routerAdminReq is routerPOSTReq with the admin token, see isAdmin.
+func routerAdminReq(method, path string, jsonData []byte, router *gin.Engine) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Admin-Token", adminToken)
+	router.ServeHTTP(w, req)
+	return w
+}
+
 // go test -run TestPing -v
 // CGO_ENABLED=1 go test -race -run TestItems -v
 // CGO_ENABLED=1 go test -race -run TestAddCheckProduceCode -v
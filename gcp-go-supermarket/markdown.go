@@ -0,0 +1,130 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// markdownRule takes PercentOff off the unit price of an item whose
+// first-expiring lot reaches its best-before date within Within.
+type markdownRule struct {
+	Within     time.Duration
+	PercentOff int
+}
+
+func (r markdownRule) String() string {
+	return fmt.Sprintf("%d%% off within %s", r.PercentOff, formatWithin(r.Within))
+}
+
+// formatWithin prints whole hours as "24h" rather than time.Duration's "24h0m0s".
+func formatWithin(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return d.String()
+}
+
+// markdownRules are the markdown rules in effect. They are set from the
+// -markdown.rules flag in main; see parseMarkdownRules for the format.
+var markdownRules = []markdownRule{
+	{Within: 24 * time.Hour, PercentOff: 30},
+	{Within: 6 * time.Hour, PercentOff: 50},
+}
+
+// parseMarkdownRules parses a comma separated list of within:percent pairs,
+// e.g. "24h:30,6h:50".
+func parseMarkdownRules(s string) ([]markdownRule, error) {
+	rules := []markdownRule{}
+	if strings.TrimSpace(s) == "" {
+		return rules, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		within, pct, ok := strings.Cut(strings.TrimSpace(field), ":")
+		if !ok {
+			return nil, fmt.Errorf("markdown rule %q: want within:percent", field)
+		}
+		d, err := time.ParseDuration(within)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("markdown rule %q: invalid duration %q", field, within)
+		}
+		p, err := strconv.Atoi(pct)
+		if err != nil || p <= 0 || p >= 100 {
+			return nil, fmt.Errorf("markdown rule %q: percent must be between 1 and 99", field)
+		}
+		rules = append(rules, markdownRule{Within: d, PercentOff: p})
+	}
+	return rules, nil
+}
+
+// Markdown is the reduced price of an item nearing its best-before date.
+// It is computed at read time and never stored.
+type Markdown struct {
+	Price      string    `json:"price"`       // Price is the unit price after the markdown, e.g. $2.09
+	Rule       string    `json:"rule"`        // Rule describes the rule that fired, e.g. 30% off within 24h
+	PercentOff int       `json:"percent_off"` // PercentOff is the discount applied
+	BestBefore time.Time `json:"best_before"` // BestBefore is the date of the lot that triggered the markdown
+}
+
+// markdownFor returns the markdown of item at now, or nil when no rule fires.
+// Of the rules that match the first-expiring lot the deepest discount wins.
+func markdownFor(item Item, rules []markdownRule, now time.Time) *Markdown {
+	if len(item.Lots) == 0 || len(rules) == 0 {
+		return nil
+	}
+	lots := append([]Lot(nil), item.Lots...)
+	sortFEFO(lots)
+	left := lots[0].BestBefore.Sub(now)
+
+	matching := []markdownRule{}
+	for _, r := range rules {
+		if left <= r.Within {
+			matching = append(matching, r)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].PercentOff != matching[j].PercentOff {
+			return matching[i].PercentOff > matching[j].PercentOff
+		}
+		return matching[i].Within < matching[j].Within
+	})
+	rule := matching[0]
+
+	cents, err := parseCents(item.UnitPrice)
+	if err != nil {
+		return nil // stored prices are validated on the way in
+	}
+	return &Markdown{
+		Price:      formatCents(cents - percentOf(cents, rule.PercentOff)),
+		Rule:       rule.String(),
+		PercentOff: rule.PercentOff,
+		BestBefore: lots[0].BestBefore,
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestParseMarkdownRules -v
+
+func TestParseMarkdownRules(t *testing.T) {
+	tests := map[string]struct {
+		rules   string
+		want    []markdownRule
+		wantErr string
+	}{
+		"default": {rules: "24h:30,6h:50", want: []markdownRule{{24 * time.Hour, 30}, {6 * time.Hour, 50}}},
+		"spaces":  {rules: " 90m:10 ", want: []markdownRule{{90 * time.Minute, 10}}},
+		"empty":   {rules: "", want: []markdownRule{}},
+		"pair":    {rules: "24h", wantErr: "want within:percent"},
+		"within":  {rules: "1d:30", wantErr: `invalid duration "1d"`},
+		"percent": {rules: "24h:100", wantErr: "percent must be between 1 and 99"},
+	}
+	for name, tc := range tests {
+		got, err := parseMarkdownRules(tc.rules)
+		if tc.wantErr != "" {
+			assert.ErrorContains(t, err, tc.wantErr, name)
+			continue
+		}
+		assert.NilError(t, err, name)
+		assert.DeepEqual(t, got, tc.want)
+	}
+	assert.Equal(t, markdownRule{90 * time.Minute, 10}.String(), "10% off within 1h30m0s")
+}
+
+// go test -run TestMarkdownFor -v
+
+func TestMarkdownFor(t *testing.T) {
+	now := time.Date(2022, 7, 8, 12, 0, 0, 0, time.UTC)
+	lots := func(left ...time.Duration) []Lot {
+		var lots []Lot
+		for _, d := range left {
+			lots = append(lots, Lot{BestBefore: now.Add(d), Quantity: 1})
+		}
+		return lots
+	}
+	tests := map[string]struct {
+		item Item
+		want *Markdown
+	}{
+		"no lots":  {item: Item{UnitPrice: "$2.99"}},
+		"fresh":    {item: Item{UnitPrice: "$2.99", Lots: lots(72 * time.Hour)}},
+		"24h":      {item: Item{UnitPrice: "$2.99", Lots: lots(72*time.Hour, 24*time.Hour)}, want: &Markdown{Price: "$2.09", Rule: "30% off within 24h", PercentOff: 30, BestBefore: now.Add(24 * time.Hour)}},
+		"6h":       {item: Item{UnitPrice: "$3.41", Lots: lots(5 * time.Hour)}, want: &Markdown{Price: "$1.70", Rule: "50% off within 6h", PercentOff: 50, BestBefore: now.Add(5 * time.Hour)}},
+		"expired":  {item: Item{UnitPrice: "$3.41", Lots: lots(-time.Hour)}, want: &Markdown{Price: "$1.70", Rule: "50% off within 6h", PercentOff: 50, BestBefore: now.Add(-time.Hour)}},
+		"bad data": {item: Item{UnitPrice: "free", Lots: lots(time.Hour)}},
+	}
+	for name, tc := range tests {
+		got := markdownFor(tc.item, markdownRules, now)
+		if tc.want == nil {
+			assert.Assert(t, got == nil, name)
+			continue
+		}
+		assert.Assert(t, got != nil, name)
+		assert.DeepEqual(t, *got, *tc.want)
+	}
+	assert.Assert(t, markdownFor(Item{UnitPrice: "$2.99", Lots: lots(time.Hour)}, nil, now) == nil)
+}
+
+// go test -run TestItemsMarkdown -v
+
+func TestItemsMarkdown(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	bestBefore := time.Now().UTC().Add(5 * time.Hour).Truncate(time.Second).Format(time.RFC3339)
+
+	got := routerPOSTReq("POST", "/api/v1/stock/E5T6-9UI3-TH15-QR88/lots", []byte(fmt.Sprintf(`{"best_before":"%s","quantity":3}`, bestBefore)), router)
+	assert.Equal(t, got.Code, 201)
+
+	markdown := fmt.Sprintf(`"markdown":{"price":"$1.49","rule":"50%% off within 6h","percent_off":50,"best_before":"%s"}`, bestBefore)
+	tests := map[string]struct {
+		method     string
+		path       string
+		wantCode   int
+		wantResult string
+	}{
+		"items": {method: "GET", path: "/api/v1/items", wantCode: 200, wantResult: `[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"},{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","price":"$2.99",` + markdown + `},{"code":"TQ4C-VV6T-75ZX-1RMR","name":"Gala Apple","price":"$3.59"},{"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","price":"$0.79"}]`},
+		"item":  {method: "GET", path: "/api/v1/item/E5T6-9UI3-TH15-QR88", wantCode: 200, wantResult: `{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","price":"$2.99",` + markdown + `}`},
+		"none":  {method: "GET", path: "/api/v1/item/A12T-4GH7-QPL9-3N4M", wantCode: 200, wantResult: `{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"}`},
+	}
+	for name, tc := range tests {
+		got := routerGETReq(tc.method, tc.path, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	// a markdown sent with an item is ignored
+	got = routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","price":"1.99","markdown":{"price":"$0.01"}}]`), router)
+	assert.Equal(t, got.Code, 201)
+	got = routerGETReq("GET", "/api/v1/item/ZRT6-72AS-K736-L4AZ", router)
+	assert.Equal(t, got.Body.String(), `{"code":"ZRT6-72AS-K736-L4AZ","name":"Plum","price":"$1.99"}`)
+}
@@ -0,0 +1,156 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The collectors are shared by every router; each router has a registry of
+// its own, see newMetricsRegistry, so tests can build as many as they like.
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "supermarket_http_requests_total",
+		Help: "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "supermarket_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	storeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "supermarket_store_operation_duration_seconds",
+		Help:    "Latency of catalog and backup store operations.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9), // 100µs to 6.5s
+	}, []string{"store", "operation"})
+	validationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "supermarket_validation_failures_total",
+		Help: "Request fields that failed validation, by validation tag.",
+	}, []string{"tag"})
+)
+
+// unmatchedRoute is the route label of requests no route matched, so that
+// probing random paths does not add label values.
+const unmatchedRoute = "unmatched"
+
+// newMetricsRegistry returns the registry /metrics serves for the router of
+// db: the shared collectors, the size of db and the Go runtime's.
+func newMetricsRegistry(db database) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(httpRequests, httpDuration, storeDuration, validationFailures)
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "supermarket_catalog_items",
+		Help: "Items in the catalog, not counting the trash.",
+	}, func() float64 {
+		dbmux.Lock()
+		defer dbmux.Unlock()
+		return float64(len(db))
+	}))
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+// metricsHandler serves the metrics in reg in the Prometheus text format.
+func metricsHandler(reg *prometheus.Registry) gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+}
+
+// instrument is middleware counting requests and timing them by their route
+// template, e.g. /api/v1/item/:code, rather than the path.
+func instrument(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
+
+// timeStore records how long a store operation took, started at start.
+// Use it deferred: defer timeStore("catalog", "put", time.Now()).
+func timeStore(store, operation string, start time.Time) {
+	storeDuration.WithLabelValues(store, operation).Observe(time.Since(start).Seconds())
+}
+
+// countingValidator counts the validation failures of the validator it
+// wraps by tag, e.g. isproducecode or required.
+type countingValidator struct {
+	binding.StructValidator
+}
+
+func (v countingValidator) ValidateStruct(obj any) error {
+	err := v.StructValidator.ValidateStruct(obj)
+	countValidationFailures(err)
+	return err
+}
+
+func countValidationFailures(err error) {
+	var fields validator.ValidationErrors
+	var slice binding.SliceValidationError
+	switch {
+	case errors.As(err, &fields):
+		for _, f := range fields {
+			validationFailures.WithLabelValues(f.Tag()).Inc()
+		}
+	case errors.As(err, &slice): // a JSON array of items, e.g. POST /api/v1/add
+		for _, err := range slice {
+			countValidationFailures(err)
+		}
+	}
+}
+
+// timedObjectStore records the latency of the operations of an objectStore
+// and traces them, see traceStore.
+type timedObjectStore struct {
+	objectStore
+}
+
+func (s timedObjectStore) put(ctx context.Context, name string, data []byte) error {
+	defer timeStore("backup", "put", time.Now())
+	defer traceStore(ctx, "backup", "put").End()
+	return s.objectStore.put(ctx, name, data)
+}
+
+func (s timedObjectStore) get(ctx context.Context, name string) ([]byte, error) {
+	defer timeStore("backup", "get", time.Now())
+	defer traceStore(ctx, "backup", "get").End()
+	return s.objectStore.get(ctx, name)
+}
+
+func (s timedObjectStore) list(ctx context.Context, prefix string) ([]string, error) {
+	defer timeStore("backup", "list", time.Now())
+	defer traceStore(ctx, "backup", "list").End()
+	return s.objectStore.list(ctx, prefix)
+}
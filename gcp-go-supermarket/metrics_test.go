@@ -0,0 +1,73 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestMetrics -v
+
+func TestMetrics(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	itemOK := httpRequests.WithLabelValues("GET", "/api/v1/item/:code", "200")
+	unmatched := httpRequests.WithLabelValues("GET", unmatchedRoute, "405")
+	isproducecode := validationFailures.WithLabelValues("isproducecode")
+	required := validationFailures.WithLabelValues("required")
+	before := []float64{testutil.ToFloat64(itemOK), testutil.ToFloat64(unmatched), testutil.ToFloat64(isproducecode), testutil.ToFloat64(required)}
+
+	routerPOSTReq("GET", "/api/v1/item/A12T-4GH7-QPL9-3N4M", nil, router)
+	routerPOSTReq("GET", "/api/v1/item/E5T6-9UI3-TH15-QR88", nil, router)
+	routerPOSTReq("GET", "/no/such/path", nil, router)
+	routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"bad","name":"Kiwi","price":"0.50"},{"code":"B111-2222-3333-4444","price":"0.50"}]`), router)
+	routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"0.50"}]`), router)
+
+	assert.Equal(t, testutil.ToFloat64(itemOK)-before[0], 2.0)
+	assert.Equal(t, testutil.ToFloat64(unmatched)-before[1], 1.0)
+	assert.Equal(t, testutil.ToFloat64(isproducecode)-before[2], 1.0)
+	assert.Equal(t, testutil.ToFloat64(required)-before[3], 1.0)
+
+	w := routerPOSTReq("GET", "/metrics", nil, router)
+	assert.Equal(t, w.Code, 200)
+	body := w.Body.String()
+	for _, want := range []string{
+		`supermarket_http_requests_total{code="200",method="GET",route="/api/v1/item/:code"}`,
+		`supermarket_http_request_duration_seconds_bucket{method="GET",route="/api/v1/item/:code",le="0.005"}`,
+		"supermarket_catalog_items 5\n",
+		`supermarket_store_operation_duration_seconds_count{operation="put",store="catalog"}`,
+		`supermarket_validation_failures_total{tag="isproducecode"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("/metrics: expected: %v, got: %v", want, body)
+		}
+	}
+	if strings.Contains(body, "A12T-4GH7-QPL9-3N4M") || strings.Contains(body, "/no/such/path") {
+		t.Fatalf("/metrics: expected route templates only, got: %v", body)
+	}
+}
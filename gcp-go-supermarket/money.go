@@ -0,0 +1,61 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseCents converts a unit price such as "$3.41", "3.41" or "3.4" to cents.
+func parseCents(price string) (int64, error) {
+	s := strings.TrimPrefix(price, "$")
+	if !unitPriceRegex.MatchString(s) {
+		return 0, fmt.Errorf("invalid price %q", price)
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(frac) == 1 {
+		frac += "0"
+	}
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid price %q: %w", price, err)
+	}
+	f, _ := strconv.ParseInt(frac, 10, 64) // two digits, checked by unitPriceRegex
+	return w*100 + f, nil
+}
+
+// formatCents formats cents the way UnitPrice is stored, e.g. "$3.41".
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, cents/100, cents%100)
+}
+
+// percentOf returns pct percent of cents, rounded half up to the nearest cent.
+func percentOf(cents int64, pct int) int64 {
+	return (cents*int64(pct) + 50) / 100
+}
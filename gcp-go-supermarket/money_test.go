@@ -0,0 +1,61 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestCents -v
+
+func TestCents(t *testing.T) {
+	tests := map[string]struct {
+		price   string
+		want    int64
+		wantErr string
+	}{
+		"stored":     {price: "$3.41", want: 341},
+		"bound":      {price: "3.41", want: 341},
+		"one digit":  {price: "$9.4", want: 940},
+		"zero":       {price: "$0.00", want: 0},
+		"no decimal": {price: "$9", wantErr: `invalid price "$9"`},
+		"negative":   {price: "-3.41", wantErr: `invalid price "-3.41"`},
+	}
+	for name, tc := range tests {
+		got, err := parseCents(tc.price)
+		if tc.wantErr != "" {
+			assert.ErrorContains(t, err, tc.wantErr, name)
+			continue
+		}
+		assert.NilError(t, err, name)
+		assert.Equal(t, got, tc.want, name)
+		if tc.price[0] == '$' && name != "one digit" {
+			assert.Equal(t, formatCents(got), tc.price, name)
+		}
+	}
+	assert.Equal(t, formatCents(-5), "-$0.05")
+	assert.Equal(t, percentOf(299, 30), int64(90)) // 89.7 rounds up
+	assert.Equal(t, percentOf(341, 50), int64(171))
+}
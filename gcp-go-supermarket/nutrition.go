@@ -0,0 +1,98 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Nutrition is the nutrition facts panel of an item, per serving.
+type Nutrition struct {
+	ServingSize  string  `json:"serving_size" binding:"required,max=64"`         // ServingSize as printed on the panel, e.g. 1 medium (150g)
+	ServingGrams float64 `json:"serving_g,omitempty" binding:"min=0"`            // ServingGrams is the weight of a serving in grams
+	Calories     int     `json:"calories" binding:"min=0"`                       // Calories is the energy per serving in kcal
+	TotalFat     float64 `json:"total_fat_g" binding:"min=0"`                    // TotalFat per serving in grams
+	Carbohydrate float64 `json:"carbohydrate_g" binding:"min=0"`                 // Carbohydrate per serving in grams
+	Fiber        float64 `json:"fiber_g" binding:"min=0,ltefield=Carbohydrate"`  // Fiber per serving in grams, part of Carbohydrate
+	Sugars       float64 `json:"sugars_g" binding:"min=0,ltefield=Carbohydrate"` // Sugars per serving in grams, part of Carbohydrate
+	Protein      float64 `json:"protein_g" binding:"min=0"`                      // Protein per serving in grams
+	Sodium       float64 `json:"sodium_mg" binding:"min=0"`                      // Sodium per serving in milligrams
+}
+
+// allergens are the allergen flags an item can carry: the major food
+// allergens of the US FALCPA and FASTER acts plus those of EU 1169/2011.
+var allergens = map[string]bool{
+	"celery":    true,
+	"eggs":      true,
+	"fish":      true,
+	"gluten":    true,
+	"lupin":     true,
+	"milk":      true,
+	"molluscs":  true,
+	"mustard":   true,
+	"peanuts":   true,
+	"sesame":    true,
+	"shellfish": true,
+	"soy":       true,
+	"sulphites": true,
+	"tree_nuts": true,
+	"wheat":     true,
+}
+
+// dietaryFlags are the dietary flags an item can carry.
+var dietaryFlags = map[string]bool{
+	"gluten_free": true,
+	"halal":       true,
+	"kosher":      true,
+	"non_gmo":     true,
+	"vegan":       true,
+	"vegetarian":  true,
+}
+
+// parseAllergenFilter parses a comma separated list of allergens, as taken by
+// the exclude_allergens query parameter of items.
+func parseAllergenFilter(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	exclude := map[string]bool{}
+	for _, a := range strings.Split(s, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if !allergens[a] {
+			return nil, fmt.Errorf("unknown allergen %q", a)
+		}
+		exclude[a] = true
+	}
+	return exclude, nil
+}
+
+// containsAllergen reports whether item declares one of the allergens in set.
+func containsAllergen(item Item, set map[string]bool) bool {
+	for _, a := range item.Allergens {
+		if set[a] {
+			return true
+		}
+	}
+	return false
+}
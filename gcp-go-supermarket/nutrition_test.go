@@ -0,0 +1,63 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"testing"
+)
+
+// go test -run TestNutrition -v
+
+func TestNutrition(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	peach := `{"code":"ZRT6-72AS-K736-L4AZ","name":"Peach Cobbler","price":"5.99","nutrition":{"serving_size":"1 slice","serving_g":120,"calories":290,"total_fat_g":11,"carbohydrate_g":45,"fiber_g":2,"sugars_g":27,"protein_g":3,"sodium_mg":210},"allergens":["wheat","milk","eggs"],"dietary":["vegetarian"]}`
+	nuts := `{"code":"ZRT6-72AS-K736-L4AY","name":"Trail Mix","price":"4.49","allergens":["peanuts","tree_nuts"],"dietary":["vegan","gluten_free"]}`
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "add", method: "POST", path: "/api/v1/add", jsonData: []byte(`[` + peach + `,` + nuts + `]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "item", method: "GET", path: "/api/v1/item/ZRT6-72AS-K736-L4AZ", wantCode: 200, wantResult: `{"code":"ZRT6-72AS-K736-L4AZ","name":"Peach Cobbler","price":"$5.99","nutrition":{"serving_size":"1 slice","serving_g":120,"calories":290,"total_fat_g":11,"carbohydrate_g":45,"fiber_g":2,"sugars_g":27,"protein_g":3,"sodium_mg":210},"allergens":["wheat","milk","eggs"],"dietary":["vegetarian"]}`},
+		{name: "exclude peanuts", method: "GET", path: "/api/v1/items?exclude_allergens=peanuts", wantCode: 200, wantResult: `[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"},{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","price":"$2.99"},{"code":"TQ4C-VV6T-75ZX-1RMR","name":"Gala Apple","price":"$3.59"},{"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","price":"$0.79"},{"code":"ZRT6-72AS-K736-L4AZ","name":"Peach Cobbler","price":"$5.99","nutrition":{"serving_size":"1 slice","serving_g":120,"calories":290,"total_fat_g":11,"carbohydrate_g":45,"fiber_g":2,"sugars_g":27,"protein_g":3,"sodium_mg":210},"allergens":["wheat","milk","eggs"],"dietary":["vegetarian"]}]`},
+		{name: "exclude milk and nuts", method: "GET", path: "/api/v1/items?exclude_allergens=Milk,%20tree_nuts", wantCode: 200, wantResult: `[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"},{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","price":"$2.99"},{"code":"TQ4C-VV6T-75ZX-1RMR","name":"Gala Apple","price":"$3.59"},{"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","price":"$0.79"}]`},
+		{name: "unknown allergen", method: "GET", path: "/api/v1/items?exclude_allergens=nuts", wantCode: 400, wantResult: `{"error":"unknown allergen \"nuts\""}`},
+		{name: "bad allergen", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","allergens":["kiwi"]}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.Allergens[0]' Error:Field validation for 'Allergens[0]' failed on the 'isallergen' tag"}`},
+		{name: "duplicate allergen", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","allergens":["milk","milk"]}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.Allergens' Error:Field validation for 'Allergens' failed on the 'unique' tag"}`},
+		{name: "bad dietary", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","dietary":["paleo"]}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.Dietary[0]' Error:Field validation for 'Dietary[0]' failed on the 'isdietary' tag"}`},
+		{name: "missing serving", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","nutrition":{"calories":42}}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.Nutrition.ServingSize' Error:Field validation for 'ServingSize' failed on the 'required' tag"}`},
+		{name: "negative calories", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","nutrition":{"serving_size":"1 kiwi","calories":-1}}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.Nutrition.Calories' Error:Field validation for 'Calories' failed on the 'min' tag"}`},
+		{name: "sugars above carbohydrate", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"ZRT6-72AS-K736-L4AX","name":"Kiwi","price":"0.59","nutrition":{"serving_size":"1 kiwi","carbohydrate_g":10,"sugars_g":11}}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'Item.Nutrition.Sugars' Error:Field validation for 'Sugars' failed on the 'ltefield' tag"}`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Order statuses. An order is created pending, paid once, and refunded
+// only after it was paid.
+const (
+	orderPending  = "pending"
+	orderPaid     = "paid"
+	orderRefunded = "refunded"
+)
+
+// Payment methods.
+const (
+	paymentCash = "cash"
+	paymentCard = "card"
+)
+
+// order is a sale. Its basket is a snapshot of the names, prices, discounts
+// and tax at the time the order was created; later catalog changes do not
+// affect it.
+type order struct {
+	Number      int
+	Status      string
+	Basket      pricedBasket
+	CreatedAt   time.Time
+	Payment     *payment
+	RefundedAt  *time.Time
+	CreditNotes []*creditNote // CreditNotes are the returns against the order, oldest first
+}
+
+// payment is how an order was paid.
+type payment struct {
+	Method        string
+	TenderedCents int64
+	ChangeCents   int64
+	PaidAt        time.Time
+}
+
+// totalCents returns what the customer owes for o.
+func (o *order) totalCents() int64 {
+	var cents int64
+	for _, l := range o.Basket.Lines {
+		cents += l.totalCents()
+	}
+	return cents
+}
+
+// orderBook holds the orders, numbered from 1 in the order they were created.
+type orderBook struct {
+	mu          sync.Mutex
+	orders      map[int]*order
+	last        int
+	creditNotes map[int]*creditNote
+	lastCredit  int
+	pricer      *pricer
+	carts       *cartStore
+	now         func() time.Time
+}
+
+func newOrderBook(p *pricer, carts *cartStore) *orderBook {
+	return &orderBook{orders: map[int]*order{}, creditNotes: map[int]*creditNote{}, pricer: p, carts: carts, now: time.Now}
+}
+
+// Binding from JSON with POST. Exactly one of Cart and Lines is required.
+type OrderRequest struct {
+	Cart         string     `json:"cart" binding:"omitempty,hexadecimal,len=32"` // Cart is the ID of a cart to check out; the cart is closed
+	Lines        []CartLine `json:"lines" binding:"omitempty,dive"`
+	Jurisdiction string     `json:"jurisdiction" binding:"omitempty,max=32"` // Jurisdiction is where the order is taxed; defaults to the store's
+}
+
+// OrderId is the URL binding of an order number.
+type OrderId struct {
+	Number int `uri:"id" binding:"required,min=1"`
+}
+
+// Binding from JSON with POST.
+type Payment struct {
+	Method   string `json:"method" binding:"required,oneof=cash card"`
+	Tendered string `json:"tendered" binding:"omitempty,isunitprice"` // Tendered is the cash handed over; required for cash
+}
+
+// paymentView is the JSON view of a payment.
+type paymentView struct {
+	Method   string    `json:"method"`
+	Tendered string    `json:"tendered"`
+	Change   string    `json:"change"`
+	PaidAt   time.Time `json:"paid_at"`
+}
+
+// orderView is the JSON view of an order.
+type orderView struct {
+	Number      int          `json:"id"`
+	Status      string       `json:"status"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Payment     *paymentView `json:"payment,omitempty"`
+	RefundedAt  *time.Time   `json:"refunded_at,omitempty"`
+	CreditNotes []int        `json:"credit_notes,omitempty"` // CreditNotes are the numbers of the returns against the order
+	basketView
+}
+
+// view returns the JSON view of o.
+func (o *order) view() orderView {
+	v := orderView{Number: o.Number, Status: o.Status, CreatedAt: o.CreatedAt, RefundedAt: o.RefundedAt, basketView: o.Basket.view()}
+	if p := o.Payment; p != nil {
+		v.Payment = &paymentView{Method: p.Method, Tendered: formatCents(p.TenderedCents), Change: formatCents(p.ChangeCents), PaidAt: p.PaidAt}
+	}
+	for _, cn := range o.CreditNotes {
+		v.CreditNotes = append(v.CreditNotes, cn.Number)
+	}
+	return v
+}
+
+// errOrderNotFound is returned for unknown order numbers.
+var errOrderNotFound = errors.New("order not found")
+
+// transition moves order number from status from to status to, calling
+// update with the order to record the transition.
+func (b *orderBook) transition(number int, from, to string, update func(o *order) error) (orderView, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.orders[number]
+	if !ok {
+		return orderView{}, http.StatusOK, errOrderNotFound
+	}
+	if o.Status != from {
+		return orderView{}, http.StatusConflict, fmt.Errorf("order is %s, not %s", o.Status, from)
+	}
+	if err := update(o); err != nil {
+		return orderView{}, http.StatusBadRequest, err
+	}
+	o.Status = to
+	return o.view(), http.StatusOK, nil
+}
+
+// Create Order godoc
+// @Summary Create Order
+// @Schemes
+// @Description Create a pending order from a cart or from lines. Names and prices are snapshotted when the order is created
+// @Tags orders
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /orders [post]
+func (b *orderBook) create(c *gin.Context) {
+	var req OrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Cart == "") == (len(req.Lines) == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "either cart or lines is required"})
+		return
+	}
+	lines, err := b.pricer.basketLines(req.Lines)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var ct *cart // taken out of the cart store until the order is placed
+	giveBack := func() {
+		if ct != nil {
+			b.carts.reopen(ct)
+		}
+	}
+	if req.Cart != "" {
+		var ok bool
+		if ct, ok = b.carts.checkout(req.Cart); !ok {
+			c.JSON(http.StatusOK, gin.H{"error": "cart not found"})
+			return
+		}
+		if lines = ct.Lines; len(lines) == 0 {
+			giveBack()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cart is empty"})
+			return
+		}
+	}
+	priced, err := b.pricer.price(lines, req.Jurisdiction)
+	if err != nil {
+		giveBack()
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(priced.Unavailable) > 0 {
+		giveBack()
+		c.JSON(http.StatusConflict, gin.H{"error": "items no longer available: " + strings.Join(priced.Unavailable, ", ")})
+		return
+	}
+
+	b.mu.Lock()
+	b.last++
+	o := &order{Number: b.last, Status: orderPending, Basket: priced, CreatedAt: b.now()}
+	b.orders[o.Number] = o
+	view := o.view()
+	b.mu.Unlock()
+	c.JSON(http.StatusCreated, view)
+}
+
+// Get Order godoc
+// @Summary Get Order
+// @Schemes
+// @Description Get an order with its lines and status
+// @Tags orders
+// @Param        id   path      int  true  "Order number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /order/:id [get]
+func (b *orderBook) get(c *gin.Context) {
+	var orderId OrderId
+	if err := c.ShouldBindUri(&orderId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.orders[orderId.Number]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": errOrderNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, o.view())
+}
+
+// Pay Order godoc
+// @Summary Pay Order
+// @Schemes
+// @Description Pay a pending order by card or cash. Cash payments must tender at least the total and get change
+// @Tags orders
+// @Param        id   path      int  true  "Order number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /order/:id/pay [post]
+func (b *orderBook) pay(c *gin.Context) {
+	var orderId OrderId
+	if err := c.ShouldBindUri(&orderId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var p Payment
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	view, code, err := b.transition(orderId.Number, orderPending, orderPaid, func(o *order) error {
+		total := o.totalCents()
+		paid := &payment{Method: p.Method, TenderedCents: total, PaidAt: b.now()}
+		if p.Method == paymentCash {
+			tendered, err := parseCents(p.Tendered)
+			if err != nil {
+				return errors.New("tendered is required for cash")
+			}
+			if tendered < total {
+				return fmt.Errorf("tendered %s is less than the total %s", formatCents(tendered), formatCents(total))
+			}
+			paid.TenderedCents, paid.ChangeCents = tendered, tendered-total
+		}
+		o.Payment = paid
+		return nil
+	})
+	if err != nil {
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// Refund Order godoc
+// @Summary Refund Order
+// @Schemes
+// @Description Refund a paid order in full. Orders with returns are refunded by returning the remaining lines
+// @Tags orders
+// @Param        id   path      int  true  "Order number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /order/:id/refund [post]
+func (b *orderBook) refund(c *gin.Context) {
+	var orderId OrderId
+	if err := c.ShouldBindUri(&orderId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	view, code, err := b.transition(orderId.Number, orderPaid, orderRefunded, func(o *order) error {
+		if len(o.CreditNotes) > 0 {
+			return errors.New("order has returns, return the remaining lines instead")
+		}
+		now := b.now()
+		o.RefundedAt = &now
+		return nil
+	})
+	if err != nil {
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// Receipt godoc
+// @Summary Receipt
+// @Schemes
+// @Description Receipt of an order as plain text, or as JSON with ?format=json
+// @Tags orders
+// @Param        id   path      int  true  "Order number"
+// @Param        format   query      string  false  "text or json"
+// @Produce plain
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /order/:id/receipt [get]
+func (b *orderBook) receipt(c *gin.Context) {
+	var orderId OrderId
+	if err := c.ShouldBindUri(&orderId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	format := c.DefaultQuery("format", "text")
+	if format != "text" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid format %q", format)})
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.orders[orderId.Number]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": errOrderNotFound.Error()})
+		return
+	}
+	if format == "json" {
+		c.JSON(http.StatusOK, o.receiptView())
+		return
+	}
+	c.String(http.StatusOK, o.receiptText())
+}
@@ -0,0 +1,157 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/golden"
+)
+
+// go test -run TestOrders -v
+
+func TestOrders(t *testing.T) {
+	now := time.Date(2022, 7, 8, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	defer func(table *TaxTable) { taxRates = table }(taxRates)
+	taxRates = flatTaxTable(big.NewRat(725, 10000))
+
+	db := database{
+		"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41"},
+		"E5T6-9UI3-TH15-QR88": {Name: "Peach", UnitPrice: "$2.99", Lots: []Lot{{LotNumber: "L1", BestBefore: now.Add(20 * time.Hour), Quantity: 10}}},
+		"YRT6-72AS-K736-L4AR": {Name: "Green Pepper", UnitPrice: "$0.79", Unit: unitLb},
+	}
+	database{}.setupRouter() // registers the validators
+	prices := newPricer(db, nil)
+	prices.now = clock
+	carts := newCartStore(prices)
+	carts.now = clock
+	orders := newOrderBook(prices, carts)
+	orders.now = clock
+	r := gin.New()
+	r.POST("/api/v1/carts", carts.create)
+	r.POST("/api/v1/cart/:id/lines", carts.addLine)
+	r.GET("/api/v1/cart/:id", carts.get)
+	r.POST("/api/v1/orders", orders.create)
+	r.GET("/api/v1/order/:id", orders.get)
+	r.POST("/api/v1/order/:id/pay", orders.pay)
+	r.POST("/api/v1/order/:id/refund", orders.refund)
+	r.GET("/api/v1/order/:id/receipt", orders.receipt)
+
+	var created cartView
+	assert.NilError(t, json.Unmarshal(routerPOSTReq("POST", "/api/v1/carts", nil, r).Body.Bytes(), &created))
+	cart := "/api/v1/cart/" + created.ID
+	for _, line := range []string{`{"code":"A12T-4GH7-QPL9-3N4M","quantity":"2"}`, `{"code":"E5T6-9UI3-TH15-QR88","quantity":"3"}`, `{"code":"YRT6-72AS-K736-L4AR","quantity":"1.235"}`} {
+		assert.Equal(t, routerPOSTReq("POST", cart+"/lines", []byte(line), r).Code, 200)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "neither", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{}`), wantCode: 400, wantResult: `{"error":"either cart or lines is required"}`},
+		{name: "unknown cart", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"cart":"` + strings.Repeat("0", 32) + `"}`), wantCode: 200, wantResult: `{"error":"cart not found"}`},
+		{name: "huge quantity", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"lines":[{"code":"A12T-4GH7-QPL9-3N4M","quantity":"99999999999999999999"}]}`), wantCode: 400, wantResult: `{"error":"Key: 'OrderRequest.Lines[0].Quantity' Error:Field validation for 'Quantity' failed on the 'max' tag"}`},
+		{name: "too much", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"lines":[{"code":"A12T-4GH7-QPL9-3N4M","quantity":"6000"},{"code":"A12T-4GH7-QPL9-3N4M","quantity":"6000"}]}`), wantCode: 400, wantResult: `{"error":"[1]: quantity must be at most 10000"}`},
+		{name: "unavailable", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"lines":[{"code":"ZRT6-72AS-K736-L4AZ","quantity":"1"}]}`), wantCode: 409, wantResult: `{"error":"items no longer available: ZRT6-72AS-K736-L4AZ"}`},
+		{name: "checkout", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"cart":"` + created.ID + `"}`), wantCode: 201, wantResult: `{"id":1,"status":"pending","created_at":"2022-07-08T12:00:00Z","lines":[`},
+		{name: "cart closed", method: "GET", path: cart, wantCode: 200, wantResult: `{"error":"cart not found"}`},
+		{name: "from lines", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"lines":[{"code":"A12T-4GH7-QPL9-3N4M","quantity":"1"}]}`), wantCode: 201, wantResult: `{"id":2,"status":"pending",`},
+		{name: "refund pending", method: "POST", path: "/api/v1/order/1/refund", wantCode: 409, wantResult: `{"error":"order is pending, not paid"}`},
+		{name: "short cash", method: "POST", path: "/api/v1/order/1/pay", jsonData: []byte(`{"method":"cash","tendered":"10.00"}`), wantCode: 400, wantResult: `{"error":"tendered $10.00 is less than the total $15.08"}`},
+		{name: "no cash", method: "POST", path: "/api/v1/order/1/pay", jsonData: []byte(`{"method":"cash"}`), wantCode: 400, wantResult: `{"error":"tendered is required for cash"}`},
+		{name: "pay", method: "POST", path: "/api/v1/order/1/pay", jsonData: []byte(`{"method":"cash","tendered":"20.00"}`), wantCode: 200, wantResult: `"status":"paid","created_at":"2022-07-08T12:00:00Z","payment":{"method":"cash","tendered":"$20.00","change":"$4.92","paid_at":"2022-07-08T12:00:00Z"}`},
+		{name: "pay twice", method: "POST", path: "/api/v1/order/1/pay", jsonData: []byte(`{"method":"card"}`), wantCode: 409, wantResult: `{"error":"order is paid, not pending"}`},
+		{name: "card", method: "POST", path: "/api/v1/order/2/pay", jsonData: []byte(`{"method":"card"}`), wantCode: 200, wantResult: `"payment":{"method":"card","tendered":"$3.66","change":"$0.00"`},
+		{name: "refund", method: "POST", path: "/api/v1/order/2/refund", wantCode: 200, wantResult: `"status":"refunded","created_at":"2022-07-08T12:00:00Z","payment":{"method":"card","tendered":"$3.66","change":"$0.00","paid_at":"2022-07-08T12:00:00Z"},"refunded_at":"2022-07-08T12:00:00Z"`},
+		{name: "refund twice", method: "POST", path: "/api/v1/order/2/refund", wantCode: 409, wantResult: `{"error":"order is refunded, not paid"}`},
+		{name: "not found", method: "GET", path: "/api/v1/order/3", wantCode: 200, wantResult: `{"error":"order not found"}`},
+		{name: "bad number", method: "GET", path: "/api/v1/order/0", wantCode: 400, wantResult: `{"error":"Key: 'OrderId.Number' Error:Field validation for 'Number' failed on the 'required' tag"}`},
+		{name: "bad format", method: "GET", path: "/api/v1/order/1/receipt?format=pdf", wantCode: 400, wantResult: `{"error":"invalid format \"pdf\""}`},
+		{name: "json receipt", method: "GET", path: "/api/v1/order/2/receipt?format=json", wantCode: 200, wantResult: `{"store":"GCP Go Supermarket","id":2,"status":"refunded",`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, r)
+		if tc.wantCode != got.Code || !strings.Contains(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	// Prices are snapshotted: changing the catalog does not change the order.
+	dbmux.Lock()
+	db["A12T-4GH7-QPL9-3N4M"] = Item{Name: "Romaine", UnitPrice: "$3.99"}
+	dbmux.Unlock()
+	got := routerPOSTReq("GET", "/api/v1/order/1/receipt", nil, r)
+	assert.Equal(t, got.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	golden.Assert(t, got.Body.String(), "receipt.golden")
+}
+
+// go test -run TestCheckoutRace -v
+
+func TestCheckoutRace(t *testing.T) {
+	db := database{
+		"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41"},
+	}
+	database{}.setupRouter() // registers the validators
+	prices := newPricer(db, nil)
+	carts := newCartStore(prices)
+	orders := newOrderBook(prices, carts)
+	r := gin.New()
+	r.POST("/api/v1/carts", carts.create)
+	r.POST("/api/v1/cart/:id/lines", carts.addLine)
+	r.GET("/api/v1/cart/:id", carts.get)
+	r.POST("/api/v1/orders", orders.create)
+
+	var created cartView
+	assert.NilError(t, json.Unmarshal(routerPOSTReq("POST", "/api/v1/carts", nil, r).Body.Bytes(), &created))
+	cart := "/api/v1/cart/" + created.ID
+	checkout := []byte(`{"cart":"` + created.ID + `"}`)
+
+	// A cart no order is placed for stays open.
+	assert.Equal(t, routerPOSTReq("POST", "/api/v1/orders", checkout, r).Code, 400) // empty
+	assert.Equal(t, routerPOSTReq("POST", cart+"/lines", []byte(`{"code":"A12T-4GH7-QPL9-3N4M","quantity":"2"}`), r).Code, 200)
+
+	// Checkouts of the same cart place one order.
+	codes := make(chan int)
+	for i := 0; i < 8; i++ {
+		go func() { codes <- routerPOSTReq("POST", "/api/v1/orders", checkout, r).Code }()
+	}
+	placed := 0
+	for i := 0; i < 8; i++ {
+		if <-codes == 201 {
+			placed++
+		}
+	}
+	assert.Equal(t, placed, 1)
+	assert.Equal(t, routerPOSTReq("GET", cart, nil, r).Body.String(), `{"error":"cart not found"}`)
+}
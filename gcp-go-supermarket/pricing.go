@@ -0,0 +1,310 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// basketLine is a quantity of an item to price.
+type basketLine struct {
+	ProduceCode string
+	Quantity    *big.Rat // Quantity is in the item's unit; whole for items sold by each or bunch
+}
+
+// discount is an amount taken off a line by a markdown or a promotion.
+type discount struct {
+	Promotion   string // Promotion is the ID of the promotion; empty for a markdown
+	Rule        string
+	Explanation string // Explanation says how the amount was worked out
+	Cents       int64
+}
+
+// pricedLine is a basket line priced against the catalog. All amounts are
+// in cents and rounded half up once, when they are computed.
+type pricedLine struct {
+	ProduceCode   string
+	Name          string
+	Unit          string
+	Quantity      *big.Rat
+	Category      string
+	UnitCents     int64 // UnitCents is the regular unit price
+	PriceCents    int64 // PriceCents is the unit price after any markdown
+	SubtotalCents int64 // SubtotalCents is UnitCents times Quantity
+	Discounts     []discount
+	TaxClass      string   // TaxClass is the class the line was taxed as
+	TaxRate       *big.Rat // TaxRate is the fraction charged
+	TaxCents      int64
+}
+
+// discountCents returns the sum of the discounts of l.
+func (l pricedLine) discountCents() int64 {
+	var cents int64
+	for _, d := range l.Discounts {
+		cents += d.Cents
+	}
+	return cents
+}
+
+// totalCents returns what the customer pays for l.
+func (l pricedLine) totalCents() int64 {
+	return l.SubtotalCents - l.discountCents() + l.TaxCents
+}
+
+// pricedBasket is the result of pricing a basket.
+type pricedBasket struct {
+	Lines        []pricedLine
+	Unavailable  []string // Unavailable are the codes of lines no longer in the catalog
+	Jurisdiction string   // Jurisdiction is where the basket was taxed
+	TaxTable     string   // TaxTable is the version of the rate table used
+}
+
+// maxBasketCents is the largest subtotal a basket can have. It leaves room
+// for tax and for adding up the amounts of a basket or order in int64.
+const maxBasketCents = math.MaxInt64 / 4
+
+// pricer prices baskets against the live catalog. Given the same catalog,
+// promotions, lines and clock it always produces the same result.
+type pricer struct {
+	db         database
+	promotions *promotionStore // promotions may be nil
+	now        func() time.Time
+}
+
+func newPricer(db database, promotions *promotionStore) *pricer {
+	return &pricer{db: db, promotions: promotions, now: time.Now}
+}
+
+// price prices lines in order: the regular subtotal, then markdowns, then
+// promotions, then tax on what is left after discounts. Lines are taxed in
+// jurisdiction, or taxJurisdiction when it is empty.
+func (p *pricer) price(lines []basketLine, jurisdiction string) (pricedBasket, error) {
+	if jurisdiction == "" {
+		jurisdiction = taxJurisdiction
+	}
+	calc, err := taxRates.calculator(jurisdiction)
+	if err != nil {
+		return pricedBasket{}, err
+	}
+	now := p.now()
+	var promos []activePromotion
+	if p.promotions != nil {
+		promos = p.promotions.active(now)
+	}
+	dbmux.Lock()
+	basket := pricedBasket{Lines: []pricedLine{}, Jurisdiction: calc.Jurisdiction, TaxTable: calc.Version}
+	var subtotal int64
+	for _, l := range lines {
+		item, ok := p.db[l.ProduceCode]
+		if !ok {
+			basket.Unavailable = append(basket.Unavailable, l.ProduceCode)
+			continue
+		}
+		cents, err := parseCents(item.UnitPrice)
+		if err != nil { // stored prices are validated on the way in
+			basket.Unavailable = append(basket.Unavailable, l.ProduceCode)
+			continue
+		}
+		lineCents, err := extendedPriceCents(cents, l.Quantity)
+		if err != nil || lineCents > maxBasketCents-subtotal {
+			dbmux.Unlock()
+			return pricedBasket{}, fmt.Errorf("%s: basket total too large", l.ProduceCode)
+		}
+		subtotal += lineCents
+		line := pricedLine{
+			ProduceCode:   l.ProduceCode,
+			Name:          item.Name,
+			Unit:          itemUnit(item),
+			Quantity:      l.Quantity,
+			Category:      item.Category,
+			TaxClass:      item.TaxClass,
+			UnitCents:     cents,
+			PriceCents:    cents,
+			SubtotalCents: lineCents,
+		}
+		if m := markdownFor(item, markdownRules, now); m != nil {
+			if mc, err := parseCents(m.Price); err == nil {
+				marked, _ := extendedPriceCents(mc, l.Quantity) // markdowns lower the price, so it fits when the subtotal does
+				line.PriceCents = mc
+				line.Discounts = append(line.Discounts, discount{Rule: "markdown " + m.Rule, Cents: line.SubtotalCents - marked})
+			}
+		}
+		basket.Lines = append(basket.Lines, line)
+	}
+	dbmux.Unlock()
+
+	applyPromotions(basket.Lines, promos)
+	for i, line := range basket.Lines {
+		tax := calc.tax(line.TaxClass, line.SubtotalCents-line.discountCents())
+		basket.Lines[i].TaxClass, basket.Lines[i].TaxRate, basket.Lines[i].TaxCents = tax.Class, tax.Rate, tax.Cents
+	}
+	return basket, nil
+}
+
+// discountView is the JSON view of a discount.
+type discountView struct {
+	Promotion   string `json:"promotion,omitempty"`
+	Rule        string `json:"rule"`
+	Explanation string `json:"explanation,omitempty"`
+	Amount      string `json:"amount"`
+}
+
+// lineView is the JSON view of a priced line.
+type lineView struct {
+	ProduceCode string         `json:"code"`
+	Name        string         `json:"name"`
+	Quantity    string         `json:"quantity"`
+	Unit        string         `json:"unit"`
+	UnitPrice   string         `json:"unit_price"`
+	Subtotal    string         `json:"subtotal"`
+	Discounts   []discountView `json:"discounts"`
+	Discount    string         `json:"discount"`
+	TaxClass    string         `json:"tax_class"`
+	TaxRate     string         `json:"tax_rate"` // TaxRate is in percent
+	Tax         string         `json:"tax"`
+	Total       string         `json:"total"`
+}
+
+// basketView is the JSON view of a priced basket.
+type basketView struct {
+	Lines        []lineView `json:"lines"`
+	Unavailable  []string   `json:"unavailable,omitempty"`
+	Subtotal     string     `json:"subtotal"`
+	Discount     string     `json:"discount"`
+	Tax          string     `json:"tax"`
+	Total        string     `json:"total"`
+	Jurisdiction string     `json:"jurisdiction"`
+	TaxTable     string     `json:"tax_table"`
+}
+
+// formatQuantity prints whole quantities without decimals and weights to 3
+// decimal places.
+func formatQuantity(q *big.Rat) string {
+	if q.IsInt() {
+		return q.Num().String()
+	}
+	return q.FloatString(3)
+}
+
+// view returns the JSON view of b.
+func (b pricedBasket) view() basketView {
+	v := basketView{Lines: []lineView{}, Unavailable: b.Unavailable, Jurisdiction: b.Jurisdiction, TaxTable: b.TaxTable}
+	var subtotal, disc, tax int64
+	for _, l := range b.Lines {
+		lv := lineView{
+			ProduceCode: l.ProduceCode,
+			Name:        l.Name,
+			Quantity:    formatQuantity(l.Quantity),
+			Unit:        l.Unit,
+			UnitPrice:   formatCents(l.UnitCents),
+			Subtotal:    formatCents(l.SubtotalCents),
+			Discounts:   []discountView{},
+			Discount:    formatCents(l.discountCents()),
+			TaxClass:    l.TaxClass,
+			TaxRate:     formatTaxRate(l.TaxRate),
+			Tax:         formatCents(l.TaxCents),
+			Total:       formatCents(l.totalCents()),
+		}
+		for _, d := range l.Discounts {
+			lv.Discounts = append(lv.Discounts, discountView{Promotion: d.Promotion, Rule: d.Rule, Explanation: d.Explanation, Amount: formatCents(d.Cents)})
+		}
+		v.Lines = append(v.Lines, lv)
+		subtotal += l.SubtotalCents
+		disc += l.discountCents()
+		tax += l.TaxCents
+	}
+	v.Subtotal = formatCents(subtotal)
+	v.Discount = formatCents(disc)
+	v.Tax = formatCents(tax)
+	v.Total = formatCents(subtotal - disc + tax)
+	return v
+}
+
+// Binding from JSON with POST.
+type Basket struct {
+	Lines        []CartLine `json:"lines" binding:"required,min=1,dive"`
+	Jurisdiction string     `json:"jurisdiction" binding:"omitempty,max=32"` // Jurisdiction is where the basket is taxed; defaults to the store's
+}
+
+// basketLines parses requested lines, combining lines with the same code.
+// Codes not in the catalog are kept and priced as unavailable.
+func (p *pricer) basketLines(requested []CartLine) ([]basketLine, error) {
+	var lines []basketLine
+	index := map[string]int{}
+	for i, l := range requested {
+		code := strings.ToUpper(l.ProduceCode)
+		dbmux.Lock()
+		item := p.db[code]
+		dbmux.Unlock()
+		qty, err := parseQuantity(l.Quantity, itemUnit(item))
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %v", i, err)
+		}
+		if j, ok := index[code]; ok {
+			lines[j].Quantity = new(big.Rat).Add(lines[j].Quantity, qty)
+			if err := checkQuantity(lines[j].Quantity); err != nil {
+				return nil, fmt.Errorf("[%d]: %v", i, err)
+			}
+			continue
+		}
+		index[code] = len(lines)
+		lines = append(lines, basketLine{ProduceCode: code, Quantity: qty})
+	}
+	return lines, nil
+}
+
+// Price Basket godoc
+// @Summary Price Basket
+// @Schemes
+// @Description Price a basket of items against the current catalog. Each line lists the markdowns and promotions applied to it with an explanation. Lines with the same code are combined
+// @Tags pricing
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /price-basket [post]
+func (p *pricer) priceBasket(c *gin.Context) {
+	var basket Basket
+	if err := c.ShouldBindJSON(&basket); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	lines, err := p.basketLines(basket.Lines)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	priced, err := p.price(lines, basket.Jurisdiction)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, priced.view())
+}
@@ -0,0 +1,69 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/golden"
+)
+
+// go test -run TestPriceBasket -v
+// go test -run TestPriceBasket -update
+
+func TestPriceBasket(t *testing.T) {
+	now := time.Date(2022, 7, 8, 12, 0, 0, 0, time.UTC)
+	defer func(table *TaxTable) { taxRates = table }(taxRates)
+	taxRates = flatTaxTable(big.NewRat(725, 10000))
+
+	db := database{
+		"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41"},
+		"E5T6-9UI3-TH15-QR88": {Name: "Peach", UnitPrice: "$2.99", Lots: []Lot{{LotNumber: "L1", BestBefore: now.Add(20 * time.Hour), Quantity: 10}}},
+		"YRT6-72AS-K736-L4AR": {Name: "Green Pepper", UnitPrice: "$0.79", Unit: unitLb},
+		"TQ4C-VV6T-75ZX-1RMR": {Name: "Gala Apple", UnitPrice: "$3.59", Unit: unitKg, Lots: []Lot{{LotNumber: "L2", BestBefore: now.Add(4 * time.Hour), Quantity: 5}}},
+	}
+	qty := func(s string) *big.Rat {
+		q, _ := new(big.Rat).SetString(s)
+		return q
+	}
+	p := &pricer{db: db, now: func() time.Time { return now }}
+	basket, err := p.price([]basketLine{
+		{ProduceCode: "A12T-4GH7-QPL9-3N4M", Quantity: qty("2")},
+		{ProduceCode: "E5T6-9UI3-TH15-QR88", Quantity: qty("3")},
+		{ProduceCode: "YRT6-72AS-K736-L4AR", Quantity: qty("1.235")},
+		{ProduceCode: "TQ4C-VV6T-75ZX-1RMR", Quantity: qty("0.5")},
+		{ProduceCode: "ZRT6-72AS-K736-L4AZ", Quantity: qty("1")},
+	}, "")
+	assert.NilError(t, err)
+
+	var got bytes.Buffer
+	enc := json.NewEncoder(&got)
+	enc.SetIndent("", "  ")
+	assert.NilError(t, enc.Encode(basket.view()))
+	golden.Assert(t, got.String(), "basket.golden")
+}
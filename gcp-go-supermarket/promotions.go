@@ -0,0 +1,373 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Promotion kinds.
+const (
+	promoBOGO     = "bogo"     // buy Buy, get Get free
+	promoMultiBuy = "multibuy" // Buy for Price, e.g. 3 Peaches for $5
+	promoPercent  = "percent"  // PercentOff off
+	promoBundle   = "bundle"   // one of each of Codes for Price
+)
+
+// Binding from JSON with POST.
+// Promotion is a deal on basket lines. Lines are eligible by code or by
+// category, including subcategories. Promotions apply highest Priority first;
+// a line takes at most one promotion unless every promotion on it is Stackable.
+type Promotion struct {
+	ID         string     `json:"id" binding:"required,isslug"`
+	Name       string     `json:"name" binding:"required,max=64"` // Name is shown on receipts, e.g. 3 Peaches for $5
+	Kind       string     `json:"kind" binding:"required,oneof=bogo multibuy percent bundle"`
+	Codes      []string   `json:"codes,omitempty" binding:"omitempty,unique,dive,isproducecode"`
+	Categories []string   `json:"categories,omitempty" binding:"omitempty,unique,dive,isslug"`
+	Buy        int        `json:"buy,omitempty" binding:"omitempty,min=1"`                // Buy is the units paid for (bogo) or the units in a set (multibuy)
+	Get        int        `json:"get,omitempty" binding:"omitempty,min=1"`                // Get is the units free per Buy (bogo); defaults to 1
+	Price      string     `json:"price,omitempty" binding:"omitempty,isunitprice"`        // Price is the price of a set (multibuy, bundle)
+	PercentOff int        `json:"percent_off,omitempty" binding:"omitempty,min=1,max=99"` // PercentOff is the discount (percent)
+	Starts     *time.Time `json:"starts,omitempty"`                                       // Starts is when the promotion begins; empty for now
+	Ends       *time.Time `json:"ends,omitempty"`                                         // Ends is when the promotion ends; empty for never
+	Priority   int        `json:"priority,omitempty"`                                     // Priority orders promotions, highest first
+	Stackable  bool       `json:"stackable,omitempty"`                                    // Stackable promotions combine with other stackable ones
+}
+
+// PromotionId is the URL binding of a promotion ID.
+type PromotionId struct {
+	ID string `uri:"id" binding:"required,isslug"`
+}
+
+// live reports whether p is scheduled at now.
+func (p Promotion) live(now time.Time) bool {
+	return (p.Starts == nil || !now.Before(*p.Starts)) && (p.Ends == nil || now.Before(*p.Ends))
+}
+
+// sortPromotions sorts promotions in the order they apply.
+func sortPromotions(ps []Promotion) {
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].Priority != ps[j].Priority {
+			return ps[i].Priority > ps[j].Priority
+		}
+		return ps[i].ID < ps[j].ID
+	})
+}
+
+// activePromotion is a live promotion with its categories expanded to
+// their subtrees.
+type activePromotion struct {
+	Promotion
+	codes      map[string]bool
+	categories map[string]bool
+	priceCents int64
+}
+
+// eligible reports whether line l qualifies for p.
+func (p activePromotion) eligible(l pricedLine) bool {
+	return p.codes[l.ProduceCode] || l.Category != "" && p.categories[l.Category]
+}
+
+// promotionStore holds the promotions. Its methods must not be called while
+// holding dbmux.
+type promotionStore struct {
+	mu         sync.Mutex
+	byID       map[string]Promotion
+	categories *categoryTree
+}
+
+func newPromotionStore(categories *categoryTree) *promotionStore {
+	return &promotionStore{byID: map[string]Promotion{}, categories: categories}
+}
+
+// check checks the fields p.Kind needs and normalizes codes and defaults.
+func (s *promotionStore) check(p *Promotion) error {
+	for i, code := range p.Codes {
+		p.Codes[i] = strings.ToUpper(code)
+	}
+	for _, id := range p.Categories {
+		if s.categories.subtree(id) == nil {
+			return fmt.Errorf("category %q not found", id)
+		}
+	}
+	if p.Starts != nil && p.Ends != nil && !p.Ends.After(*p.Starts) {
+		return errors.New("ends must be after starts")
+	}
+	if p.Kind == promoBundle {
+		if len(p.Codes) < 2 || len(p.Categories) > 0 {
+			return errors.New("a bundle needs two or more codes and no categories")
+		}
+	} else if len(p.Codes) == 0 && len(p.Categories) == 0 {
+		return errors.New("codes or categories are required")
+	}
+	switch p.Kind {
+	case promoBOGO:
+		if p.Buy == 0 {
+			return errors.New("bogo needs buy")
+		}
+		if p.Get == 0 {
+			p.Get = 1
+		}
+	case promoMultiBuy:
+		if p.Buy < 2 || p.Price == "" {
+			return errors.New("multibuy needs buy of 2 or more and price")
+		}
+	case promoPercent:
+		if p.PercentOff == 0 {
+			return errors.New("percent needs percent_off")
+		}
+	case promoBundle:
+		if p.Price == "" {
+			return errors.New("bundle needs price")
+		}
+	}
+	return nil
+}
+
+// active returns the promotions live at now in the order they apply.
+func (s *promotionStore) active(now time.Time) []activePromotion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var live []Promotion
+	for _, p := range s.byID {
+		if p.live(now) {
+			live = append(live, p)
+		}
+	}
+	sortPromotions(live)
+	promos := make([]activePromotion, 0, len(live))
+	for _, p := range live {
+		a := activePromotion{Promotion: p, codes: map[string]bool{}, categories: map[string]bool{}}
+		for _, code := range p.Codes {
+			a.codes[code] = true
+		}
+		for _, id := range p.Categories {
+			for cid := range s.categories.subtree(id) {
+				a.categories[cid] = true
+			}
+		}
+		if p.Price != "" {
+			a.priceCents, _ = parseCents(p.Price) // checked by isunitprice
+		}
+		promos = append(promos, a)
+	}
+	return promos
+}
+
+// wholeUnits returns the quantity of a line sold by each or bunch.
+func wholeUnits(l pricedLine) (int64, bool) {
+	if isWeightUnit(l.Unit) || !l.Quantity.IsInt() {
+		return 0, false
+	}
+	return l.Quantity.Num().Int64(), true
+}
+
+// lineDiscount is a discount for the line at index line.
+type lineDiscount struct {
+	line int
+	discount
+}
+
+// discounts works out what p takes off the eligible lines.
+func (p activePromotion) discounts(lines []pricedLine, eligible []int) []lineDiscount {
+	var out []lineDiscount
+	add := func(i int, cents int64, explanation string) {
+		out = append(out, lineDiscount{line: i, discount: discount{Promotion: p.ID, Rule: p.Name, Explanation: explanation, Cents: cents}})
+	}
+	switch p.Kind {
+	case promoBOGO:
+		for _, i := range eligible {
+			n, ok := wholeUnits(lines[i])
+			if !ok {
+				continue
+			}
+			free := n / int64(p.Buy+p.Get) * int64(p.Get)
+			add(i, free*lines[i].PriceCents, fmt.Sprintf("buy %d get %d free: %d of %d free at %s", p.Buy, p.Get, free, n, formatCents(lines[i].PriceCents)))
+		}
+	case promoMultiBuy:
+		for _, i := range eligible {
+			n, ok := wholeUnits(lines[i])
+			if !ok {
+				continue
+			}
+			sets := n / int64(p.Buy)
+			regular := int64(p.Buy) * lines[i].PriceCents
+			add(i, sets*(regular-p.priceCents), fmt.Sprintf("%d × %d for %s instead of %s", sets, p.Buy, formatCents(p.priceCents), formatCents(regular)))
+		}
+	case promoPercent:
+		for _, i := range eligible {
+			base := lines[i].SubtotalCents - lines[i].discountCents()
+			add(i, percentOf(base, p.PercentOff), fmt.Sprintf("%d%% off %s", p.PercentOff, formatCents(base)))
+		}
+	case promoBundle:
+		var members []int // one eligible line per bundle code, in the order of Codes
+		sets := int64(-1)
+		var regular int64
+		for _, code := range p.Codes {
+			found := false
+			for _, i := range eligible {
+				if n, ok := wholeUnits(lines[i]); ok && lines[i].ProduceCode == code {
+					members = append(members, i)
+					regular += lines[i].PriceCents
+					if sets < 0 || n < sets {
+						sets = n
+					}
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil
+			}
+		}
+		save := regular - p.priceCents
+		if save <= 0 {
+			return nil
+		}
+		total, left := sets*save, sets*save
+		explanation := fmt.Sprintf("%d × bundle for %s instead of %s", sets, formatCents(p.priceCents), formatCents(regular))
+		for k, i := range members { // split in proportion to the unit prices, the rest to the last line
+			share := total * lines[i].PriceCents / regular
+			if k == len(members)-1 {
+				share = left
+			}
+			left -= share
+			add(i, share, explanation)
+		}
+	}
+	return out
+}
+
+// applyPromotions adds the discounts of promos, in order, to lines.
+// A promotion never takes a line below zero.
+func applyPromotions(lines []pricedLine, promos []activePromotion) {
+	promoted := make([]bool, len(lines))  // the line has a promotion
+	exclusive := make([]bool, len(lines)) // the line has a promotion that does not stack
+	for _, p := range promos {
+		var eligible []int
+		for i, l := range lines {
+			if exclusive[i] || promoted[i] && !p.Stackable || !p.eligible(l) {
+				continue
+			}
+			eligible = append(eligible, i)
+		}
+		for _, d := range p.discounts(lines, eligible) {
+			l := &lines[d.line]
+			if left := l.SubtotalCents - l.discountCents(); d.Cents > left {
+				d.Cents = left
+			}
+			if d.Cents <= 0 {
+				continue
+			}
+			l.Discounts = append(l.Discounts, d.discount)
+			promoted[d.line] = true
+			exclusive[d.line] = exclusive[d.line] || !p.Stackable
+		}
+	}
+}
+
+// List Promotions godoc
+// @Summary List Promotions
+// @Schemes
+// @Description List all promotions, scheduled or not, in the order they apply
+// @Tags pricing
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Router /promotions [get]
+func (s *promotionStore) list(c *gin.Context) {
+	s.mu.Lock()
+	promos := []Promotion{}
+	for _, p := range s.byID {
+		promos = append(promos, p)
+	}
+	s.mu.Unlock()
+	sortPromotions(promos)
+	c.JSON(http.StatusOK, promos)
+}
+
+// Add Promotion godoc
+// @Summary Add Promotion
+// @Schemes
+// @Description Add a bogo, multibuy, percent or bundle promotion
+// @Tags pricing
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /promotions [post]
+func (s *promotionStore) add(c *gin.Context) {
+	var p Promotion
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.check(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[p.ID]; ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "promotion exists"})
+		return
+	}
+	s.byID[p.ID] = p
+	c.JSON(http.StatusCreated, gin.H{"status": "promotion added"})
+}
+
+// Delete Promotion godoc
+// @Summary Delete Promotion
+// @Schemes
+// @Description Delete a promotion
+// @Tags pricing
+// @Param        id   path      string  true  "Promotion ID"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /promotion/:id [delete]
+func (s *promotionStore) delete(c *gin.Context) {
+	var promotionId PromotionId
+	if err := c.ShouldBindUri(&promotionId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[promotionId.ID]; !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "promotion not found"})
+		return
+	}
+	delete(s.byID, promotionId.ID)
+	c.JSON(http.StatusOK, gin.H{"status": "promotion deleted"})
+}
@@ -0,0 +1,123 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestPromotions -v
+
+func TestPromotions(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	setup := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "produce", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"produce","name":"Produce"}`), wantCode: 201, wantResult: `{"status":"category added"}`},
+		{name: "fruit", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"fruit","name":"Fruit","parent":"produce"}`), wantCode: 201, wantResult: `{"status":"category added"}`},
+		{name: "peach", method: "POST", path: "/api/v1/item/E5T6-9UI3-TH15-QR88/category", jsonData: []byte(`{"category":"fruit"}`), wantCode: 200, wantResult: `{"status":"category assigned"}`},
+		{name: "apple", method: "POST", path: "/api/v1/item/TQ4C-VV6T-75ZX-1RMR/category", jsonData: []byte(`{"category":"fruit"}`), wantCode: 200, wantResult: `{"status":"category assigned"}`},
+		{name: "multibuy", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"peaches-3-for-5","name":"3 Peaches for $5","kind":"multibuy","codes":["e5t6-9ui3-th15-qr88"],"buy":3,"price":"5.00","priority":10}`), wantCode: 201, wantResult: `{"status":"promotion added"}`},
+		{name: "bundle", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"salad","name":"Salad bundle","kind":"bundle","codes":["A12T-4GH7-QPL9-3N4M","YRT6-72AS-K736-L4AR"],"price":"3.50","priority":5}`), wantCode: 201, wantResult: `{"status":"promotion added"}`},
+		{name: "percent", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"produce-10","name":"10% off produce","kind":"percent","categories":["produce"],"percent_off":10,"priority":1,"stackable":true}`), wantCode: 201, wantResult: `{"status":"promotion added"}`},
+		{name: "bogo", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"lettuce-bogo","name":"Lettuce BOGO","kind":"bogo","codes":["A12T-4GH7-QPL9-3N4M"],"buy":1}`), wantCode: 201, wantResult: `{"status":"promotion added"}`},
+		{name: "ended", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"summer","name":"Summer sale","kind":"percent","categories":["fruit"],"percent_off":50,"priority":99,"starts":"2022-06-01T00:00:00Z","ends":"2022-09-01T00:00:00Z"}`), wantCode: 201, wantResult: `{"status":"promotion added"}`},
+		{name: "exists", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"summer","name":"Summer sale","kind":"percent","codes":["A12T-4GH7-QPL9-3N4M"],"percent_off":5}`), wantCode: 409, wantResult: `{"error":"promotion exists"}`},
+		{name: "bad kind", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"x","name":"X","kind":"coupon","codes":["A12T-4GH7-QPL9-3N4M"]}`), wantCode: 400, wantResult: `{"error":"Key: 'Promotion.Kind' Error:Field validation for 'Kind' failed on the 'oneof' tag"}`},
+		{name: "no eligibility", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"x","name":"X","kind":"percent","percent_off":5}`), wantCode: 400, wantResult: `{"error":"codes or categories are required"}`},
+		{name: "unknown category", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"x","name":"X","kind":"percent","categories":["dairy"],"percent_off":5}`), wantCode: 400, wantResult: `{"error":"category \"dairy\" not found"}`},
+		{name: "multibuy of one", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"x","name":"X","kind":"multibuy","codes":["A12T-4GH7-QPL9-3N4M"],"buy":1,"price":"1.00"}`), wantCode: 400, wantResult: `{"error":"multibuy needs buy of 2 or more and price"}`},
+		{name: "bundle of one", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"x","name":"X","kind":"bundle","codes":["A12T-4GH7-QPL9-3N4M"],"price":"1.00"}`), wantCode: 400, wantResult: `{"error":"a bundle needs two or more codes and no categories"}`},
+		{name: "schedule", method: "POST", path: "/api/v1/promotions", jsonData: []byte(`{"id":"x","name":"X","kind":"percent","codes":["A12T-4GH7-QPL9-3N4M"],"percent_off":5,"starts":"2022-09-01T00:00:00Z","ends":"2022-06-01T00:00:00Z"}`), wantCode: 400, wantResult: `{"error":"ends must be after starts"}`},
+		{name: "delete", method: "DELETE", path: "/api/v1/promotion/x", wantCode: 200, wantResult: `{"error":"promotion not found"}`},
+		{name: "empty basket", method: "POST", path: "/api/v1/price-basket", jsonData: []byte(`{"lines":[]}`), wantCode: 400, wantResult: `{"error":"Key: 'Basket.Lines' Error:Field validation for 'Lines' failed on the 'min' tag"}`},
+		{name: "fractional each", method: "POST", path: "/api/v1/price-basket", jsonData: []byte(`{"lines":[{"code":"A12T-4GH7-QPL9-3N4M","quantity":"1"},{"code":"E5T6-9UI3-TH15-QR88","quantity":"1.5"}]}`), wantCode: 400, wantResult: `{"error":"[1]: item is sold by each, quantity must be whole"}`},
+	}
+	for _, tc := range setup {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	got := routerPOSTReq("GET", "/api/v1/promotions", nil, router)
+	var promos []Promotion
+	assert.NilError(t, json.Unmarshal(got.Body.Bytes(), &promos))
+	var order []string
+	for _, p := range promos {
+		order = append(order, p.ID)
+	}
+	assert.DeepEqual(t, order, []string{"summer", "peaches-3-for-5", "salad", "produce-10", "lettuce-bogo"})
+	assert.Equal(t, promos[4].Get, 1)
+
+	tests := []struct {
+		name   string
+		basket string
+		want   map[string][]discountView // discounts by code
+		total  string
+	}{
+		{
+			name:   "priority and stacking",
+			basket: `{"lines":[{"code":"E5T6-9UI3-TH15-QR88","quantity":"4"},{"code":"TQ4C-VV6T-75ZX-1RMR","quantity":"2"},{"code":"A12T-4GH7-QPL9-3N4M","quantity":"2"},{"code":"YRT6-72AS-K736-L4AR","quantity":"1"},{"code":"E5T6-9UI3-TH15-QR88","quantity":"3"}]}`,
+			want: map[string][]discountView{
+				"E5T6-9UI3-TH15-QR88": {{Promotion: "peaches-3-for-5", Rule: "3 Peaches for $5", Explanation: "2 × 3 for $5.00 instead of $8.97", Amount: "$7.94"}},
+				"TQ4C-VV6T-75ZX-1RMR": {{Promotion: "produce-10", Rule: "10% off produce", Explanation: "10% off $7.18", Amount: "$0.72"}},
+				"A12T-4GH7-QPL9-3N4M": {{Promotion: "salad", Rule: "Salad bundle", Explanation: "1 × bundle for $3.50 instead of $4.20", Amount: "$0.56"}},
+				"YRT6-72AS-K736-L4AR": {{Promotion: "salad", Rule: "Salad bundle", Explanation: "1 × bundle for $3.50 instead of $4.20", Amount: "$0.14"}},
+			},
+			total: "$26.36", // 20.93 + 7.18 + 6.82 + 0.79 - 7.94 - 0.72 - 0.70
+		},
+		{
+			name:   "bogo",
+			basket: `{"lines":[{"code":"A12T-4GH7-QPL9-3N4M","quantity":"3"}]}`,
+			want: map[string][]discountView{
+				"A12T-4GH7-QPL9-3N4M": {{Promotion: "lettuce-bogo", Rule: "Lettuce BOGO", Explanation: "buy 1 get 1 free: 1 of 3 free at $3.41", Amount: "$3.41"}},
+			},
+			total: "$6.82",
+		},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq("POST", "/api/v1/price-basket", []byte(tc.basket), router)
+		assert.Equal(t, got.Code, 200, tc.name)
+		var basket basketView
+		assert.NilError(t, json.Unmarshal(got.Body.Bytes(), &basket), tc.name)
+		discounts := map[string][]discountView{}
+		for _, l := range basket.Lines {
+			if len(l.Discounts) > 0 {
+				discounts[l.ProduceCode] = l.Discounts
+			}
+		}
+		assert.DeepEqual(t, discounts, tc.want)
+		assert.Equal(t, basket.Total, tc.total, tc.name)
+	}
+}
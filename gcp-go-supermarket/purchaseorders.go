@@ -0,0 +1,328 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Purchase order statuses. A purchase order is drafted, sent to the
+// supplier and received once.
+const (
+	poDraft    = "draft"
+	poSent     = "sent"
+	poReceived = "received"
+)
+
+// Binding from JSON with POST.
+type PurchaseOrderRequest struct {
+	Supplier string              `json:"supplier" binding:"required,isslug"`
+	Lines    []PurchaseOrderLine `json:"lines" binding:"required,min=1,dive"`
+}
+
+// Binding from JSON with POST.
+type PurchaseOrderLine struct {
+	SKU   string `json:"sku" binding:"required,max=32"` // SKU must be mapped for the supplier
+	Packs int    `json:"packs" binding:"required,min=1"`
+}
+
+// Binding from JSON with POST. Lines not listed are received as ordered.
+type Receipt struct {
+	Lines []ReceiptLine `json:"lines" binding:"omitempty,dive"`
+}
+
+// Binding from JSON with POST.
+type ReceiptLine struct {
+	Line       int        `json:"line" binding:"required,min=1"`    // Line is the 1-based number of the line on the purchase order
+	Packs      *int       `json:"packs" binding:"omitempty,min=0"`  // Packs received; defaults to the packs ordered
+	LotNumber  string     `json:"lot" binding:"omitempty,alphanum"` // LotNumber of the lot, generated when omitted
+	BestBefore *time.Time `json:"best_before"`                      // BestBefore makes the received units a lot
+}
+
+// PurchaseOrderId is the URL binding of a purchase order number.
+type PurchaseOrderId struct {
+	Number int `uri:"id" binding:"required,min=1"`
+}
+
+// poLine is a line of a purchase order, with the mapping's cost and pack
+// size at the time the order was drafted.
+type poLine struct {
+	SKU         string `json:"sku"`
+	ProduceCode string `json:"code"`
+	Packs       int    `json:"packs"`
+	PackSize    int    `json:"pack_size"`
+	Cost        string `json:"cost"`                     // Cost is the price of one pack
+	Received    *int   `json:"received_packs,omitempty"` // Received is set when the order is received
+}
+
+// stockReceipt is the stock posted for one line of a received purchase order.
+type stockReceipt struct {
+	Line        int        `json:"line"`
+	ProduceCode string     `json:"code"`
+	Units       int        `json:"units"`
+	LotNumber   string     `json:"lot,omitempty"`
+	BestBefore  *time.Time `json:"best_before,omitempty"`
+}
+
+// purchaseOrder is an order to a supplier.
+type purchaseOrder struct {
+	Number     int            `json:"id"`
+	Supplier   string         `json:"supplier"`
+	Status     string         `json:"status"`
+	Lines      []poLine       `json:"lines"`
+	Total      string         `json:"total"` // Total is the cost of the packs ordered
+	CreatedAt  time.Time      `json:"created_at"`
+	SentAt     *time.Time     `json:"sent_at,omitempty"`
+	ReceivedAt *time.Time     `json:"received_at,omitempty"`
+	Receipts   []stockReceipt `json:"receipts,omitempty"`
+}
+
+// Create Purchase Order godoc
+// @Summary Create Purchase Order
+// @Schemes
+// @Description Draft a purchase order to a supplier by supplier SKU. Pack costs and sizes are taken from the supplier's item mappings
+// @Tags procurement
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Router /purchase-orders [post]
+func (p *procurement) createOrder(c *gin.Context) {
+	var req PurchaseOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.suppliers[req.Supplier]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "supplier not found"})
+		return
+	}
+	po := &purchaseOrder{Supplier: s.ID, Status: poDraft, Lines: []poLine{}, CreatedAt: p.now()}
+	var total int64
+	for i, l := range req.Lines {
+		m, ok := s.Items[l.SKU]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("[%d]: sku %s is not mapped for %s", i, l.SKU, s.ID)})
+			return
+		}
+		cost, _ := parseCents(m.Cost) // checked by isunitprice
+		total += cost * int64(l.Packs)
+		po.Lines = append(po.Lines, poLine{SKU: m.SKU, ProduceCode: m.ProduceCode, Packs: l.Packs, PackSize: m.PackSize, Cost: formatCents(cost)})
+	}
+	po.Total = formatCents(total)
+	p.last++
+	po.Number = p.last
+	p.orders[po.Number] = po
+	c.JSON(http.StatusCreated, po)
+}
+
+// List Purchase Orders godoc
+// @Summary List Purchase Orders
+// @Schemes
+// @Description List purchase orders, newest first, optionally only those with ?status=draft, sent or received
+// @Tags procurement
+// @Param        status   query      string  false  "draft, sent or received"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Router /purchase-orders [get]
+func (p *procurement) listOrders(c *gin.Context) {
+	status := c.Query("status")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	orders := []*purchaseOrder{}
+	for _, po := range p.orders {
+		if status == "" || po.Status == status {
+			orders = append(orders, po)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].Number > orders[j].Number })
+	c.JSON(http.StatusOK, orders)
+}
+
+// lookupOrder binds the purchase order number of c and returns the order.
+// It writes the error response itself. The caller must hold p.mu.
+func (p *procurement) lookupOrder(c *gin.Context) (*purchaseOrder, bool) {
+	var id PurchaseOrderId
+	if err := c.ShouldBindUri(&id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	po, ok := p.orders[id.Number]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "purchase order not found"})
+	}
+	return po, ok
+}
+
+// Get Purchase Order godoc
+// @Summary Get Purchase Order
+// @Schemes
+// @Description Get a purchase order with its lines and, once received, the stock posted
+// @Tags procurement
+// @Param        id   path      int  true  "Purchase order number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /purchase-order/:id [get]
+func (p *procurement) getOrder(c *gin.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if po, ok := p.lookupOrder(c); ok {
+		c.JSON(http.StatusOK, po)
+	}
+}
+
+// Send Purchase Order godoc
+// @Summary Send Purchase Order
+// @Schemes
+// @Description Mark a draft purchase order as sent to the supplier
+// @Tags procurement
+// @Param        id   path      int  true  "Purchase order number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /purchase-order/:id/send [post]
+func (p *procurement) sendOrder(c *gin.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	po, ok := p.lookupOrder(c)
+	if !ok {
+		return
+	}
+	if po.Status != poDraft {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("purchase order is %s, not %s", po.Status, poDraft)})
+		return
+	}
+	now := p.now()
+	po.Status, po.SentAt = poSent, &now
+	c.JSON(http.StatusOK, po)
+}
+
+// Receive Purchase Order godoc
+// @Summary Receive Purchase Order
+// @Schemes
+// @Description Receive a sent purchase order and post the units received to stock. Lines with a best-before date are received as lots
+// @Tags procurement
+// @Param        id   path      int  true  "Purchase order number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /purchase-order/:id/receive [post]
+func (p *procurement) receiveOrder(c *gin.Context) {
+	var receipt Receipt
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&receipt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	po, ok := p.lookupOrder(c)
+	if !ok {
+		return
+	}
+	if po.Status != poSent {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("purchase order is %s, not %s", po.Status, poSent)})
+		return
+	}
+	received := make([]ReceiptLine, len(po.Lines))
+	for i, l := range po.Lines {
+		packs := l.Packs
+		received[i] = ReceiptLine{Line: i + 1, Packs: &packs}
+	}
+	for i, r := range receipt.Lines {
+		if r.Line > len(po.Lines) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("[%d]: purchase order has no line %d", i, r.Line)})
+			return
+		}
+		if r.Packs == nil {
+			r.Packs = received[r.Line-1].Packs
+		}
+		received[r.Line-1] = r
+	}
+
+	now := p.now()
+	name := p.suppliers[po.Supplier].Name
+	dbmux.Lock()
+	for _, l := range po.Lines {
+		if _, ok := p.db[l.ProduceCode]; !ok {
+			dbmux.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("code %s is no longer in the catalog", l.ProduceCode)})
+			return
+		}
+	}
+	var receipts []stockReceipt
+	for i, r := range received {
+		l := &po.Lines[i]
+		l.Received = r.Packs
+		units := *r.Packs * l.PackSize
+		if units == 0 {
+			continue
+		}
+		item := p.db[l.ProduceCode]
+		sr := stockReceipt{Line: i + 1, ProduceCode: l.ProduceCode, Units: units}
+		if r.BestBefore != nil {
+			untracked := item.Stock - lotQuantity(item.Lots)
+			lot := Lot{LotNumber: r.LotNumber, Supplier: name, ReceivedAt: now, BestBefore: *r.BestBefore, Quantity: units}
+			if lot.LotNumber == "" {
+				base := fmt.Sprintf("PO%d%s", po.Number, now.Format("20060102"))
+				lot.LotNumber = newLotNumber(item.Lots, func(n int) string {
+					if n == 1 {
+						return base
+					}
+					return fmt.Sprintf("%s%d", base, n) // e.g. two lines of the order for the item
+				})
+			}
+			item.Lots = append(item.Lots[:len(item.Lots):len(item.Lots)], lot)
+			normalizeLots(&item, now)
+			item.Stock = untracked + lotQuantity(item.Lots)
+			sr.LotNumber, sr.BestBefore = lot.LotNumber, r.BestBefore
+		} else {
+			item.Stock += units
+		}
+		p.db.put(actorFrom(c), l.ProduceCode, item)
+		receipts = append(receipts, sr)
+	}
+	dbmux.Unlock()
+
+	po.Status, po.ReceivedAt, po.Receipts = poReceived, &now, receipts
+	if p.inv != nil {
+		p.inv.evaluator.evaluate()
+	}
+	c.JSON(http.StatusOK, po)
+}
@@ -0,0 +1,97 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestPurchaseOrders -v
+
+func TestPurchaseOrders(t *testing.T) {
+	now := time.Date(2022, 7, 8, 12, 0, 0, 0, time.UTC)
+	db := database{
+		"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41", Stock: 5},
+		"E5T6-9UI3-TH15-QR88": {Name: "Peach", UnitPrice: "$2.99", Stock: 2, Lots: []Lot{{LotNumber: "L1", Supplier: "Coast Produce", ReceivedAt: now.Add(-48 * time.Hour), BestBefore: now.Add(24 * time.Hour), Quantity: 2}}},
+	}
+	database{}.setupRouter() // registers the validators
+	p := newProcurement(db, nil)
+	p.now = func() time.Time { return now }
+	r := gin.New()
+	r.POST("/api/v1/suppliers", p.addSupplier)
+	r.POST("/api/v1/supplier/:id/items", p.mapItems)
+	r.GET("/api/v1/purchase-orders", p.listOrders)
+	r.POST("/api/v1/purchase-orders", p.createOrder)
+	r.GET("/api/v1/purchase-order/:id", p.getOrder)
+	r.POST("/api/v1/purchase-order/:id/send", p.sendOrder)
+	r.POST("/api/v1/purchase-order/:id/receive", p.receiveOrder)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "supplier", method: "POST", path: "/api/v1/suppliers", jsonData: []byte(`{"id":"valley-farms","name":"Valley Farms"}`), wantCode: 201, wantResult: `{"status":"supplier added"}`},
+		{name: "map", method: "POST", path: "/api/v1/supplier/valley-farms/items", jsonData: []byte(`[{"sku":"VF-LET-24","code":"A12T-4GH7-QPL9-3N4M","cost":"48.00","pack_size":24},{"sku":"VF-PCH-40","code":"E5T6-9UI3-TH15-QR88","cost":"71.60","pack_size":40}]`), wantCode: 201, wantResult: `{"status":"supplier items mapped"}`},
+		{name: "unknown supplier", method: "POST", path: "/api/v1/purchase-orders", jsonData: []byte(`{"supplier":"hill","lines":[{"sku":"VF-LET-24","packs":1}]}`), wantCode: 400, wantResult: `{"error":"supplier not found"}`},
+		{name: "unmapped sku", method: "POST", path: "/api/v1/purchase-orders", jsonData: []byte(`{"supplier":"valley-farms","lines":[{"sku":"VF-APL-40","packs":1}]}`), wantCode: 400, wantResult: `{"error":"[0]: sku VF-APL-40 is not mapped for valley-farms"}`},
+		{name: "draft", method: "POST", path: "/api/v1/purchase-orders", jsonData: []byte(`{"supplier":"valley-farms","lines":[{"sku":"VF-LET-24","packs":2},{"sku":"VF-PCH-40","packs":1}]}`), wantCode: 201, wantResult: `{"id":1,"supplier":"valley-farms","status":"draft","lines":[{"sku":"VF-LET-24","code":"A12T-4GH7-QPL9-3N4M","packs":2,"pack_size":24,"cost":"$48.00"},{"sku":"VF-PCH-40","code":"E5T6-9UI3-TH15-QR88","packs":1,"pack_size":40,"cost":"$71.60"}],"total":"$167.60","created_at":"2022-07-08T12:00:00Z"}`},
+		{name: "receive draft", method: "POST", path: "/api/v1/purchase-order/1/receive", wantCode: 409, wantResult: `{"error":"purchase order is draft, not sent"}`},
+		{name: "send", method: "POST", path: "/api/v1/purchase-order/1/send", wantCode: 200, wantResult: `"status":"sent",`},
+		{name: "send twice", method: "POST", path: "/api/v1/purchase-order/1/send", wantCode: 409, wantResult: `{"error":"purchase order is sent, not draft"}`},
+		{name: "bad line", method: "POST", path: "/api/v1/purchase-order/1/receive", jsonData: []byte(`{"lines":[{"line":3,"packs":1}]}`), wantCode: 400, wantResult: `{"error":"[0]: purchase order has no line 3"}`},
+		{name: "receive", method: "POST", path: "/api/v1/purchase-order/1/receive", jsonData: []byte(`{"lines":[{"line":1,"packs":1},{"line":2,"best_before":"2022-07-12T00:00:00Z"}]}`), wantCode: 200, wantResult: `"status":"received","lines":[{"sku":"VF-LET-24","code":"A12T-4GH7-QPL9-3N4M","packs":2,"pack_size":24,"cost":"$48.00","received_packs":1},{"sku":"VF-PCH-40","code":"E5T6-9UI3-TH15-QR88","packs":1,"pack_size":40,"cost":"$71.60","received_packs":1}],"total":"$167.60","created_at":"2022-07-08T12:00:00Z","sent_at":"2022-07-08T12:00:00Z","received_at":"2022-07-08T12:00:00Z","receipts":[{"line":1,"code":"A12T-4GH7-QPL9-3N4M","units":24},{"line":2,"code":"E5T6-9UI3-TH15-QR88","units":40,"lot":"PO120220708","best_before":"2022-07-12T00:00:00Z"}]}`},
+		{name: "receive twice", method: "POST", path: "/api/v1/purchase-order/1/receive", wantCode: 409, wantResult: `{"error":"purchase order is received, not sent"}`},
+		{name: "second draft", method: "POST", path: "/api/v1/purchase-orders", jsonData: []byte(`{"supplier":"valley-farms","lines":[{"sku":"VF-LET-24","packs":1}]}`), wantCode: 201, wantResult: `{"id":2,`},
+		{name: "list drafts", method: "GET", path: "/api/v1/purchase-orders?status=draft", wantCode: 200, wantResult: `[{"id":2,"supplier":"valley-farms","status":"draft",`},
+		{name: "not found", method: "GET", path: "/api/v1/purchase-order/3", wantCode: 200, wantResult: `{"error":"purchase order not found"}`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, r)
+		if tc.wantCode != got.Code || !strings.Contains(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	var orders []purchaseOrder
+	assert.NilError(t, json.Unmarshal(routerPOSTReq("GET", "/api/v1/purchase-orders", nil, r).Body.Bytes(), &orders))
+	assert.Equal(t, len(orders), 2)
+
+	// Received units are posted to stock; units with a best-before date become a lot.
+	assert.Equal(t, db["A12T-4GH7-QPL9-3N4M"].Stock, 29)
+	peach := db["E5T6-9UI3-TH15-QR88"]
+	assert.Equal(t, peach.Stock, 42)
+	assert.DeepEqual(t, peach.Lots, []Lot{
+		{LotNumber: "L1", Supplier: "Coast Produce", ReceivedAt: now.Add(-48 * time.Hour), BestBefore: now.Add(24 * time.Hour), Quantity: 2},
+		{LotNumber: "PO120220708", Supplier: "Valley Farms", ReceivedAt: now, BestBefore: time.Date(2022, 7, 12, 0, 0, 0, 0, time.UTC), Quantity: 40},
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// receiptStore is the store name printed at the top of receipts.
+const receiptStore = "GCP Go Supermarket"
+
+// receiptWidth is the width of a plain text receipt, in characters.
+const receiptWidth = 40
+
+// receiptView is the JSON receipt of an order.
+type receiptView struct {
+	Store string `json:"store"`
+	orderView
+}
+
+// receiptView returns the JSON receipt of o.
+func (o *order) receiptView() receiptView {
+	return receiptView{Store: receiptStore, orderView: o.view()}
+}
+
+// receiptRow returns left and right on one line of a receipt, truncating
+// left so right always fits.
+func receiptRow(left, right string) string {
+	room := receiptWidth - utf8.RuneCountInString(right) - 1
+	if n := utf8.RuneCountInString(left); n > room {
+		left = string([]rune(left)[:room])
+	}
+	return left + strings.Repeat(" ", receiptWidth-utf8.RuneCountInString(left)-utf8.RuneCountInString(right)) + right + "\n"
+}
+
+// receiptText returns the plain text receipt of o.
+func (o *order) receiptText() string {
+	var b strings.Builder
+	rule := strings.Repeat("-", receiptWidth) + "\n"
+	pad := (receiptWidth - len(receiptStore)) / 2
+	b.WriteString(strings.Repeat(" ", pad) + receiptStore + "\n")
+	b.WriteString(receiptRow(fmt.Sprintf("Order %d", o.Number), o.CreatedAt.Format("2006-01-02 15:04")))
+	b.WriteString(rule)
+
+	v := o.Basket.view()
+	for _, l := range v.Lines {
+		b.WriteString(receiptRow(l.Name, l.Subtotal))
+		if l.Unit == unitEach {
+			b.WriteString(fmt.Sprintf("  %s @ %s\n", l.Quantity, l.UnitPrice))
+		} else {
+			b.WriteString(fmt.Sprintf("  %s %s @ %s/%s\n", l.Quantity, l.Unit, l.UnitPrice, l.Unit))
+		}
+		for _, d := range l.Discounts {
+			b.WriteString(receiptRow("  "+d.Rule, "-"+d.Amount))
+		}
+	}
+	b.WriteString(rule)
+	b.WriteString(receiptRow("Subtotal", v.Subtotal))
+	if v.Discount != formatCents(0) {
+		b.WriteString(receiptRow("Discounts", "-"+v.Discount))
+	}
+	tax := "Tax"
+	if v.Jurisdiction != defaultJurisdiction {
+		tax += " " + v.Jurisdiction
+	}
+	b.WriteString(receiptRow(tax, v.Tax))
+	b.WriteString(receiptRow("Total", v.Total))
+
+	if p := o.Payment; p != nil {
+		b.WriteString(rule)
+		b.WriteString(receiptRow(strings.ToUpper(p.Method[:1])+p.Method[1:], formatCents(p.TenderedCents)))
+		if p.Method == paymentCash {
+			b.WriteString(receiptRow("Change", formatCents(p.ChangeCents)))
+		}
+	}
+	b.WriteString(strings.ToUpper(o.Status) + "\n")
+	return b.String()
+}
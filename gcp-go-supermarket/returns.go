@@ -0,0 +1,345 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// returnApprovalCents is the total refunded on an order above which a return
+// needs a manager's approval. It is set from the -returns.approval flag in
+// main.
+var returnApprovalCents int64 = 5000
+
+// creditNote records a return against an order. Each line references the
+// order line it returns.
+type creditNote struct {
+	Number     int
+	Order      int
+	Lines      []creditLine
+	ApprovedBy string
+	CreatedAt  time.Time
+}
+
+// creditLine is a returned quantity of one order line.
+type creditLine struct {
+	OrderLine   int // OrderLine is the 1-based number of the line on the order
+	Quantity    *big.Rat
+	Reason      string
+	Resaleable  bool
+	TaxCents    int64 // TaxCents is the part of AmountCents that is tax
+	AmountCents int64
+}
+
+// totalCents returns the refund of n.
+func (n *creditNote) totalCents() int64 {
+	var cents int64
+	for _, l := range n.Lines {
+		cents += l.AmountCents
+	}
+	return cents
+}
+
+// Binding from JSON with POST.
+type ReturnRequest struct {
+	Lines      []ReturnLine `json:"lines" binding:"required,min=1,dive"`
+	ApprovedBy string       `json:"approved_by" binding:"omitempty,alphanum,max=32"` // ApprovedBy is the ID of the manager approving a refund above the threshold
+}
+
+// Binding from JSON with POST.
+type ReturnLine struct {
+	Line       int    `json:"line" binding:"required,min=1"`                                                 // Line is the 1-based number of the line on the order
+	Quantity   string `json:"quantity" binding:"required,isweight,max=9"`                                    // Quantity returned, whole for items sold by each or bunch
+	Reason     string `json:"reason" binding:"required,oneof=damaged expired quality wrong_item not_wanted"` // Reason is the reason code
+	Resaleable bool   `json:"resaleable"`                                                                    // Resaleable lines go back into stock
+}
+
+// CreditNoteId is the URL binding of a credit note number.
+type CreditNoteId struct {
+	Number int `uri:"id" binding:"required,min=1"`
+}
+
+// creditLineView is the JSON view of a credit note line.
+type creditLineView struct {
+	OrderLine  int    `json:"order_line"`
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	Quantity   string `json:"quantity"`
+	Reason     string `json:"reason"`
+	Resaleable bool   `json:"resaleable"`
+	Tax        string `json:"tax"`
+	Amount     string `json:"amount"`
+}
+
+// creditNoteView is the JSON view of a credit note.
+type creditNoteView struct {
+	Number     int              `json:"id"`
+	Order      int              `json:"order"`
+	Lines      []creditLineView `json:"lines"`
+	Total      string           `json:"total"`
+	ApprovedBy string           `json:"approved_by,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+// view returns the JSON view of n, a credit note against o.
+func (n *creditNote) view(o *order) creditNoteView {
+	v := creditNoteView{Number: n.Number, Order: n.Order, Lines: []creditLineView{}, Total: formatCents(n.totalCents()), ApprovedBy: n.ApprovedBy, CreatedAt: n.CreatedAt}
+	for _, l := range n.Lines {
+		sold := o.Basket.Lines[l.OrderLine-1]
+		v.Lines = append(v.Lines, creditLineView{
+			OrderLine:  l.OrderLine,
+			Code:       sold.ProduceCode,
+			Name:       sold.Name,
+			Quantity:   formatQuantity(l.Quantity),
+			Reason:     l.Reason,
+			Resaleable: l.Resaleable,
+			Tax:        formatCents(l.TaxCents),
+			Amount:     formatCents(l.AmountCents),
+		})
+	}
+	return v
+}
+
+// refundedCents returns the refunds of the credit notes of o.
+func (o *order) refundedCents() int64 {
+	var cents int64
+	for _, n := range o.CreditNotes {
+		cents += n.totalCents()
+	}
+	return cents
+}
+
+// returned returns the quantity and refund of order line i (0-based) across
+// the credit notes of o.
+func (o *order) returned(i int) (*big.Rat, int64, int64) {
+	qty := new(big.Rat)
+	var amount, tax int64
+	for _, n := range o.CreditNotes {
+		for _, l := range n.Lines {
+			if l.OrderLine == i+1 {
+				qty.Add(qty, l.Quantity)
+				amount += l.AmountCents
+				tax += l.TaxCents
+			}
+		}
+	}
+	return qty, amount, tax
+}
+
+// share returns part of cents for returning qty of sold, rounded half up.
+// The return that completes a line gets what is left of it instead, so the
+// refunds of a line always add up to what was paid for it.
+func share(cents int64, qty, returned, sold *big.Rat, refunded int64) int64 {
+	if new(big.Rat).Add(returned, qty).Cmp(sold) == 0 {
+		return cents - refunded
+	}
+	r := new(big.Rat).Mul(new(big.Rat).SetInt64(cents), qty)
+	part, _ := roundHalfUp(r.Quo(r, sold)) // at most cents, as qty is less than what is left of sold
+	return part
+}
+
+// creditLines works out the refund of each requested line of o. The caller
+// must hold the order book's lock.
+func (o *order) creditLines(req []ReturnLine) ([]creditLine, error) {
+	var lines []creditLine
+	for i, r := range req {
+		if r.Line > len(o.Basket.Lines) {
+			return nil, fmt.Errorf("[%d]: order has no line %d", i, r.Line)
+		}
+		sold := o.Basket.Lines[r.Line-1]
+		qty, err := parseQuantity(r.Quantity, sold.Unit)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %v", i, err)
+		}
+		returned, amount, tax := o.returned(r.Line - 1)
+		for _, l := range lines { // the same line may be listed more than once
+			if l.OrderLine == r.Line {
+				returned.Add(returned, l.Quantity)
+				amount += l.AmountCents
+				tax += l.TaxCents
+			}
+		}
+		if left := new(big.Rat).Sub(sold.Quantity, returned); qty.Cmp(left) > 0 {
+			return nil, fmt.Errorf("[%d]: only %s of line %d can be returned", i, formatQuantity(left), r.Line)
+		}
+		lines = append(lines, creditLine{
+			OrderLine:   r.Line,
+			Quantity:    qty,
+			Reason:      r.Reason,
+			Resaleable:  r.Resaleable,
+			TaxCents:    share(sold.TaxCents, qty, returned, sold.Quantity, tax),
+			AmountCents: share(sold.totalCents(), qty, returned, sold.Quantity, amount),
+		})
+	}
+	return lines, nil
+}
+
+// fullyReturned reports whether every line of o has been returned.
+func (o *order) fullyReturned() bool {
+	for i, l := range o.Basket.Lines {
+		if returned, _, _ := o.returned(i); returned.Cmp(l.Quantity) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// restock puts the resaleable whole units of n back into stock. Items no
+// longer in the catalog and items sold by weight are not restocked.
+func (b *orderBook) restock(who actor, o *order, n *creditNote) {
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	for _, l := range n.Lines {
+		code := o.Basket.Lines[l.OrderLine-1].ProduceCode
+		item, ok := b.pricer.db[code]
+		if !l.Resaleable || !ok || isWeightUnit(itemUnit(item)) || !l.Quantity.IsInt() {
+			continue
+		}
+		item.Stock += int(l.Quantity.Num().Int64())
+		b.pricer.db.put(who, code, item)
+	}
+}
+
+// Return Items godoc
+// @Summary Return Items
+// @Schemes
+// @Description Return some or all of the lines of a paid order and issue a credit note. Refunds are the share of what was paid for each line, tax included. Returns that take the order's refunds above the approval threshold need approved_by and the admin token. Resaleable lines go back into stock
+// @Tags orders
+// @Param        id   path      int  true  "Order number"
+// @Param X-Admin-Token header string false "admin token, see -admin.token; needed with approved_by"
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Failure 403 {string} error
+// @Failure 409 {string} error
+// @Router /order/:id/returns [post]
+func (b *orderBook) returnItems(c *gin.Context) {
+	var orderId OrderId
+	if err := c.ShouldBindUri(&orderId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req ReturnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ApprovedBy != "" && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "approving a refund needs an admin token"})
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.orders[orderId.Number]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": errOrderNotFound.Error()})
+		return
+	}
+	if o.Status != orderPaid {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("order is %s, not %s", o.Status, orderPaid)})
+		return
+	}
+	lines, err := o.creditLines(req.Lines)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	note := &creditNote{Order: o.Number, Lines: lines, ApprovedBy: req.ApprovedBy, CreatedAt: b.now()}
+	if o.refundedCents()+note.totalCents() > returnApprovalCents && req.ApprovedBy == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("refunds over %s need a manager's approval", formatCents(returnApprovalCents))})
+		return
+	}
+	b.lastCredit++
+	note.Number = b.lastCredit
+	b.creditNotes[note.Number] = note
+	o.CreditNotes = append(o.CreditNotes, note)
+	if o.fullyReturned() {
+		o.Status, o.RefundedAt = orderRefunded, &note.CreatedAt
+	}
+	b.restock(actorFrom(c), o, note)
+	c.JSON(http.StatusCreated, note.view(o))
+}
+
+// List Returns godoc
+// @Summary List Returns
+// @Schemes
+// @Description List the credit notes of an order
+// @Tags orders
+// @Param        id   path      int  true  "Order number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /order/:id/returns [get]
+func (b *orderBook) returns(c *gin.Context) {
+	var orderId OrderId
+	if err := c.ShouldBindUri(&orderId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.orders[orderId.Number]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": errOrderNotFound.Error()})
+		return
+	}
+	views := []creditNoteView{}
+	for _, n := range o.CreditNotes {
+		views = append(views, n.view(o))
+	}
+	c.JSON(http.StatusOK, views)
+}
+
+// Get Credit Note godoc
+// @Summary Get Credit Note
+// @Schemes
+// @Description Get a credit note with the order lines it returns
+// @Tags orders
+// @Param        id   path      int  true  "Credit note number"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /credit-note/:id [get]
+func (b *orderBook) creditNote(c *gin.Context) {
+	var creditNoteId CreditNoteId
+	if err := c.ShouldBindUri(&creditNoteId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, ok := b.creditNotes[creditNoteId.Number]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "credit note not found"})
+		return
+	}
+	c.JSON(http.StatusOK, n.view(b.orders[n.Order]))
+}
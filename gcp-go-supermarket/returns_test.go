@@ -0,0 +1,123 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestShare -v
+
+func TestShare(t *testing.T) {
+	three := big.NewRat(3, 1)
+	one := big.NewRat(1, 1)
+	// $10.00 for 3 units returned one at a time refunds 3.33, 3.33 and the 3.34 left.
+	assert.Equal(t, share(1000, one, new(big.Rat), three, 0), int64(333))
+	assert.Equal(t, share(1000, one, one, three, 333), int64(333))
+	assert.Equal(t, share(1000, one, big.NewRat(2, 1), three, 666), int64(334))
+	assert.Equal(t, share(1000, three, new(big.Rat), three, 0), int64(1000))
+	assert.Equal(t, share(98, big.NewRat(1, 2), new(big.Rat), big.NewRat(1235, 1000), 0), int64(40)) // 39.68
+}
+
+// go test -run TestReturns -v
+
+func TestReturns(t *testing.T) {
+	now := time.Date(2022, 7, 8, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	defer func(table *TaxTable) { taxRates = table }(taxRates)
+	taxRates = flatTaxTable(big.NewRat(725, 10000))
+
+	db := database{
+		"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41", Stock: 10},
+		"E5T6-9UI3-TH15-QR88": {Name: "Peach", UnitPrice: "$2.99", Stock: 10},
+		"YRT6-72AS-K736-L4AR": {Name: "Green Pepper", UnitPrice: "$0.79", Unit: unitLb},
+		"TQ4C-VV6T-75ZX-1RMR": {Name: "Gala Apple", UnitPrice: "$30.00", Stock: 10},
+	}
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "s3cret"
+	database{}.setupRouter() // registers the validators
+	prices := newPricer(db, nil)
+	orders := newOrderBook(prices, newCartStore(prices))
+	orders.now = clock
+	r := gin.New()
+	r.POST("/api/v1/orders", orders.create)
+	r.GET("/api/v1/order/:id", orders.get)
+	r.POST("/api/v1/order/:id/pay", orders.pay)
+	r.POST("/api/v1/order/:id/refund", orders.refund)
+	r.POST("/api/v1/order/:id/returns", orders.returnItems)
+	r.GET("/api/v1/order/:id/returns", orders.returns)
+	r.GET("/api/v1/credit-note/:id", orders.creditNote)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		admin      bool
+		wantCode   int
+		wantResult string
+	}{
+		{name: "order", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"lines":[{"code":"A12T-4GH7-QPL9-3N4M","quantity":"3"},{"code":"YRT6-72AS-K736-L4AR","quantity":"1.235"}]}`), wantCode: 201, wantResult: `{"id":1,"status":"pending"`},
+		{name: "pending", method: "POST", path: "/api/v1/order/1/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"1","reason":"damaged"}]}`), wantCode: 409, wantResult: `{"error":"order is pending, not paid"}`},
+		{name: "pay", method: "POST", path: "/api/v1/order/1/pay", jsonData: []byte(`{"method":"card"}`), wantCode: 200, wantResult: `"status":"paid"`},
+		{name: "no line", method: "POST", path: "/api/v1/order/1/returns", jsonData: []byte(`{"lines":[{"line":3,"quantity":"1","reason":"damaged"}]}`), wantCode: 400, wantResult: `{"error":"[0]: order has no line 3"}`},
+		{name: "bad reason", method: "POST", path: "/api/v1/order/1/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"1","reason":"bored"}]}`), wantCode: 400, wantResult: `{"error":"Key: 'ReturnRequest.Lines[0].Reason' Error:Field validation for 'Reason' failed on the 'oneof' tag"}`},
+		{name: "too many", method: "POST", path: "/api/v1/order/1/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"2","reason":"damaged"},{"line":1,"quantity":"2","reason":"expired"}]}`), wantCode: 400, wantResult: `{"error":"[1]: only 1 of line 1 can be returned"}`},
+		{name: "fractional", method: "POST", path: "/api/v1/order/1/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"0.5","reason":"damaged"}]}`), wantCode: 400, wantResult: `{"error":"[0]: item is sold by each, quantity must be whole"}`},
+		{name: "partial", method: "POST", path: "/api/v1/order/1/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"1","reason":"not_wanted","resaleable":true},{"line":2,"quantity":"0.5","reason":"quality"}]}`), wantCode: 201, wantResult: `{"id":1,"order":1,"lines":[{"order_line":1,"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","quantity":"1","reason":"not_wanted","resaleable":true,"tax":"$0.25","amount":"$3.66"},{"order_line":2,"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","quantity":"0.500","reason":"quality","resaleable":false,"tax":"$0.03","amount":"$0.43"}],"total":"$4.09","created_at":"2022-07-08T12:00:00Z"}`},
+		{name: "still paid", method: "GET", path: "/api/v1/order/1", wantCode: 200, wantResult: `"status":"paid","created_at":"2022-07-08T12:00:00Z","payment":{"method":"card","tendered":"$12.02","change":"$0.00","paid_at":"2022-07-08T12:00:00Z"},"credit_notes":[1],`},
+		{name: "full refund", method: "POST", path: "/api/v1/order/1/refund", wantCode: 400, wantResult: `{"error":"order has returns, return the remaining lines instead"}`},
+		{name: "rest", method: "POST", path: "/api/v1/order/1/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"2","reason":"expired"},{"line":2,"quantity":"0.735","reason":"quality"}]}`), wantCode: 201, wantResult: `"lines":[{"order_line":1,"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","quantity":"2","reason":"expired","resaleable":false,"tax":"$0.49","amount":"$7.31"},{"order_line":2,"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","quantity":"0.735","reason":"quality","resaleable":false,"tax":"$0.04","amount":"$0.62"}],"total":"$7.93"`},
+		{name: "refunded", method: "GET", path: "/api/v1/order/1", wantCode: 200, wantResult: `"status":"refunded",`},
+		{name: "list", method: "GET", path: "/api/v1/order/1/returns", wantCode: 200, wantResult: `[{"id":1,"order":1,`},
+		{name: "credit note", method: "GET", path: "/api/v1/credit-note/2", wantCode: 200, wantResult: `{"id":2,"order":1,`},
+		{name: "credit note not found", method: "GET", path: "/api/v1/credit-note/3", wantCode: 200, wantResult: `{"error":"credit note not found"}`},
+		{name: "big order", method: "POST", path: "/api/v1/orders", jsonData: []byte(`{"lines":[{"code":"TQ4C-VV6T-75ZX-1RMR","quantity":"2"}]}`), wantCode: 201, wantResult: `{"id":2,"status":"pending"`},
+		{name: "pay big", method: "POST", path: "/api/v1/order/2/pay", jsonData: []byte(`{"method":"card"}`), wantCode: 200, wantResult: `"status":"paid"`},
+		{name: "needs approval", method: "POST", path: "/api/v1/order/2/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"2","reason":"wrong_item","resaleable":true}]}`), wantCode: 403, wantResult: `{"error":"refunds over $50.00 need a manager's approval"}`},
+		{name: "under threshold", method: "POST", path: "/api/v1/order/2/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"1","reason":"wrong_item","resaleable":true}]}`), wantCode: 201, wantResult: `"amount":"$32.18"}],"total":"$32.18",`},
+		{name: "refunds add up", method: "POST", path: "/api/v1/order/2/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"1","reason":"damaged"}]}`), wantCode: 403, wantResult: `{"error":"refunds over $50.00 need a manager's approval"}`},
+		{name: "approved without token", method: "POST", path: "/api/v1/order/2/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"1","reason":"damaged"}],"approved_by":"M042"}`), wantCode: 403, wantResult: `{"error":"approving a refund needs an admin token"}`},
+		{name: "approved", method: "POST", path: "/api/v1/order/2/returns", jsonData: []byte(`{"lines":[{"line":1,"quantity":"1","reason":"damaged"}],"approved_by":"M042"}`), admin: true, wantCode: 201, wantResult: `"total":"$32.17","approved_by":"M042",`},
+	}
+	for _, tc := range tests {
+		req := routerPOSTReq
+		if tc.admin {
+			req = routerAdminReq
+		}
+		got := req(tc.method, tc.path, tc.jsonData, r)
+		if tc.wantCode != got.Code || !strings.Contains(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	// Only resaleable whole units go back into stock.
+	assert.Equal(t, db["A12T-4GH7-QPL9-3N4M"].Stock, 11)
+	assert.Equal(t, db["TQ4C-VV6T-75ZX-1RMR"].Stock, 11)
+}
@@ -0,0 +1,214 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gopkg.in/yaml.v2"
+)
+
+// The built in fixtures, one per environment.
+const (
+	fixtureDev   = "dev"
+	fixtureDemo  = "demo"
+	fixtureTest  = "test"
+	fixtureEmpty = "empty"
+)
+
+//go:embed fixtures/*.yaml
+var fixtureFiles embed.FS
+
+// seedFixture is the fixture dbInit loads the catalog from, set with -seed.
+// Nil means the test fixture.
+var seedFixture *fixture
+
+// fixture is seed data for the catalog. Items are written the way the add
+// endpoint takes them and are checked with the same rules.
+type fixture struct {
+	Name        string `json:"-"`                     // Name is the environment or file the fixture was loaded from
+	Description string `json:"description,omitempty"` // Description says what the fixture is for
+	Items       []Item `json:"items"`                 // Items are the catalog
+}
+
+// loadFixture loads the built in fixture of an environment, one of dev, demo,
+// test and empty, or a fixture file ending in .yaml, .yml or .json.
+func loadFixture(name string) (*fixture, error) {
+	var data []byte
+	var err error
+	switch ext := filepath.Ext(name); {
+	case name == fixtureDev || name == fixtureDemo || name == fixtureTest || name == fixtureEmpty:
+		data, err = fixtureFiles.ReadFile("fixtures/" + name + ".yaml")
+	case ext == ".yaml" || ext == ".yml" || ext == ".json":
+		data, err = os.ReadFile(name)
+	default:
+		return nil, fmt.Errorf("unknown fixture %q, want dev, demo, test, empty or a .yaml or .json file", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(name) != ".json" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	f := &fixture{Name: name}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if err := f.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return f, nil
+}
+
+// check validates the items of f with the rules of the add endpoint. A
+// fixture cannot seed categories, so items must not name one.
+func (f *fixture) check() error {
+	registerValidators()
+	seen := map[string]bool{}
+	for i, item := range f.Items {
+		if err := binding.Validator.ValidateStruct(&item); err != nil {
+			return fmt.Errorf("items[%d]: %v", i, err)
+		}
+		code := strings.ToUpper(item.ProduceCode)
+		if seen[code] {
+			return fmt.Errorf("items[%d]: code %s is listed twice", i, code)
+		}
+		seen[code] = true
+	}
+	if err := (database{}).identifierConflict(f.Items); err != nil {
+		return fmt.Errorf("items%v", err)
+	}
+	return newCategoryTree(database{}).checkItems(f.Items)
+}
+
+// database returns the catalog of f as the add endpoint would store it.
+func (f *fixture) database(now time.Time) database {
+	db := database{}
+	for _, item := range f.Items {
+		item.ProduceCode = strings.ToUpper(item.ProduceCode)
+		item.UnitPrice = "$" + item.UnitPrice
+		normalizeLots(&item, now)
+		item.Markdown = nil
+		db[item.ProduceCode] = item
+	}
+	return db
+}
+
+// yamlToJSON converts a YAML document to JSON so that fixtures are decoded
+// with the json tags of the API types.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonValue replaces the map[interface{}]interface{} values yaml decodes
+// mappings into with the map[string]any json encodes.
+func jsonValue(v any) (any, error) {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", k)
+			}
+			e, err := jsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = e
+		}
+		return m, nil
+	case []any:
+		for i, e := range v {
+			e, err := jsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+	}
+	return v, nil
+}
+
+// seeder resets the catalog to a fixture.
+type seeder struct {
+	db      database
+	fixture *fixture
+	now     func() time.Time
+}
+
+func newSeeder(db database, f *fixture) *seeder {
+	return &seeder{db: db, fixture: f, now: time.Now}
+}
+
+// Reset godoc
+// @Summary Reset Catalog
+// @Schemes
+// @Description Replace the catalog with the fixture the server was started with. Carts, orders and other state are kept. Needs the admin token; not available in production (GIN_MODE=release)
+// @Tags admin
+// @Produce json
+// @Param X-Admin-Token header string true "admin token, see -admin.token"
+// @Success 200 {string} ok
+// @Failure 403 {string} error
+// @Router /reset [post]
+func (s *seeder) reset(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "resetting the catalog needs an admin token"})
+		return
+	}
+	items := s.fixture.database(s.now())
+	dbmux.Lock()
+	for code := range s.db {
+		if _, ok := items[code]; !ok {
+			s.db.remove(actorFrom(c), code)
+		}
+	}
+	for code, item := range items {
+		s.db.put(actorFrom(c), code, item)
+	}
+	trashFrom(c).clear(actorFrom(c))
+	dbmux.Unlock()
+	c.JSON(http.StatusOK, gin.H{"status": "catalog reset", "fixture": s.fixture.Name, "items": len(items)})
+}
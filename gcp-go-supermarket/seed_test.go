@@ -0,0 +1,129 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// go test -run TestLoadFixture -v
+
+func TestLoadFixture(t *testing.T) {
+	for name, want := range map[string]int{fixtureDev: 7, fixtureDemo: 10, fixtureTest: 4, fixtureEmpty: 0} {
+		f, err := loadFixture(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(f.Items) != want {
+			t.Fatalf("%s: expected: %d items, got: %d", name, want, len(f.Items))
+		}
+	}
+
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		wantErr string
+	}{
+		{name: "json", file: "ok.json", data: `{"items":[{"code":"a12t-4gh7-qpl9-3n4m","name":"Lettuce","price":"3.41"}]}`},
+		{name: "yaml", file: "ok.yml", data: "items:\n  - {code: A12T-4GH7-QPL9-3N4M, name: Lettuce, price: \"3.41\"}\n"},
+		{name: "unknown environment", file: "prod", wantErr: `unknown fixture "prod", want dev, demo, test, empty or a .yaml or .json file`},
+		{name: "missing file", file: "missing.yaml", wantErr: "no such file or directory"},
+		{name: "unknown field", file: "field.yaml", data: "items:\n  - {code: A12T-4GH7-QPL9-3N4M, name: Lettuce, price: \"3.41\", colour: green}\n", wantErr: `json: unknown field "colour"`},
+		{name: "number price", file: "number.yaml", data: "items:\n  - {code: A12T-4GH7-QPL9-3N4M, name: Lettuce, price: 3.41}\n", wantErr: "price of type string"},
+		{name: "bad price", file: "price.yaml", data: "items:\n  - {code: A12T-4GH7-QPL9-3N4M, name: Lettuce, price: \"$3.41\"}\n", wantErr: "items[0]: Key: 'Item.UnitPrice' Error:Field validation for 'UnitPrice' failed on the 'isunitprice' tag"},
+		{name: "twice", file: "twice.yaml", data: "items:\n  - {code: A12T-4GH7-QPL9-3N4M, name: Lettuce, price: \"3.41\"}\n  - {code: a12t-4gh7-qpl9-3n4m, name: Lettuce, price: \"3.41\"}\n", wantErr: "items[1]: code A12T-4GH7-QPL9-3N4M is listed twice"},
+		{name: "barcode", file: "barcode.yaml", data: "items:\n  - {code: A12T-4GH7-QPL9-3N4M, name: Lettuce, price: \"3.41\", upc: \"036000291452\"}\n  - {code: E5T6-9UI3-TH15-QR88, name: Peach, price: \"2.99\", upc: \"036000291452\"}\n", wantErr: "items[1]: upc 036000291452 is already used by A12T-4GH7-QPL9-3N4M"},
+		{name: "category", file: "category.yaml", data: "items:\n  - {code: A12T-4GH7-QPL9-3N4M, name: Lettuce, price: \"3.41\", category: produce}\n", wantErr: `[0]: category "produce" not found`},
+	}
+	for _, tc := range tests {
+		path := tc.file
+		if tc.data != "" {
+			path = filepath.Join(dir, tc.file)
+			if err := os.WriteFile(path, []byte(tc.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		} else if strings.Contains(tc.file, ".") {
+			path = filepath.Join(dir, tc.file)
+		}
+		_, err := loadFixture(path)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Fatalf("%s: expected: %q, got: %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+// go test -run TestReset -v
+
+func TestReset(t *testing.T) {
+	defer func(f *fixture, token string) { seedFixture, adminToken = f, token }(seedFixture, adminToken)
+	var err error
+	if seedFixture, err = loadFixture(fixtureDev); err != nil {
+		t.Fatal(err)
+	}
+	adminToken = "s3cret"
+	db := database{}
+	router := db.dbInit()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		notAdmin   bool
+		wantCode   int
+		wantResult string
+	}{
+		{name: "seeded", method: "GET", path: "/api/v1/item/BN4N-4011-YL0W-0001", wantCode: 200, wantResult: `{"code":"BN4N-4011-YL0W-0001","name":"Banana","price":"$0.59","unit":"lb","tax_class":"grocery","plu":"4011"}`},
+		{name: "add", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"0.50"}]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "delete", method: "GET", path: "/api/v1/delete/BN4N-4011-YL0W-0001", wantCode: 200, wantResult: `{"status":"item deleted"}`},
+		{name: "not admin", method: "POST", path: "/api/v1/reset", notAdmin: true, wantCode: 403, wantResult: `{"error":"resetting the catalog needs an admin token"}`},
+		{name: "reset", method: "POST", path: "/api/v1/reset", wantCode: 200, wantResult: `{"fixture":"dev","items":7,"status":"catalog reset"}`},
+		{name: "restored", method: "GET", path: "/api/v1/item/BN4N-4011-YL0W-0001", wantCode: 200, wantResult: `{"code":"BN4N-4011-YL0W-0001","name":"Banana"`},
+		{name: "added is gone", method: "GET", path: "/api/v1/item/B111-2222-3333-4444", wantCode: 200, wantResult: `{"error":"code not found"}`},
+		{name: "trash emptied", method: "GET", path: "/api/v1/trash", wantCode: 200, wantResult: `[]`},
+	}
+	for _, tc := range tests {
+		req := routerAdminReq
+		if tc.notAdmin {
+			req = routerPOSTReq
+		}
+		got := req(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || !strings.HasPrefix(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	defer gin.SetMode(gin.Mode())
+	gin.SetMode(gin.ReleaseMode)
+	router = database{}.dbInit()
+	if got := routerAdminReq("POST", "/api/v1/reset", nil, router); got.Code != 405 || got.Body.String() != `{"error":"endpoint not found"}` {
+		t.Fatalf("release mode: expected: 405, got: %v %v", got.Code, got.Body.String())
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	shutdownTimeout = 8 * time.Second // how long in-flight requests have to finish, set with -shutdown.timeout
+	shutdownDelay   time.Duration     // how long readiness fails before the listener closes, set with -shutdown.delay
+	flushTimeout    = 2 * time.Second // how long the shutdown hooks have, after the requests are drained
+)
+
+// shutdownHook closes or flushes something when the server stops, e.g. a
+// store or the trace exporter.
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// shutdownHooks run after the last request, in reverse order of onShutdown
+// like deferred calls. Only main registers hooks.
+var shutdownHooks []shutdownHook
+
+// onShutdown registers fn to run when the server has stopped.
+func onShutdown(name string, fn func(ctx context.Context) error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// runShutdownHooks runs the hooks, last registered first, and returns their
+// errors. Every hook runs, whatever the ones before returned.
+func runShutdownHooks(ctx context.Context) error {
+	var errs []error
+	for i := len(shutdownHooks) - 1; i >= 0; i-- {
+		h := shutdownHooks[i]
+		if err := h.fn(ctx); err != nil {
+			slog.ErrorContext(ctx, "shutdown: "+h.name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+		}
+	}
+	shutdownHooks = nil
+	return errors.Join(errs...)
+}
+
+// serve serves s on l until ctx is done, e.g. by the SIGTERM Cloud Run sends
+// before it stops an instance. Readiness then fails, and after shutdownDelay
+// the listener closes and the requests in flight get shutdownTimeout to
+// finish; the ones still running after that are cut off.
+func serve(ctx context.Context, s *http.Server, l net.Listener) error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(l) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "delay", shutdownDelay.String(), "timeout", shutdownTimeout.String())
+	draining.Store(true)
+	time.Sleep(shutdownDelay) // load balancers probing /readyz stop sending requests
+
+	drain, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(drain); err != nil {
+		s.Close()
+		return fmt.Errorf("draining requests: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("requests drained")
+	return nil
+}
+
+// jobRunner runs background jobs, such as scheduled backups and trash
+// purges, until it is stopped.
+type jobRunner struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+func newJobRunner() *jobRunner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobRunner{ctx: ctx, cancel: cancel}
+}
+
+// backgroundJobs runs the jobs the router starts. main stops it after the
+// requests are drained, before the shutdown hooks close the stores the jobs
+// write to.
+var backgroundJobs = newJobRunner()
+
+// start runs job in its own goroutine with a context that is done when the
+// runner is stopped.
+func (r *jobRunner) start(job func(ctx context.Context)) {
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		job(r.ctx)
+	}()
+}
+
+// stop cancels the jobs and waits for them to return, or for ctx to be done.
+func (r *jobRunner) stop(ctx context.Context) error {
+	r.cancel()
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background jobs: %w", ctx.Err())
+	}
+}
+
+// closeStore is a hook closing a store with dbmux held, so no change is
+// being written to it.
+func closeStore(close func() error) func(context.Context) error {
+	return func(context.Context) error {
+		dbmux.Lock()
+		defer dbmux.Unlock()
+		return close()
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// slowServer serves /slow, which answers once release is closed, on a local
+// port.
+func slowServer(t *testing.T) (s *http.Server, l net.Listener, started, release chan struct{}) {
+	started, release = make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	return &http.Server{Handler: mux}, l, started, release
+}
+
+type response struct {
+	body string
+	err  error
+}
+
+func get(url string) chan response {
+	c := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			c <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		c <- response{body: string(body), err: err}
+	}()
+	return c
+}
+
+// go test -run TestServeDrains -v
+
+func TestServeDrains(t *testing.T) {
+	defer draining.Store(false)
+	s, l, started, release := slowServer(t)
+	addr := l.Addr().String()
+	ctx, stop := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- serve(ctx, s, l) }()
+
+	inFlight := get("http://" + addr + "/slow")
+	<-started
+	stop() // SIGTERM
+
+	for deadline := time.Now().Add(5 * time.Second); ; { // the listener closes, the request in flight carries on
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("shutdown: expected: connections refused, got: %v accepting", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Assert(t, draining.Load())
+	select {
+	case err := <-errc:
+		t.Fatalf("shutdown: expected: serve waiting for the request in flight, got: %v", err)
+	default:
+	}
+
+	close(release)
+	res := <-inFlight
+	assert.NilError(t, res.err)
+	assert.Equal(t, res.body, "done")
+	assert.NilError(t, <-errc)
+}
+
+// go test -run TestServeDeadline -v
+
+func TestServeDeadline(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout; draining.Store(false) }(shutdownTimeout)
+	shutdownTimeout = 50 * time.Millisecond
+	s, l, started, release := slowServer(t)
+	defer close(release)
+	ctx, stop := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- serve(ctx, s, l) }()
+
+	inFlight := get("http://" + l.Addr().String() + "/slow")
+	<-started
+	stop()
+	err := <-errc
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Equal(t, err.Error(), "draining requests: context deadline exceeded")
+	assert.Assert(t, (<-inFlight).err != nil) // cut off
+}
+
+// go test -run TestServeFails -v
+
+func TestServeFails(t *testing.T) {
+	s, l, _, release := slowServer(t)
+	defer close(release)
+	l.Close()
+	err := serve(context.Background(), s, l)
+	assert.Assert(t, err != nil && strings.Contains(err.Error(), "use of closed network connection"), "%v", err)
+	assert.Assert(t, !draining.Load())
+}
+
+// go test -run TestShutdownHooks -v
+
+func TestShutdownHooks(t *testing.T) {
+	defer func(hooks []shutdownHook) { shutdownHooks = hooks }(shutdownHooks)
+	shutdownHooks = nil
+	var ran []string
+	hook := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+	onShutdown("event store", hook("event store", nil))
+	onShutdown("audit log", hook("audit log", errors.New("disk full")))
+	onShutdown("traces", hook("traces", nil))
+
+	err := runShutdownHooks(context.Background())
+	assert.Error(t, err, "audit log: disk full")
+	assert.DeepEqual(t, ran, []string{"traces", "audit log", "event store"})
+	assert.Equal(t, len(shutdownHooks), 0)
+
+	j, err := openJournal(t.TempDir() + "/journal.jsonl")
+	assert.NilError(t, err)
+	onShutdown("journal", closeStore(j.close))
+	assert.NilError(t, runShutdownHooks(context.Background()))
+}
+
+// go test -run TestJobRunner -v
+
+func TestJobRunner(t *testing.T) {
+	jobs := newJobRunner()
+	stopped := make(chan struct{})
+	jobs.start(func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+	assert.NilError(t, jobs.stop(context.Background()))
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("stop returned before the job did")
+	}
+
+	// A job that does not return in time fails the stop.
+	jobs = newJobRunner()
+	release := make(chan struct{})
+	defer close(release)
+	jobs.start(func(context.Context) { <-release })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, jobs.stop(ctx), "background jobs: context deadline exceeded")
+}
@@ -0,0 +1,461 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reorder configuration. The values are set from command line flags in main;
+// a zero reorderInterval disables the background evaluator (e.g. in tests).
+var (
+	reorderInterval   time.Duration // how often the background evaluator scans the catalog
+	reorderWebhookURL string        // when set, low-stock alerts are POSTed here instead of logged
+	reorderWindowDays = 7           // number of days in the sales moving average
+	reorderCoverDays  = 7           // number of days of sales a reorder should cover
+)
+
+// salesLedger keeps the number of units sold per item per day.
+// salesLedger methods are safe to call concurrently.
+type salesLedger struct {
+	mu    sync.Mutex
+	daily map[string]map[string]int // ProduceCode -> day (2006-01-02) -> units sold
+}
+
+func newSalesLedger() *salesLedger {
+	return &salesLedger{daily: map[string]map[string]int{}}
+}
+
+// record adds qty units sold of code on the day of at.
+func (l *salesLedger) record(code string, qty int, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	days, ok := l.daily[code]
+	if !ok {
+		days = map[string]int{}
+		l.daily[code] = days
+	}
+	days[at.Format("2006-01-02")] += qty
+}
+
+// movingAverage returns the average number of units of code sold per day
+// over the window of days ending with the day of now.
+func (l *salesLedger) movingAverage(code string, window int, now time.Time) float64 {
+	if window <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := 0
+	for i := 0; i < window; i++ {
+		total += l.daily[code][now.AddDate(0, 0, -i).Format("2006-01-02")]
+	}
+	return float64(total) / float64(window)
+}
+
+// reorderSuggestion describes an item at or below its reorder point and
+// how many units should be ordered to cover the next reorderCoverDays.
+type reorderSuggestion struct {
+	ProduceCode   string  `json:"code"`
+	Name          string  `json:"name"`
+	Stock         int     `json:"stock"`
+	ReorderPoint  int     `json:"reorder_point"`
+	AvgDailySales float64 `json:"avg_daily_sales"`
+	SuggestedQty  int     `json:"suggested_qty"`
+}
+
+// lowStockAlert is what a notifier receives when an item drops to its reorder point.
+type lowStockAlert struct {
+	reorderSuggestion
+	RaisedAt time.Time `json:"raised_at"`
+}
+
+// notifier delivers low-stock alerts.
+type notifier interface {
+	notify(alert lowStockAlert) error
+}
+
+// logNotifier writes alerts to a logger.
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (n logNotifier) notify(alert lowStockAlert) error {
+	n.logger.Printf("low stock: %s (%s) stock=%d reorder_point=%d suggested_qty=%d",
+		alert.ProduceCode, alert.Name, alert.Stock, alert.ReorderPoint, alert.SuggestedQty)
+	return nil
+}
+
+// webhookNotifier POSTs alerts as JSON to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n webhookNotifier) notify(alert lowStockAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json; charset=UTF-8", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: unexpected status %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// memoryNotifier collects alerts in memory; it is used as a test sink.
+type memoryNotifier struct {
+	mu     sync.Mutex
+	alerts []lowStockAlert
+}
+
+func (n *memoryNotifier) notify(alert lowStockAlert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+// received returns a copy of the alerts collected so far.
+func (n *memoryNotifier) received() []lowStockAlert {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]lowStockAlert(nil), n.alerts...)
+}
+
+// newNotifier returns the notifier selected by the reorder configuration.
+func newNotifier() notifier {
+	if reorderWebhookURL != "" {
+		return webhookNotifier{url: reorderWebhookURL, client: &http.Client{Timeout: 5 * time.Second}}
+	}
+	return logNotifier{logger: log.Default()}
+}
+
+// reorderEvaluator computes reorder suggestions and raises an alert once
+// per item each time it drops to its reorder point.
+type reorderEvaluator struct {
+	db       database
+	ledger   *salesLedger
+	notifier notifier
+	now      func() time.Time
+
+	jobs     *jobRunner // sends the notifications, so that main waits for them before exiting
+
+	mu      sync.Mutex
+	alerted map[string]bool // items already alerted that have not been restocked since
+	sending sync.WaitGroup  // notifications in flight
+}
+
+func newReorderEvaluator(db database, ledger *salesLedger, n notifier) *reorderEvaluator {
+	return &reorderEvaluator{db: db, ledger: ledger, notifier: n, now: time.Now, jobs: backgroundJobs, alerted: map[string]bool{}}
+}
+
+// suggestions returns the items at or below their reorder point, sorted by code.
+func (e *reorderEvaluator) suggestions() []reorderSuggestion {
+	now := e.now()
+	dbmux.Lock()
+	var low []Item
+	for code, item := range e.db {
+		if item.ReorderPoint > 0 && item.Stock <= item.ReorderPoint {
+			item.ProduceCode = code
+			low = append(low, item)
+		}
+	}
+	dbmux.Unlock()
+
+	sort.Slice(low, func(i, j int) bool { return low[i].ProduceCode < low[j].ProduceCode })
+	suggestions := []reorderSuggestion{}
+	for _, item := range low {
+		avg := e.ledger.movingAverage(item.ProduceCode, reorderWindowDays, now)
+		qty := int(math.Ceil(avg*float64(reorderCoverDays))) + item.ReorderPoint - item.Stock
+		if need := item.ReorderPoint - item.Stock + 1; qty < need { // always order enough to get back above the reorder point
+			qty = need
+		}
+		suggestions = append(suggestions, reorderSuggestion{
+			ProduceCode:   item.ProduceCode,
+			Name:          item.Name,
+			Stock:         item.Stock,
+			ReorderPoint:  item.ReorderPoint,
+			AvgDailySales: math.Round(avg*100) / 100,
+			SuggestedQty:  qty,
+		})
+	}
+	return suggestions
+}
+
+// evaluate computes the current suggestions and notifies, in a background
+// job of e.jobs, about items that have dropped to their reorder point since
+// the last evaluation. The notifier may be a slow webhook, so it is not
+// called with e.mu or the caller's locks held.
+func (e *reorderEvaluator) evaluate() []reorderSuggestion {
+	suggestions := e.suggestions()
+	now := e.now()
+
+	e.mu.Lock()
+	low := map[string]bool{}
+	var alerts []lowStockAlert
+	for _, s := range suggestions {
+		low[s.ProduceCode] = true
+		if !e.alerted[s.ProduceCode] {
+			e.alerted[s.ProduceCode] = true // so the next evaluation does not alert it too
+			alerts = append(alerts, lowStockAlert{reorderSuggestion: s, RaisedAt: now})
+		}
+	}
+	for code := range e.alerted {
+		if !low[code] { // restocked, alert again next time it runs low
+			delete(e.alerted, code)
+		}
+	}
+	e.mu.Unlock()
+
+	if len(alerts) > 0 {
+		e.sending.Add(1)
+		e.jobs.start(func(ctx context.Context) { e.send(ctx, alerts) })
+	}
+	return suggestions
+}
+
+// send notifies about alerts. An alert that fails is raised again by the
+// next evaluation, as are the ones not sent yet when ctx is done because the
+// server is stopping.
+func (e *reorderEvaluator) send(ctx context.Context, alerts []lowStockAlert) {
+	defer e.sending.Done()
+	for _, alert := range alerts {
+		err := ctx.Err()
+		if err == nil {
+			err = e.notifier.notify(alert)
+		}
+		if err != nil {
+			log.Printf("reorder: notify %s: %v", alert.ProduceCode, err)
+			e.mu.Lock()
+			delete(e.alerted, alert.ProduceCode)
+			e.mu.Unlock()
+		}
+	}
+}
+
+// run evaluates the catalog every interval until ctx is done.
+func (e *reorderEvaluator) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.evaluate()
+		}
+	}
+}
+
+// inventory serves the stock endpoints.
+type inventory struct {
+	db        database
+	ledger    *salesLedger
+	evaluator *reorderEvaluator
+}
+
+func newInventory(db database, n notifier) *inventory {
+	ledger := newSalesLedger()
+	return &inventory{db: db, ledger: ledger, evaluator: newReorderEvaluator(db, ledger, n)}
+}
+
+// Binding from JSON with POST. Omitted fields are left unchanged.
+type StockLevel struct {
+	Stock        *int `json:"stock" binding:"omitempty,min=0"`
+	ReorderPoint *int `json:"reorder_point" binding:"omitempty,min=0"`
+}
+
+// Binding from JSON with POST.
+type Sale struct {
+	Quantity int `json:"quantity" binding:"required,min=1"`
+}
+
+// stockStatus is the stock report of a single item.
+type stockStatus struct {
+	ProduceCode   string  `json:"code"`
+	Name          string  `json:"name"`
+	Stock         int     `json:"stock"`
+	ReorderPoint  int     `json:"reorder_point"`
+	AvgDailySales float64 `json:"avg_daily_sales"`
+	Low           bool    `json:"low"`
+}
+
+// Get Stock godoc
+// @Summary Get Stock
+// @Schemes
+// @Description Get stock level, reorder point and average daily sales of an item
+// @Tags stock
+// @Param        code   path      string  true  "Code"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /stock/:code [get]
+func (inv *inventory) stockCode(c *gin.Context) {
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	dbmux.Lock()
+	item, ok := inv.db[code]
+	dbmux.Unlock()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	avg := inv.ledger.movingAverage(code, reorderWindowDays, inv.evaluator.now())
+	c.JSON(http.StatusOK, stockStatus{
+		ProduceCode:   code,
+		Name:          item.Name,
+		Stock:         item.Stock,
+		ReorderPoint:  item.ReorderPoint,
+		AvgDailySales: math.Round(avg*100) / 100,
+		Low:           item.ReorderPoint > 0 && item.Stock <= item.ReorderPoint,
+	})
+}
+
+// Set Stock godoc
+// @Summary Set Stock
+// @Schemes
+// @Description Set the stock count and/or reorder point of an item. Omitted fields are unchanged. Lowering the count below the units held in lots writes off the first-expiring units
+// @Tags stock
+// @Param        code   path      string  true  "Code"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /stock/:code [post]
+func (inv *inventory) setStock(c *gin.Context) {
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var level StockLevel
+	if err := c.ShouldBindJSON(&level); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	dbmux.Lock()
+	item, ok := inv.db[code]
+	if ok {
+		if level.Stock != nil {
+			item.Stock = *level.Stock
+			if shrink := lotQuantity(item.Lots) - item.Stock; shrink > 0 { // counted less than the lots hold, write off the first-expiring units
+				item.Lots, _ = pickFEFO(item.Lots, shrink)
+			}
+		}
+		if level.ReorderPoint != nil {
+			item.ReorderPoint = *level.ReorderPoint
+		}
+		inv.db.put(actorFrom(c), code, item)
+	}
+	dbmux.Unlock()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	inv.evaluator.evaluate()
+	c.JSON(http.StatusOK, gin.H{"status": "stock updated"})
+}
+
+// Record Sale godoc
+// @Summary Record Sale
+// @Schemes
+// @Description Deduct sold units from stock, first-expired-first-out across lots, and record them in the daily sales history
+// @Tags stock
+// @Param        code   path      string  true  "Code"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /stock/:code/sale [post]
+func (inv *inventory) sale(c *gin.Context) {
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var sale Sale
+	if err := c.ShouldBindJSON(&sale); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	dbmux.Lock()
+	item, ok := inv.db[code]
+	enough := ok && item.Stock >= sale.Quantity
+	var picks []lotPick
+	if enough {
+		item.Stock -= sale.Quantity
+		item.Lots, picks = pickFEFO(item.Lots, sale.Quantity) // sold units leave the first-expiring lots first
+		inv.db.put(actorFrom(c), code, item)
+	}
+	dbmux.Unlock()
+	switch {
+	case !ok:
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	case !enough:
+		c.JSON(http.StatusConflict, gin.H{"error": "insufficient stock"})
+		return
+	}
+	inv.ledger.record(code, sale.Quantity, inv.evaluator.now())
+	inv.evaluator.evaluate()
+	c.JSON(http.StatusOK, gin.H{"status": "sale recorded", "picked": picks})
+}
+
+// Reorder godoc
+// @Summary Reorder Suggestions
+// @Schemes
+// @Description List items at or below their reorder point with suggested order quantities
+// @Tags stock
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Router /reorder [get]
+func (inv *inventory) reorder(c *gin.Context) {
+	c.JSON(http.StatusOK, inv.evaluator.suggestions())
+}
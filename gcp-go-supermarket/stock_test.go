@@ -0,0 +1,221 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestStock -v
+
+func TestStock(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "initial", method: "GET", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M", wantCode: 200, wantResult: `{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","stock":0,"reorder_point":0,"avg_daily_sales":0,"low":false}`},
+		{name: "set", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M", jsonData: []byte(`{"stock": 20, "reorder_point": 5}`), wantCode: 200, wantResult: `{"status":"stock updated"}`},
+		{name: "sale", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M/sale", jsonData: []byte(`{"quantity": 14}`), wantCode: 200, wantResult: `{"picked":[],"status":"sale recorded"}`},
+		{name: "after sale", method: "GET", path: "/api/v1/stock/a12t-4gh7-qpl9-3n4m", wantCode: 200, wantResult: `{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","stock":6,"reorder_point":5,"avg_daily_sales":2,"low":false}`},
+		{name: "insufficient", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M/sale", jsonData: []byte(`{"quantity": 7}`), wantCode: 409, wantResult: `{"error":"insufficient stock"}`},
+		{name: "low", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M/sale", jsonData: []byte(`{"quantity": 2}`), wantCode: 200, wantResult: `{"picked":[],"status":"sale recorded"}`},
+		{name: "reorder", method: "GET", path: "/api/v1/reorder", wantCode: 200, wantResult: `[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","stock":4,"reorder_point":5,"avg_daily_sales":2.29,"suggested_qty":17}]`},
+		{name: "bad quantity", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M/sale", jsonData: []byte(`{"quantity": 0}`), wantCode: 400, wantResult: `{"error":"Key: 'Sale.Quantity' Error:Field validation for 'Quantity' failed on the 'required' tag"}`},
+		{name: "bad level", method: "POST", path: "/api/v1/stock/A12T-4GH7-QPL9-3N4M", jsonData: []byte(`{"stock": -1}`), wantCode: 400, wantResult: `{"error":"Key: 'StockLevel.Stock' Error:Field validation for 'Stock' failed on the 'min' tag"}`},
+		{name: "not found", method: "GET", path: "/api/v1/stock/Z5T6-9UI3-TH15-QR88", wantCode: 200, wantResult: `{"error":"code not found"}`},
+		{name: "bad code", method: "GET", path: "/api/v1/stock/Z5T6-9UI3-TH15-QR881", wantCode: 400, wantResult: `{"error":"Key: 'ProduceId.ProduceCode' Error:Field validation for 'ProduceCode' failed on the 'isproducecode' tag"}`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
+
+// go test -run TestReorderEvaluator -v
+
+func TestReorderEvaluator(t *testing.T) {
+	now := time.Date(2022, 7, 8, 12, 0, 0, 0, time.UTC)
+	db := database{
+		"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41", Stock: 3, ReorderPoint: 4},
+		"E5T6-9UI3-TH15-QR88": {Name: "Peach", UnitPrice: "$2.99", Stock: 50, ReorderPoint: 10},
+		"YRT6-72AS-K736-L4AR": {Name: "Green Pepper", UnitPrice: "$0.79", Stock: 0},
+	}
+	ledger := newSalesLedger()
+	for day := 0; day < 7; day++ {
+		ledger.record("A12T-4GH7-QPL9-3N4M", day+1, now.AddDate(0, 0, -day)) // 28 units in the window
+	}
+	ledger.record("A12T-4GH7-QPL9-3N4M", 100, now.AddDate(0, 0, -7)) // outside the window
+	sink := &memoryNotifier{}
+	e := newReorderEvaluator(db, ledger, sink)
+	e.now = func() time.Time { return now }
+
+	got := e.evaluate()
+	assert.DeepEqual(t, got, []reorderSuggestion{
+		{ProduceCode: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", Stock: 3, ReorderPoint: 4, AvgDailySales: 4, SuggestedQty: 29},
+	})
+	e.sending.Wait()
+	assert.Equal(t, len(sink.received()), 1)
+	assert.Equal(t, sink.received()[0].RaisedAt, now)
+
+	e.evaluate() // still low, not alerted again
+	e.sending.Wait()
+	assert.Equal(t, len(sink.received()), 1)
+
+	dbmux.Lock()
+	item := db["A12T-4GH7-QPL9-3N4M"]
+	item.Stock = 40
+	db["A12T-4GH7-QPL9-3N4M"] = item
+	dbmux.Unlock()
+	assert.Equal(t, len(e.evaluate()), 0)
+
+	item.Stock = 1
+	dbmux.Lock()
+	db["A12T-4GH7-QPL9-3N4M"] = item
+	dbmux.Unlock()
+	e.evaluate() // low again after a restock, alerted again
+	e.sending.Wait()
+	assert.Equal(t, len(sink.received()), 2)
+}
+
+// funcNotifier notifies with a function.
+type funcNotifier func(lowStockAlert) error
+
+func (f funcNotifier) notify(alert lowStockAlert) error { return f(alert) }
+
+// go test -run TestReorderEvaluatorSlowNotifier -v
+
+func TestReorderEvaluatorSlowNotifier(t *testing.T) {
+	db := database{"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41", Stock: 1, ReorderPoint: 4}}
+	calls, release := make(chan struct{}, 10), make(chan error)
+	e := newReorderEvaluator(db, newSalesLedger(), funcNotifier(func(lowStockAlert) error {
+		calls <- struct{}{}
+		return <-release
+	}))
+
+	// Evaluations do not wait for the notifier, and do not alert an item
+	// whose alert is still being sent.
+	e.evaluate()
+	<-calls
+	e.evaluate()
+	assert.Equal(t, len(calls), 0)
+
+	// A failed alert is raised again by the next evaluation.
+	release <- errors.New("webhook down")
+	e.sending.Wait()
+	e.evaluate()
+	<-calls
+	release <- nil
+	e.sending.Wait()
+	e.evaluate()
+	e.sending.Wait()
+	assert.Equal(t, len(calls), 0)
+}
+
+// go test -run TestReorderEvaluatorStop -v
+
+func TestReorderEvaluatorStop(t *testing.T) {
+	db := database{
+		"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41", Stock: 1, ReorderPoint: 4},
+		"E5T6-9UI3-TH15-QR88": {Name: "Peach", UnitPrice: "$2.99", Stock: 0, ReorderPoint: 2},
+	}
+	calls, release := make(chan string, 10), make(chan error)
+	e := newReorderEvaluator(db, newSalesLedger(), funcNotifier(func(alert lowStockAlert) error {
+		calls <- alert.ProduceCode
+		return <-release
+	}))
+	e.jobs = newJobRunner()
+
+	// Stopping the background jobs waits for the alert being sent; the
+	// next one is left for the next evaluation.
+	e.evaluate()
+	assert.Equal(t, <-calls, "A12T-4GH7-QPL9-3N4M")
+	stopped := make(chan error, 1)
+	go func() { stopped <- e.jobs.stop(context.Background()) }()
+	<-e.jobs.ctx.Done()
+	select {
+	case err := <-stopped:
+		t.Fatalf("stop: expected: to wait for the alert, got: %v", err)
+	default:
+	}
+	release <- nil
+	assert.NilError(t, <-stopped)
+	assert.Equal(t, len(calls), 0)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	assert.DeepEqual(t, e.alerted, map[string]bool{"A12T-4GH7-QPL9-3N4M": true})
+}
+
+func TestReorderEvaluatorRun(t *testing.T) {
+	db := database{"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce", UnitPrice: "$3.41", Stock: 1, ReorderPoint: 4}}
+	sink := &memoryNotifier{}
+	e := newReorderEvaluator(db, newSalesLedger(), sink)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.run(ctx, time.Millisecond)
+	}()
+	for len(sink.received()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+	assert.Equal(t, sink.received()[0].ProduceCode, "A12T-4GH7-QPL9-3N4M")
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got lowStockAlert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	n := webhookNotifier{url: ts.URL, client: ts.Client()}
+	alert := lowStockAlert{reorderSuggestion: reorderSuggestion{ProduceCode: "A12T-4GH7-QPL9-3N4M", Name: "Lettuce", Stock: 1, ReorderPoint: 4, SuggestedQty: 4}}
+	assert.NilError(t, n.notify(alert))
+	assert.Equal(t, got.reorderSuggestion, alert.reorderSuggestion)
+
+	n.url = ts.URL + "/missing"
+	ts.Config.Handler = http.NotFoundHandler()
+	assert.ErrorContains(t, n.notify(alert), "unexpected status 404")
+}
@@ -0,0 +1,295 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Binding from JSON with POST.
+type Supplier struct {
+	ID    string `json:"id" binding:"required,isslug"`
+	Name  string `json:"name" binding:"required,alphanumandspace"` // Name is recorded as the supplier of lots received from it
+	Email string `json:"email,omitempty" binding:"omitempty,email"`
+}
+
+// Binding from JSON with POST.
+// SupplierItem maps a supplier's SKU to an item in the catalog.
+type SupplierItem struct {
+	SKU         string `json:"sku" binding:"required,max=32,printascii,excludesall= "` // SKU is the supplier's own item number
+	ProduceCode string `json:"code" binding:"required,isproducecode"`
+	Cost        string `json:"cost" binding:"required,isunitprice"` // Cost is the price of one pack
+	PackSize    int    `json:"pack_size" binding:"required,min=1"`  // PackSize is the units of the item in a pack, in the item's unit
+}
+
+// SupplierId is the URL binding of a supplier ID.
+type SupplierId struct {
+	ID string `uri:"id" binding:"required,isslug"`
+}
+
+// supplier is a supplier with its item mappings by SKU.
+type supplier struct {
+	Supplier
+	Items map[string]SupplierItem
+}
+
+// supplierView is the JSON view of a supplier.
+type supplierView struct {
+	Supplier
+	Items []SupplierItem `json:"items"`
+}
+
+// view returns the JSON view of s with its items ordered by SKU.
+func (s *supplier) view() supplierView {
+	v := supplierView{Supplier: s.Supplier, Items: []SupplierItem{}}
+	for _, item := range s.Items {
+		v.Items = append(v.Items, item)
+	}
+	sort.Slice(v.Items, func(i, j int) bool { return v.Items[i].SKU < v.Items[j].SKU })
+	return v
+}
+
+// procurement holds the suppliers and purchase orders. Its methods must not
+// be called while holding dbmux.
+type procurement struct {
+	mu        sync.Mutex
+	db        database
+	inv       *inventory
+	suppliers map[string]*supplier
+	orders    map[int]*purchaseOrder
+	last      int
+	now       func() time.Time
+}
+
+func newProcurement(db database, inv *inventory) *procurement {
+	return &procurement{db: db, inv: inv, suppliers: map[string]*supplier{}, orders: map[int]*purchaseOrder{}, now: time.Now}
+}
+
+// unitCost returns the cost of one unit of an item bought in packs of
+// packSize for costCents, in cents.
+func unitCost(costCents int64, packSize int) *big.Rat {
+	return big.NewRat(costCents, int64(packSize))
+}
+
+// margin is the margin on an item bought from a supplier.
+type margin struct {
+	ProduceCode   string `json:"code"`
+	Name          string `json:"name"`
+	UnitPrice     string `json:"unit_price"`
+	Supplier      string `json:"supplier"`
+	SKU           string `json:"sku"`
+	UnitCost      string `json:"unit_cost"`      // UnitCost is the pack cost over the pack size, rounded half up
+	Margin        string `json:"margin"`         // Margin is UnitPrice less the unit cost, rounded half up
+	MarginPercent string `json:"margin_percent"` // MarginPercent is Margin as a percentage of UnitPrice, to 1 decimal place
+}
+
+// newMargin returns the margin of selling item at its unit price when bought
+// as m.
+func newMargin(code string, item Item, supplierID string, m SupplierItem) (margin, error) {
+	price, err := parseCents(item.UnitPrice)
+	if err != nil {
+		return margin{}, err
+	}
+	cost, err := parseCents(m.Cost)
+	if err != nil {
+		return margin{}, err
+	}
+	unit := unitCost(cost, m.PackSize)
+	diff := new(big.Rat).Sub(new(big.Rat).SetInt64(price), unit)
+	percent := "0.0"
+	if price > 0 {
+		percent = new(big.Rat).Mul(diff, big.NewRat(100, price)).FloatString(1)
+	}
+	return margin{
+		ProduceCode:   code,
+		Name:          item.Name,
+		UnitPrice:     formatCents(price),
+		Supplier:      supplierID,
+		SKU:           m.SKU,
+		UnitCost:      formatCents(roundCents(unit, roundingHalfUp)),
+		Margin:        formatCents(roundCents(diff, roundingHalfUp)),
+		MarginPercent: percent,
+	}, nil
+}
+
+// List Suppliers godoc
+// @Summary List Suppliers
+// @Schemes
+// @Description List the suppliers with their item mappings
+// @Tags procurement
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Router /suppliers [get]
+func (p *procurement) listSuppliers(c *gin.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	views := []supplierView{}
+	for _, s := range p.suppliers {
+		views = append(views, s.view())
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+	c.JSON(http.StatusOK, views)
+}
+
+// Add Supplier godoc
+// @Summary Add Supplier
+// @Schemes
+// @Description Add a supplier
+// @Tags procurement
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Failure 409 {string} error
+// @Router /suppliers [post]
+func (p *procurement) addSupplier(c *gin.Context) {
+	var s Supplier
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.suppliers[s.ID]; ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "supplier exists"})
+		return
+	}
+	p.suppliers[s.ID] = &supplier{Supplier: s, Items: map[string]SupplierItem{}}
+	c.JSON(http.StatusCreated, gin.H{"status": "supplier added"})
+}
+
+// Get Supplier godoc
+// @Summary Get Supplier
+// @Schemes
+// @Description Get a supplier with its item mappings
+// @Tags procurement
+// @Param        id   path      string  true  "Supplier ID"
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /supplier/:id [get]
+func (p *procurement) getSupplier(c *gin.Context) {
+	var supplierId SupplierId
+	if err := c.ShouldBindUri(&supplierId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.suppliers[supplierId.ID]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "supplier not found"})
+		return
+	}
+	c.JSON(http.StatusOK, s.view())
+}
+
+// Map Supplier Items godoc
+// @Summary Map Supplier Items
+// @Schemes
+// @Description Map supplier SKUs to items with their pack cost and pack size. Mappings with an existing SKU are replaced
+// @Tags procurement
+// @Param        id   path      string  true  "Supplier ID"
+// @Accept json
+// @Produce json
+// @Success 201 {string} ok
+// @Failure 400 {string} error
+// @Router /supplier/:id/items [post]
+func (p *procurement) mapItems(c *gin.Context) {
+	var supplierId SupplierId
+	if err := c.ShouldBindUri(&supplierId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var items []SupplierItem
+	if err := c.ShouldBindJSON(&items); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.suppliers[supplierId.ID]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "supplier not found"})
+		return
+	}
+	dbmux.Lock()
+	for i := range items {
+		items[i].ProduceCode = strings.ToUpper(items[i].ProduceCode)
+		if _, ok := p.db[items[i].ProduceCode]; !ok {
+			dbmux.Unlock()
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("[%d]: code %s not found", i, items[i].ProduceCode)})
+			return
+		}
+	}
+	dbmux.Unlock()
+	for _, item := range items {
+		s.Items[item.SKU] = item
+	}
+	c.JSON(http.StatusCreated, gin.H{"status": "supplier items mapped"})
+}
+
+// Margins godoc
+// @Summary Margins
+// @Schemes
+// @Description Margin of each item against each supplier it is mapped to: unit price less pack cost over pack size
+// @Tags procurement
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Router /margins [get]
+func (p *procurement) margins(c *gin.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	margins := []margin{}
+	dbmux.Lock()
+	for id, s := range p.suppliers {
+		for _, m := range s.Items {
+			item, ok := p.db[m.ProduceCode]
+			if !ok {
+				continue
+			}
+			if mg, err := newMargin(m.ProduceCode, item, id, m); err == nil {
+				margins = append(margins, mg)
+			}
+		}
+	}
+	dbmux.Unlock()
+	sort.Slice(margins, func(i, j int) bool {
+		if margins[i].ProduceCode != margins[j].ProduceCode {
+			return margins[i].ProduceCode < margins[j].ProduceCode
+		}
+		return margins[i].Supplier < margins[j].Supplier
+	})
+	c.JSON(http.StatusOK, margins)
+}
@@ -0,0 +1,64 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"strings"
+	"testing"
+)
+
+// go test -run TestSuppliers -v
+
+func TestSuppliers(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "add", method: "POST", path: "/api/v1/suppliers", jsonData: []byte(`{"id":"valley-farms","name":"Valley Farms","email":"orders@valleyfarms.example"}`), wantCode: 201, wantResult: `{"status":"supplier added"}`},
+		{name: "add second", method: "POST", path: "/api/v1/suppliers", jsonData: []byte(`{"id":"coast-produce","name":"Coast Produce"}`), wantCode: 201, wantResult: `{"status":"supplier added"}`},
+		{name: "exists", method: "POST", path: "/api/v1/suppliers", jsonData: []byte(`{"id":"coast-produce","name":"Coast Produce"}`), wantCode: 409, wantResult: `{"error":"supplier exists"}`},
+		{name: "bad email", method: "POST", path: "/api/v1/suppliers", jsonData: []byte(`{"id":"hill","name":"Hill","email":"hill"}`), wantCode: 400, wantResult: `{"error":"Key: 'Supplier.Email' Error:Field validation for 'Email' failed on the 'email' tag"}`},
+		{name: "map", method: "POST", path: "/api/v1/supplier/valley-farms/items", jsonData: []byte(`[{"sku":"VF-LET-24","code":"a12t-4gh7-qpl9-3n4m","cost":"48.00","pack_size":24},{"sku":"VF-PCH-40","code":"E5T6-9UI3-TH15-QR88","cost":"71.60","pack_size":40}]`), wantCode: 201, wantResult: `{"status":"supplier items mapped"}`},
+		{name: "map second", method: "POST", path: "/api/v1/supplier/coast-produce/items", jsonData: []byte(`[{"sku":"8812","code":"E5T6-9UI3-TH15-QR88","cost":"50.00","pack_size":25}]`), wantCode: 201, wantResult: `{"status":"supplier items mapped"}`},
+		{name: "map unknown code", method: "POST", path: "/api/v1/supplier/coast-produce/items", jsonData: []byte(`[{"sku":"8813","code":"Z5T6-9UI3-TH15-QR88","cost":"50.00","pack_size":25}]`), wantCode: 400, wantResult: `{"error":"[0]: code Z5T6-9UI3-TH15-QR88 not found"}`},
+		{name: "map bad pack", method: "POST", path: "/api/v1/supplier/coast-produce/items", jsonData: []byte(`[{"sku":"8813","code":"E5T6-9UI3-TH15-QR88","cost":"50.00","pack_size":0}]`), wantCode: 400, wantResult: `{"error":"[0]: Key: 'SupplierItem.PackSize' Error:Field validation for 'PackSize' failed on the 'required' tag"}`},
+		{name: "map unknown supplier", method: "POST", path: "/api/v1/supplier/hill/items", jsonData: []byte(`[]`), wantCode: 200, wantResult: `{"error":"supplier not found"}`},
+		{name: "remap", method: "POST", path: "/api/v1/supplier/valley-farms/items", jsonData: []byte(`[{"sku":"VF-LET-24","code":"A12T-4GH7-QPL9-3N4M","cost":"48.00","pack_size":24}]`), wantCode: 201, wantResult: `{"status":"supplier items mapped"}`},
+		{name: "get", method: "GET", path: "/api/v1/supplier/valley-farms", wantCode: 200, wantResult: `{"id":"valley-farms","name":"Valley Farms","email":"orders@valleyfarms.example","items":[{"sku":"VF-LET-24","code":"A12T-4GH7-QPL9-3N4M","cost":"48.00","pack_size":24},{"sku":"VF-PCH-40","code":"E5T6-9UI3-TH15-QR88","cost":"71.60","pack_size":40}]}`},
+		{name: "list", method: "GET", path: "/api/v1/suppliers", wantCode: 200, wantResult: `[{"id":"coast-produce","name":"Coast Produce","items":[{"sku":"8812","code":"E5T6-9UI3-TH15-QR88","cost":"50.00","pack_size":25}]},{"id":"valley-farms",`},
+		{name: "margins", method: "GET", path: "/api/v1/margins", wantCode: 200, wantResult: `[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","unit_price":"$3.41","supplier":"valley-farms","sku":"VF-LET-24","unit_cost":"$2.00","margin":"$1.41","margin_percent":"41.3"},{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","unit_price":"$2.99","supplier":"coast-produce","sku":"8812","unit_cost":"$2.00","margin":"$0.99","margin_percent":"33.1"},{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","unit_price":"$2.99","supplier":"valley-farms","sku":"VF-PCH-40","unit_cost":"$1.79","margin":"$1.20","margin_percent":"40.1"}]`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.wantCode != got.Code || !strings.HasPrefix(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rounding modes for tax amounts.
+const (
+	roundingHalfUp   = "half_up"   // halves away from zero
+	roundingHalfEven = "half_even" // halves to the even cent
+	roundingUp       = "up"        // any fraction of a cent up
+	roundingDown     = "down"      // fractions of a cent dropped
+)
+
+// taxClassStandard is the tax class of items without one. Every jurisdiction
+// must have a standard rate; classes a jurisdiction does not list fall back
+// to it.
+const taxClassStandard = "standard"
+
+// defaultJurisdiction is the only jurisdiction of a flat rate table.
+const defaultJurisdiction = "default"
+
+// taxRateRegex matches a rate in percent with up to 4 decimal places, e.g. 8.875.
+var taxRateRegex = regexp.MustCompile(`^\d{1,3}(\.\d{1,4})?$`)
+
+// TaxTable is a versioned table of sales tax rates by jurisdiction and tax
+// class, loaded from a JSON file such as testdata/taxrates.json.
+type TaxTable struct {
+	Version       string                  `json:"version"`            // Version identifies the table, e.g. 2022-07-01
+	Rounding      string                  `json:"rounding,omitempty"` // Rounding is the default rounding mode; half_up when empty
+	Jurisdictions map[string]Jurisdiction `json:"jurisdictions"`
+}
+
+// Jurisdiction is the tax rates of one taxing jurisdiction.
+type Jurisdiction struct {
+	Name     string            `json:"name"`
+	Rounding string            `json:"rounding,omitempty"` // Rounding overrides the table's rounding mode
+	Rates    map[string]string `json:"rates"`              // Rates are percentages by tax class, e.g. {"standard":"7.25","grocery":"0"}
+}
+
+// taxRates is the rate table in effect and taxJurisdiction the jurisdiction
+// baskets are taxed in unless they name one. They are set from the
+// -tax.table, -tax.rate and -tax.jurisdiction flags in main.
+var (
+	taxRates        = flatTaxTable(new(big.Rat))
+	taxJurisdiction = defaultJurisdiction
+)
+
+// parseTaxRate parses a percentage such as "7.25" to a fraction.
+func parseTaxRate(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !taxRateRegex.MatchString(s) || !ok || r.Cmp(big.NewRat(100, 1)) > 0 {
+		return nil, fmt.Errorf("invalid tax rate %q", s)
+	}
+	return r.Quo(r, big.NewRat(100, 1)), nil
+}
+
+// formatTaxRate formats a fraction as a percentage without trailing zeros.
+func formatTaxRate(r *big.Rat) string {
+	s := new(big.Rat).Mul(r, big.NewRat(100, 1)).FloatString(4)
+	for s[len(s)-1] == '0' {
+		s = s[:len(s)-1]
+	}
+	if s[len(s)-1] == '.' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// flatTaxTable returns a table taxing every class at rate in a single
+// default jurisdiction.
+func flatTaxTable(rate *big.Rat) *TaxTable {
+	return &TaxTable{
+		Version:       "flat",
+		Rounding:      roundingHalfUp,
+		Jurisdictions: map[string]Jurisdiction{defaultJurisdiction: {Name: "Default", Rates: map[string]string{taxClassStandard: formatTaxRate(rate)}}},
+	}
+}
+
+// validRounding reports whether mode is a rounding mode.
+func validRounding(mode string) bool {
+	switch mode {
+	case roundingHalfUp, roundingHalfEven, roundingUp, roundingDown:
+		return true
+	}
+	return false
+}
+
+// readTaxTable decodes and checks a rate table.
+func readTaxTable(r io.Reader) (*TaxTable, error) {
+	var t TaxTable
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, err
+	}
+	if t.Version == "" {
+		return nil, errors.New("version is required")
+	}
+	if t.Rounding == "" {
+		t.Rounding = roundingHalfUp
+	}
+	if !validRounding(t.Rounding) {
+		return nil, fmt.Errorf("invalid rounding %q", t.Rounding)
+	}
+	if len(t.Jurisdictions) == 0 {
+		return nil, errors.New("no jurisdictions")
+	}
+	for id, j := range t.Jurisdictions {
+		if j.Rounding != "" && !validRounding(j.Rounding) {
+			return nil, fmt.Errorf("%s: invalid rounding %q", id, j.Rounding)
+		}
+		if _, ok := j.Rates[taxClassStandard]; !ok {
+			return nil, fmt.Errorf("%s: no %s rate", id, taxClassStandard)
+		}
+		for class, rate := range j.Rates {
+			if !slugRegex.MatchString(class) {
+				return nil, fmt.Errorf("%s: invalid tax class %q", id, class)
+			}
+			if _, err := parseTaxRate(rate); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", id, class, err)
+			}
+		}
+	}
+	return &t, nil
+}
+
+// loadTaxTable reads the rate table in the file at path.
+func loadTaxTable(path string) (*TaxTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := readTaxTable(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// taxCalculator works out the tax of basket lines in one jurisdiction.
+type taxCalculator struct {
+	Version      string // Version is the version of the rate table
+	Jurisdiction string
+	Rounding     string
+	rates        map[string]string
+}
+
+// calculator returns the tax calculator of jurisdiction id.
+func (t *TaxTable) calculator(id string) (*taxCalculator, error) {
+	j, ok := t.Jurisdictions[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown tax jurisdiction %q", id)
+	}
+	rounding := j.Rounding
+	if rounding == "" {
+		rounding = t.Rounding
+	}
+	return &taxCalculator{Version: t.Version, Jurisdiction: id, Rounding: rounding, rates: j.Rates}, nil
+}
+
+// rate returns the tax class charged for class and its rate.
+func (c *taxCalculator) rate(class string) (string, *big.Rat) {
+	if class == "" {
+		class = taxClassStandard
+	}
+	s, ok := c.rates[class]
+	if !ok {
+		class, s = taxClassStandard, c.rates[taxClassStandard]
+	}
+	r, _ := parseTaxRate(s) // checked by readTaxTable
+	return class, r
+}
+
+// lineTax is the tax on one basket line.
+type lineTax struct {
+	Class string
+	Rate  *big.Rat
+	Cents int64
+}
+
+// tax returns the tax on baseCents of an item of tax class class.
+func (c *taxCalculator) tax(class string, baseCents int64) lineTax {
+	class, rate := c.rate(class)
+	amount := new(big.Rat).Mul(new(big.Rat).SetInt64(baseCents), rate)
+	return lineTax{Class: class, Rate: rate, Cents: roundCents(amount, c.Rounding)}
+}
+
+// roundCents rounds r to an integer using mode. Negative amounts round
+// symmetrically to positive ones.
+func roundCents(r *big.Rat, mode string) int64 {
+	neg := r.Sign() < 0
+	num := new(big.Int).Abs(r.Num())
+	q, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	twice := new(big.Int).Lsh(rem, 1)
+	up := false
+	switch mode {
+	case roundingDown:
+	case roundingUp:
+		up = rem.Sign() > 0
+	case roundingHalfEven:
+		cmp := twice.Cmp(r.Denom())
+		up = cmp > 0 || cmp == 0 && q.Bit(0) == 1
+	default:
+		up = twice.Cmp(r.Denom()) >= 0
+	}
+	if up {
+		q.Add(q, big.NewInt(1))
+	}
+	if neg {
+		q.Neg(q)
+	}
+	return q.Int64()
+}
+
+// Tax Rates godoc
+// @Summary Tax Rates
+// @Schemes
+// @Description The sales tax rate table in effect: its version, rounding mode and the rates by jurisdiction and tax class
+// @Tags pricing
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Router /tax/rates [get]
+func getTaxRates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"default_jurisdiction": taxJurisdiction, "table": taxRates})
+}
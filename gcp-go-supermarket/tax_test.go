@@ -0,0 +1,167 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestRoundCents -v
+
+func TestRoundCents(t *testing.T) {
+	tests := []struct {
+		r    *big.Rat
+		mode string
+		want int64
+	}{
+		{r: big.NewRat(725, 10), mode: roundingHalfUp, want: 73},
+		{r: big.NewRat(725, 10), mode: roundingHalfEven, want: 72},
+		{r: big.NewRat(735, 10), mode: roundingHalfEven, want: 74},
+		{r: big.NewRat(7251, 100), mode: roundingHalfEven, want: 73},
+		{r: big.NewRat(7201, 100), mode: roundingUp, want: 73},
+		{r: big.NewRat(72, 1), mode: roundingUp, want: 72},
+		{r: big.NewRat(7299, 100), mode: roundingDown, want: 72},
+		{r: big.NewRat(-725, 10), mode: roundingHalfUp, want: -73},
+		{r: big.NewRat(-7201, 100), mode: roundingUp, want: -73},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, roundCents(tc.r, tc.mode), tc.want, "%s %s", tc.r.FloatString(2), tc.mode)
+	}
+}
+
+// go test -run TestReadTaxTable -v
+
+func TestReadTaxTable(t *testing.T) {
+	table, err := loadTaxTable("testdata/taxrates.json")
+	assert.NilError(t, err)
+	assert.Equal(t, table.Version, "2022-07-01")
+	assert.Equal(t, len(table.Jurisdictions), 3)
+
+	tests := map[string]struct {
+		table   string
+		wantErr string
+	}{
+		"version":  {table: `{"jurisdictions":{"X":{"rates":{"standard":"5"}}}}`, wantErr: "version is required"},
+		"rounding": {table: `{"version":"1","rounding":"nearest","jurisdictions":{"X":{"rates":{"standard":"5"}}}}`, wantErr: `invalid rounding "nearest"`},
+		"empty":    {table: `{"version":"1","jurisdictions":{}}`, wantErr: "no jurisdictions"},
+		"standard": {table: `{"version":"1","jurisdictions":{"X":{"rates":{"grocery":"0"}}}}`, wantErr: "X: no standard rate"},
+		"rate":     {table: `{"version":"1","jurisdictions":{"X":{"rates":{"standard":"7,25"}}}}`, wantErr: `X: standard: invalid tax rate "7,25"`},
+		"too high": {table: `{"version":"1","jurisdictions":{"X":{"rates":{"standard":"101"}}}}`, wantErr: `X: standard: invalid tax rate "101"`},
+		"class":    {table: `{"version":"1","jurisdictions":{"X":{"rates":{"standard":"5","Hot Food":"9"}}}}`, wantErr: `X: invalid tax class "Hot Food"`},
+		"unknown":  {table: `{"version":"1","jurisdiction":{}}`, wantErr: `unknown field "jurisdiction"`},
+	}
+	for name, tc := range tests {
+		_, err := readTaxTable(strings.NewReader(tc.table))
+		assert.ErrorContains(t, err, tc.wantErr, name)
+	}
+}
+
+// go test -run TestTaxCalculator -v
+
+func TestTaxCalculator(t *testing.T) {
+	table, err := loadTaxTable("testdata/taxrates.json")
+	assert.NilError(t, err)
+	_, err = table.calculator("US-CA-LA")
+	assert.Error(t, err, `unknown tax jurisdiction "US-CA-LA"`)
+
+	tests := []struct {
+		jurisdiction string
+		class        string
+		base         int64
+		want         lineTax
+	}{
+		{jurisdiction: "US-CA-SF", class: "", base: 1000, want: lineTax{Class: "standard", Rate: big.NewRat(8625, 100000), Cents: 86}},        // 86.25
+		{jurisdiction: "US-CA-SF", class: "grocery", base: 1000, want: lineTax{Class: "grocery", Rate: new(big.Rat), Cents: 0}},               // exempt
+		{jurisdiction: "US-CA-SF", class: "alcohol", base: 1000, want: lineTax{Class: "standard", Rate: big.NewRat(8625, 100000), Cents: 86}}, // not listed
+		{jurisdiction: "US-NY-NYC", class: "", base: 400, want: lineTax{Class: "standard", Rate: big.NewRat(8875, 100000), Cents: 36}},        // 35.5
+		{jurisdiction: "US-TX-AUS", class: "", base: 600, want: lineTax{Class: "standard", Rate: big.NewRat(825, 10000), Cents: 50}},          // 49.5 to even
+		{jurisdiction: "US-TX-AUS", class: "", base: 1000, want: lineTax{Class: "standard", Rate: big.NewRat(825, 10000), Cents: 82}},         // 82.5 to even
+	}
+	for _, tc := range tests {
+		calc, err := table.calculator(tc.jurisdiction)
+		assert.NilError(t, err)
+		got := calc.tax(tc.class, tc.base)
+		assert.Equal(t, got.Class, tc.want.Class)
+		assert.Equal(t, got.Rate.Cmp(tc.want.Rate), 0, "%s %s", tc.jurisdiction, got.Rate)
+		assert.Equal(t, got.Cents, tc.want.Cents, "%s %d", tc.jurisdiction, tc.base)
+	}
+}
+
+// go test -run TestBasketTax -v
+
+func TestBasketTax(t *testing.T) {
+	defer func(table *TaxTable, jurisdiction string) { taxRates, taxJurisdiction = table, jurisdiction }(taxRates, taxJurisdiction)
+	var err error
+	taxRates, err = loadTaxTable("testdata/taxrates.json")
+	assert.NilError(t, err)
+	taxJurisdiction = "US-CA-SF"
+
+	db := database{}
+	router := db.dbInit()
+	got := routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"ZRT6-72AS-K736-L4AZ","name":"Fruit Salad","price":"4.99","tax_class":"prepared_food"},{"code":"ZRT6-72AS-K736-L4AY","name":"Kiwi","price":"0.59","tax_class":"grocery"}]`), router)
+	assert.Equal(t, got.Code, 201)
+	assert.Equal(t, routerPOSTReq("GET", "/api/v1/item/ZRT6-72AS-K736-L4AY", nil, router).Body.String(), `{"code":"ZRT6-72AS-K736-L4AY","name":"Kiwi","price":"$0.59","tax_class":"grocery"}`)
+
+	tests := []struct {
+		name   string
+		basket string
+		want   [][3]string // class, rate and tax of each line
+		tax    string
+	}{
+		{
+			name:   "store jurisdiction",
+			basket: `{"lines":[{"code":"ZRT6-72AS-K736-L4AZ","quantity":"2"},{"code":"ZRT6-72AS-K736-L4AY","quantity":"6"},{"code":"A12T-4GH7-QPL9-3N4M","quantity":"1"}]}`,
+			want:   [][3]string{{"prepared_food", "8.625", "$0.86"}, {"grocery", "0", "$0.00"}, {"standard", "8.625", "$0.29"}},
+			tax:    "$1.15",
+		},
+		{
+			name:   "named jurisdiction",
+			basket: `{"jurisdiction":"US-NY-NYC","lines":[{"code":"ZRT6-72AS-K736-L4AZ","quantity":"2"},{"code":"ZRT6-72AS-K736-L4AY","quantity":"6"}]}`,
+			want:   [][3]string{{"standard", "8.875", "$0.89"}, {"grocery", "0", "$0.00"}},
+			tax:    "$0.89",
+		},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq("POST", "/api/v1/price-basket", []byte(tc.basket), router)
+		assert.Equal(t, got.Code, 200, tc.name)
+		var basket basketView
+		assert.NilError(t, json.Unmarshal(got.Body.Bytes(), &basket))
+		var lines [][3]string
+		for _, l := range basket.Lines {
+			lines = append(lines, [3]string{l.TaxClass, l.TaxRate, l.Tax})
+		}
+		assert.DeepEqual(t, lines, tc.want)
+		assert.Equal(t, basket.Tax, tc.tax, tc.name)
+		assert.Equal(t, basket.TaxTable, "2022-07-01")
+	}
+
+	got = routerPOSTReq("POST", "/api/v1/price-basket", []byte(`{"jurisdiction":"US-CA-LA","lines":[{"code":"ZRT6-72AS-K736-L4AY","quantity":"1"}]}`), router)
+	assert.Equal(t, got.Body.String(), `{"error":"unknown tax jurisdiction \"US-CA-LA\""}`)
+	got = routerPOSTReq("GET", "/api/v1/tax/rates", nil, router)
+	assert.Assert(t, strings.HasPrefix(got.Body.String(), `{"default_jurisdiction":"US-CA-SF","table":{"version":"2022-07-01","rounding":"half_up","jurisdictions":{"US-CA-SF":`), got.Body.String())
+}
@@ -0,0 +1,193 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of the spans of this service.
+const tracerName = "mobiledatabooks.com/gcp-go-supermarket"
+
+// tracerProvider makes the tracer of the router, set by main from
+// -trace.exporter. The default records nothing.
+var tracerProvider trace.TracerProvider = noop.NewTracerProvider()
+
+// tracePropagator reads the trace a request is part of from its headers: a
+// W3C traceparent, else the X-Cloud-Trace-Context Google front ends set.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(cloudTraceContext{}, propagation.TraceContext{}) // the last one found wins
+
+// traceRequests is middleware that starts a server span for each request,
+// named after its route template, as the parent of the spans of the handler
+// and the stores it calls.
+func traceRequests(tracer trace.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		ctx := tracePropagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", route, c.Request)...))
+		defer span.End()
+		span.SetAttributes(attribute.String("request_id", requestIDFrom(c)))
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+		if len(c.Errors) > 0 {
+			span.SetStatus(codes.Error, c.Errors.String())
+		}
+	}
+}
+
+// traceStore starts the span of a store operation in the trace of ctx; the
+// caller ends it. Use it deferred: defer traceStore(ctx, "catalog", "put").End().
+func traceStore(ctx context.Context, store, operation string) trace.Span {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, store+"."+operation,
+		trace.WithAttributes(attribute.String("store", store), attribute.String("operation", operation)))
+	return span
+}
+
+// cloudTraceContext propagates the X-Cloud-Trace-Context header of Google
+// Cloud load balancers and Cloud Run: TRACE_ID/SPAN_ID;o=OPTIONS with a hex
+// trace ID, a decimal span ID and o=1 when the trace is sampled.
+type cloudTraceContext struct{}
+
+const cloudTraceHeader = "X-Cloud-Trace-Context"
+
+func (cloudTraceContext) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	spanID := sc.SpanID()
+	value := sc.TraceID().String() + "/" + strconv.FormatUint(binaryUint64(spanID[:]), 10)
+	if sc.IsSampled() {
+		value += ";o=1"
+	}
+	carrier.Set(cloudTraceHeader, value)
+}
+
+func (cloudTraceContext) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	value, options, _ := strings.Cut(carrier.Get(cloudTraceHeader), ";")
+	traceHex, spanDec, ok := strings.Cut(value, "/")
+	if !ok {
+		return ctx
+	}
+	traceID, err := trace.TraceIDFromHex(strings.ToLower(traceHex))
+	if err != nil {
+		return ctx
+	}
+	span, err := strconv.ParseUint(spanDec, 10, 64)
+	if err != nil {
+		return ctx
+	}
+	var spanID trace.SpanID
+	for i := range spanID {
+		spanID[i] = byte(span >> (56 - 8*i))
+	}
+	var flags trace.TraceFlags
+	if options == "o=1" {
+		flags = trace.FlagsSampled
+	}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: flags, Remote: true})
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+func (cloudTraceContext) Fields() []string {
+	return []string{cloudTraceHeader}
+}
+
+func binaryUint64(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// newTracerProvider returns the provider of -trace.exporter: "stdout" writes
+// the spans as JSON to out, "otlp" exports them with OTLP/HTTP to the
+// collector at endpoint. ratio is the share of new traces sampled; requests
+// carry on the sampling decision of their caller.
+func newTracerProvider(exporter, endpoint string, ratio float64, out io.Writer) (*sdktrace.TracerProvider, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	case "otlp":
+		exp, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want stdout or otlp", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	service := os.Getenv("K_SERVICE") // set by Cloud Run
+	if service == "" {
+		service = "gcp-go-supermarket"
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	), nil
+}
+
+// defaultOTLPEndpoint is $OTEL_EXPORTER_OTLP_ENDPOINT, else a collector on
+// the local host.
+func defaultOTLPEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return "http://localhost:4318"
+}
@@ -0,0 +1,216 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/v3/assert"
+)
+
+// traceTo makes the routers built until the test ends export their spans to
+// an in-memory exporter.
+func traceTo(t *testing.T) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	old := tracerProvider
+	t.Cleanup(func() { tracerProvider = old })
+	tracerProvider = tp
+	return exp
+}
+
+func spanNamed(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func spanAttribute(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// go test -run TestTraceRequests -v
+
+func TestTraceRequests(t *testing.T) {
+	exp := traceTo(t)
+	db := database{}
+	router := db.dbInit()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		header     string
+		value      string
+		jsonData   []byte
+		wantSpan   string
+		wantTrace  string
+		wantParent string
+		wantStore  string
+	}{
+		{name: "traceparent", method: "GET", path: "/api/v1/item/A12T-4GH7-QPL9-3N4M", header: "traceparent", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantSpan: "GET /api/v1/item/:code", wantTrace: "4bf92f3577b34da6a3ce929d0e0e4736", wantParent: "00f067aa0ba902b7"},
+		{name: "cloud trace", method: "POST", path: "/api/v1/add", header: "X-Cloud-Trace-Context", value: "105445aa7843bc8bf206b12000100000/1;o=1", jsonData: []byte(`[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"0.50"}]`), wantSpan: "POST /api/v1/add", wantTrace: "105445aa7843bc8bf206b12000100000", wantParent: "0000000000000001", wantStore: "catalog.put"},
+		{name: "new trace", method: "GET", path: "/api/v1/delete/B111-2222-3333-4444", wantSpan: "GET /api/v1/delete/:code", wantStore: "catalog.remove"},
+		{name: "unmatched", method: "GET", path: "/no/such/path", wantSpan: "GET unmatched"},
+	}
+	for _, tc := range tests {
+		exp.Reset()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(tc.method, tc.path, bytes.NewReader(tc.jsonData))
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		router.ServeHTTP(w, req)
+
+		spans := exp.GetSpans()
+		server, ok := spanNamed(spans, tc.wantSpan)
+		if !ok {
+			t.Fatalf("%s: expected: span %v, got: %v", tc.name, tc.wantSpan, spans.Snapshots())
+		}
+		assert.Equal(t, server.SpanKind, trace.SpanKindServer, tc.name)
+		assert.Equal(t, spanAttribute(server, "http.status_code").AsInt64(), int64(w.Code), tc.name)
+		if tc.wantTrace != "" {
+			assert.Equal(t, server.SpanContext.TraceID().String(), tc.wantTrace, tc.name)
+			assert.Equal(t, server.Parent.SpanID().String(), tc.wantParent, tc.name)
+		} else {
+			assert.Assert(t, !server.Parent.IsValid(), tc.name)
+		}
+		if tc.wantStore != "" {
+			store, ok := spanNamed(spans, tc.wantStore)
+			if !ok {
+				t.Fatalf("%s: expected: span %v, got: %v", tc.name, tc.wantStore, spans.Snapshots())
+			}
+			assert.Equal(t, store.Parent.SpanID(), server.SpanContext.SpanID(), tc.name)
+			assert.Equal(t, store.SpanContext.TraceID(), server.SpanContext.TraceID(), tc.name)
+		}
+	}
+}
+
+// go test -run TestCloudTraceContext -v
+
+func TestCloudTraceContext(t *testing.T) {
+	tests := map[string]struct {
+		header    string
+		wantValid bool
+		wantOut   string
+	}{
+		"sampled":     {header: "105445aa7843bc8bf206b12000100000/12345678901234567890;o=1", wantValid: true, wantOut: "105445aa7843bc8bf206b12000100000/12345678901234567890;o=1"},
+		"not sampled": {header: "105445AA7843BC8BF206B12000100000/1", wantValid: true, wantOut: "105445aa7843bc8bf206b12000100000/1"},
+		"no span":     {header: "105445aa7843bc8bf206b12000100000"},
+		"zero span":   {header: "105445aa7843bc8bf206b12000100000/0;o=1"},
+		"bad trace":   {header: "105445aa/1;o=1"},
+		"empty":       {},
+	}
+	for name, tc := range tests {
+		in := propagation.HeaderCarrier{}
+		in.Set("X-Cloud-Trace-Context", tc.header)
+		ctx := cloudTraceContext{}.Extract(context.Background(), in)
+		assert.Equal(t, trace.SpanContextFromContext(ctx).IsValid(), tc.wantValid, name)
+		out := propagation.HeaderCarrier{}
+		cloudTraceContext{}.Inject(ctx, out)
+		assert.Equal(t, out.Get("X-Cloud-Trace-Context"), tc.wantOut, name)
+	}
+}
+
+// go test -run TestOTLPExporter -v
+
+func TestOTLPExporter(t *testing.T) {
+	var got coltracepb.ExportTraceServiceRequest
+	var path, contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		data, _ := io.ReadAll(r.Body)
+		assert.NilError(t, proto.Unmarshal(data, &got))
+	}))
+	defer collector.Close()
+
+	tp, err := newTracerProvider("otlp", collector.URL+"/", 1, nil)
+	assert.NilError(t, err)
+	ctx, parent := tp.Tracer(tracerName).Start(context.Background(), "GET /api/v1/items", trace.WithSpanKind(trace.SpanKindServer))
+	traceStore(ctx, "catalog", "put").End()
+	parent.End()
+	assert.NilError(t, tp.Shutdown(context.Background()))
+
+	assert.Equal(t, path, "/v1/traces")
+	assert.Equal(t, contentType, "application/x-protobuf")
+	assert.Equal(t, len(got.ResourceSpans), 1)
+	assert.Equal(t, got.ResourceSpans[0].Resource.Attributes[0].Key, "service.name")
+	scope := got.ResourceSpans[0].ScopeSpans[0]
+	assert.Equal(t, scope.Scope.Name, tracerName)
+	spans := map[string]*tracepb.Span{}
+	for _, s := range scope.Spans {
+		spans[s.Name] = s
+	}
+	put, server := spans["catalog.put"], spans["GET /api/v1/items"]
+	assert.Equal(t, server.Kind, tracepb.Span_SPAN_KIND_SERVER)
+	assert.DeepEqual(t, put.TraceId, server.TraceId)
+	assert.DeepEqual(t, put.ParentSpanId, server.SpanId)
+	assert.Equal(t, put.Attributes[0].Key, "store")
+	assert.Equal(t, put.Attributes[0].Value.GetStringValue(), "catalog")
+
+	_, err = newTracerProvider("jaeger", "", 1, nil)
+	assert.Error(t, err, `unknown trace exporter "jaeger", want stdout or otlp`)
+}
+
+// go test -run TestStdoutExporter -v
+
+func TestStdoutExporter(t *testing.T) {
+	var out bytes.Buffer
+	tp, err := newTracerProvider("stdout", "", 1, &out)
+	assert.NilError(t, err)
+	_, span := tp.Tracer(tracerName).Start(context.Background(), "GET /api/v1/items")
+	span.AddEvent("cache miss")
+	span.End()
+	assert.NilError(t, tp.Shutdown(context.Background()))
+
+	var got struct {
+		Name   string
+		Events []struct{ Name string }
+	}
+	assert.NilError(t, json.Unmarshal(out.Bytes(), &got))
+	assert.Equal(t, got.Name, "GET /api/v1/items")
+	assert.Equal(t, len(got.Events), 1)
+	assert.Equal(t, got.Events[0].Name, "cache miss")
+}
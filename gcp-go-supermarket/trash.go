@@ -0,0 +1,255 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deleted items are kept in the trash until they are purged, see -trash.retention.
+var (
+	trashRetention     time.Duration // how long a deleted item can be restored; 0 keeps them
+	trashPurgeInterval time.Duration // how often the purge job runs; 0 disables it
+)
+
+// trashed is a deleted item and its tombstone.
+type trashed struct {
+	item      Item
+	deletedAt time.Time
+}
+
+// trash holds deleted items out of db, so every reader of db sees them as
+// gone, until they are restored or purged. It is guarded by dbmux like the
+// catalog it belongs to. Like the catalog it is a projection of the events,
+// ItemTrashed, ItemRestored and ItemPurged, so it outlives a restart with
+// -events.store.
+type trash struct {
+	db    database
+	items map[string]trashed
+	now   func() time.Time
+}
+
+func newTrash(db database) *trash {
+	return &trash{db: db, items: map[string]trashed{}, now: time.Now}
+}
+
+// trashKey is the gin context key of the request's *trash.
+const trashKey = "trash"
+
+// trashFrom returns the trash set on the context by setupRouter.
+func trashFrom(c *gin.Context) *trash {
+	return c.MustGet(trashKey).(*trash)
+}
+
+// deleteItem moves the item stored under code to the trash for who. The
+// caller must hold dbmux.
+func (t *trash) deleteItem(who actor, code string) {
+	t.items[code] = trashed{item: t.db[code], deletedAt: t.now().UTC()}
+	t.db.write(who, code, nil, eventItemTrashed)
+}
+
+// apply applies e to the trash.
+func (t *trash) apply(e event) error {
+	switch e.Type {
+	case eventItemTrashed:
+		var data itemAdded
+		if err := json.Unmarshal(e.Data, &data); err != nil {
+			return fmt.Errorf("event %d: %v", e.Seq, err)
+		}
+		t.items[e.ProduceCode] = trashed{item: data.Item, deletedAt: e.Time}
+	case eventItemRestored, eventItemPurged:
+		delete(t.items, e.ProduceCode)
+	}
+	return nil
+}
+
+// clear purges every item in the trash for who, e.g. when the catalog is
+// restored from a backup. The caller must hold dbmux.
+func (t *trash) clear(who actor) {
+	if t == nil {
+		return
+	}
+	for code := range t.items {
+		delete(t.items, code)
+		catalogEvents.recordAs(who, code, eventItemPurged, nil)
+	}
+}
+
+// deletedItem is an item with its tombstone, as listed by the trash and by
+// items with include_deleted.
+type deletedItem struct {
+	Item
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // DeletedAt is when the item was deleted
+	PurgeAt   *time.Time `json:"purge_at,omitempty"`   // PurgeAt is when the item will be purged; omitted when it is kept
+}
+
+// view returns the public view of the trashed item stored under code.
+func (t *trash) view(code string, now time.Time) deletedItem {
+	v := t.items[code]
+	item := itemView(code, v.item, now)
+	item.Markdown = nil // deleted items are not for sale
+	view := deletedItem{Item: item, DeletedAt: &v.deletedAt}
+	if trashRetention > 0 {
+		purgeAt := v.deletedAt.Add(trashRetention)
+		view.PurgeAt = &purgeAt
+	}
+	return view
+}
+
+// purge drops the items deleted before now less the retention.
+func (t *trash) purge() int {
+	if trashRetention <= 0 {
+		return 0
+	}
+	cutoff := t.now().Add(-trashRetention)
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	n := 0
+	for code, v := range t.items {
+		if v.deletedAt.Before(cutoff) {
+			delete(t.items, code)
+			catalogEvents.recordAs(actor{Name: "purge"}, code, eventItemPurged, nil)
+			n++
+		}
+	}
+	return n
+}
+
+// run purges the trash every interval until ctx is done.
+func (t *trash) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := t.purge(); n > 0 {
+				log.Printf("trash: %d deleted items purged", n)
+			}
+		}
+	}
+}
+
+// includeDeleted reports whether the request asks for deleted items, which
+// only admins can. It answers 403 when a non-admin asks.
+func includeDeleted(c *gin.Context) (include, ok bool) {
+	if c.Query("include_deleted") != "true" {
+		return false, true
+	}
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "include_deleted needs an admin token"})
+		return false, false
+	}
+	return true, true
+}
+
+// List Trash godoc
+// @Summary List Trash
+// @Schemes
+// @Description List the deleted items that can still be restored, ordered by code, with when they were deleted and when they will be purged. Admins only, see X-Admin-Token
+// @Tags admin
+// @Param        X-Admin-Token   header      string  true  "Admin token"
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 403 {string} error
+// @Router /trash [get]
+func (t *trash) list(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "the trash needs an admin token"})
+		return
+	}
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	codes := make([]string, 0, len(t.items))
+	for code := range t.items {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	now := t.now()
+	items := []deletedItem{}
+	for _, code := range codes {
+		items = append(items, t.view(code, now))
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// Restore Item godoc
+// @Summary Restore Item
+// @Schemes
+// @Description Restore a deleted item from the trash with its stock and lots. Fails if its code or one of its barcodes or PLU has been reused since, or its category no longer declares its attributes. Admins only, see X-Admin-Token
+// @Tags admin
+// @Param        X-Admin-Token   header      string  true  "Admin token"
+// @Param        code   path      string  true  "Code"
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Failure 403 {string} error
+// @Failure 409 {string} error
+// @Router /item/{code}/restore [post]
+func (t *trash) restore(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "restoring an item needs an admin token"})
+		return
+	}
+	var produceId ProduceId
+	if err := c.ShouldBindUri(&produceId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(produceId.ProduceCode)
+	categories := categoriesFrom(c)
+	categories.mu.Lock() // held until the item is restored so its category cannot change meanwhile
+	defer categories.mu.Unlock()
+	dbmux.Lock()
+	defer dbmux.Unlock()
+	v, ok := t.items[code]
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found in trash"})
+		return
+	}
+	if _, ok := t.db[code]; ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "code " + code + " is in use"})
+		return
+	}
+	if err := t.db.identifierConflict([]Item{v.item}); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": strings.TrimPrefix(err.Error(), "[0]: ")})
+		return
+	}
+	if err := categories.checkAttributesLocked(v.item.Category, v.item.Attributes); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	delete(t.items, code)
+	t.db.write(actorFrom(c), code, &v.item, eventItemRestored)
+	c.JSON(http.StatusOK, gin.H{"status": "item restored"})
+}
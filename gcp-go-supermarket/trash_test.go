@@ -0,0 +1,124 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestTrash -v
+
+func TestTrash(t *testing.T) {
+	defer func(token string, retention time.Duration) { adminToken, trashRetention = token, retention }(adminToken, trashRetention)
+	adminToken, trashRetention = "s3cret", 24*time.Hour
+	db := database{}
+	router := db.dbInit()
+	admin := func(method, path string, jsonData []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(string(jsonData)))
+		req.Header.Set("X-Admin-Token", adminToken)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		admin      bool
+		method     string
+		path       string
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		{name: "add", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"0.50","upc":"036000291452","stock":12}]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "delete", method: "GET", path: "/api/v1/delete/B111-2222-3333-4444", wantCode: 200, wantResult: `{"status":"item deleted"}`},
+		{name: "hidden from item", method: "GET", path: "/api/v1/item/B111-2222-3333-4444", wantCode: 200, wantResult: `{"error":"code not found"}`},
+		{name: "hidden from items", method: "GET", path: "/api/v1/items", wantCode: 200, wantResult: `[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"},{"code":"E5T6-9UI3-TH15-QR88","name":"Peach","price":"$2.99"},{"code":"TQ4C-VV6T-75ZX-1RMR","name":"Gala Apple","price":"$3.59"},{"code":"YRT6-72AS-K736-L4AR","name":"Green Pepper","price":"$0.79"}]`},
+		{name: "hidden from lookup", method: "GET", path: "/api/v1/lookup/036000291452", wantCode: 200, wantResult: `{"error":"code not found"}`},
+		{name: "delete again", method: "GET", path: "/api/v1/delete/B111-2222-3333-4444", wantCode: 200, wantResult: `{"error":"code not found"}`},
+		{name: "include deleted needs admin", method: "GET", path: "/api/v1/items?include_deleted=true", wantCode: 403, wantResult: `{"error":"include_deleted needs an admin token"}`},
+		{name: "trash needs admin", method: "GET", path: "/api/v1/trash", wantCode: 403, wantResult: `{"error":"the trash needs an admin token"}`},
+		{name: "items include deleted", admin: true, method: "GET", path: "/api/v1/items?include_deleted=true", wantCode: 200, wantResult: `[{"code":"A12T-4GH7-QPL9-3N4M","name":"Lettuce","price":"$3.41"},{"code":"B111-2222-3333-4444","name":"Kiwi","price":"$0.50","upc":"036000291452","deleted_at":"`},
+		{name: "item include deleted", admin: true, method: "GET", path: "/api/v1/item/B111-2222-3333-4444?include_deleted=true", wantCode: 200, wantResult: `{"code":"B111-2222-3333-4444","name":"Kiwi","price":"$0.50","upc":"036000291452","deleted_at":"`},
+		{name: "trash", admin: true, method: "GET", path: "/api/v1/trash", wantCode: 200, wantResult: `[{"code":"B111-2222-3333-4444","name":"Kiwi","price":"$0.50","upc":"036000291452","deleted_at":"`},
+		{name: "restore unknown", admin: true, method: "POST", path: "/api/v1/item/C111-2222-3333-4444/restore", wantCode: 200, wantResult: `{"error":"code not found in trash"}`},
+		{name: "restore bad code", admin: true, method: "POST", path: "/api/v1/item/C111/restore", wantCode: 400, wantResult: `{"error":"Key: 'ProduceId.ProduceCode' Error:Field validation for 'ProduceCode' failed on the 'isproducecode' tag"}`},
+		{name: "barcode reused", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"C111-2222-3333-4444","name":"Gold Kiwi","price":"0.80","upc":"036000291452"}]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "restore barcode conflict", admin: true, method: "POST", path: "/api/v1/item/B111-2222-3333-4444/restore", wantCode: 409, wantResult: `{"error":"upc 036000291452 is already used by C111-2222-3333-4444"}`},
+		{name: "free barcode", method: "GET", path: "/api/v1/delete/C111-2222-3333-4444", wantCode: 200, wantResult: `{"status":"item deleted"}`},
+		{name: "restore needs admin", method: "POST", path: "/api/v1/item/B111-2222-3333-4444/restore", wantCode: 403, wantResult: `{"error":"restoring an item needs an admin token"}`},
+		{name: "restore", admin: true, method: "POST", path: "/api/v1/item/b111-2222-3333-4444/restore", wantCode: 200, wantResult: `{"status":"item restored"}`},
+		{name: "restored with stock", method: "GET", path: "/api/v1/stock/B111-2222-3333-4444", wantCode: 200, wantResult: `{"code":"B111-2222-3333-4444","name":"Kiwi","stock":12`},
+		{name: "left the trash", admin: true, method: "GET", path: "/api/v1/trash", wantCode: 200, wantResult: `[{"code":"C111-2222-3333-4444","name":"Gold Kiwi"`},
+		{name: "code reused", method: "POST", path: "/api/v1/add", jsonData: []byte(`[{"code":"C111-2222-3333-4444","name":"Gold Kiwi","price":"0.90"}]`), wantCode: 201, wantResult: `{"status":"item added"}`},
+		{name: "restore code conflict", admin: true, method: "POST", path: "/api/v1/item/C111-2222-3333-4444/restore", wantCode: 409, wantResult: `{"error":"code C111-2222-3333-4444 is in use"}`},
+		{name: "category", method: "POST", path: "/api/v1/categories", jsonData: []byte(`{"id":"fruit","name":"Fruit","attributes":[{"name":"organic","type":"bool"}]}`), wantCode: 201, wantResult: `{"status":"category added"}`},
+		{name: "organic", method: "POST", path: "/api/v1/item/B111-2222-3333-4444/category", jsonData: []byte(`{"category":"fruit","attributes":{"organic":true}}`), wantCode: 200, wantResult: `{"status":"category assigned"}`},
+		{name: "delete organic", method: "GET", path: "/api/v1/delete/B111-2222-3333-4444", wantCode: 200, wantResult: `{"status":"item deleted"}`},
+		{name: "category in the trash", method: "DELETE", path: "/api/v1/category/fruit", wantCode: 409, wantResult: `{"error":"category has items in the trash"}`},
+		{name: "organic dropped", method: "POST", path: "/api/v1/category/fruit", jsonData: []byte(`{"id":"fruit","name":"Fruit"}`), wantCode: 200, wantResult: `{"status":"category updated"}`},
+		{name: "restore undeclared", admin: true, method: "POST", path: "/api/v1/item/B111-2222-3333-4444/restore", wantCode: 409, wantResult: `{"error":"attribute \"organic\" is not declared for category \"fruit\""}`},
+	}
+	for _, tc := range tests {
+		got := routerPOSTReq(tc.method, tc.path, tc.jsonData, router)
+		if tc.admin {
+			got = admin(tc.method, tc.path, tc.jsonData)
+		}
+		if tc.wantCode != got.Code || !strings.HasPrefix(got.Body.String(), tc.wantResult) {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", tc.name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+}
+
+// go test -run TestTrashPurge -v
+
+func TestTrashPurge(t *testing.T) {
+	defer func(retention time.Duration) { trashRetention = retention }(trashRetention)
+	trashRetention = 0
+	clock := time.Date(2022, 7, 1, 10, 0, 0, 0, time.UTC)
+	db := database{"A12T-4GH7-QPL9-3N4M": {Name: "Lettuce"}, "E5T6-9UI3-TH15-QR88": {Name: "Peach"}}
+	bin := newTrash(db)
+	bin.now = func() time.Time { return clock }
+	bin.deleteItem(actor{}, "A12T-4GH7-QPL9-3N4M")
+	clock = clock.Add(12 * time.Hour)
+	bin.deleteItem(actor{}, "E5T6-9UI3-TH15-QR88")
+	clock = clock.Add(13 * time.Hour)
+	assert.Equal(t, bin.purge(), 0) // a zero retention keeps them
+
+	trashRetention = 24 * time.Hour
+	view := bin.view("E5T6-9UI3-TH15-QR88", clock)
+	assert.Equal(t, view.PurgeAt.Format(time.RFC3339), "2022-07-02T22:00:00Z")
+	assert.Equal(t, bin.purge(), 1)
+	_, ok := bin.items["E5T6-9UI3-TH15-QR88"]
+	assert.Assert(t, ok)
+	clock = clock.Add(12 * time.Hour)
+	assert.Equal(t, bin.purge(), 1)
+	assert.Equal(t, len(bin.items), 0)
+	assert.Equal(t, len(db), 0)
+}
@@ -0,0 +1,177 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Units of measure an item can be sold by. An empty Item.Unit means unitEach.
+const (
+	unitEach  = "each"
+	unitBunch = "bunch"
+	unitLb    = "lb"
+	unitKg    = "kg"
+)
+
+// kgPerUnit is the mass of one unit of each weight unit, in kilograms.
+var kgPerUnit = map[string]*big.Rat{
+	unitKg: big.NewRat(1, 1),
+	unitLb: big.NewRat(45359237, 100000000), // international avoirdupois pound
+}
+
+// itemUnit returns the unit of measure of item, defaulting to each.
+func itemUnit(item Item) string {
+	if item.Unit == "" {
+		return unitEach
+	}
+	return item.Unit
+}
+
+// isWeightUnit reports whether unit is a unit of mass.
+func isWeightUnit(unit string) bool {
+	_, ok := kgPerUnit[unit]
+	return ok
+}
+
+// convertWeight converts w from one weight unit to another.
+func convertWeight(w *big.Rat, from, to string) (*big.Rat, error) {
+	f, ok := kgPerUnit[from]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a unit of weight", from)
+	}
+	t, ok := kgPerUnit[to]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a unit of weight", to)
+	}
+	r := new(big.Rat).Mul(w, f)
+	return r.Quo(r, t), nil
+}
+
+// roundHalfUp rounds a non-negative r to the nearest integer, halves up. It
+// returns an error if the result does not fit in an int64.
+func roundHalfUp(r *big.Rat) (int64, error) {
+	n := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	n.Add(n, r.Denom())
+	d := new(big.Int).Mul(r.Denom(), big.NewInt(2))
+	if n.Quo(n, d); !n.IsInt64() {
+		return 0, fmt.Errorf("amount %s out of range", r.FloatString(2))
+	}
+	return n.Int64(), nil
+}
+
+// extendedPriceCents returns the price of weight units at unitCents per unit,
+// rounded half up to the nearest cent.
+func extendedPriceCents(unitCents int64, weight *big.Rat) (int64, error) {
+	return roundHalfUp(new(big.Rat).Mul(new(big.Rat).SetInt64(unitCents), weight))
+}
+
+// Binding from JSON with POST.
+type PriceQuoteRequest struct {
+	ProduceCode string `json:"code" binding:"required,isproducecode"`    // ProduceCode of an item sold by weight
+	Weight      string `json:"weight" binding:"required,isweight,max=9"` // Weight is the measured net weight, e.g. 1.235
+	Unit        string `json:"unit" binding:"omitempty,oneof=lb kg"`     // Unit the weight was measured in; defaults to the item's unit
+}
+
+// priceQuote is the extended price of a measured weight of an item.
+type priceQuote struct {
+	ProduceCode  string `json:"code"`
+	Name         string `json:"name"`
+	UnitPrice    string `json:"unit_price"`              // UnitPrice is the effective price per Unit, after any markdown
+	Unit         string `json:"unit"`                    // Unit is the unit the item is priced by
+	Weight       string `json:"weight"`                  // Weight is the measured weight in Unit, to 3 decimal places
+	Price        string `json:"price"`                   // Price is UnitPrice times Weight rounded half up to the cent
+	MarkdownRule string `json:"markdown_rule,omitempty"` // MarkdownRule is the markdown that fired, if any
+}
+
+// Price Quote godoc
+// @Summary Price Quote
+// @Schemes
+// @Description Extended price of a measured weight of an item sold by lb or kg, for scales. The weight is converted to the item's unit and the price rounded half up to the cent
+// @Tags example
+// @Accept json
+// @Produce json
+// @Success 200 {string} ok
+// @Failure 400 {string} error
+// @Router /price-quote [post]
+func (db database) priceQuote(c *gin.Context) {
+	var req PriceQuoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := strings.ToUpper(req.ProduceCode)
+	dbmux.Lock()
+	item, ok := db[code]
+	dbmux.Unlock()
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": "code not found"})
+		return
+	}
+	unit := itemUnit(item)
+	if !isWeightUnit(unit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("item is sold by %s, not by weight", unit)})
+		return
+	}
+	measured := req.Unit
+	if measured == "" {
+		measured = unit
+	}
+	weight, _ := new(big.Rat).SetString(req.Weight) // checked by isWeight
+	weight, err := convertWeight(weight, measured, unit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	weight, _ = new(big.Rat).SetString(weight.FloatString(3)) // priced as quoted, to the gram or thousandth of a pound
+	if weight.Sign() <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "weight must be greater than 0"})
+		return
+	}
+
+	price := item.UnitPrice
+	quote := priceQuote{ProduceCode: code, Name: item.Name, Unit: unit}
+	if m := markdownFor(item, markdownRules, time.Now()); m != nil {
+		price, quote.MarkdownRule = m.Price, m.Rule
+	}
+	cents, err := parseCents(price)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	quote.UnitPrice = formatCents(cents)
+	quote.Weight = weight.FloatString(3)
+	priceCents, err := extendedPriceCents(cents, weight)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	quote.Price = formatCents(priceCents)
+	c.JSON(http.StatusOK, quote)
+}
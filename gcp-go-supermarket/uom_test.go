@@ -0,0 +1,119 @@
+package main
+
+// MIT License
+
+// Copyright (c) 2022 Mobile Data Books, LLC
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+import (
+	"math/big"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// go test -run TestConvertWeight -v
+
+func TestConvertWeight(t *testing.T) {
+	tests := map[string]struct {
+		weight   string
+		from, to string
+		want     string
+		wantErr  string
+	}{
+		"kg to lb":  {weight: "1", from: unitKg, to: unitLb, want: "2.204623"},
+		"lb to kg":  {weight: "2.5", from: unitLb, to: unitKg, want: "1.133981"},
+		"same unit": {weight: "0.125", from: unitLb, to: unitLb, want: "0.125000"},
+		"each":      {weight: "1", from: unitEach, to: unitLb, wantErr: "each is not a unit of weight"},
+		"bunch":     {weight: "1", from: unitKg, to: unitBunch, wantErr: "bunch is not a unit of weight"},
+	}
+	for name, tc := range tests {
+		w, _ := new(big.Rat).SetString(tc.weight)
+		got, err := convertWeight(w, tc.from, tc.to)
+		if tc.wantErr != "" {
+			assert.ErrorContains(t, err, tc.wantErr, name)
+			continue
+		}
+		assert.NilError(t, err, name)
+		assert.Equal(t, got.FloatString(6), tc.want, name)
+	}
+}
+
+func TestExtendedPriceCents(t *testing.T) {
+	tests := map[string]struct {
+		cents  int64
+		weight string
+		want   int64
+	}{
+		"exact":      {cents: 299, weight: "2", want: 598},
+		"half cent":  {cents: 100, weight: "0.005", want: 1},   // 0.5 cents
+		"round down": {cents: 341, weight: "1.234", want: 421}, // 420.794
+		"round up":   {cents: 199, weight: "0.755", want: 150}, // 150.245
+		"half":       {cents: 100, weight: "0.125", want: 13},  // 12.5
+		"zero":       {cents: 341, weight: "0", want: 0},
+	}
+	for name, tc := range tests {
+		w, _ := new(big.Rat).SetString(tc.weight)
+		got, err := extendedPriceCents(tc.cents, w)
+		assert.NilError(t, err, name)
+		assert.Equal(t, got, tc.want, name)
+	}
+	w, _ := new(big.Rat).SetString("99999999999999999999")
+	_, err := extendedPriceCents(341, w)
+	assert.Error(t, err, "amount 34099999999999999999659.00 out of range")
+}
+
+// go test -run TestPriceQuote -v
+
+func TestPriceQuote(t *testing.T) {
+	db := database{}
+	router := db.dbInit()
+	got := routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"ZRT6-72AS-K736-L4AZ","name":"Cherries","price":"4.99","unit":"lb"},{"code":"ZRT6-72AS-K736-L4KG","name":"Bananas","price":"1.50","unit":"kg"}]`), router)
+	assert.Equal(t, got.Code, 201)
+
+	tests := map[string]struct {
+		jsonData   []byte
+		wantCode   int
+		wantResult string
+	}{
+		"lb":            {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4AZ","weight":"1.234"}`), wantCode: 200, wantResult: `{"code":"ZRT6-72AS-K736-L4AZ","name":"Cherries","unit_price":"$4.99","unit":"lb","weight":"1.234","price":"$6.16"}`},
+		"kg on lb item": {jsonData: []byte(`{"code":"zrt6-72as-k736-l4az","weight":"0.5","unit":"kg"}`), wantCode: 200, wantResult: `{"code":"ZRT6-72AS-K736-L4AZ","name":"Cherries","unit_price":"$4.99","unit":"lb","weight":"1.102","price":"$5.50"}`},
+		"lb on kg item": {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4KG","weight":"2","unit":"lb"}`), wantCode: 200, wantResult: `{"code":"ZRT6-72AS-K736-L4KG","name":"Bananas","unit_price":"$1.50","unit":"kg","weight":"0.907","price":"$1.36"}`},
+		"quoted weight": {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4AZ","weight":"0.005","unit":"kg"}`), wantCode: 200, wantResult: `{"code":"ZRT6-72AS-K736-L4AZ","name":"Cherries","unit_price":"$4.99","unit":"lb","weight":"0.011","price":"$0.05"}`},
+		"zero":          {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4AZ","weight":"0"}`), wantCode: 400, wantResult: `{"error":"weight must be greater than 0"}`},
+		"rounds to 0":   {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4KG","weight":"0.001","unit":"lb"}`), wantCode: 400, wantResult: `{"error":"weight must be greater than 0"}`},
+		"each item":     {jsonData: []byte(`{"code":"A12T-4GH7-QPL9-3N4M","weight":"1"}`), wantCode: 400, wantResult: `{"error":"item is sold by each, not by weight"}`},
+		"not found":     {jsonData: []byte(`{"code":"Z5T6-9UI3-TH15-QR88","weight":"1"}`), wantCode: 200, wantResult: `{"error":"code not found"}`},
+		"bad weight":    {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4AZ","weight":"1.2345"}`), wantCode: 400, wantResult: `{"error":"Key: 'PriceQuoteRequest.Weight' Error:Field validation for 'Weight' failed on the 'isweight' tag"}`},
+		"huge weight":   {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4AZ","weight":"99999999999999999999"}`), wantCode: 400, wantResult: `{"error":"Key: 'PriceQuoteRequest.Weight' Error:Field validation for 'Weight' failed on the 'max' tag"}`},
+		"bad unit":      {jsonData: []byte(`{"code":"ZRT6-72AS-K736-L4AZ","weight":"1","unit":"oz"}`), wantCode: 400, wantResult: `{"error":"Key: 'PriceQuoteRequest.Unit' Error:Field validation for 'Unit' failed on the 'oneof' tag"}`},
+	}
+	for name, tc := range tests {
+		got := routerPOSTReq("POST", "/api/v1/price-quote", tc.jsonData, router)
+		if tc.wantCode != got.Code || tc.wantResult != got.Body.String() {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", name, tc.wantCode, tc.wantResult, got.Code, got.Body.String())
+		}
+	}
+
+	got = routerGETReq("GET", "/api/v1/item/ZRT6-72AS-K736-L4AZ", router)
+	assert.Equal(t, got.Body.String(), `{"code":"ZRT6-72AS-K736-L4AZ","name":"Cherries","price":"$4.99","unit":"lb"}`)
+	got = routerPOSTReq("POST", "/api/v1/add", []byte(`[{"code":"ZRT6-72AS-K736-L4OZ","name":"Figs","price":"4.99","unit":"oz"}]`), router)
+	assert.Equal(t, got.Body.String(), `{"error":"[0]: Key: 'Item.Unit' Error:Field validation for 'Unit' failed on the 'oneof' tag"}`)
+}